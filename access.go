@@ -0,0 +1,112 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// AccessMode determines how a lookup affects the item it returns. Modes can be
+// combined with a bitwise or.
+type AccessMode int
+
+const (
+	// AccessTouch keeps the item alive, i.e. resets its idle timeout and marks
+	// it as recently used for eviction.
+	AccessTouch AccessMode = 1 << iota
+	// AccessCount increments the item's access counter.
+	AccessCount
+
+	// AccessPeek neither keeps the item alive nor counts the access.
+	AccessPeek AccessMode = 0
+	// AccessDefault is the mode used by Value.
+	AccessDefault = AccessTouch | AccessCount
+)
+
+// ValueWithMode works like Value, but lets the caller choose how the lookup
+// affects the returned item.
+func (table *CacheTable) ValueWithMode(key interface{}, mode AccessMode, args ...interface{}) (*CacheItem, error) {
+	return table.ValueWithModeCtx(context.Background(), key, mode, args...)
+}
+
+// ValueWithModeCtx works like ValueWithMode, but passes ctx on to the
+// data-loader callback.
+func (table *CacheTable) ValueWithModeCtx(ctx context.Context, key interface{}, mode AccessMode, args ...interface{}) (*CacheItem, error) {
+	return table.handle(ctx, &Request{Op: OpValue, Key: key, Args: args, Mode: mode})
+}
+
+// Peek returns the item stored under key without touching it: unlike Value,
+// it neither keeps the item alive nor counts the access or the lookup, and
+// doesn't try the data-loader or run middleware, so inspecting an item never
+// changes when it expires. It returns ErrKeyNotFound if the key is missing.
+func (table *CacheTable) Peek(key interface{}) (*CacheItem, error) {
+	if v := table.degradedView(); v != nil {
+		if r, ok := v.get(key); ok {
+			return r, nil
+		}
+	}
+
+	key, err := table.resolveKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	table.RLock()
+	r, ok := table.items.get(key)
+	table.RUnlock()
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+
+	return r, nil
+}
+
+// SetAccessTracking configures whether lookups record their accesses, which
+// is the default. Without it, reads don't update the items' access
+// timestamps and counters, sparing them a write lock per read. This suits
+// tables whose items live for a fixed time only: lifespans no longer get
+// renewed by accesses, capacity-bounded tables evict in insertion order and
+// MostAccessed loses its meaning.
+func (table *CacheTable) SetAccessTracking(enabled bool) {
+	var v int32
+	if !enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&table.noAccessTracking, v)
+}
+
+// Reports whether lookups record their accesses.
+func (table *CacheTable) tracksAccess() bool {
+	return atomic.LoadInt32(&table.noAccessTracking) == 0
+}
+
+// Records an access to item according to mode.
+func (table *CacheTable) access(item *CacheItem, mode AccessMode) {
+	if mode&(AccessTouch|AccessCount) == 0 || !table.tracksAccess() {
+		return
+	}
+
+	item.touch(mode)
+	if mode&AccessTouch != 0 {
+		table.segmentsAccess(item)
+	}
+}
+
+// Updates the access timestamp and counter of item according to mode.
+func (item *CacheItem) touch(mode AccessMode) {
+	item.Lock()
+	defer item.Unlock()
+	if mode&AccessTouch != 0 {
+		item.accessedOn = time.Now()
+	}
+	if mode&AccessCount != 0 {
+		item.accessCount++
+	}
+}
@@ -0,0 +1,146 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import "context"
+
+// Alias makes newKey refer to the item stored under existingKey, e.g. to look
+// up the same user by id, slug or email without storing three copies. Lookups
+// and updates via an alias act on the shared item, so all keys always see the
+// same value. The item is reference counted by its keys: deleting any of them,
+// including the one it got added under, only drops that reference, and the
+// item only gets deleted along with its last key. If its own key gets deleted,
+// the oldest remaining alias becomes the item's key. Expiring or evicting the
+// item removes it along with all its aliases. Aliasing an alias refers to its
+// item directly.
+func (table *CacheTable) Alias(existingKey, newKey interface{}) error {
+	if err := table.checkWritable(); err != nil {
+		return err
+	}
+	existingKey, err := table.resolveKey(existingKey)
+	if err != nil {
+		return err
+	}
+	newKey, err = table.normalizeKey(newKey)
+	if err != nil {
+		return err
+	}
+
+	table.Lock()
+	defer table.Unlock()
+
+	r, ok := table.items.get(existingKey)
+	if !ok {
+		return ErrKeyNotFound
+	}
+	if _, ok := table.items.get(newKey); ok {
+		return ErrKeyExists
+	}
+	if table.aliases == nil {
+		table.aliases = newStore(table.hasher)
+	}
+	if _, ok := table.aliases.get(newKey); ok {
+		return ErrKeyExists
+	}
+
+	// Aliases are kept in a store of their own, wrapped in items.
+	a := &CacheItem{key: ownKey(newKey), data: ownKey(existingKey)}
+	table.aliases.set(a)
+	r.aliases = append(r.aliases, a)
+	table.log("Aliased key", newKey, "to", existingKey, "in table", table.name)
+
+	return nil
+}
+
+// AliasCount returns how many aliases refer to the item stored under key.
+func (table *CacheTable) AliasCount(key interface{}) int {
+	key, err := table.resolveKey(key)
+	if err != nil {
+		return 0
+	}
+
+	table.RLock()
+	defer table.RUnlock()
+	r, ok := table.items.get(key)
+	if !ok {
+		return 0
+	}
+	return len(r.aliases)
+}
+
+// Maps an alias to the key of the item it refers to. Other keys are returned
+// as is.
+// Careful: do not run this method unless the table-mutex is at least
+// read-locked!
+func (table *CacheTable) unalias(key interface{}) (interface{}, bool) {
+	if table.aliases == nil {
+		return key, false
+	}
+	a, ok := table.aliases.get(key)
+	if !ok {
+		return key, false
+	}
+	return a.data, true
+}
+
+// Removes the alias from the store and from the item it refers to.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) removeAlias(alias interface{}) {
+	a, ok := table.aliases.get(alias)
+	if !ok {
+		return
+	}
+	table.aliases.remove(alias)
+
+	if r, ok := table.items.get(a.data); ok {
+		for i, ra := range r.aliases {
+			if ra == a {
+				r.aliases = append(r.aliases[:i:i], r.aliases[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// Drops the item's own key, moving the item under its oldest alias, which
+// takes over as its key. The item must have at least one alias.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) promoteAlias(ctx context.Context, item *CacheItem) {
+	key := item.aliases[0].key
+	table.aliases.remove(key)
+	table.items.remove(item.key)
+	table.unindexPath(item.key)
+	table.namespaceRemove(item)
+
+	item.Lock()
+	item.key = key
+	item.Unlock()
+	// Aliases might be shared with a degraded view, so replace rather than
+	// modify them.
+	aliases := make([]*CacheItem, 0, len(item.aliases)-1)
+	for _, a := range item.aliases[1:] {
+		a = &CacheItem{key: a.key, data: key}
+		table.aliases.set(a)
+		aliases = append(aliases, a)
+	}
+	item.aliases = aliases
+
+	table.items.set(item)
+	table.indexPath(key)
+	table.namespaceAdd(ctx, item, nil)
+	table.log("Moved item to key", key, "in table", table.name)
+}
+
+// Removes all aliases referring to the item.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) removeAliases(item *CacheItem) {
+	for _, a := range item.aliases {
+		table.aliases.remove(a.key)
+	}
+	item.aliases = nil
+}
@@ -0,0 +1,143 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// CacheAside caches the values of a backing store, e.g. a database, in a
+// table. Get loads missing values from the store, Write updates the store
+// and then invalidates the cached value. It takes care of the ordering
+// issues commonly got wrong with this pattern: a load racing with a write
+// never caches the value it read before the write, and concurrent loads of
+// the same key share a single call to the store.
+//
+// Writes invalidate rather than update the cached value, since concurrent
+// writes could otherwise leave an older value in the cache than in the store.
+// The table should not have a data-loader of its own.
+type CacheAside[K comparable, V any] struct {
+	table    *CacheTable
+	lifeSpan time.Duration
+	load     func(ctx context.Context, key K) (V, error)
+	store    func(ctx context.Context, key K, value V) error
+
+	mu sync.Mutex
+	// Loads in progress, by key.
+	loads map[K]*asideLoad[V]
+}
+
+// A load of a CacheAside in progress.
+type asideLoad[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+	// Set when a write happened meanwhile, so the loaded value must not be
+	// cached.
+	stale bool
+}
+
+// NewCacheAside returns a CacheAside caching values in table for lifeSpan.
+// load reads a value from the backing store, store writes one to it.
+func NewCacheAside[K comparable, V any](table *CacheTable, lifeSpan time.Duration, load func(ctx context.Context, key K) (V, error), store func(ctx context.Context, key K, value V) error) *CacheAside[K, V] {
+	return &CacheAside[K, V]{
+		table:    table,
+		lifeSpan: lifeSpan,
+		load:     load,
+		store:    store,
+		loads:    make(map[K]*asideLoad[V]),
+	}
+}
+
+// Get returns the value for key, from the cache if present or else from the
+// backing store.
+func (c *CacheAside[K, V]) Get(key K) (V, error) {
+	return c.GetCtx(context.Background(), key)
+}
+
+// GetCtx works like Get, but passes ctx on to the table and the backing
+// store.
+func (c *CacheAside[K, V]) GetCtx(ctx context.Context, key K) (V, error) {
+	item, err := c.table.ValueCtx(ctx, key)
+	if err == nil {
+		v, ok := item.Data().(V)
+		if !ok {
+			return v, ErrWrongType
+		}
+		return v, nil
+	}
+	if !errors.Is(err, ErrKeyNotFound) {
+		var v V
+		return v, err
+	}
+
+	c.mu.Lock()
+	l := c.loads[key]
+	if l != nil {
+		c.mu.Unlock()
+		<-l.done
+		return l.value, l.err
+	}
+	l = &asideLoad[V]{done: make(chan struct{})}
+	c.loads[key] = l
+	c.mu.Unlock()
+
+	l.value, l.err = c.load(ctx, key)
+
+	c.mu.Lock()
+	if c.loads[key] == l {
+		delete(c.loads, key)
+	}
+	if l.err == nil && !l.stale {
+		if _, err := c.table.AddCtx(ctx, key, c.lifeSpan, l.value); err != nil {
+			c.table.log("Caching value of key", key, "in table", c.table.name, "failed:", err)
+		}
+	}
+	c.mu.Unlock()
+	close(l.done)
+
+	return l.value, l.err
+}
+
+// Write stores value for key in the backing store and, if that succeeded,
+// invalidates the cached value, so the next Get loads it again.
+func (c *CacheAside[K, V]) Write(key K, value V) error {
+	return c.WriteCtx(context.Background(), key, value)
+}
+
+// WriteCtx works like Write, but passes ctx on to the backing store and the
+// table.
+func (c *CacheAside[K, V]) WriteCtx(ctx context.Context, key K, value V) error {
+	if err := c.store(ctx, key, value); err != nil {
+		return err
+	}
+	c.invalidate(ctx, key)
+	return nil
+}
+
+// Invalidate removes the cached value for key, e.g. after the backing store
+// got modified by others.
+func (c *CacheAside[K, V]) Invalidate(key K) {
+	c.invalidate(context.Background(), key)
+}
+
+func (c *CacheAside[K, V]) invalidate(ctx context.Context, key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Loads in progress may have read the previous value. Keep them from
+	// caching it, and later lookups from waiting for them.
+	if l := c.loads[key]; l != nil {
+		l.stale = true
+		delete(c.loads, key)
+	}
+	c.table.DeleteCtx(ctx, key)
+}
@@ -0,0 +1,128 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// AuditFormat determines how audit records get written.
+type AuditFormat int
+
+const (
+	// AuditText writes one human readable line per record.
+	AuditText AuditFormat = iota
+	// AuditJSON writes one JSON object per line.
+	AuditJSON
+)
+
+// AuditEvent is the kind of change an audit record describes.
+type AuditEvent string
+
+const (
+	// AuditAdded is recorded when a new key gets added to the table.
+	AuditAdded AuditEvent = "add"
+	// AuditUpdated is recorded when an existing key gets replaced.
+	AuditUpdated AuditEvent = "update"
+	// AuditDeleted is recorded when an item gets deleted.
+	AuditDeleted AuditEvent = "delete"
+	// AuditExpired is recorded when an item exceeded its lifespan.
+	AuditExpired AuditEvent = "expire"
+	// AuditFlushed is recorded for every item dropped by a flush.
+	AuditFlushed AuditEvent = "flush"
+	// AuditEvicted is recorded when an item got evicted due to capacity.
+	AuditEvicted AuditEvent = "evict"
+)
+
+// AuditRecord is a single entry in a table's audit log.
+type AuditRecord struct {
+	Time       time.Time  `json:"time"`
+	Table      string     `json:"table"`
+	Event      AuditEvent `json:"event"`
+	Key        string     `json:"key"`
+	CreatedOn  time.Time  `json:"created_on"`
+	AccessedOn time.Time  `json:"accessed_on"`
+	Actor      string     `json:"actor,omitempty"`
+}
+
+type auditActorKey struct{}
+
+// WithAuditActor returns a copy of ctx carrying the given actor. Audit records
+// for changes made with this context, e.g. via AddCtx or DeleteCtx, name the
+// actor responsible.
+func WithAuditActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, auditActorKey{}, actor)
+}
+
+// AuditActor returns the actor stored in ctx by WithAuditActor, if any.
+func AuditActor(ctx context.Context) string {
+	actor, _ := ctx.Value(auditActorKey{}).(string)
+	return actor
+}
+
+// SetAuditWriter configures a writer which every change to this table gets
+// recorded to, in the given format. Pass a nil writer to disable auditing.
+func (table *CacheTable) SetAuditWriter(w io.Writer, format AuditFormat) {
+	table.Lock()
+	defer table.Unlock()
+	table.auditWriter = w
+	table.auditFormat = format
+}
+
+// Maps a removal reason to the matching audit event.
+func auditEventForRemoval(reason RemovalReason) AuditEvent {
+	switch reason {
+	case RemovalExpired:
+		return AuditExpired
+	case RemovalFlushed:
+		return AuditFlushed
+	case RemovalEvicted:
+		return AuditEvicted
+	}
+	return AuditDeleted
+}
+
+// Writes an audit record for the given item.
+// Careful: do not run this method unless the table-mutex is locked and the
+// item is at least read-locked!
+func (table *CacheTable) audit(ctx context.Context, event AuditEvent, item *CacheItem) {
+	if table.auditWriter == nil {
+		return
+	}
+
+	rec := AuditRecord{
+		Time:       time.Now(),
+		Table:      table.name,
+		Event:      event,
+		Key:        fmt.Sprint(item.key),
+		CreatedOn:  item.createdOn,
+		AccessedOn: item.accessedOn,
+		Actor:      AuditActor(ctx),
+	}
+
+	var err error
+	switch table.auditFormat {
+	case AuditJSON:
+		var b []byte
+		b, err = json.Marshal(rec)
+		if err == nil {
+			_, err = table.auditWriter.Write(append(b, '\n'))
+		}
+	default:
+		_, err = fmt.Fprintf(table.auditWriter, "%s table=%q event=%s key=%q created=%s accessed=%s actor=%q\n",
+			rec.Time.Format(time.RFC3339Nano), rec.Table, rec.Event, rec.Key,
+			rec.CreatedOn.Format(time.RFC3339Nano), rec.AccessedOn.Format(time.RFC3339Nano), rec.Actor)
+	}
+	if err != nil {
+		table.log("Writing audit record failed for table", table.name, ":", err)
+	}
+}
@@ -47,3 +47,39 @@ func BenchmarkNotFoundAdd(b *testing.B) {
 	finish.Wait()
 
 }
+
+func BenchmarkCountApprox(b *testing.B) {
+	table := Cache("testCountApprox")
+	table.Add(k, 0, v)
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			table.CountApprox()
+		}
+	})
+}
+
+func BenchmarkGet(b *testing.B) {
+	table := Cache("testGet")
+	table.Add(k, 0, v)
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			table.Get(k)
+		}
+	})
+}
+
+func BenchmarkGetNoAccessTracking(b *testing.B) {
+	table := Cache("testGetNoAccessTracking")
+	table.SetAccessTracking(false)
+	table.Add(k, 0, v)
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			table.Get(k)
+		}
+	})
+}
@@ -0,0 +1,122 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sync"
+)
+
+// A Bloom filter remembering keys the data-loader could not load.
+type missFilter struct {
+	sync.Mutex
+
+	bits     []uint64
+	hashes   uint64
+	count    int
+	capacity int
+}
+
+// SetLoaderMissFilter installs a Bloom filter in front of the data-loader.
+// Keys the data-loader fails to load get remembered, and subsequent lookups
+// of these keys fail right away without calling the data-loader again.
+// Capacity is the number of keys the filter holds before it gets reset,
+// fpRate the acceptable probability of skipping the data-loader for a key
+// that has never been missed. A capacity of 0 removes the filter.
+func (table *CacheTable) SetLoaderMissFilter(capacity int, fpRate float64) {
+	table.Lock()
+	defer table.Unlock()
+
+	if capacity <= 0 {
+		table.missFilter = nil
+		return
+	}
+	table.missFilter = newMissFilter(capacity, fpRate)
+}
+
+// ResetLoaderMissFilter forgets all keys remembered by the loader miss
+// filter, e.g. after new keys have been added to the backing store.
+func (table *CacheTable) ResetLoaderMissFilter() {
+	table.RLock()
+	f := table.missFilter
+	table.RUnlock()
+
+	if f != nil {
+		f.reset()
+	}
+}
+
+func newMissFilter(capacity int, fpRate float64) *missFilter {
+	if fpRate <= 0 || fpRate >= 1 {
+		fpRate = 0.01
+	}
+	m := math.Ceil(-float64(capacity) * math.Log(fpRate) / (math.Ln2 * math.Ln2))
+	k := math.Max(1, math.Round(m/float64(capacity)*math.Ln2))
+
+	return &missFilter{
+		bits:     make([]uint64, (uint64(m)+63)/64),
+		hashes:   uint64(k),
+		capacity: capacity,
+	}
+}
+
+// Returns two independent hashes of key, used for double hashing.
+func missFilterHashes(key interface{}) (uint64, uint64) {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%T:%v", key, key)
+	h1 := h.Sum64()
+	h.Write([]byte{0})
+	return h1, h.Sum64() | 1
+}
+
+func (f *missFilter) add(key interface{}) {
+	h1, h2 := missFilterHashes(key)
+	n := uint64(len(f.bits)) * 64
+
+	f.Lock()
+	defer f.Unlock()
+	if f.count >= f.capacity {
+		f.clear()
+	}
+	for i := uint64(0); i < f.hashes; i++ {
+		bit := (h1 + i*h2) % n
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+	f.count++
+}
+
+func (f *missFilter) contains(key interface{}) bool {
+	h1, h2 := missFilterHashes(key)
+	n := uint64(len(f.bits)) * 64
+
+	f.Lock()
+	defer f.Unlock()
+	for i := uint64(0); i < f.hashes; i++ {
+		bit := (h1 + i*h2) % n
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *missFilter) reset() {
+	f.Lock()
+	defer f.Unlock()
+	f.clear()
+}
+
+// Careful: do not run this method unless the filter-mutex is locked!
+func (f *missFilter) clear() {
+	for i := range f.bits {
+		f.bits[i] = 0
+	}
+	f.count = 0
+}
@@ -0,0 +1,117 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"context"
+	"time"
+)
+
+// ItemBuilder constructs a cache item using its table's defaults.
+type ItemBuilder struct {
+	table       *CacheTable
+	key         interface{}
+	data        interface{}
+	lifeSpan    time.Duration
+	maxLifeSpan time.Duration
+	expiresAt   time.Time
+	tags        []string
+	etag        string
+	origin      string
+	size        int64
+}
+
+// NewItem returns a builder for an item with the given key and data. The
+// item's lifespan defaults to the DefaultLifeSpan of the table's Info.
+func (table *CacheTable) NewItem(key interface{}, data interface{}) *ItemBuilder {
+	return &ItemBuilder{
+		table:    table,
+		key:      key,
+		data:     data,
+		lifeSpan: table.Info().DefaultLifeSpan,
+	}
+}
+
+// WithLifeSpan overrides the item's lifespan.
+func (b *ItemBuilder) WithLifeSpan(lifeSpan time.Duration) *ItemBuilder {
+	b.lifeSpan = lifeSpan
+	return b
+}
+
+// WithMaxLifeSpan caps the item's lifetime since its creation, no matter how
+// often it gets accessed. The item expires as soon as either its lifespan or
+// its maximum lifetime is exceeded.
+func (b *ItemBuilder) WithMaxLifeSpan(maxLifeSpan time.Duration) *ItemBuilder {
+	b.maxLifeSpan = maxLifeSpan
+	return b
+}
+
+// WithExpiresAt makes the item expire at the given point in time at the
+// latest, no matter how often it gets accessed.
+func (b *ItemBuilder) WithExpiresAt(t time.Time) *ItemBuilder {
+	b.expiresAt = t
+	return b
+}
+
+// WithSchedule makes the item expire at the next occurrence of the given
+// schedule at the latest, e.g. at the end of the day. All items added with
+// the same schedule roll over together.
+func (b *ItemBuilder) WithSchedule(s Schedule) *ItemBuilder {
+	return b.WithExpiresAt(s.Next(time.Now()))
+}
+
+// WithTags attaches the given tags to the item.
+func (b *ItemBuilder) WithTags(tags ...string) *ItemBuilder {
+	b.tags = append(b.tags, tags...)
+	return b
+}
+
+// WithETag attaches the validator of the data at its origin to the item, see
+// StaleItem.
+func (b *ItemBuilder) WithETag(etag string) *ItemBuilder {
+	b.etag = etag
+	return b
+}
+
+// WithOrigin names the loader producing the item, e.g. to tell apart the
+// backends a data-loader consults.
+func (b *ItemBuilder) WithOrigin(origin string) *ItemBuilder {
+	b.origin = origin
+	return b
+}
+
+// WithSize sets the size in bytes the item accounts for in the table's
+// memory budget and namespace quotas, instead of estimating the size of its
+// data with EstimateSize.
+func (b *ItemBuilder) WithSize(size int64) *ItemBuilder {
+	b.size = size
+	return b
+}
+
+// Build returns the item without adding it to the table, e.g. to return it
+// from a data-loader.
+func (b *ItemBuilder) Build() *CacheItem {
+	item := NewCacheItem(b.key, b.lifeSpan, b.data)
+	item.maxLifeSpan = b.maxLifeSpan
+	item.expiresAt = b.expiresAt
+	item.tags = b.tags
+	item.etag = b.etag
+	item.origin = b.origin
+	item.sizeHint = b.size
+	return item
+}
+
+// Add adds the item to the table and returns the stored item.
+func (b *ItemBuilder) Add() (*CacheItem, error) {
+	return b.AddCtx(context.Background())
+}
+
+// AddCtx works like Add, but passes ctx on to the AddedItem callbacks.
+func (b *ItemBuilder) AddCtx(ctx context.Context) (*CacheItem, error) {
+	return b.table.handle(ctx, &Request{Op: OpAdd, Key: b.key, LifeSpan: b.lifeSpan, Data: b.data, template: b.Build()})
+}
@@ -9,7 +9,9 @@
 package cache2go
 
 import (
+	"sort"
 	"sync"
+	"time"
 )
 
 var (
@@ -29,14 +31,58 @@ func Cache(table string) *CacheTable {
 		t, ok = cache[table]
 		// Double check whether the table exists or not.
 		if !ok {
-			t = &CacheTable{
-				name:  table,
-				items: make(map[interface{}]*CacheItem),
-			}
+			t = newCacheTable(table)
 			cache[table] = t
 		}
 		mutex.Unlock()
+
+		if !ok {
+			tableCreated(t)
+		}
 	}
 
 	return t
 }
+
+// RemoveTable flushes the cache table with the given name and removes it, so
+// Cache returns a new table for that name from now on. It returns false if
+// the table does not exist.
+func RemoveTable(name string) bool {
+	mutex.Lock()
+	t, ok := cache[name]
+	delete(cache, name)
+	mutex.Unlock()
+	if !ok {
+		return false
+	}
+
+	t.Flush()
+	tableRemoved(name)
+	return true
+}
+
+// Returns a new, unregistered cache table.
+func newCacheTable(name string) *CacheTable {
+	watchClock()
+	table := &CacheTable{
+		name:      name,
+		items:     newStore(nil),
+		createdOn: time.Now(),
+	}
+	table.Reconfigure(Defaults())
+	return table
+}
+
+// AllTables returns the names of all existing cache tables, sorted.
+func AllTables() []string {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	names := make([]string, 0, len(cache))
+	for name := range cache {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
@@ -9,8 +9,21 @@ package cache2go
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -192,6 +205,90 @@ func TestDelete(t *testing.T) {
 	}
 }
 
+func TestDeleteConcurrent(t *testing.T) {
+	table := Cache("testDeleteConcurrent")
+	table.Flush()
+	defer table.RemoveAboutToDeleteItemCallback()
+
+	var calls int32
+	release := make(chan struct{})
+	table.SetAboutToDeleteItemCallback(func(item *CacheItem) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+	})
+	table.Add(k, 0, v)
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := table.Delete(k)
+			errs <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	var deleted int
+	for i := 0; i < 2; i++ {
+		if <-errs == nil {
+			deleted++
+		}
+	}
+	if deleted != 1 {
+		t.Error("Expected exactly one delete to succeed, got", deleted)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Error("Expected AboutToDeleteItem callback to run once, ran", n, "times")
+	}
+	if table.Exists(k) {
+		t.Error("Expected item to be deleted")
+	}
+}
+
+func TestDeleteReentrantCallback(t *testing.T) {
+	table := Cache("testDeleteReentrantCallback")
+	table.Flush()
+	defer table.RemoveAboutToDeleteItemCallback()
+
+	var calls int32
+	var nested error
+	table.SetAboutToDeleteItemCallback(func(item *CacheItem) {
+		if item.Key() != k {
+			return
+		}
+		atomic.AddInt32(&calls, 1)
+		// Removing the item again counts it as gone, and adding an expiring
+		// item runs an expiration check which finds the item expired.
+		_, nested = table.Delete(k)
+		time.Sleep(20 * time.Millisecond)
+		table.Add(k+"2", time.Minute, v)
+	})
+	table.Add(k, 10*time.Millisecond, v)
+
+	done := make(chan error)
+	go func() {
+		_, err := table.Delete(k)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error("Error deleting item", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Delete hung while its callback wrote to the table")
+	}
+	if nested != ErrKeyNotFound {
+		t.Error("Expected nested delete to return ErrKeyNotFound, got", nested)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Error("Expected AboutToDeleteItem callback to run once, ran", n, "times")
+	}
+	if table.Exists(k) || !table.Exists(k+"2") {
+		t.Error("Expected item to be deleted and the callback's item to be added")
+	}
+}
+
 func TestFlush(t *testing.T) {
 	// add an item to the cache
 	table := Cache("testFlush")
@@ -263,6 +360,273 @@ func TestDataLoader(t *testing.T) {
 	}
 }
 
+func TestKeyLoader(t *testing.T) {
+	table := Cache("testKeyLoader")
+	table.Flush()
+	err := table.AddKeyLoader("user:{id}:post:{post}", func(ctx context.Context, key string, params map[string]string, args ...interface{}) *CacheItem {
+		return NewCacheItem(key, 0, params["id"]+"/"+params["post"])
+	})
+	if err != nil {
+		t.Fatal("Error adding key loader:", err)
+	}
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		return NewCacheItem(key, 0, "fallback")
+	})
+
+	if p, err := table.Value("user:42:post:7"); err != nil || p.Data() != "42/7" {
+		t.Error("Expected parameters to be extracted, got", p, err)
+	}
+	if p, err := table.Value("user:42"); err != nil || p.Data() != "fallback" {
+		t.Error("Expected fallback to the data-loader, got", p, err)
+	}
+
+	for _, pattern := range []string{"user:{id", "user:{}", "{a}{b}", "{a}:{a}", "user}", "user:{uid}:post:{p}"} {
+		if err := table.AddKeyLoader(pattern, nil); !errors.Is(err, ErrInvalidKeyTemplate) {
+			t.Error("Expected ErrInvalidKeyTemplate for", pattern, "got", err)
+		}
+	}
+
+	tmpl, _ := ParseKeyTemplate("{tenant}/items/{id}.json")
+	for key, want := range map[string]string{
+		"acme/items/1.json":     "map[id:1 tenant:acme]",
+		"acme/items/a.b.json":   "map[id:a.b tenant:acme]",
+		"acme/items/.json":      "",
+		"/items/1.json":         "",
+		"acme/other/1.json":     "",
+		"acme/items/1.json.bak": "",
+	} {
+		params, ok := tmpl.Match(key)
+		if got := fmt.Sprint(params); ok != (want != "") || ok && got != want {
+			t.Error("Unexpected match of", key, "got", got, ok)
+		}
+	}
+
+	if !table.RemoveKeyLoader("user:{id}:post:{post}") || table.RemoveKeyLoader("user:{id}:post:{post}") {
+		t.Error("Expected key loader to be removed once")
+	}
+	if p, err := table.Value("user:1:post:1"); err != nil || p.Data() != "fallback" {
+		t.Error("Expected removed key loader to be skipped, got", p, err)
+	}
+}
+
+func TestCacheAside(t *testing.T) {
+	table := Cache("testCacheAside")
+	table.Flush()
+	var mu sync.Mutex
+	db := map[string]int{"a": 1}
+	loads := 0
+	block := make(chan struct{})
+	aside := NewCacheAside(table, 0, func(ctx context.Context, key string) (int, error) {
+		mu.Lock()
+		loads++
+		v, ok := db[key]
+		mu.Unlock()
+		if key == "slow" {
+			<-block
+		}
+		if !ok {
+			return 0, ErrKeyNotFound
+		}
+		return v, nil
+	}, func(ctx context.Context, key string, value int) error {
+		mu.Lock()
+		defer mu.Unlock()
+		db[key] = value
+		return nil
+	})
+
+	for i := 0; i < 2; i++ {
+		if v, err := aside.Get("a"); err != nil || v != 1 {
+			t.Error("Unexpected value", v, err)
+		}
+	}
+	if loads != 1 {
+		t.Error("Expected cached value to be served, loads:", loads)
+	}
+	if err := aside.Write("a", 2); err != nil || table.Exists("a") {
+		t.Error("Expected write to invalidate the cached value", err)
+	}
+	if v, _ := aside.Get("a"); v != 2 {
+		t.Error("Expected written value, got", v)
+	}
+
+	// A load reading the value from before a write must not cache it.
+	db["slow"] = 1
+	done := make(chan int)
+	go func() {
+		v, _ := aside.Get("slow")
+		done <- v
+	}()
+	for {
+		mu.Lock()
+		n := loads
+		mu.Unlock()
+		if n == 3 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	aside.Write("slow", 2)
+	close(block)
+	if v := <-done; v != 1 {
+		t.Error("Expected racing load to return the value it read, got", v)
+	}
+	if table.Exists("slow") {
+		t.Error("Expected value read before the write not to be cached")
+	}
+	if v, _ := aside.Get("slow"); v != 2 {
+		t.Error("Expected written value, got", v)
+	}
+}
+
+func TestCacheTableOf(t *testing.T) {
+	table := CacheOf[string, int]("testCacheTableOf")
+	table.Table().Flush()
+	table.Add("a", 0, 1)
+	table.Add("b", 0, 2)
+	table.Table().Add("c", 0, "three")
+
+	if v, err := table.Value("a"); err != nil || v != 1 {
+		t.Error("Unexpected value", v, err)
+	}
+	if _, err := table.Value("c"); err != ErrWrongType {
+		t.Error("Expected ErrWrongType, got", err)
+	}
+	if _, err := table.Value("d"); err != ErrKeyNotFound {
+		t.Error("Expected ErrKeyNotFound, got", err)
+	}
+
+	sum := 0
+	table.Foreach(func(key string, value int) {
+		sum += value
+	})
+	if sum != 3 {
+		t.Error("Expected items of other types to be skipped, got sum", sum)
+	}
+	if err := table.Delete("a"); err != nil || table.Exists("a") || table.Count() != 2 {
+		t.Error("Error deleting item", err)
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	table := Cache("testSoftDelete")
+	table.Flush()
+	table.Add(k, 0, v)
+
+	if r, err := table.SoftDelete(k, 50*time.Millisecond); err != nil || r == nil || table.Exists(k) {
+		t.Error("Error soft-deleting item", r, err)
+	}
+	if !table.Tombstoned(k) {
+		t.Error("Expected key to be tombstoned")
+	}
+	if _, err := table.AddCtx(context.Background(), k, 0, v); err != ErrTombstoned {
+		t.Error("Expected ErrTombstoned, got", err)
+	}
+	if _, err := table.NotFoundAddCtx(context.Background(), k, 0, v); err != ErrTombstoned {
+		t.Error("Expected ErrTombstoned, got", err)
+	}
+
+	// Data-loaders which started after the soft delete may store the key.
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		return NewCacheItem(key, 0, v)
+	})
+	if _, err := table.Value(k); err != nil {
+		t.Error("Expected data-loader to store the key, got", err)
+	}
+	table.SetDataLoader(nil)
+
+	table.SetTombstonePolicy(TombstoneFlag)
+	if r, _ := table.SoftDelete(k+"_missing", time.Minute); r != nil {
+		t.Error("Expected no item for missing key, got", r)
+	}
+	if item, err := table.AddCtx(context.Background(), k+"_missing", 0, v); err != nil || !item.Resurrected() {
+		t.Error("Expected item to be added and flagged", err)
+	}
+	if !table.RemoveTombstone(k+"_missing") || table.RemoveTombstone(k+"_missing") {
+		t.Error("Expected tombstone to be removed once")
+	}
+	if item, _ := table.AddCtx(context.Background(), k+"_missing", 0, v); item.Resurrected() {
+		t.Error("Expected item without tombstone not to be flagged")
+	}
+	table.SetTombstonePolicy(TombstoneReject)
+
+	table.SoftDelete(k, 50*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	if table.Tombstoned(k) {
+		t.Error("Expected tombstone to expire")
+	}
+	if _, err := table.AddCtx(context.Background(), k, 0, v); err != nil {
+		t.Error("Expected key to be added after its tombstone expired, got", err)
+	}
+}
+
+func TestFencingTokens(t *testing.T) {
+	table := Cache("testFencingTokens")
+	table.Flush()
+
+	older := table.NextToken(k)
+	newer := table.NextToken(k)
+	if newer <= older {
+		t.Error("Expected tokens to increase, got", older, newer)
+	}
+	if _, err := table.AddIfTokenNewer(k, newer, 0, "new"); err != nil {
+		t.Error("Error adding item with newest token:", err)
+	}
+	if _, err := table.AddIfTokenNewer(k, older, 0, "old"); err != ErrStaleToken {
+		t.Error("Expected ErrStaleToken, got", err)
+	}
+	if p, _ := table.Value(k); p.Data() != "new" {
+		t.Error("Expected newer data to be kept, got", p.Data())
+	}
+
+	// Deleting the key fences out the tokens drawn before.
+	racing := table.NextToken(k)
+	table.Delete(k)
+	if _, err := table.AddIfTokenNewer(k, racing, 0, "old"); err != ErrStaleToken {
+		t.Error("Expected fill racing with a delete to be rejected, got", err)
+	}
+	if _, err := table.AddIfTokenNewer(k, table.NextToken(k), 0, "new"); err != nil {
+		t.Error("Error adding item with token drawn after delete:", err)
+	}
+
+	// Fences of removed keys get pruned, unless tokens are outstanding.
+	outstanding := table.NextToken(k)
+	table.EvictTo(0)
+	table.AddIfTokenNewer(k+"2", table.NextToken(k+"2"), 0, v)
+	table.Delete(k + "2")
+	if n := table.fenceCount(); n != 1 {
+		t.Error("Expected only the fence with an outstanding token to be kept, got", n)
+	}
+	if _, err := table.AddIfTokenNewer(k, outstanding, 0, "new"); err != nil {
+		t.Error("Error adding item with outstanding token:", err)
+	}
+	table.Delete(k)
+	if n := table.fenceCount(); n != 0 {
+		t.Error("Expected fences to be pruned, got", n)
+	}
+	if _, err := table.AddIfTokenNewer(k+"2", outstanding, 0, "old"); err != ErrStaleToken {
+		t.Error("Expected fill with a token of a pruned fence to be rejected, got", err)
+	}
+	if _, err := table.AddIfTokenNewer(k, table.NextToken(k), 0, "new"); err != nil {
+		t.Error("Error adding item with token drawn after pruning:", err)
+	}
+
+	racing = table.NextToken(k)
+	table.Flush()
+	if _, err := table.AddIfTokenNewer(k, racing, 0, "old"); err != ErrStaleToken {
+		t.Error("Expected fill racing with a flush to be rejected, got", err)
+	}
+}
+
+func (table *CacheTable) fenceCount() int {
+	table.RLock()
+	defer table.RUnlock()
+	if table.fences == nil {
+		return 0
+	}
+	return table.fences.len()
+}
+
 func TestAccessCount(t *testing.T) {
 	// add 100 items to the cache
 	count := 100
@@ -472,3 +836,4284 @@ func TestLogger(t *testing.T) {
 		t.Error("Logger is empty")
 	}
 }
+
+func TestRecentlyRemoved(t *testing.T) {
+	table := Cache("testRecentlyRemoved")
+	table.SetRemovedHistorySize(2)
+
+	// nothing has been removed yet
+	if len(table.RecentlyRemoved(10)) != 0 {
+		t.Error("Expected empty removal history")
+	}
+
+	table.Add(k+"_1", 0, v)
+	table.Add(k+"_2", 0, v)
+	table.Add(k+"_3", 100*time.Millisecond, v)
+	table.Delete(k + "_1")
+	table.Delete(k + "_2")
+	time.Sleep(150 * time.Millisecond)
+
+	// the history only keeps the two latest removals, newest first
+	r := table.RecentlyRemoved(10)
+	if len(r) != 2 {
+		t.Fatal("Expected two items in removal history, got", len(r))
+	}
+	if r[0].Key != k+"_3" || r[0].Reason != RemovalExpired {
+		t.Error("Error recording expired item:", r[0].Key, r[0].Reason)
+	}
+	if r[1].Key != k+"_2" || r[1].Reason != RemovalDeleted {
+		t.Error("Error recording deleted item:", r[1].Key, r[1].Reason)
+	}
+	if r[0].RemovedOn.Before(r[1].RemovedOn) {
+		t.Error("Removal history is not sorted by removal time")
+	}
+
+	// a flush gets recorded as well
+	table.Add(k+"_4", 0, v)
+	table.Flush()
+	r = table.RecentlyRemoved(1)
+	if len(r) != 1 || r[0].Key != k+"_4" || r[0].Reason != RemovalFlushed {
+		t.Error("Error recording flushed item")
+	}
+}
+
+func TestAuditWriter(t *testing.T) {
+	out := new(bytes.Buffer)
+	table := Cache("testAuditWriter")
+	table.SetAuditWriter(out, AuditJSON)
+
+	table.Add(k, 0, v)
+	table.Add(k, 0, v)
+	table.Delete(k)
+	table.Add(k+"_expire", 50*time.Millisecond, v)
+	time.Sleep(100 * time.Millisecond)
+	table.SetAuditWriter(nil, AuditJSON)
+
+	// verify every change has been recorded in order
+	dec := json.NewDecoder(out)
+	expected := []AuditEvent{AuditAdded, AuditUpdated, AuditDeleted, AuditAdded, AuditExpired}
+	for _, ev := range expected {
+		var rec AuditRecord
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatal("Error decoding audit record:", err)
+		}
+		if rec.Event != ev || rec.Table != "testAuditWriter" {
+			t.Error("Unexpected audit record", rec.Event, "expected", ev)
+		}
+		if rec.Time.IsZero() || rec.CreatedOn.IsZero() {
+			t.Error("Audit record is missing timestamps")
+		}
+	}
+
+	// verify the text format and disabling the writer
+	out.Reset()
+	table.SetAuditWriter(out, AuditText)
+	table.Add(k, 0, v)
+	if !strings.Contains(out.String(), "event=add key=\""+k+"\"") {
+		t.Error("Unexpected text audit record:", out.String())
+	}
+	out.Reset()
+	table.SetAuditWriter(nil, AuditText)
+	table.Delete(k)
+	if out.Len() != 0 {
+		t.Error("Audit writer has not been disabled")
+	}
+}
+
+func TestContextCallbacks(t *testing.T) {
+	type ctxKey struct{}
+	ctx := context.WithValue(context.Background(), ctxKey{}, "trace-42")
+
+	var m sync.Mutex
+	var added, deleted, loaded interface{}
+	table := Cache("testContextCallbacks")
+	table.AddAddedItemCallbackCtx(func(ctx context.Context, item *CacheItem) {
+		m.Lock()
+		added = ctx.Value(ctxKey{})
+		m.Unlock()
+	})
+	table.AddAboutToDeleteItemCallbackCtx(func(ctx context.Context, item *CacheItem) {
+		m.Lock()
+		deleted = ctx.Value(ctxKey{})
+		m.Unlock()
+	})
+	table.SetDataLoaderCtx(func(ctx context.Context, key interface{}, args ...interface{}) *CacheItem {
+		m.Lock()
+		loaded = ctx.Value(ctxKey{})
+		m.Unlock()
+		return NewCacheItem(key, 0, v)
+	})
+
+	// verify the context reaches the callbacks and the data-loader
+	if _, err := table.AddCtx(ctx, k, 0, v); err != nil {
+		t.Error("Error adding item with context", err)
+	}
+	if _, err := table.DeleteCtx(ctx, k); err != nil {
+		t.Error("Error deleting item with context", err)
+	}
+	if _, err := table.ValueCtx(ctx, k+"_loaded"); err != nil {
+		t.Error("Error loading item with context", err)
+	}
+	m.Lock()
+	if added != "trace-42" || deleted != "trace-42" || loaded != "trace-42" {
+		t.Error("Context has not been passed to callbacks:", added, deleted, loaded)
+	}
+	m.Unlock()
+
+	// a cancelled context must not modify the table
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := table.AddCtx(cctx, k, 0, v); err != context.Canceled || table.Exists(k) {
+		t.Error("Expected cancelled context to prevent adding an item")
+	}
+	if _, err := table.DeleteCtx(cctx, k+"_loaded"); err != context.Canceled || !table.Exists(k+"_loaded") {
+		t.Error("Expected cancelled context to prevent deleting an item")
+	}
+}
+
+func TestAuditActor(t *testing.T) {
+	out := new(bytes.Buffer)
+	table := Cache("testAuditActor")
+	table.SetAuditWriter(out, AuditJSON)
+
+	table.AddCtx(WithAuditActor(context.Background(), "purge-job"), k, 0, v)
+
+	var rec AuditRecord
+	if err := json.NewDecoder(out).Decode(&rec); err != nil {
+		t.Fatal("Error decoding audit record:", err)
+	}
+	if rec.Actor != "purge-job" {
+		t.Error("Expected audit record to name the actor, got", rec.Actor)
+	}
+}
+
+func TestCallbackHandles(t *testing.T) {
+	var m sync.Mutex
+	var first, second, deleted, expired int
+	table := Cache("testCallbackHandles")
+
+	h1 := table.AddAddedItemCallback(func(item *CacheItem) {
+		m.Lock()
+		first++
+		m.Unlock()
+	})
+	table.AddAddedItemCallback(func(item *CacheItem) {
+		m.Lock()
+		second++
+		m.Unlock()
+	})
+	hd := table.AddAboutToDeleteItemCallback(func(item *CacheItem) {
+		m.Lock()
+		deleted++
+		m.Unlock()
+	})
+
+	// remove only the first added-item callback
+	if !table.RemoveCallback(h1) {
+		t.Error("Error removing callback by handle")
+	}
+	if table.RemoveCallback(h1) {
+		t.Error("Removing a callback twice should fail")
+	}
+
+	item := table.Add(k, 0, v)
+	he := item.AddAboutToExpireCallback(func(key interface{}) {
+		m.Lock()
+		expired++
+		m.Unlock()
+	})
+	if !item.RemoveCallback(he) {
+		t.Error("Error removing item callback by handle")
+	}
+	if !table.RemoveCallback(hd) {
+		t.Error("Error removing about-to-delete callback by handle")
+	}
+	table.Delete(k)
+
+	m.Lock()
+	if first != 0 || second != 1 {
+		t.Error("Wrong added-item callbacks triggered:", first, second)
+	}
+	if deleted != 0 || expired != 0 {
+		t.Error("Removed callbacks have been triggered:", deleted, expired)
+	}
+	m.Unlock()
+}
+
+func TestMiddleware(t *testing.T) {
+	var m sync.Mutex
+	var calls []string
+	table := Cache("testMiddleware")
+
+	// record the order in which middleware gets called
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(ctx context.Context, req *Request) (*CacheItem, error) {
+				m.Lock()
+				calls = append(calls, name+":"+req.Op.String())
+				m.Unlock()
+				return next(ctx, req)
+			}
+		}
+	}
+	// upper-case all stored string values
+	upper := func(next Handler) Handler {
+		return func(ctx context.Context, req *Request) (*CacheItem, error) {
+			if req.Op == OpAdd {
+				req.Data = strings.ToUpper(req.Data.(string))
+			}
+			return next(ctx, req)
+		}
+	}
+	table.Use(trace("outer"), trace("inner"))
+	table.Use(upper)
+
+	table.Add(k, 0, v)
+	p, err := table.Value(k)
+	if err != nil || p.Data().(string) != strings.ToUpper(v) {
+		t.Error("Middleware did not modify the request", err)
+	}
+	table.Delete(k)
+
+	m.Lock()
+	expected := []string{"outer:add", "inner:add", "outer:value", "inner:value", "outer:delete", "inner:delete"}
+	if strings.Join(calls, ",") != strings.Join(expected, ",") {
+		t.Error("Unexpected middleware calls:", calls)
+	}
+	m.Unlock()
+}
+
+func TestValidator(t *testing.T) {
+	errNil := errors.New("nil data")
+	table := Cache("testValidator")
+	table.SetValidator(func(key, data interface{}) error {
+		if data == nil {
+			return errNil
+		}
+		return nil
+	})
+
+	// invalid data must be rejected by all add methods
+	if p := table.Add(k, 0, nil); p != nil || table.Exists(k) {
+		t.Error("Add stored invalid data")
+	}
+	if _, err := table.AddCtx(context.Background(), k, 0, nil); err != errNil {
+		t.Error("Expected AddCtx to return the validation error, got", err)
+	}
+	if table.NotFoundAdd(k, 0, nil) || table.Exists(k) {
+		t.Error("NotFoundAdd stored invalid data")
+	}
+	if _, err := table.NotFoundAddCtx(context.Background(), k, 0, nil); err != errNil {
+		t.Error("Expected NotFoundAddCtx to return the validation error, got", err)
+	}
+
+	// so must invalid data returned by the data-loader
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		return NewCacheItem(key, 0, nil)
+	})
+	if _, err := table.Value(k); err != errNil || table.Exists(k) {
+		t.Error("Expected Value to return the validation error, got", err)
+	}
+
+	// valid data gets added as usual
+	if p := table.Add(k, 0, v); p == nil || !table.Exists(k) {
+		t.Error("Error adding valid data")
+	}
+}
+
+func TestKeyNormalizer(t *testing.T) {
+	table := Cache("testKeyNormalizer")
+	table.SetKeyNormalizer(func(key interface{}) interface{} {
+		if s, ok := key.(string); ok {
+			return strings.ToLower(strings.TrimSpace(s))
+		}
+		return key
+	})
+
+	// different spellings of the same logical key share a single item
+	table.Add(" SomeKey ", 0, v)
+	if !table.Exists("somekey") || !table.Exists("SOMEKEY") {
+		t.Error("Error looking up normalized key")
+	}
+	p, err := table.Value("someKey")
+	if err != nil || p.Key() != "somekey" {
+		t.Error("Error retrieving item by normalized key", err)
+	}
+	if table.NotFoundAdd("SOMEKEY", 0, v) {
+		t.Error("NotFoundAdd added a duplicate of a normalized key")
+	}
+	if table.Count() != 1 {
+		t.Error("Expected a single item, got", table.Count())
+	}
+
+	// non-string keys are left untouched by this normalizer
+	table.Add(42, 0, v)
+	if !table.Exists(42) {
+		t.Error("Error looking up non-string key")
+	}
+
+	if _, err := table.Delete("  SOMEKEY"); err != nil || table.Exists("somekey") {
+		t.Error("Error deleting item by normalized key", err)
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	table := Cache("testMaxSize")
+	table.SetMaxKeySize(8, func(key interface{}) int64 {
+		return int64(len(key.(string)))
+	})
+	table.SetMaxValueSize(64, nil)
+
+	// oversized keys and values get rejected with a typed error
+	_, err := table.AddCtx(context.Background(), "muchtoolongkey", 0, v)
+	if !errors.Is(err, ErrKeyTooLarge) {
+		t.Error("Expected ErrKeyTooLarge, got", err)
+	}
+	_, err = table.AddCtx(context.Background(), k, 0, make([]byte, 128))
+	if !errors.Is(err, ErrValueTooLarge) {
+		t.Error("Expected ErrValueTooLarge, got", err)
+	}
+	var serr *SizeError
+	if !errors.As(err, &serr) || serr.Limit != 64 || serr.Size < 128 {
+		t.Error("Expected SizeError with size details, got", err)
+	}
+	if table.Count() != 0 {
+		t.Error("Oversized items have been added")
+	}
+
+	// items within the limits get added
+	if _, err = table.AddCtx(context.Background(), k, 0, v); err != nil {
+		t.Error("Error adding item within size limits", err)
+	}
+}
+
+func TestEstimateSize(t *testing.T) {
+	type node struct {
+		name string
+		next *node
+	}
+	n := &node{name: "first"}
+	n.next = &node{name: "second", next: n}
+
+	if EstimateSize(nil) != 0 {
+		t.Error("Expected size of nil to be 0")
+	}
+	if EstimateSize("four") < 4 || EstimateSize(make([]byte, 100)) < 100 {
+		t.Error("Estimated size too small")
+	}
+	// cyclic references must be handled
+	if EstimateSize(n) < int64(len("first")+len("second")) {
+		t.Error("Estimated size of cyclic structure too small")
+	}
+	if EstimateSize(map[string]string{"a": "b"}) <= EstimateSize(map[string]string{}) {
+		t.Error("Map entries not considered in size estimate")
+	}
+}
+
+func TestLease(t *testing.T) {
+	table := Cache("testLease")
+
+	l, err := table.Lease(k, 100*time.Millisecond)
+	if err != nil || l.Key() != k || l.ExpiresOn().IsZero() {
+		t.Fatal("Error acquiring lease", err)
+	}
+	// nobody else gets the key while it is leased
+	if _, err = table.Lease(k, time.Second); err != ErrLeased {
+		t.Error("Expected ErrLeased, got", err)
+	}
+
+	// renewing keeps the lease alive past its initial ttl
+	time.Sleep(60 * time.Millisecond)
+	if err = l.Renew(100 * time.Millisecond); err != nil {
+		t.Error("Error renewing lease", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, err = table.Lease(k, time.Second); err != ErrLeased {
+		t.Error("Renewed lease has expired too early")
+	}
+
+	// an expired lease can't be renewed and the key is free again
+	time.Sleep(100 * time.Millisecond)
+	if err = l.Renew(time.Second); err != ErrLeaseExpired {
+		t.Error("Expected ErrLeaseExpired, got", err)
+	}
+	l2, err := table.Lease(k, 0)
+	if err != nil {
+		t.Fatal("Error acquiring lease after expiration", err)
+	}
+
+	// releasing frees the key immediately
+	if err = l2.Release(); err != nil {
+		t.Error("Error releasing lease", err)
+	}
+	if err = l2.Release(); err != ErrLeaseExpired {
+		t.Error("Releasing a lease twice should fail")
+	}
+	if _, err = table.Lease(k, time.Second); err != nil {
+		t.Error("Error acquiring released lease", err)
+	}
+}
+
+func TestSemaphore(t *testing.T) {
+	table := Cache("testSemaphore")
+
+	// acquire the entire capacity in two steps
+	if err := table.Acquire(k, 2, 3, 100*time.Millisecond); err != nil {
+		t.Error("Error acquiring semaphore", err)
+	}
+	if err := table.Acquire(k, 1, 3, 100*time.Millisecond); err != nil {
+		t.Error("Error acquiring semaphore", err)
+	}
+	if err := table.Acquire(k, 1, 3, 100*time.Millisecond); err != ErrSemaphoreFull {
+		t.Error("Expected ErrSemaphoreFull, got", err)
+	}
+	p, err := table.Value(k)
+	if err != nil || p.Data().(*Semaphore).Used() != 3 || p.Data().(*Semaphore).Capacity() != 3 {
+		t.Error("Error verifying semaphore state", err)
+	}
+
+	// releasing frees capacity again
+	if err = table.Release(k, 2); err != nil {
+		t.Error("Error releasing semaphore", err)
+	}
+	if err = table.Acquire(k, 2, 3, 100*time.Millisecond); err != nil {
+		t.Error("Error acquiring released capacity", err)
+	}
+	if err = table.Release(k, 5); err != ErrSemaphoreRelease {
+		t.Error("Expected ErrSemaphoreRelease, got", err)
+	}
+	if p.Data().(*Semaphore).Used() != 3 {
+		t.Error("Expected failed release to keep the held units, got", p.Data().(*Semaphore).Used())
+	}
+	if err = table.Acquire(k, -1, 3, 100*time.Millisecond); err != ErrSemaphoreUnits {
+		t.Error("Expected ErrSemaphoreUnits, got", err)
+	}
+	if err = table.Release(k, 0); err != ErrSemaphoreUnits {
+		t.Error("Expected ErrSemaphoreUnits, got", err)
+	}
+
+	// the semaphore vanishes once it has been idle for its ttl
+	time.Sleep(150 * time.Millisecond)
+	if err = table.Release(k, 1); err != ErrKeyNotFound {
+		t.Error("Expected idle semaphore to expire, got", err)
+	}
+
+	// regular items can't be used as semaphores
+	table.Add(k, 0, v)
+	if err = table.Acquire(k, 1, 3, 0); err != ErrWrongType {
+		t.Error("Expected ErrWrongType, got", err)
+	}
+}
+
+func TestLoaderMissFilter(t *testing.T) {
+	var m sync.Mutex
+	calls := 0
+	table := Cache("testLoaderMissFilter")
+	table.SetLoaderMissFilter(1000, 0.001)
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		m.Lock()
+		defer m.Unlock()
+		calls++
+		if key.(string) == "nil" {
+			return nil
+		}
+		return NewCacheItem(key, 0, v)
+	})
+
+	// the loader only gets asked once for a missing key
+	for i := 0; i < 3; i++ {
+		if _, err := table.Value("nil"); err != ErrKeyNotFoundOrLoadable {
+			t.Error("Expected ErrKeyNotFoundOrLoadable, got", err)
+		}
+	}
+	m.Lock()
+	if calls != 1 {
+		t.Error("Expected a single loader call, got", calls)
+	}
+	m.Unlock()
+
+	// loadable keys are not affected
+	for i := 0; i < 100; i++ {
+		if _, err := table.Value(k + strconv.Itoa(i)); err != nil {
+			t.Error("Error loading key", err)
+		}
+	}
+
+	// resetting the filter makes the loader get asked again
+	table.ResetLoaderMissFilter()
+	table.Value("nil")
+	m.Lock()
+	if calls != 102 {
+		t.Error("Expected loader to be called after reset, got", calls)
+	}
+	m.Unlock()
+}
+
+func TestEarlyRefresh(t *testing.T) {
+	var m sync.Mutex
+	calls := 0
+	table := Cache("testEarlyRefresh")
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		time.Sleep(10 * time.Millisecond)
+		m.Lock()
+		defer m.Unlock()
+		calls++
+		return NewCacheItem(key, time.Second, calls)
+	})
+
+	// without early refreshes the item gets loaded once
+	table.Value(k)
+	table.Value(k)
+	m.Lock()
+	if calls != 1 {
+		t.Error("Expected a single loader call, got", calls)
+	}
+	m.Unlock()
+
+	// a huge beta makes a refresh practically certain
+	table.SetEarlyRefresh(1e9)
+	p, err := table.Value(k)
+	if err != nil || p.Data().(int) != 2 {
+		t.Error("Expected item to be refreshed early", err)
+	}
+
+	// failed refreshes keep serving the cached item
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	})
+	p, err = table.Value(k)
+	if err != nil || p.Data().(int) != 2 {
+		t.Error("Expected cached item after failed refresh", err)
+	}
+}
+
+func TestMaxItems(t *testing.T) {
+	table := Cache("testMaxItems")
+	table.SetRemovedHistorySize(10)
+	table.SetMaxItems(3)
+
+	table.Add("a", 0, v)
+	table.Add("b", 0, v)
+	table.Add("c", 0, v)
+	table.Value("a")
+	table.Add("d", 0, v)
+
+	// the least recently used item got evicted
+	if table.Count() != 3 || table.Exists("b") || !table.Exists("a") {
+		t.Error("Error evicting least recently used item")
+	}
+	r := table.RecentlyRemoved(1)
+	if len(r) != 1 || r[0].Key != "b" || r[0].Reason != RemovalEvicted {
+		t.Error("Error recording evicted item")
+	}
+
+	// lowering the limit evicts right away
+	table.SetMaxItems(1)
+	if table.Count() != 1 || !table.Exists("d") {
+		t.Error("Error evicting items after lowering the limit")
+	}
+}
+
+func TestMaxItemsReentrantCallback(t *testing.T) {
+	table := Cache("testMaxItemsReentrantCallback")
+	table.Flush()
+	table.SetMaxItems(1)
+	defer table.SetMaxItems(0)
+	defer table.RemoveAboutToDeleteItemCallback()
+
+	table.Add("x", 0, v)
+	table.SetAboutToDeleteItemCallback(func(item *CacheItem) {
+		if item.Key() == "x" {
+			table.Add("y", 0, v)
+		}
+	})
+
+	done := make(chan struct{})
+	go func() {
+		table.Delete("x")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Delete hung while its callback added to the full table")
+	}
+	if table.Exists("x") || !table.Exists("y") || table.Count() != 1 {
+		t.Error("Expected x to be replaced by y, got", table.Count(), "items")
+	}
+}
+
+func TestSegmentedEviction(t *testing.T) {
+	table := Cache("testSegmentedEviction")
+	table.SetMaxItems(4)
+	table.SetSegmented(0.5)
+
+	// accessing items again promotes them to the protected segment
+	table.Add("hot1", 0, v)
+	table.Add("hot2", 0, v)
+	table.Value("hot1")
+	table.Value("hot2")
+
+	// a scan over many keys only churns the probation segment
+	for i := 0; i < 10; i++ {
+		table.Add(k+strconv.Itoa(i), 0, v)
+	}
+	if !table.Exists("hot1") || !table.Exists("hot2") {
+		t.Error("Scan evicted protected items")
+	}
+	if table.Count() != 4 {
+		t.Error("Expected 4 items, got", table.Count())
+	}
+
+	// promoting a third item demotes the least recently used protected one
+	table.Value(k + "9")
+	table.Add("new1", 0, v)
+	table.Add("new2", 0, v)
+	if table.Exists("hot1") || !table.Exists("hot2") || !table.Exists(k+"9") {
+		t.Error("Error demoting protected items")
+	}
+}
+
+// caseInsensitiveHasher treats string keys case-insensitively.
+type caseInsensitiveHasher struct{}
+
+func (caseInsensitiveHasher) Hash(key interface{}) (uint64, error) {
+	s, ok := key.(string)
+	if !ok {
+		return 0, ErrUnhashableKey
+	}
+	h := fnv.New64a()
+	h.Write([]byte(strings.ToLower(s)))
+	return h.Sum64(), nil
+}
+
+func (caseInsensitiveHasher) Equal(a, b interface{}) bool {
+	return strings.EqualFold(a.(string), b.(string))
+}
+
+func TestHasher(t *testing.T) {
+	table := Cache("testHasher")
+
+	// unhashable keys return an error instead of panicking
+	if _, err := table.AddCtx(context.Background(), []int{1}, 0, v); err != ErrUnhashableKey {
+		t.Error("Expected ErrUnhashableKey, got", err)
+	}
+	if _, err := table.Value(struct{ k interface{} }{[]int{1}}); err != ErrUnhashableKey {
+		t.Error("Expected ErrUnhashableKey, got", err)
+	}
+	if table.Exists(map[string]int{}) {
+		t.Error("Unhashable key reported as existing")
+	}
+
+	// existing items get rehashed
+	table.Add("SomeKey", 0, v)
+	table.SetHasher(caseInsensitiveHasher{})
+	if !table.Exists("somekey") {
+		t.Error("Error rehashing existing items")
+	}
+
+	table.Add("OtherKey", 0, v+"_1")
+	table.Add("OTHERKEY", 0, v+"_2")
+	if table.Count() != 2 {
+		t.Error("Expected 2 items, got", table.Count())
+	}
+	p, err := table.Value("otherkey")
+	if err != nil || p.Data().(string) != v+"_2" {
+		t.Error("Error retrieving item with custom hasher", err)
+	}
+	if _, err = table.AddCtx(context.Background(), 42, 0, v); err != ErrUnhashableKey {
+		t.Error("Expected hasher error for unsupported key, got", err)
+	}
+
+	table.Delete("SOMEKEY")
+	if table.Exists("SomeKey") || table.Count() != 1 {
+		t.Error("Error deleting item with custom hasher")
+	}
+}
+
+func TestByteSliceKeys(t *testing.T) {
+	table := Cache("testByteSliceKeys")
+
+	key := []byte("bytekey")
+	if _, err := table.AddCtx(context.Background(), key, 0, v); err != nil {
+		t.Fatal("Error adding item with []byte key", err)
+	}
+	table.Add("bytekey", 0, v+"_string")
+
+	// lookups work with any slice holding the same bytes, and []byte keys
+	// don't collide with string keys
+	p, err := table.Value([]byte("bytekey"))
+	if err != nil || p.Data().(string) != v {
+		t.Error("Error retrieving item by []byte key", err)
+	}
+	if table.Count() != 2 {
+		t.Error("Expected 2 items, got", table.Count())
+	}
+	found := false
+	table.Foreach(func(k interface{}, item *CacheItem) {
+		if b, ok := k.([]byte); ok && string(b) == "bytekey" {
+			found = true
+		}
+	})
+	if !found {
+		t.Error("Foreach did not visit item with []byte key")
+	}
+
+	if _, err = table.Delete([]byte("bytekey")); err != nil || table.Exists(key) {
+		t.Error("Error deleting item by []byte key", err)
+	}
+	if !table.Exists("bytekey") {
+		t.Error("Deleting []byte key removed string key")
+	}
+}
+
+func TestByteSliceKeyReuse(t *testing.T) {
+	table := Cache("testByteSliceKeyReuse")
+	table.Flush()
+
+	// callers may reuse their buffers right after adding an item
+	buf := []byte("expiring")
+	table.Add(buf, 20*time.Millisecond, v)
+	copy(buf, "reusedbf")
+
+	if !table.Exists([]byte("expiring")) || table.Exists(buf) {
+		t.Error("Expected the item to keep the key it was added with")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if table.Count() != 0 {
+		t.Error("Expected item with reused []byte key to expire, got", table.Count(), "items")
+	}
+}
+
+func TestView(t *testing.T) {
+	table := Cache("testView")
+	table.Add(k, 0, v)
+
+	// the visitor sees the data and its error gets passed on
+	var seen interface{}
+	errVisitor := errors.New("visitor error")
+	err := table.View(k, func(data interface{}) error {
+		seen = data
+		return errVisitor
+	})
+	if err != errVisitor || seen != v {
+		t.Error("Error viewing item", err, seen)
+	}
+	p, _ := table.Value(k)
+	if p.AccessCount() != 2 {
+		t.Error("View did not mark the item as accessed")
+	}
+
+	if err = table.View(k+"_missing", func(data interface{}) error { return nil }); err != ErrKeyNotFound {
+		t.Error("Expected ErrKeyNotFound, got", err)
+	}
+}
+
+func TestWithLock(t *testing.T) {
+	table := Cache("testWithLock")
+	item := table.Add(k, 0, map[string]int{})
+
+	// concurrently mutate a shared map stored as data
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				item.WithLock(func(data interface{}) {
+					data.(map[string]int)["counter"]++
+					// the table stays usable while holding the lock
+					table.Exists(k)
+				})
+				item.WithRLock(func(data interface{}) {
+					_ = data.(map[string]int)["counter"]
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	item.WithRLock(func(data interface{}) {
+		if data.(map[string]int)["counter"] != 1000 {
+			t.Error("Lost updates to shared data:", data)
+		}
+	})
+}
+
+func TestItemsSortedBy(t *testing.T) {
+	table := Cache("testItemsSortedBy")
+	for i := 0; i < 10; i++ {
+		item := table.Add(i, time.Duration(10-i)*time.Second, v)
+		for j := 0; j < i; j++ {
+			item.KeepAlive()
+		}
+	}
+	table.Add("immortal", 0, v)
+
+	// the most accessed items come first in descending order
+	r := table.ItemsSortedBy(SortByAccessCount, false, 3)
+	if len(r) != 3 || r[0].Key() != 9 || r[1].Key() != 8 || r[2].Key() != 7 {
+		t.Error("Error sorting by access count")
+	}
+
+	// the items expiring first come first in ascending order
+	r = table.ItemsSortedBy(SortByRemainingTTL, true, 2)
+	if len(r) != 2 || r[0].Key() != 9 || r[1].Key() != 8 {
+		t.Error("Error sorting by remaining TTL")
+	}
+	r = table.ItemsSortedBy(SortByRemainingTTL, false, 1)
+	if len(r) != 1 || r[0].Key() != "immortal" {
+		t.Error("Expected non-expiring item to have the longest TTL")
+	}
+
+	// without a limit all items get returned in order
+	r = table.ItemsSortedBy(SortByCreatedOn, true, 0)
+	if len(r) != 11 {
+		t.Error("Error sorting all items by creation time")
+	}
+	for i := 1; i < len(r); i++ {
+		if r[i].CreatedOn().Before(r[i-1].CreatedOn()) {
+			t.Error("Items not sorted by creation time")
+		}
+	}
+}
+
+func TestStreamItems(t *testing.T) {
+	table := Cache("testStreamItems")
+	table.Flush()
+	table.Add("a", 3*time.Second, v)
+	table.Add("b", time.Second, v)
+	table.Add("c", 0, v)
+	table.Add("d", 2*time.Second, v)
+
+	var buf bytes.Buffer
+	if err := table.StreamItems(&buf, ItemJSON, ItemOrder{By: SortByRemainingTTL}); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var s ItemSummary
+		if err := dec.Decode(&s); err != nil {
+			t.Fatal(err)
+		}
+		if s.Expires != (s.Key != "c") || s.Size != EstimateSize(v) {
+			t.Error("Unexpected summary", s)
+		}
+		keys = append(keys, s.Key)
+	}
+	if fmt.Sprint(keys) != "[b d a c]" {
+		t.Error("Expected items ordered by remaining TTL, got", keys)
+	}
+
+	buf.Reset()
+	table.StreamItems(&buf, ItemText, ItemOrder{By: SortByRemainingTTL, Desc: true})
+	if lines := strings.Split(buf.String(), "\n"); len(lines) != 5 || !strings.HasPrefix(lines[0], `key="c" ttl=never`) {
+		t.Error("Unexpected text output", buf.String())
+	}
+}
+
+func TestStreamItemsConcurrentWrites(t *testing.T) {
+	table := Cache("testStreamItemsConcurrentWrites")
+	table.Flush()
+	item := table.Add(k, 0, map[int]int{})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			item.WithLock(func(data interface{}) {
+				data.(map[int]int)[i] = i
+			})
+		}
+	}()
+
+	// Summaries must not read the data while it gets written.
+	for i := 0; i < 100; i++ {
+		if err := table.StreamItems(ioutil.Discard, ItemText, ItemOrder{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
+
+func TestSample(t *testing.T) {
+	table := Cache("testSample")
+	if len(table.Sample(10)) != 0 {
+		t.Error("Expected empty sample of empty table")
+	}
+
+	for i := 0; i < 100; i++ {
+		table.Add(i, 0, v)
+	}
+	for i := 0; i < 50; i++ {
+		table.Delete(i * 2)
+	}
+
+	// samples only contain distinct, existing items
+	for _, count := range []int{1, 10, 40, 50, 100} {
+		r := table.Sample(count)
+		if (count <= 50 && len(r) != count) || (count > 50 && len(r) != 50) {
+			t.Error("Unexpected sample size", len(r), "for count", count)
+		}
+		seen := make(map[interface{}]bool)
+		for _, item := range r {
+			if seen[item.Key()] || item.Key().(int)%2 == 0 {
+				t.Error("Unexpected item in sample", item.Key())
+			}
+			seen[item.Key()] = true
+		}
+	}
+
+	// every item gets picked eventually
+	seen := make(map[interface{}]bool)
+	for i := 0; i < 1000; i++ {
+		seen[table.Sample(1)[0].Key()] = true
+	}
+	if len(seen) != 50 {
+		t.Error("Sampling is not uniform, only saw", len(seen), "items")
+	}
+}
+
+func TestCountApprox(t *testing.T) {
+	table := Cache("testCountApprox")
+	for i := 0; i < 100; i++ {
+		table.Add(i, 0, v)
+	}
+	table.Add(0, 0, v)
+	table.Delete(1)
+	if table.CountApprox() != 99 || table.CountApprox() != table.Count() {
+		t.Error("Expected approximate count of 99, got", table.CountApprox())
+	}
+
+	table.Flush()
+	if table.CountApprox() != 0 {
+		t.Error("Expected approximate count of 0 after flush, got", table.CountApprox())
+	}
+}
+
+func TestInfo(t *testing.T) {
+	table := Cache("testInfo")
+	table.SetInfo(Info{
+		Owner:           "team-cache",
+		Purpose:         "testing metadata",
+		DefaultLifeSpan: time.Minute,
+		CreatedOn:       time.Unix(0, 0),
+	})
+
+	info := table.Info()
+	if info.Owner != "team-cache" || info.Purpose != "testing metadata" || info.DefaultLifeSpan != time.Minute {
+		t.Error("Error retrieving table info", info)
+	}
+	if info.CreatedOn.Unix() == 0 || info.CreatedOn.After(time.Now()) {
+		t.Error("Error getting table creation time")
+	}
+	if table.Name() != "testInfo" {
+		t.Error("Error getting table name")
+	}
+
+	// the table is listed among all tables
+	names := AllTables()
+	if !sort.StringsAreSorted(names) {
+		t.Error("Table names are not sorted")
+	}
+	i := sort.SearchStrings(names, "testInfo")
+	if i == len(names) || names[i] != "testInfo" {
+		t.Error("Table missing from AllTables")
+	}
+}
+
+func TestTablesInfo(t *testing.T) {
+	table := Cache("testTablesInfo")
+	table.SetInfo(Info{Owner: "team-cache"})
+	for i := 0; i < 10; i++ {
+		table.Add(i, 0, make([]byte, 1000))
+	}
+	table.Value(0)
+	table.Value(1)
+	table.Value(2)
+	table.Value(k)
+
+	var ti *TableInfo
+	for _, info := range TablesInfo() {
+		if info.Name == "testTablesInfo" {
+			info := info
+			ti = &info
+		}
+	}
+	if ti == nil {
+		t.Fatal("Table missing from TablesInfo")
+	}
+	if ti.Count != 10 || ti.Hits != 3 || ti.Misses != 1 || ti.HitRatio != 0.75 {
+		t.Error("Unexpected table stats", ti.Count, ti.Hits, ti.Misses, ti.HitRatio)
+	}
+	if ti.MemoryEstimate < 10000 {
+		t.Error("Memory estimate too small:", ti.MemoryEstimate)
+	}
+	if ti.Info.Owner != "team-cache" {
+		t.Error("Table metadata missing from TablesInfo")
+	}
+
+	found := false
+	ForEachTable(func(table *CacheTable) {
+		if table.Name() == "testTablesInfo" {
+			found = true
+		}
+	})
+	if !found {
+		t.Error("ForEachTable did not visit table")
+	}
+}
+
+func TestGlobalStats(t *testing.T) {
+	before := GlobalStats()
+
+	table := Cache("testGlobalStats")
+	table.Add(k, 0, v)
+	table.Value(k)
+	table.Value(k + "missing")
+
+	s := table.Stats()
+	if s.Items != 1 || s.Hits != 1 || s.Misses != 1 || s.HitRatio() != 0.5 {
+		t.Error("Unexpected table stats", s)
+	}
+
+	after := GlobalStats()
+	if after.Tables != before.Tables+1 {
+		t.Error("Expected one more table, got", after.Tables-before.Tables)
+	}
+	if after.Hits-before.Hits != 1 || after.Misses-before.Misses != 1 {
+		t.Error("Global stats did not include table counters")
+	}
+
+	ticks := make(chan Stats, 10)
+	stop := OnStatsTick(10*time.Millisecond, func(s Stats) {
+		ticks <- s
+	})
+	select {
+	case s := <-ticks:
+		if s.Tables < after.Tables {
+			t.Error("Stats tick missing tables")
+		}
+	case <-time.After(time.Second):
+		t.Error("Stats tick never fired")
+	}
+	stop()
+	stop()
+}
+
+func TestStatsRemovals(t *testing.T) {
+	table := Cache("testStatsRemovals")
+	table.Flush()
+	table.ResetStats(false)
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		return NewCacheItem(key, 0, v)
+	})
+	defer table.SetDataLoader(nil)
+	table.SetMaxItems(2)
+	defer table.SetMaxItems(0)
+
+	table.Value("a")
+	table.Value("a")
+	table.Add("b", 0, v)
+	table.Add("c", 0, v)
+	table.Delete("c")
+	table.Add("d", 10*time.Millisecond, v)
+	time.Sleep(50 * time.Millisecond)
+
+	s := table.Stats()
+	if s.Loads != 1 || s.Evictions != 1 || s.Deletes != 1 || s.Expirations != 1 || s.Items != 1 {
+		t.Error("Unexpected table stats", s)
+	}
+	table.ResetStats(false)
+	if s := table.Stats(); s.Loads != 0 || s.Evictions != 0 || s.Deletes != 0 || s.Expirations != 0 {
+		t.Error("Expected stats to be reset", s)
+	}
+}
+
+func TestItemBuilder(t *testing.T) {
+	table := Cache("testItemBuilder")
+	table.SetInfo(Info{DefaultLifeSpan: time.Minute})
+
+	item, err := table.NewItem(k, v).WithTags("a", "b").Add()
+	if err != nil {
+		t.Fatal("Error adding item via builder:", err)
+	}
+	if item.LifeSpan() != time.Minute {
+		t.Error("Expected table default lifespan, got", item.LifeSpan())
+	}
+	if p, _ := table.Value(k); p != item || len(p.Tags()) != 2 {
+		t.Error("Builder did not store tagged item")
+	}
+
+	item, _ = table.NewItem(k+"short", v).WithLifeSpan(time.Second).Add()
+	if item.LifeSpan() != time.Second {
+		t.Error("Expected overridden lifespan, got", item.LifeSpan())
+	}
+
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		return table.NewItem(key, v).WithTags("loaded").Build()
+	})
+	p, err := table.Value(k + "loaded")
+	if err != nil || p.LifeSpan() != time.Minute || len(p.Tags()) != 1 || p.Tags()[0] != "loaded" {
+		t.Error("Loader lost builder defaults", err)
+	}
+}
+
+func TestDataLoaderReturnsStoredItem(t *testing.T) {
+	table := Cache("testDataLoaderReturnsStoredItem")
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		return NewCacheItem(key, 0, v)
+	})
+
+	p, err := table.Value(k)
+	if err != nil {
+		t.Fatal("Error retrieving loaded item:", err)
+	}
+	if stored, _ := table.Value(k); stored != p {
+		t.Error("Value did not return the stored item")
+	}
+
+	// A concurrent add while loading wins over the loaded item.
+	var concurrent *CacheItem
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		concurrent = table.Add(key, 0, "concurrent")
+		return NewCacheItem(key, 0, v)
+	})
+	p, err = table.Value(k + "race")
+	if err != nil || p != concurrent || p.Data().(string) != "concurrent" {
+		t.Error("Expected concurrently added item to be kept")
+	}
+}
+
+func TestGet(t *testing.T) {
+	table := Cache("testGet")
+	table.Add(k, 0, v)
+
+	data, ok := table.Get(k)
+	if !ok || data.(string) != v {
+		t.Error("Error retrieving data via Get")
+	}
+	if _, ok := table.Get(k + "missing"); ok {
+		t.Error("Get found a non-existing key")
+	}
+	if _, ok := table.Get([]int{1}); ok {
+		t.Error("Get found an unhashable key")
+	}
+
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		return NewCacheItem(key, 0, v)
+	})
+	if _, ok := table.Get(k + "loadable"); ok {
+		t.Error("Get must not use the data-loader")
+	}
+}
+
+func TestValueWithMode(t *testing.T) {
+	table := Cache("testValueWithMode")
+	item := table.Add(k, 0, v)
+	accessedOn := item.AccessedOn()
+	time.Sleep(10 * time.Millisecond)
+
+	table.ValueWithMode(k, AccessPeek)
+	if item.AccessCount() != 0 || !item.AccessedOn().Equal(accessedOn) {
+		t.Error("Peek modified the item")
+	}
+
+	table.ValueWithMode(k, AccessCount)
+	if item.AccessCount() != 1 || !item.AccessedOn().Equal(accessedOn) {
+		t.Error("Count-only access touched the item or did not count")
+	}
+
+	table.ValueWithMode(k, AccessTouch)
+	if item.AccessCount() != 1 || !item.AccessedOn().After(accessedOn) {
+		t.Error("Touch-only access counted or did not touch the item")
+	}
+
+	table.Value(k)
+	if item.AccessCount() != 2 {
+		t.Error("Default access did not count")
+	}
+}
+
+func TestRaceChecks(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	EnableRaceChecks()
+	defer func() {
+		DisableRaceChecks()
+		log.SetOutput(os.Stderr)
+	}()
+
+	table := Cache("testRaceChecks")
+	item := table.Add(k, 0, map[string]int{})
+
+	item.WithLock(func(data interface{}) {
+		data.(map[string]int)["a"] = 1
+	})
+	item.Data()
+	if buf.Len() != 0 {
+		t.Error("Unexpected race report:", buf.String())
+	}
+
+	item.Data().(map[string]int)["b"] = 2
+	item.WithRLock(func(data interface{}) {})
+	if !strings.Contains(buf.String(), "data changed without WithLock") {
+		t.Error("Unsynchronized modification not reported:", buf.String())
+	}
+
+	buf.Reset()
+	item.WithRLock(func(data interface{}) {
+		data.(map[string]int)["c"] = 3
+	})
+	if !strings.Contains(buf.String(), "data changed within WithRLock") {
+		t.Error("Modification within WithRLock not reported:", buf.String())
+	}
+}
+
+func TestMaxLifeSpan(t *testing.T) {
+	table := Cache("testMaxLifeSpan")
+	item, _ := table.NewItem(k, v).
+		WithLifeSpan(100 * time.Millisecond).
+		WithMaxLifeSpan(250 * time.Millisecond).
+		Add()
+	if item.MaxLifeSpan() != 250*time.Millisecond {
+		t.Error("Unexpected max lifespan", item.MaxLifeSpan())
+	}
+
+	// Accessing keeps the item alive beyond its lifespan...
+	for i := 0; i < 3; i++ {
+		time.Sleep(50 * time.Millisecond)
+		if _, err := table.Value(k); err != nil {
+			t.Fatal("Item expired before its max lifespan")
+		}
+	}
+
+	// ...but not beyond its max lifespan.
+	time.Sleep(200 * time.Millisecond)
+	if table.Exists(k) {
+		t.Error("Item outlived its max lifespan")
+	}
+}
+
+func TestExpirationMode(t *testing.T) {
+	table := Cache("testExpirationMode")
+	table.SetExpirationMode(ExpireAfterWrite)
+	table.Add(k, 150*time.Millisecond, v)
+
+	// Accessing doesn't keep the item alive beyond its lifespan.
+	for i := 0; i < 2; i++ {
+		time.Sleep(50 * time.Millisecond)
+		if _, err := table.Value(k); err != nil {
+			t.Fatal("Item expired before its lifespan")
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if table.Exists(k) {
+		t.Error("Item outlived its lifespan despite expiring after write")
+	}
+
+	// Combine an idle timeout with a maximum lifetime.
+	table.SetExpirationMode(ExpireAfterAccess)
+	table.SetMaxLifeSpan(150 * time.Millisecond)
+	defer table.SetMaxLifeSpan(0)
+	table.Add(k, 100*time.Millisecond, v)
+	table.NewItem(k+"_own", v).WithLifeSpan(time.Minute).WithMaxLifeSpan(time.Minute).Add()
+	table.Add(k+"_idle", 50*time.Millisecond, v)
+	for i := 0; i < 2; i++ {
+		time.Sleep(50 * time.Millisecond)
+		if _, err := table.Value(k); err != nil {
+			t.Fatal("Item expired before its max lifespan")
+		}
+	}
+	if table.Exists(k + "_idle") {
+		t.Error("Item outlived its idle timeout")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if table.Exists(k) || !table.Exists(k+"_own") {
+		t.Error("Expected table's max lifespan to apply to items without one")
+	}
+}
+
+type ttlValue time.Duration
+
+func (v ttlValue) CacheTTL() time.Duration { return time.Duration(v) }
+
+func TestExpiryProvider(t *testing.T) {
+	table := Cache("testExpiryProvider")
+	table.Flush()
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		return NewCacheItem(key, time.Hour, ttlValue(time.Minute))
+	})
+	defer table.SetDataLoader(nil)
+
+	if item := table.Add("own", time.Hour, ttlValue(time.Second)); item.LifeSpan() != time.Second {
+		t.Error("Expected value's TTL to be honored, got", item.LifeSpan())
+	}
+	if item := table.Add("none", time.Hour, ttlValue(0)); item.LifeSpan() != time.Hour {
+		t.Error("Expected passed lifespan without a TTL of the value, got", item.LifeSpan())
+	}
+	if item, _ := table.Value("loaded"); item.LifeSpan() != time.Minute {
+		t.Error("Expected value's TTL to be honored for loaded items, got", item.LifeSpan())
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+
+	if n := EndOfDay(time.UTC).Next(at("2020-02-28T13:45:00Z")); !n.Equal(at("2020-02-29T00:00:00Z")) {
+		t.Error("Unexpected end of day", n)
+	}
+
+	tests := []struct {
+		spec, from, next string
+	}{
+		{"*/15 * * * *", "2020-01-01T10:07:30Z", "2020-01-01T10:15:00Z"},
+		{"30 4 * * 1-5", "2020-01-03T05:00:00Z", "2020-01-06T04:30:00Z"},
+		{"@daily", "2020-12-31T23:59:00Z", "2021-01-01T00:00:00Z"},
+		{"0 0 1,15 * 0", "2020-01-02T00:00:00Z", "2020-01-05T00:00:00Z"},
+		{"CRON_TZ=UTC 0 12 29 2 *", "2020-03-01T00:00:00Z", "2024-02-29T12:00:00Z"},
+	}
+	for _, test := range tests {
+		s, err := ParseSchedule(test.spec)
+		if err != nil {
+			t.Fatal("Error parsing schedule", test.spec, err)
+		}
+		if n := s.Next(at(test.from).In(time.UTC)); !n.Equal(at(test.next)) {
+			t.Error("Unexpected next occurrence for", test.spec, n)
+		}
+	}
+
+	for _, spec := range []string{"* * * *", "60 * * * *", "*/0 * * * *", "CRON_TZ=Nowhere/Town * * * * *"} {
+		if _, err := ParseSchedule(spec); err == nil {
+			t.Error("Expected error parsing", spec)
+		}
+	}
+}
+
+func TestScheduledExpiry(t *testing.T) {
+	table := Cache("testScheduledExpiry")
+	deadline := time.Now().Add(100 * time.Millisecond)
+	item, _ := table.NewItem(k, v).WithExpiresAt(deadline).Add()
+	if !item.ExpiresAt().Equal(deadline) {
+		t.Error("Unexpected expiry time", item.ExpiresAt())
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if table.Exists(k) {
+		t.Error("Item outlived its expiry time")
+	}
+
+	item, _ = table.NewItem(k, v).WithSchedule(EndOfDay(time.UTC)).Add()
+	if item.ExpiresAt().Sub(time.Now()) > 24*time.Hour || item.ExpiresAt().UTC().Hour() != 0 {
+		t.Error("Unexpected scheduled expiry time", item.ExpiresAt())
+	}
+}
+
+type everyInterval time.Duration
+
+func (s everyInterval) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(s))
+}
+
+func TestScheduleRefresh(t *testing.T) {
+	table := Cache("testScheduleRefresh")
+	if _, err := table.ScheduleRefresh("bogus", func(*CacheTable) {}); err == nil {
+		t.Error("Expected error for invalid spec")
+	}
+
+	stop, err := table.ScheduleRefresh("* * * * *", func(*CacheTable) {})
+	if err != nil {
+		t.Fatal("Error scheduling refresh:", err)
+	}
+	stop()
+
+	// Overlapping runs get skipped, panics recovered.
+	var runs int32
+	release := make(chan struct{})
+	r := &scheduledRefresh{table: table, schedule: everyInterval(10 * time.Millisecond), fn: func(table *CacheTable) {
+		if atomic.AddInt32(&runs, 1) == 1 {
+			<-release
+		}
+		panic("refresh failed")
+	}}
+	r.arm()
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&runs); n != 1 {
+		t.Error("Expected overlapping runs to be skipped, got", n)
+	}
+	close(release)
+	time.Sleep(100 * time.Millisecond)
+	r.stop()
+	if n := atomic.LoadInt32(&runs); n < 2 {
+		t.Error("Expected refresh to keep running after a panic, got", n)
+	}
+}
+
+func TestAddContent(t *testing.T) {
+	table := Cache("testAddContent")
+	fragment := []byte("<div>rendered</div>")
+
+	key := table.AddContent(fragment, 0)
+	if key2 := table.AddContent([]byte("<div>rendered</div>"), 0); key2 != key {
+		t.Error("Identical content got different keys")
+	}
+	if key3 := table.AddContent([]byte("<div>other</div>"), 0); key3 == key {
+		t.Error("Different content got the same key")
+	}
+	if table.Count() != 2 {
+		t.Error("Expected identical content to be stored once, got", table.Count())
+	}
+	if key != ContentKey(fragment) {
+		t.Error("Unexpected content key", key)
+	}
+
+	if err := table.ReleaseContent(key); err != nil {
+		t.Error("Error releasing content:", err)
+	}
+	if !table.Exists(key) {
+		t.Error("Content deleted while still referenced")
+	}
+	if err := table.ReleaseContent(key); err != nil {
+		t.Error("Error releasing content:", err)
+	}
+	if table.Exists(key) {
+		t.Error("Content not deleted after its last release")
+	}
+	if err := table.ReleaseContent(key); err != ErrKeyNotFound {
+		t.Error("Expected ErrKeyNotFound, got", err)
+	}
+}
+
+func TestAlias(t *testing.T) {
+	table := Cache("testAlias")
+	item := table.Add("id:1", 0, v)
+
+	if err := table.Alias("id:1", "slug:one"); err != nil {
+		t.Fatal("Error creating alias:", err)
+	}
+	if err := table.Alias("slug:one", "email:one"); err != nil {
+		t.Fatal("Error aliasing an alias:", err)
+	}
+	if err := table.Alias("id:2", "slug:two"); err != ErrKeyNotFound {
+		t.Error("Expected ErrKeyNotFound, got", err)
+	}
+	if err := table.Alias("id:1", "slug:one"); err != ErrKeyExists {
+		t.Error("Expected ErrKeyExists, got", err)
+	}
+	if table.AliasCount("id:1") != 2 || table.Count() != 1 {
+		t.Error("Unexpected alias count", table.AliasCount("id:1"))
+	}
+
+	if p, err := table.Value("email:one"); err != nil || p != item {
+		t.Error("Alias did not resolve to the shared item")
+	}
+	if data, ok := table.Get("slug:one"); !ok || data.(string) != v {
+		t.Error("Get did not resolve alias")
+	}
+
+	// Updates via an alias are visible under all keys.
+	table.Add("slug:one", 0, "updated")
+	if p, _ := table.Value("id:1"); p.Data().(string) != "updated" || table.AliasCount("id:1") != 2 {
+		t.Error("Update via alias not visible consistently")
+	}
+
+	// Deleting an alias only drops that reference.
+	table.Delete("email:one")
+	if table.Exists("email:one") || !table.Exists("id:1") || table.AliasCount("id:1") != 1 {
+		t.Error("Deleting an alias affected the item")
+	}
+
+	// The item lives on under its aliases.
+	table.Alias("id:1", "email:one")
+	item, _ = table.Value("id:1")
+	if p, err := table.Delete("id:1"); err != nil || p != item {
+		t.Error("Error deleting the item's key:", err)
+	}
+	if table.Exists("id:1") || item.Key() != "slug:one" || table.AliasCount("slug:one") != 1 {
+		t.Error("Expected the oldest alias to take over the deleted key")
+	}
+	if p, err := table.Value("email:one"); err != nil || p != item {
+		t.Error("Expected remaining aliases to refer to the item", err)
+	}
+
+	// The item gets deleted along with its last key.
+	table.Delete("slug:one")
+	if !table.Exists("email:one") || table.Count() != 1 {
+		t.Error("Item got deleted while an alias referred to it")
+	}
+	table.Delete("email:one")
+	if table.Exists("email:one") || table.Count() != 0 {
+		t.Error("Item outlived its last key")
+	}
+
+	// Expiring the item removes its aliases.
+	table.Add("id:1", 50*time.Millisecond, v)
+	table.Alias("id:1", "slug:one")
+	time.Sleep(100 * time.Millisecond)
+	if table.Exists("slug:one") {
+		t.Error("Alias outlived its item")
+	}
+	table.Add("slug:one", 0, v)
+	if table.AliasCount("slug:one") != 0 {
+		t.Error("Stale alias after its item expired")
+	}
+}
+
+func TestInvalidateSubtree(t *testing.T) {
+	for _, indexed := range []bool{false, true} {
+		table := Cache("testInvalidateSubtree" + strconv.FormatBool(indexed))
+		if indexed {
+			table.SetPathIndex(DefaultPathSeparator)
+		}
+		keys := []string{"user/42", "user/42/orders/7", "user/42/orders/8", "user/420", "user/43/orders/7"}
+		for _, key := range keys {
+			table.Add(key, 0, v)
+		}
+		table.Add(42, 0, v)
+
+		if n := table.InvalidateSubtree("user/42"); n != 3 {
+			t.Error("Expected 3 invalidated items, got", n)
+		}
+		for i, key := range keys {
+			if table.Exists(key) != (i >= 3) {
+				t.Error("Unexpected existence of", key)
+			}
+		}
+
+		table.Delete("user/43/orders/7")
+		if n := table.InvalidateSubtree("user/43"); n != 0 {
+			t.Error("Expected deleted item to be gone from the index, got", n)
+		}
+		if n := table.InvalidateSubtree("user"); n != 1 {
+			t.Error("Expected 1 invalidated item, got", n)
+		}
+	}
+}
+
+func TestDataLoaderCoalescing(t *testing.T) {
+	table := Cache("testDataLoaderCoalescing")
+	var calls int32
+	release := make(chan struct{})
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return NewCacheItem(key, 0, v)
+	})
+
+	var wg sync.WaitGroup
+	items := make([]*CacheItem, 10)
+	for i := range items {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			items[i], _ = table.Value(k)
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Error("Expected a single loader call, got", n)
+	}
+	for _, item := range items {
+		if item == nil || item != items[0] {
+			t.Error("Coalesced lookups returned different items")
+		}
+	}
+
+	flightMu.Lock()
+	_, ok := flights[table]
+	flightMu.Unlock()
+	if ok {
+		t.Error("Finished load still registered")
+	}
+}
+
+func TestConflictPolicy(t *testing.T) {
+	table := Cache("testConflictPolicy")
+	orig := table.Add(k, 0, 1)
+
+	table.SetConflictPolicy(ConflictError, nil)
+	if _, err := table.AddCtx(context.Background(), k, 0, 2); err != ErrKeyExists {
+		t.Error("Expected ErrKeyExists, got", err)
+	}
+	if table.Add(k, 0, 2) != nil {
+		t.Error("Expected Add to fail on existing key")
+	}
+	if _, err := table.AddCtx(context.Background(), k+"new", 0, 2); err != nil {
+		t.Error("Error adding new key:", err)
+	}
+
+	table.SetConflictPolicy(ConflictKeepOriginal, nil)
+	if p := table.Add(k, 0, 3); p != orig {
+		t.Error("Expected original item to be kept")
+	}
+
+	table.SetConflictPolicy(ConflictMerge, func(key, existing, added interface{}) interface{} {
+		return existing.(int) + added.(int)
+	})
+	if p := table.Add(k, 0, 4); p.Data().(int) != 5 {
+		t.Error("Expected merged data, got", p.Data())
+	}
+
+	// Merged data has to pass the checks of added data.
+	errTooLarge := errors.New("too large")
+	table.SetValidator(func(key, data interface{}) error {
+		if data.(int) > 10 {
+			return errTooLarge
+		}
+		return nil
+	})
+	defer table.SetValidator(nil)
+	if _, err := table.AddCtx(context.Background(), k, 0, 6); err != errTooLarge {
+		t.Error("Expected the validator to reject the merged data, got", err)
+	}
+	if p, _ := table.Value(k); p.Data().(int) != 5 {
+		t.Error("Expected rejected merge to keep the existing item, got", p.Data())
+	}
+
+	if err := table.SetConflictPolicy(ConflictMerge, nil); err != ErrNoMergeFunc {
+		t.Error("Expected ErrNoMergeFunc, got", err)
+	}
+
+	table.SetConflictPolicy(ConflictOverwrite, nil)
+	if p := table.Add(k, 0, 6); p.Data().(int) != 6 {
+		t.Error("Expected overwritten data, got", p.Data())
+	}
+}
+
+func TestRejectNil(t *testing.T) {
+	table := Cache("testRejectNil")
+	if table.Add(nil, 0, v) == nil || table.Add(k, 0, nil) == nil {
+		t.Error("Nil keys and data must be accepted by default")
+	}
+
+	table.SetRejectNil(true, true)
+	if _, err := table.AddCtx(context.Background(), nil, 0, v); err != ErrNilKey {
+		t.Error("Expected ErrNilKey, got", err)
+	}
+	if _, err := table.AddCtx(context.Background(), k, 0, nil); err != ErrNilData {
+		t.Error("Expected ErrNilData, got", err)
+	}
+	var m map[string]int
+	if _, err := table.AddCtx(context.Background(), k, 0, m); err != ErrNilData {
+		t.Error("Expected ErrNilData for nil map, got", err)
+	}
+	if _, err := table.AddCtx(context.Background(), k, 0, 0); err != nil {
+		t.Error("Error adding zero value:", err)
+	}
+
+	table.SetRejectNil(false, true)
+	if _, err := table.AddCtx(context.Background(), nil, 0, v); err != nil {
+		t.Error("Error adding nil key:", err)
+	}
+}
+
+func TestClone(t *testing.T) {
+	table := Cache("testClone")
+	item, _ := table.NewItem(k, map[string]int{"a": 1}).WithLifeSpan(time.Minute).WithTags("x").Add()
+	table.Value(k)
+
+	c := item.Clone()
+	if c == item || c.Key() != k || c.LifeSpan() != time.Minute || c.AccessCount() != 1 ||
+		!c.CreatedOn().Equal(item.CreatedOn()) || len(c.Tags()) != 1 {
+		t.Error("Clone lost item metadata")
+	}
+
+	// Accessing the original does not affect the clone.
+	table.Value(k)
+	if c.AccessCount() != 1 {
+		t.Error("Clone not detached from the original")
+	}
+
+	deep := item.CloneWith(func(data interface{}) interface{} {
+		m := make(map[string]int)
+		for k, v := range data.(map[string]int) {
+			m[k] = v
+		}
+		return m
+	})
+	deep.Data().(map[string]int)["a"] = 2
+	if item.Data().(map[string]int)["a"] != 1 {
+		t.Error("Deep clone shares data with the original")
+	}
+}
+
+func TestResetStats(t *testing.T) {
+	table := Cache("testResetStats")
+	item := table.Add(k, 0, v)
+	table.Value(k)
+	table.Value(k + "missing")
+	accessedOn := item.AccessedOn()
+
+	item.ResetStats(false)
+	if item.AccessCount() != 0 || !item.AccessedOn().Equal(accessedOn) {
+		t.Error("Unexpected item stats after reset")
+	}
+
+	table.Value(k)
+	time.Sleep(10 * time.Millisecond)
+	table.ResetStats(true)
+	if s := table.Stats(); s.Hits != 0 || s.Misses != 0 {
+		t.Error("Table counters not reset", s)
+	}
+	if item.AccessCount() != 0 || !item.AccessedOn().After(accessedOn) {
+		t.Error("Item stats not reset by table")
+	}
+}
+
+func TestSnapshotDiff(t *testing.T) {
+	table := Cache("testSnapshotDiff")
+	table.Add("keep", 0, v)
+	table.Add("remove", 0, v)
+	table.Add("replace", 0, v)
+	inPlace := table.Add("inPlace", 0, map[string]int{"a": 1})
+
+	a := table.Snapshot()
+	if a.Len() != 4 || len(a.Items()) != 4 || a.Table != "testSnapshotDiff" {
+		t.Error("Unexpected snapshot", a.Len())
+	}
+	if d := SnapshotDiff(a, table.Snapshot()); !d.Empty() {
+		t.Error("Expected empty diff, got", d)
+	}
+
+	table.Delete("remove")
+	table.Add("replace", 0, v+"2")
+	table.Add("add", 0, v)
+	inPlace.WithLock(func(data interface{}) {
+		data.(map[string]int)["a"] = 2
+	})
+
+	d := SnapshotDiff(a, table.Snapshot())
+	sortKeys := func(keys []interface{}) []string {
+		var r []string
+		for _, k := range keys {
+			r = append(r, k.(string))
+		}
+		sort.Strings(r)
+		return r
+	}
+	if added := sortKeys(d.Added); len(added) != 1 || added[0] != "add" {
+		t.Error("Unexpected added keys", added)
+	}
+	if removed := sortKeys(d.Removed); len(removed) != 1 || removed[0] != "remove" {
+		t.Error("Unexpected removed keys", removed)
+	}
+	if changed := sortKeys(d.Changed); len(changed) != 2 || changed[0] != "inPlace" || changed[1] != "replace" {
+		t.Error("Unexpected changed keys", changed)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	table := Cache("testVerify")
+	backend := map[int]int{}
+	for i := 0; i < 100; i++ {
+		backend[i] = i
+		table.Add(i, 0, i)
+	}
+	backend[1] = -1
+	delete(backend, 2)
+
+	sampler := func(key interface{}) (interface{}, error) {
+		if key.(int) == 3 {
+			return nil, errors.New("backend unavailable")
+		}
+		data, ok := backend[key.(int)]
+		if !ok {
+			return nil, ErrKeyNotFound
+		}
+		return data, nil
+	}
+
+	r := table.Verify(sampler, 1)
+	if r.Sampled != 100 || len(r.Diverged) != 2 || len(r.Failed) != 1 || r.Failed[0].Key != 3 {
+		t.Error("Unexpected report", r.Sampled, r.Diverged, r.Failed)
+	}
+	if ratio := r.DivergenceRatio(); ratio != 2.0/99 {
+		t.Error("Unexpected divergence ratio", ratio)
+	}
+
+	if r := table.Verify(sampler, 0.1); r.Sampled != 10 {
+		t.Error("Expected 10 sampled items, got", r.Sampled)
+	}
+}
+
+type testKey struct {
+	Tenant string
+	ID     int
+}
+
+func TestKeyCodec(t *testing.T) {
+	c := NewTypedKeyCodec()
+	c.Register("testKey", testKey{})
+
+	keys := []interface{}{"user/1", []byte{0, ':', 255}, true, 42, int8(-8), int64(-1 << 60),
+		uint16(65535), uint64(1 << 63), 1.5, float32(0.25), testKey{"acme", 7}}
+	for _, key := range keys {
+		b, err := c.EncodeKey(key)
+		if err != nil {
+			t.Fatal("Error encoding", key, err)
+		}
+		b2, _ := c.EncodeKey(key)
+		if !bytes.Equal(b, b2) {
+			t.Error("Encoding not deterministic for", key)
+		}
+		decoded, err := c.DecodeKey(b)
+		if err != nil {
+			t.Fatal("Error decoding", string(b), err)
+		}
+		if fmt.Sprintf("%T %v", decoded, decoded) != fmt.Sprintf("%T %v", key, key) {
+			t.Errorf("Key %T %v did not round-trip, got %T %v", key, key, decoded, decoded)
+		}
+	}
+
+	if _, err := c.EncodeKey(struct{ A int }{1}); !errors.Is(err, ErrUnsupportedKey) {
+		t.Error("Expected ErrUnsupportedKey for unregistered type, got", err)
+	}
+	for _, b := range []string{"nocolon", "json.unknown:{}", "x:1", "int8:300"} {
+		if _, err := c.DecodeKey([]byte(b)); err == nil {
+			t.Error("Expected error decoding", b)
+		}
+	}
+
+	table := Cache("testKeyCodec")
+	if table.KeyCodec() != DefaultKeyCodec {
+		t.Error("Expected default key codec")
+	}
+	table.SetKeyCodec(c)
+	if table.KeyCodec() != c {
+		t.Error("Key codec not set")
+	}
+}
+
+func TestMirror(t *testing.T) {
+	source := Cache("testMirrorSource")
+	var changes []Change
+	h := source.Subscribe(func(c Change) {
+		changes = append(changes, c)
+	})
+
+	var stream bytes.Buffer
+	source.Replicate(NewChangeEncoder(&stream, nil))
+	source.Add("a", 0, v)
+	source.Add(1, time.Minute, 42)
+	source.Add("b", 0, v)
+	source.Delete("b")
+
+	if !source.RemoveCallback(h) || len(changes) != 4 || changes[3].Op != ChangeDelete || changes[0].Table != "testMirrorSource" {
+		t.Error("Unexpected changes", changes)
+	}
+
+	mirror := Cache("testMirror")
+	dec := NewChangeDecoder(&stream, nil)
+	if err := mirror.Mirror(dec); err != nil {
+		t.Fatal("Error mirroring:", err)
+	}
+	if mirror.Count() != 2 || mirror.Exists("b") {
+		t.Error("Mirror does not match source, count", mirror.Count())
+	}
+	if p, err := mirror.Value(1); err != nil || p.Data().(int) != 42 || p.LifeSpan() != time.Minute {
+		t.Error("Mirrored item differs from source")
+	}
+
+	if _, err := mirror.AddCtx(context.Background(), "c", 0, v); err != ErrReadOnly {
+		t.Error("Expected ErrReadOnly, got", err)
+	}
+	if _, err := mirror.Delete("a"); err != ErrReadOnly {
+		t.Error("Expected ErrReadOnly, got", err)
+	}
+
+	source.Flush()
+	if err := mirror.Mirror(dec); err != nil {
+		t.Fatal("Error mirroring:", err)
+	}
+	if mirror.Count() != 0 {
+		t.Error("Flush not mirrored")
+	}
+}
+
+func TestReadOnlyWrites(t *testing.T) {
+	table := Cache("testReadOnlyWrites")
+	table.Flush()
+	table.SetPathIndex("/")
+	defer table.SetPathIndex("")
+	table.Add("a/1", 0, v)
+	content := table.AddContent([]byte(v), 0)
+	table.Acquire("sem", 1, 2, 0)
+
+	table.SetReadOnly(true)
+	defer table.SetReadOnly(false)
+	if err := table.Acquire("sem2", 1, 2, 0); err != ErrReadOnly || table.Exists("sem2") {
+		t.Error("Expected read-only table to reject new semaphores, got", err)
+	}
+	if err := table.Acquire("sem", 1, 2, 0); err != ErrReadOnly {
+		t.Error("Expected read-only table to reject acquiring, got", err)
+	}
+	if err := table.Release("sem", 1); err != ErrReadOnly {
+		t.Error("Expected read-only table to reject releasing, got", err)
+	}
+	if err := table.Alias("a/1", "b"); err != ErrReadOnly {
+		t.Error("Expected read-only table to reject aliases, got", err)
+	}
+	if err := table.ReleaseContent(content); err != ErrReadOnly || !table.Exists(content) {
+		t.Error("Expected read-only table to reject releasing content, got", err)
+	}
+	if n := table.InvalidateSubtree("a"); n != 0 || !table.Exists("a/1") {
+		t.Error("Expected read-only table to keep subtree, deleted", n)
+	}
+}
+
+// An in-memory GossipTransport for tests.
+type memTransport struct {
+	sync.Mutex
+	network  *sync.Map
+	addr     string
+	messages chan []byte
+	closed   bool
+}
+
+func newMemTransport(network *sync.Map, addr string) *memTransport {
+	t := &memTransport{network: network, addr: addr, messages: make(chan []byte, 64)}
+	network.Store(addr, t)
+	return t
+}
+
+func (t *memTransport) Addr() string { return t.addr }
+
+func (t *memTransport) Send(addr string, msg []byte) error {
+	peer, ok := t.network.Load(addr)
+	if !ok {
+		return errors.New("unreachable")
+	}
+	p := peer.(*memTransport)
+	p.Lock()
+	defer p.Unlock()
+	if !p.closed {
+		select {
+		case p.messages <- msg:
+		default:
+		}
+	}
+	return nil
+}
+
+func (t *memTransport) Messages() <-chan []byte { return t.messages }
+
+func (t *memTransport) Close() error {
+	t.Lock()
+	defer t.Unlock()
+	if !t.closed {
+		t.closed = true
+		t.network.Delete(t.addr)
+		close(t.messages)
+	}
+	return nil
+}
+
+func TestGossip(t *testing.T) {
+	network := &sync.Map{}
+	var mu sync.Mutex
+	events := map[string]int{}
+	newNode := func(name string) *Gossip {
+		return NewGossip(GossipConfig{
+			Name:           name,
+			Interval:       10 * time.Millisecond,
+			FailureTimeout: 100 * time.Millisecond,
+			OnJoin: func(m Member) {
+				mu.Lock()
+				events["join "+m.Name]++
+				mu.Unlock()
+			},
+			OnLeave: func(m Member) {
+				mu.Lock()
+				events["leave "+m.Name]++
+				mu.Unlock()
+			},
+		}, newMemTransport(network, name+":1"))
+	}
+	waitFor := func(what string, cond func() bool) {
+		deadline := time.Now().Add(2 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatal("Timed out waiting for", what)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	alive := func(g *Gossip) []string {
+		var r []string
+		for _, m := range g.Members() {
+			if m.State == MemberAlive {
+				r = append(r, m.Name)
+			}
+		}
+		return r
+	}
+
+	a, b, c := newNode("a"), newNode("b"), newNode("c")
+	defer a.Close()
+	if err := b.Join("a:1"); err != nil {
+		t.Fatal("Error joining:", err)
+	}
+	if err := c.Join("nowhere:1", "b:1"); err != nil {
+		t.Fatal("Error joining:", err)
+	}
+	if err := c.Join("nowhere:1"); err == nil {
+		t.Error("Expected error joining unreachable node")
+	}
+
+	// Membership spreads to nodes which weren't contacted directly.
+	waitFor("membership", func() bool {
+		return len(alive(a)) == 2 && len(alive(b)) == 2 && len(alive(c)) == 2
+	})
+
+	c.Leave()
+	waitFor("leave", func() bool {
+		return len(alive(a)) == 1 && len(alive(b)) == 1
+	})
+	if m := a.Members(); m[1].Name != "c" || m[1].State != MemberLeft {
+		t.Error("Expected c to have left, got", m)
+	}
+
+	b.Close()
+	waitFor("failure detection", func() bool {
+		return len(alive(a)) == 0
+	})
+	if m := a.Members(); m[0].State != MemberFailed {
+		t.Error("Expected b to have failed, got", m)
+	}
+
+	mu.Lock()
+	if events["join c"] == 0 || events["leave c"] == 0 || events["leave b"] == 0 {
+		t.Error("Missing membership events", events)
+	}
+	mu.Unlock()
+}
+
+func TestUDPTransport(t *testing.T) {
+	if _, err := NewUDPTransport(":0", ""); err == nil {
+		t.Error("Expected wildcard listen address without advertise address to fail")
+	}
+
+	tr, err := NewUDPTransport("127.0.0.1:0", "")
+	if err != nil {
+		t.Fatal("Error creating transport:", err)
+	}
+	defer tr.Close()
+	if host, _, _ := net.SplitHostPort(tr.Addr()); host != "127.0.0.1" {
+		t.Error("Expected listen address to be advertised, got", tr.Addr())
+	}
+
+	tr2, err := NewUDPTransport(":0", "10.0.0.1:7946")
+	if err != nil {
+		t.Fatal("Error creating transport:", err)
+	}
+	defer tr2.Close()
+	if tr2.Addr() != "10.0.0.1:7946" {
+		t.Error("Expected advertise address, got", tr2.Addr())
+	}
+}
+
+// A ChangeSource replaying a fixed list of changes.
+type changeList []Change
+
+func (l *changeList) Next() (Change, error) {
+	if len(*l) == 0 {
+		return Change{}, io.EOF
+	}
+	c := (*l)[0]
+	*l = (*l)[1:]
+	return c, nil
+}
+
+func TestReplicationLastWriterWins(t *testing.T) {
+	a := Cache("testReplicationA")
+	b := Cache("testReplicationB")
+	a.SetReplicaID("a")
+	b.SetReplicaID("b")
+
+	var fromA, fromB changeList
+	a.Replicate(sinkFunc(func(c Change) error { fromA = append(fromA, c); return nil }))
+	b.Replicate(sinkFunc(func(c Change) error { fromB = append(fromB, c); return nil }))
+
+	// Concurrent writes to the same key.
+	a.Add(k, 0, "a")
+	b.Add(k, 0, "b")
+	b.Add("onlyB", 0, v)
+
+	if err := a.ApplyChanges(&fromB); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.ApplyChanges(&fromA); err != nil {
+		t.Fatal(err)
+	}
+	if len(fromA) != 0 || len(fromB) != 0 {
+		t.Error("Replicated changes got echoed back")
+	}
+
+	pa, _ := a.Value(k)
+	pb, _ := b.Value(k)
+	if pa.Data() != pb.Data() || pa.Version() != pb.Version() || pa.Data().(string) != "b" {
+		t.Error("Replicas did not converge on the last write", pa.Data(), pb.Data())
+	}
+	if !a.Exists("onlyB") {
+		t.Error("Change not replicated")
+	}
+
+	// An older delete does not remove a newer item.
+	old := pa.Version()
+	old.Wall--
+	stale := changeList{{Op: ChangeDelete, Key: k, Version: old}}
+	a.ApplyChanges(&stale)
+	if !a.Exists(k) {
+		t.Error("Stale delete removed a newer item")
+	}
+
+	// Flushes get replicated, but not echoed back either.
+	a.Flush()
+	if len(fromA) != 1 || fromA[0].Op != ChangeFlush {
+		t.Fatal("Flush not replicated", fromA)
+	}
+	if err := b.ApplyChanges(&fromA); err != nil {
+		t.Fatal(err)
+	}
+	if b.Count() != 0 || len(fromB) != 0 {
+		t.Error("Replicated flush not applied or echoed back", b.Count(), fromB)
+	}
+}
+
+func TestReplicationMerge(t *testing.T) {
+	a := Cache("testReplicationMergeA")
+	b := Cache("testReplicationMergeB")
+	union := func(key, local, remote interface{}) interface{} {
+		return local.(int) | remote.(int)
+	}
+	for i, table := range []*CacheTable{a, b} {
+		table.SetReplicaID(strconv.Itoa(i))
+		table.SetReplicationMerge(union)
+	}
+
+	var fromA, fromB changeList
+	a.Replicate(sinkFunc(func(c Change) error { fromA = append(fromA, c); return nil }))
+	b.Replicate(sinkFunc(func(c Change) error { fromB = append(fromB, c); return nil }))
+	a.Add(k, 0, 1)
+	b.Add(k, 0, 2)
+	a.ApplyChanges(&fromB)
+	b.ApplyChanges(&fromA)
+
+	pa, _ := a.Value(k)
+	pb, _ := b.Value(k)
+	if pa.Data().(int) != 3 || pb.Data().(int) != 3 {
+		t.Error("Replicas did not converge on the merged value", pa.Data(), pb.Data())
+	}
+}
+
+type sinkFunc func(c Change) error
+
+func (f sinkFunc) Send(c Change) error { return f(c) }
+
+func TestPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache2go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	table := Cache("testPersist")
+	p, err := table.Persist(dir)
+	if err != nil {
+		t.Fatal("Error persisting:", err)
+	}
+	table.Add("a", 0, 1)
+	table.Add("b", 0, 2)
+	if err := p.Compact(); err != nil {
+		t.Fatal("Error compacting:", err)
+	}
+	table.Add("c", 0, 3)
+	table.Delete("a")
+	p.Close()
+
+	// Simulate a crash in the middle of writing a record.
+	wal, _ := os.OpenFile(filepath.Join(dir, "wal"), os.O_WRONLY|os.O_APPEND, 0)
+	wal.Write([]byte{0, 0, 1})
+	wal.Close()
+
+	restored := Cache("testPersistRestored")
+	p, err = restored.Persist(dir)
+	if err != nil {
+		t.Fatal("Error recovering:", err)
+	}
+	if restored.Count() != 2 || restored.Exists("a") || !restored.Exists("b") || !restored.Exists("c") {
+		t.Error("Restored table differs, count", restored.Count())
+	}
+
+	// The torn record got cut off, so new changes can be appended.
+	p.SetCompactThreshold(1 << 20)
+	restored.Add("d", 0, 4)
+	p.Close()
+
+	again := Cache("testPersistAgain")
+	p, err = again.Persist(dir)
+	if err != nil {
+		t.Fatal("Error recovering:", err)
+	}
+	p.Close()
+	if again.Count() != 3 || !again.Exists("d") {
+		t.Error("Change after recovery not persisted, count", again.Count())
+	}
+
+	var buf bytes.Buffer
+	if err := again.SaveSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := Cache("testPersistCorrupt").LoadSnapshot(strings.NewReader("garbage")); !errors.Is(err, ErrCorruptSnapshot) {
+		t.Error("Expected ErrCorruptSnapshot, got", err)
+	}
+}
+
+func TestSnapshotRepair(t *testing.T) {
+	table := Cache("testSnapshotRepair")
+	table.Flush()
+	table.Add("a", 0, 1)
+	table.Add("b", 0, 2)
+	table.Add("c", 0, 3)
+	var buf bytes.Buffer
+	if err := table.SaveSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := buf.Bytes()
+	second := 5 + 8 + int(binary.BigEndian.Uint32(snapshot[5:9]))
+
+	damaged := append([]byte(nil), snapshot...)
+	damaged[second+10] ^= 0xff
+	restored := Cache("testSnapshotRepairRestored")
+	restored.Flush()
+	if err := restored.LoadSnapshot(bytes.NewReader(damaged)); !errors.Is(err, ErrCorruptSnapshot) {
+		t.Error("Expected ErrCorruptSnapshot, got", err)
+	}
+
+	var reports []CorruptRecord
+	restored.SetSnapshotRepair(func(r CorruptRecord) {
+		reports = append(reports, r)
+	})
+	defer restored.SetSnapshotRepair(nil)
+	for _, b := range [][]byte{damaged, append(snapshot[:second:second], 0xff, 0xff)} {
+		restored.Flush()
+		reports = nil
+		// Damaged content as well as a damaged length skip only the one record.
+		b = append(b, snapshot[second:]...)
+		if err := restored.LoadSnapshot(bytes.NewReader(b)); err != nil {
+			t.Fatal("Error repairing snapshot:", err)
+		}
+		if len(reports) != 1 || reports[0].Offset != int64(second) || !errors.Is(reports[0].Err, ErrCorruptSnapshot) {
+			t.Error("Expected damaged record to be reported, got", reports)
+		}
+	}
+	if restored.Count() != 3 {
+		t.Error("Expected intact records to be restored, count", restored.Count())
+	}
+
+	// Snapshots of the previous format version can still be loaded.
+	var v1 bytes.Buffer
+	v1.WriteString("C2GO\x01")
+	var rec bytes.Buffer
+	NewChangeEncoder(&rec, nil).Send(Change{Op: ChangeSet, Key: "a", Data: 1})
+	binary.Write(&v1, binary.BigEndian, uint32(rec.Len()))
+	v1.Write(rec.Bytes())
+	restored.Flush()
+	if err := restored.LoadSnapshot(&v1); err != nil || !restored.Exists("a") {
+		t.Error("Error loading previous format version:", err)
+	}
+}
+
+func TestMapped(t *testing.T) {
+	table := Cache("testMapped")
+	table.Add("a", 0, []byte("alpha"))
+	table.Add(2, 0, "two")
+	table.Add("empty", 0, []byte{})
+
+	f, err := ioutil.TempFile("", "cache2go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if err := table.SaveMapped(f); err != nil {
+		t.Fatal("Error saving mapped snapshot:", err)
+	}
+	f.Close()
+
+	m, err := OpenMapped(f.Name(), nil)
+	if err != nil {
+		t.Fatal("Error opening mapped snapshot:", err)
+	}
+	defer m.Close()
+
+	if m.Len() != 3 {
+		t.Error("Unexpected item count", m.Len())
+	}
+	if b, err := m.Value("a"); err != nil || string(b) != "alpha" {
+		t.Error("Unexpected value for a:", string(b), err)
+	}
+	if b, err := m.Value(2); err != nil || string(b) != "two" {
+		t.Error("Unexpected value for 2:", string(b), err)
+	}
+	if _, err := m.Value("missing"); err != ErrKeyNotFound {
+		t.Error("Expected ErrKeyNotFound, got", err)
+	}
+	n := 0
+	m.Foreach(func(key interface{}, value []byte) { n++ })
+	if n != 3 {
+		t.Error("Foreach visited", n, "items")
+	}
+
+	table.Add("struct", 0, struct{}{})
+	if err := table.SaveMapped(ioutil.Discard); !errors.Is(err, ErrWrongType) {
+		t.Error("Expected ErrWrongType, got", err)
+	}
+	ioutil.WriteFile(f.Name(), []byte("C2GM\x01\x00\x00\x00\x05"), 0o644)
+	if _, err := OpenMapped(f.Name(), nil); !errors.Is(err, ErrCorruptSnapshot) {
+		t.Error("Expected ErrCorruptSnapshot, got", err)
+	}
+}
+
+func TestSnapshotStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache2go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := DirSnapshotStore(dir)
+	ctx := context.Background()
+
+	table := Cache("testSnapshotStore")
+	if _, err := table.BootstrapSnapshot(ctx, store); err != ErrKeyNotFound {
+		t.Error("Expected ErrKeyNotFound without snapshots, got", err)
+	}
+
+	table.Add("a", 0, 1)
+	if _, err := table.UploadSnapshot(ctx, store); err != nil {
+		t.Fatal("Error uploading snapshot:", err)
+	}
+	table.Add("b", 0, 2)
+	latest, err := table.UploadSnapshot(ctx, store)
+	if err != nil {
+		t.Fatal("Error uploading snapshot:", err)
+	}
+	// A table whose name starts with ours must not get mixed up.
+	Cache("testSnapshotStore-other").UploadSnapshot(ctx, store)
+
+	fresh := Cache("testSnapshotStoreFresh")
+	fresh.name = "testSnapshotStore"
+	name, err := fresh.BootstrapSnapshot(ctx, store)
+	if err != nil || name != latest {
+		t.Fatal("Error bootstrapping from latest snapshot:", name, err)
+	}
+	if fresh.Count() != 2 {
+		t.Error("Unexpected item count after bootstrap", fresh.Count())
+	}
+}
+
+// A finite in-memory message stream.
+type memStream struct {
+	msgs []Message
+	pos  int
+}
+
+func (s *memStream) Resume(offset int64) error {
+	s.pos = 0
+	for s.pos < len(s.msgs) && s.msgs[s.pos].Offset < offset {
+		s.pos++
+	}
+	return nil
+}
+
+func (s *memStream) Next(ctx context.Context) (Message, error) {
+	if s.pos >= len(s.msgs) {
+		return Message{}, io.EOF
+	}
+	s.pos++
+	return s.msgs[s.pos-1], nil
+}
+
+func TestIngest(t *testing.T) {
+	table := Cache("testIngest")
+	table.SetReadOnly(true)
+	offsets := DirOffsetStore(t.TempDir())
+	stream := &memStream{msgs: []Message{
+		{Offset: 0, Key: []byte("a"), Value: []byte("1")},
+		{Offset: 1, Key: []byte("b"), Value: []byte("2")},
+		{Offset: 2, Key: []byte("a")},
+	}}
+
+	cfg := IngestConfig{Offsets: offsets, CommitEvery: 2}
+	if err := table.Ingest(context.Background(), stream, cfg); err != nil {
+		t.Fatal("Error ingesting messages:", err)
+	}
+	if table.Exists("a") {
+		t.Error("Expected deleted key to be gone")
+	}
+	if v, err := table.Value("b"); err != nil || string(v.Data().([]byte)) != "2" {
+		t.Error("Error retrieving ingested item:", v, err)
+	}
+	if o, err := offsets.LoadOffset("testIngest"); err != nil || o != 3 {
+		t.Error("Expected offset 3 to be stored, got", o, err)
+	}
+
+	// Resume after the stored offset, skipping undecodable messages.
+	stream.msgs = append(stream.msgs,
+		Message{Offset: 3, Key: []byte("c"), Value: []byte("bad")},
+		Message{Offset: 4, Key: []byte("a"), Value: []byte("3")})
+	cfg.Decode = func(m Message) (Change, error) {
+		if string(m.Value) == "bad" {
+			return Change{}, ErrWrongType
+		}
+		return Change{Op: ChangeSet, Key: string(m.Key), Data: string(m.Value)}, nil
+	}
+	table.Flush()
+	if err := table.Ingest(context.Background(), stream, cfg); err != nil {
+		t.Fatal("Error ingesting messages:", err)
+	}
+	if table.Count() != 1 {
+		t.Error("Expected only the new message to be applied, got", table.Count(), "items")
+	}
+	if v, err := table.Value("a"); err != nil || v.Data().(string) != "3" {
+		t.Error("Error retrieving ingested item:", v, err)
+	}
+	if o, _ := offsets.LoadOffset("testIngest"); o != 5 {
+		t.Error("Expected offset 5 to be stored, got", o)
+	}
+}
+
+// An event sink failing every other delivery.
+type flakySink struct {
+	mu     sync.Mutex
+	calls  int
+	events []Event
+}
+
+func (s *flakySink) Emit(ctx context.Context, events []Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	if s.calls%2 == 1 {
+		return errors.New("unavailable")
+	}
+	s.events = append(s.events, events...)
+	return nil
+}
+
+func TestEmitter(t *testing.T) {
+	table := Cache("testEmitter")
+	sink := &flakySink{}
+	e := table.NewEmitter(sink, EmitterConfig{BatchSize: 2, RetryBackoff: time.Millisecond})
+
+	table.Add("a", 50*time.Millisecond, v)
+	table.Add("b", 0, v)
+	table.Delete("b")
+	time.Sleep(150 * time.Millisecond)
+	table.Flush()
+	e.Close()
+
+	// Events after closing don't get delivered.
+	table.Add("c", 0, v)
+
+	var got []string
+	for _, ev := range sink.events {
+		if ev.Table != "testEmitter" {
+			t.Error("Expected events of table testEmitter, got", ev.Table)
+		}
+		got = append(got, string(ev.Type)+":"+ev.Key)
+	}
+	want := "set:a set:b delete:b expire:a flush:"
+	if strings.Join(got, " ") != want {
+		t.Error("Expected events", want, "got", got)
+	}
+	if e.Dropped() != 0 {
+		t.Error("Expected no dropped events, got", e.Dropped())
+	}
+}
+
+func TestEmitterStuckSink(t *testing.T) {
+	table := Cache("testEmitterStuckSink")
+	// Nobody receives from the channel.
+	sink := make(chan []Event)
+	e := table.NewEmitter(ChanEventSink(sink), EmitterConfig{MaxRetries: 1, RetryBackoff: time.Millisecond, Timeout: 10 * time.Millisecond})
+	table.Add(k, 0, v)
+
+	closed := make(chan struct{})
+	go func() {
+		e.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close hung on a stuck sink")
+	}
+	if e.Dropped() != 1 {
+		t.Error("Expected the undeliverable event to be dropped, got", e.Dropped())
+	}
+}
+
+func TestDegradedReads(t *testing.T) {
+	table := Cache("testDegradedReads")
+	table.Add(k, 0, v)
+	table.SetDegradedReads(5*time.Millisecond, time.Minute)
+
+	if table.Degraded() {
+		t.Error("Expected reads not to be degraded yet")
+	}
+
+	// A reader waiting too long for the lock degrades the following reads.
+	table.Lock()
+	time.AfterFunc(20*time.Millisecond, table.Unlock)
+	if d, ok := table.Get(k); !ok || d != v {
+		t.Error("Error retrieving data from cache", d)
+	}
+	if !table.Degraded() {
+		t.Fatal("Expected reads to be degraded")
+	}
+
+	// Degraded reads don't wait for the lock.
+	table.Lock()
+	if d, ok := table.Get(k); !ok || d != v {
+		t.Error("Error retrieving data from cache", d)
+	}
+	if !table.Exists(k) {
+		t.Error("Expected key to exist")
+	}
+	if item, err := table.Value(k); err != nil || item.Data() != v {
+		t.Error("Error retrieving data from cache", err)
+	}
+	table.Unlock()
+
+	table.SetDegradedReads(0, 0)
+	if table.Degraded() {
+		t.Error("Expected degraded reads to be disabled")
+	}
+}
+
+func TestReload(t *testing.T) {
+	table := Cache("testReload")
+	table.Add("kept", 0, "same")
+	table.Add("changed", 0, "old")
+	table.Add("removed", 0, "gone")
+	kept, _ := table.Value("kept")
+
+	var added, deleted []string
+	table.AddAddedItemCallback(func(item *CacheItem) {
+		added = append(added, item.Key().(string))
+	})
+	table.AddAboutToDeleteItemCallback(func(item *CacheItem) {
+		deleted = append(deleted, item.Key().(string))
+	})
+
+	// A failing loader leaves the table untouched.
+	err := table.Reload(func(add func(key interface{}, lifeSpan time.Duration, data interface{})) error {
+		add("new", 0, "partial")
+		return errors.New("source unavailable")
+	})
+	if err == nil || table.Exists("new") || table.Count() != 3 {
+		t.Error("Expected failed reload to leave the table untouched", err)
+	}
+
+	err = table.Reload(func(add func(key interface{}, lifeSpan time.Duration, data interface{})) error {
+		// Readers keep seeing the old content while loading.
+		if !table.Exists("removed") {
+			t.Error("Expected old content to be visible during reload")
+		}
+		add("kept", 0, "same")
+		add("changed", 0, "new")
+		add("new", 0, "fresh")
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Error reloading table:", err)
+	}
+
+	if table.Count() != 3 || table.Exists("removed") {
+		t.Error("Expected reloaded content, got", table.Count(), "items")
+	}
+	if item, _ := table.Value("kept"); item != kept {
+		t.Error("Expected unchanged item to be kept")
+	}
+	if item, _ := table.Value("changed"); item.Data() != "new" {
+		t.Error("Expected changed item to be replaced, got", item.Data())
+	}
+	sort.Strings(added)
+	if strings.Join(added, ",") != "changed,new" {
+		t.Error("Expected added callbacks for changed and new items, got", added)
+	}
+	if strings.Join(deleted, ",") != "removed" {
+		t.Error("Expected delete callback for removed item, got", deleted)
+	}
+}
+
+func TestMaxStaleness(t *testing.T) {
+	table := Cache("testMaxStaleness")
+	table.SetMaxStaleness(50 * time.Millisecond)
+
+	loads := 0
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		loads++
+		return NewCacheItem(key, time.Second, loads)
+	})
+
+	// Accesses renew the sliding lifespan, but not the data's age.
+	for i := 0; i < 4; i++ {
+		if item, err := table.Value(k); err != nil || item.Data() != 1 {
+			t.Fatal("Error retrieving fresh item:", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if item, err := table.Value(k); err != nil || item.Data() != 2 {
+		t.Error("Expected stale item to get reloaded", err)
+	}
+
+	// Without a working loader, stale items aren't served.
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		return nil
+	})
+	time.Sleep(60 * time.Millisecond)
+	if _, err := table.Value(k); err != ErrKeyNotFoundOrLoadable {
+		t.Error("Expected stale item not to be served, got", err)
+	}
+	if _, ok := table.Get(k); ok {
+		t.Error("Expected stale item not to be served by Get")
+	}
+}
+
+func TestRevalidation(t *testing.T) {
+	table := Cache("testRevalidation")
+	table.SetMaxStaleness(20 * time.Millisecond)
+
+	version := "v1"
+	var conditional []string
+	table.SetDataLoaderCtx(func(ctx context.Context, key interface{}, args ...interface{}) *CacheItem {
+		if stale, ok := StaleItem(ctx); ok {
+			conditional = append(conditional, stale.ETag())
+			if stale.ETag() == version {
+				// Not modified.
+				return stale
+			}
+		}
+		return table.NewItem(key, "data "+version).WithLifeSpan(time.Second).WithETag(version).Build()
+	})
+
+	first, err := table.Value(k)
+	if err != nil || first.ETag() != "v1" {
+		t.Fatal("Error loading item:", err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if item, err := table.Value(k); err != nil || item != first {
+		t.Error("Expected unmodified item to be kept", err)
+	}
+
+	// Revalidation renewed the item's staleness.
+	if item, _ := table.Value(k); item != first || len(conditional) != 1 {
+		t.Error("Expected revalidated item to be served without reloading, got", conditional)
+	}
+
+	version = "v2"
+	time.Sleep(30 * time.Millisecond)
+	if item, err := table.Value(k); err != nil || item.Data() != "data v2" || item.ETag() != "v2" {
+		t.Error("Expected modified item to be replaced", err)
+	}
+	if strings.Join(conditional, ",") != "v1,v1" {
+		t.Error("Expected conditional loads with the stale ETag, got", conditional)
+	}
+}
+
+func TestRevalidationAfterWrite(t *testing.T) {
+	table := Cache("testRevalidationAfterWrite")
+	table.SetExpirationMode(ExpireAfterWrite)
+	table.SetMaxStaleness(50 * time.Millisecond)
+	table.SetDataLoaderCtx(func(ctx context.Context, key interface{}, args ...interface{}) *CacheItem {
+		if stale, ok := StaleItem(ctx); ok {
+			// Not modified.
+			return stale
+		}
+		return table.NewItem(key, v).WithLifeSpan(150 * time.Millisecond).Build()
+	})
+
+	first, err := table.Value(k)
+	if err != nil {
+		t.Fatal("Error loading item:", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if item, err := table.Value(k); err != nil || item != first {
+		t.Fatal("Expected unmodified item to be kept", err)
+	}
+
+	// Revalidation restarted the item's lifespan.
+	time.Sleep(80 * time.Millisecond)
+	if !table.Exists(k) {
+		t.Error("Expected revalidated item to outlive its original lifespan")
+	}
+	time.Sleep(120 * time.Millisecond)
+	if table.Exists(k) {
+		t.Error("Expected revalidated item to expire after its renewed lifespan")
+	}
+}
+
+func TestLoadMetadata(t *testing.T) {
+	table := Cache("testLoadMetadata")
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		time.Sleep(10 * time.Millisecond)
+		if key == "remote" {
+			return table.NewItem(key, v).WithOrigin("remote-api").Build()
+		}
+		return NewCacheItem(key, 0, v)
+	})
+
+	item, err := table.Value("remote")
+	if err != nil || item.Origin() != "remote-api" || item.LoadDuration() < 10*time.Millisecond {
+		t.Error("Expected origin and load duration of loaded item, got", item.Origin(), item.LoadDuration(), err)
+	}
+	if item, _ := table.Value(k); item.Origin() != OriginLoader {
+		t.Error("Expected default origin for loaded item, got", item.Origin())
+	}
+	if item := table.Add("direct", 0, v); item.Origin() != "" || item.LoadDuration() != 0 {
+		t.Error("Expected no load metadata for added item")
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	table := Cache("testNamespaces")
+	table.Flush()
+	table.SetNamespaceFunc(func(key interface{}) string {
+		return strings.SplitN(key.(string), ":", 2)[0]
+	})
+	defer table.SetNamespaceFunc(nil)
+
+	table.Add("a:1", 0, v)
+	table.Add("a:2", 0, v)
+	table.Add("b:1", 0, v)
+	table.Add("a:1", 0, v)
+	if u := table.NamespaceUsage("a"); u.Items != 2 {
+		t.Error("Expected namespace a to hold 2 items, got", u.Items)
+	}
+	if u := table.NamespaceUsage("b"); u.Items != 1 {
+		t.Error("Expected namespace b to hold 1 item, got", u.Items)
+	}
+
+	table.Delete("a:1")
+	if u := table.NamespaceUsage("a"); u.Items != 1 {
+		t.Error("Expected deletes to be accounted for, got", u.Items)
+	}
+	table.Flush()
+	if u := table.NamespaceUsage("a"); u.Items != 0 {
+		t.Error("Expected flush to reset usage, got", u.Items)
+	}
+}
+
+func TestNamespacesConcurrentWrites(t *testing.T) {
+	table := Cache("testNamespacesConcurrentWrites")
+	table.Flush()
+	defer table.SetNamespaceFunc(nil)
+	item := table.Add(k, 0, map[int]int{})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			item.WithLock(func(data interface{}) {
+				data.(map[int]int)[i] = i
+			})
+		}
+	}()
+
+	// Estimating sizes must not read the data while it gets written.
+	for i := 0; i < 100; i++ {
+		table.SetNamespaceFunc(func(key interface{}) string { return "all" })
+		table.Add(k+"new", 0, v)
+	}
+	<-done
+}
+
+func TestNamespaceQuotaReentrantCallback(t *testing.T) {
+	table := Cache("testNamespaceQuotaReentrantCallback")
+	table.Flush()
+	table.SetNamespaceFunc(func(key interface{}) string {
+		return strings.SplitN(key.(string), ":", 2)[0]
+	})
+	defer table.SetNamespaceFunc(nil)
+	table.SetNamespaceQuota("ns", NamespaceQuota{MaxItems: 2})
+	defer table.RemoveAboutToDeleteItemCallback()
+
+	table.Add("ns:a", 0, v)
+	table.Add("ns:b", 0, v)
+	table.SetAboutToDeleteItemCallback(func(item *CacheItem) {
+		if item.Key() == "ns:a" {
+			table.Add("ns:c", 0, v)
+		}
+	})
+
+	// The item being deleted makes room for the one its callback adds.
+	table.Delete("ns:a")
+	if !table.Exists("ns:b") || !table.Exists("ns:c") || table.NamespaceUsage("ns").Items != 2 {
+		t.Error("Expected ns:a to be replaced by ns:c, got", table.NamespaceUsage("ns").Items, "items")
+	}
+}
+
+func TestNamespaceQuota(t *testing.T) {
+	table := Cache("testNamespaceQuota")
+	table.SetMaxItems(100)
+	table.SetNamespaceFunc(func(key interface{}) string {
+		return strings.SplitN(key.(string), ":", 2)[0]
+	})
+	table.SetNamespaceQuota("noisy", NamespaceQuota{MaxItems: 3})
+	table.SetNamespaceQuota("big", NamespaceQuota{MaxBytes: EstimateSize(strings.Repeat("x", 100)) * 2})
+
+	table.Add("quiet:a", 0, v)
+	table.Add("quiet:b", 0, v)
+	for i := 0; i < 10; i++ {
+		table.Add("noisy:"+strconv.Itoa(i), 0, v)
+		table.Value("noisy:0")
+	}
+
+	if u := table.NamespaceUsage("noisy"); u.Items != 3 {
+		t.Error("Expected noisy namespace to be limited to 3 items, got", u.Items)
+	}
+	if !table.Exists("noisy:0") || !table.Exists("noisy:9") || table.Exists("noisy:1") {
+		t.Error("Expected the least recently used items of the namespace to be evicted")
+	}
+	if u := table.NamespaceUsage("quiet"); u.Items != 2 {
+		t.Error("Expected other namespaces to be left untouched, got", u.Items)
+	}
+
+	for i := 0; i < 3; i++ {
+		table.Add("big:"+strconv.Itoa(i), 0, strings.Repeat("x", 100))
+	}
+	if u := table.NamespaceUsage("big"); u.Items != 2 || table.Exists("big:0") {
+		t.Error("Expected byte quota to be enforced, got", u)
+	}
+
+	table.Delete("quiet:a")
+	if u := table.NamespaceUsage("quiet"); u.Items != 1 {
+		t.Error("Expected deletes to be accounted for, got", u.Items)
+	}
+	table.Flush()
+	if u := table.NamespaceUsage("noisy"); u.Items != 0 {
+		t.Error("Expected flush to reset usage, got", u.Items)
+	}
+}
+
+func TestNamespaceUsage(t *testing.T) {
+	table := Cache("testNamespaceUsage")
+	tenant := func(key interface{}) string {
+		return strings.SplitN(key.(string), "/", 2)[0]
+	}
+	table.SetNamespaceFunc(tenant)
+
+	table.Add("acme/a", 0, "data")
+	table.Add("acme/b", 0, "data")
+	table.Add("globex/a", 0, "data")
+	table.Value("acme/a")
+	table.Get("acme/b")
+	table.Value("acme/missing")
+	table.Value("initech/missing")
+
+	u := table.NamespaceUsage("acme")
+	if u.Items != 2 || u.Bytes != 2*EstimateSize("data") {
+		t.Error("Expected items and bytes of tenant to be accounted, got", u)
+	}
+	if u.Hits != 2 || u.Misses != 1 || u.HitRatio() < 0.66 || u.HitRatio() > 0.67 {
+		t.Error("Expected hits and misses of tenant to be accounted, got", u)
+	}
+
+	all := table.NamespaceUsages()
+	if len(all) != 3 || all["globex"].Items != 1 || all["initech"].Misses != 1 {
+		t.Error("Expected usage of all tenants, got", all)
+	}
+
+	table.ResetStats(false)
+	if u := table.NamespaceUsage("acme"); u.Hits != 0 || u.Items != 2 {
+		t.Error("Expected lookup counters to be reset, got", u)
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	var added int32
+	tmpl := NewTemplate(TemplateOptions{
+		Info:     Info{Owner: "tenants"},
+		MaxItems: 2,
+		DataLoader: func(ctx context.Context, key interface{}, args ...interface{}) *CacheItem {
+			return NewCacheItem(key, 0, "loaded")
+		},
+		AddedItem: func(item *CacheItem) {
+			atomic.AddInt32(&added, 1)
+		},
+		Configure: func(table *CacheTable) {
+			table.SetRemovedHistorySize(10)
+		},
+	})
+
+	table := tmpl.Cache("testTemplate")
+	if Cache("testTemplate") != table || tmpl.Cache("testTemplate") != table {
+		t.Error("Expected template to register the table")
+	}
+	if table.Info().Owner != "tenants" {
+		t.Error("Expected table to inherit info")
+	}
+	if item, err := table.Value(k); err != nil || item.Data() != "loaded" {
+		t.Error("Expected table to inherit the data-loader", err)
+	}
+	table.Add("a", 0, v)
+	table.Add("b", 0, v)
+	if table.Count() != 2 || len(table.RecentlyRemoved(1)) != 1 {
+		t.Error("Expected table to inherit limits and configuration")
+	}
+	if atomic.LoadInt32(&added) != 3 {
+		t.Error("Expected table to inherit callbacks, got", added)
+	}
+
+	// Existing tables are left alone.
+	Cache("testTemplateExisting")
+	if tmpl.Cache("testTemplateExisting").Info().Owner != "" {
+		t.Error("Expected existing table not to be reconfigured")
+	}
+}
+
+func TestTableLifecycle(t *testing.T) {
+	var created, removed []string
+	var mu sync.Mutex
+	createdHandle := OnTableCreated(func(table *CacheTable) {
+		mu.Lock()
+		defer mu.Unlock()
+		created = append(created, table.Name())
+		// Callbacks may use the package-level functions.
+		table.SetInfo(Info{Owner: "infra"})
+	})
+	removedHandle := OnTableRemoved(func(name string) {
+		mu.Lock()
+		defer mu.Unlock()
+		removed = append(removed, name)
+	})
+
+	table := Cache("testTableLifecycle")
+	Cache("testTableLifecycle")
+	NewTemplate(TemplateOptions{}).Cache("testTableLifecycleTemplate")
+	if table.Info().Owner != "infra" {
+		t.Error("Expected created callback to configure the table")
+	}
+
+	table.Add(k, 0, v)
+	if !RemoveTable("testTableLifecycle") || RemoveTable("testTableLifecycle") {
+		t.Error("Expected table to be removed exactly once")
+	}
+	if table.Count() != 0 {
+		t.Error("Expected removed table to be flushed")
+	}
+	if Cache("testTableLifecycle") == table {
+		t.Error("Expected a new table after removal")
+	}
+
+	if !RemoveLifecycleCallback(createdHandle) || !RemoveLifecycleCallback(removedHandle) {
+		t.Error("Error removing lifecycle callbacks")
+	}
+	if RemoveLifecycleCallback(createdHandle) {
+		t.Error("Expected removed lifecycle callback to be gone")
+	}
+	Cache("testTableLifecycleUnhooked")
+	RemoveTable("testTableLifecycleUnhooked")
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := "testTableLifecycle,testTableLifecycleTemplate,testTableLifecycle"
+	if strings.Join(created, ",") != want {
+		t.Error("Expected created callbacks for", want, "got", created)
+	}
+	if strings.Join(removed, ",") != "testTableLifecycle" {
+		t.Error("Expected removed callback, got", removed)
+	}
+}
+
+func TestAccessTracking(t *testing.T) {
+	table := Cache("testAccessTracking")
+	table.SetAccessTracking(false)
+	item := table.Add(k, 50*time.Millisecond, v)
+	accessedOn := item.AccessedOn()
+
+	for i := 0; i < 3; i++ {
+		time.Sleep(20 * time.Millisecond)
+		table.Value(k)
+		table.Get(k)
+	}
+	if item.AccessCount() != 0 || !item.AccessedOn().Equal(accessedOn) {
+		t.Error("Expected accesses not to be tracked")
+	}
+	if table.Exists(k) {
+		t.Error("Expected item to expire despite accesses")
+	}
+
+	table.SetAccessTracking(true)
+	table.Add(k, 0, v)
+	if item, _ := table.Value(k); item.AccessCount() != 1 {
+		t.Error("Expected accesses to be tracked again")
+	}
+}
+
+func TestSampledEviction(t *testing.T) {
+	table := Cache("testSampledEviction")
+	table.Flush()
+	table.SetMaxItems(100)
+	table.SetEvictionSamples(10)
+
+	for i := 0; i < 100; i++ {
+		table.Add(i, 0, v)
+	}
+	// Keep the first half recently used.
+	time.Sleep(time.Millisecond)
+	for i := 0; i < 50; i++ {
+		table.Value(i)
+	}
+	for i := 100; i < 150; i++ {
+		table.Add(i, 0, v)
+	}
+
+	if table.Count() != 100 {
+		t.Error("Expected table to stay within its capacity, got", table.Count())
+	}
+	kept, keptStale := 0, 0
+	for i := 0; i < 50; i++ {
+		if table.Exists(i) {
+			kept++
+		}
+		if table.Exists(i + 50) {
+			keptStale++
+		}
+	}
+	// Sampling approximates LRU, so recently used items are far more
+	// likely to survive.
+	if kept < 2*keptStale {
+		t.Error("Expected recently used items to be kept, got", kept, "recently used and", keptStale, "stale items")
+	}
+}
+
+func TestGenerations(t *testing.T) {
+	table := Cache("testGenerations")
+	table.SetGenerations(100 * time.Millisecond)
+
+	var expired int32
+	table.AddAboutToDeleteItemCallback(func(item *CacheItem) {
+		atomic.AddInt32(&expired, 1)
+	})
+
+	for i := 0; i < 10; i++ {
+		table.Add(i, 10*time.Millisecond, v)
+	}
+	table.Add("forever", 0, v)
+
+	// Items expire with their generation at the end of the window,
+	// regardless of accesses.
+	item, _ := table.Value(0)
+	remaining := item.generation.end.Sub(item.CreatedOn())
+	if remaining < 10*time.Millisecond || remaining > 110*time.Millisecond {
+		t.Error("Expected item to expire at the end of its window, got", remaining)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if table.Count() != 1 || !table.Exists("forever") {
+		t.Error("Expected the whole generation to expire, got", table.Count(), "items")
+	}
+	if atomic.LoadInt32(&expired) != 10 {
+		t.Error("Expected callbacks for all expired items, got", expired)
+	}
+
+	// Replaced and deleted items leave their generation.
+	table.Add("a", 10*time.Millisecond, v)
+	table.Add("a", time.Hour, v)
+	table.Add("b", 10*time.Millisecond, v)
+	table.Delete("b")
+	time.Sleep(150 * time.Millisecond)
+	if !table.Exists("a") {
+		t.Error("Expected replaced item to be kept")
+	}
+
+	table.SetGenerations(0)
+	table.Add("c", 10*time.Millisecond, v)
+	time.Sleep(30 * time.Millisecond)
+	if table.Exists("c") {
+		t.Error("Expected per-item expiry to be restored")
+	}
+}
+
+func TestClockJump(t *testing.T) {
+	table := Cache("testClockJump")
+	item := table.Add(k, 50*time.Millisecond, v)
+
+	// After a suspend, ages are measured with the wall clock, including the
+	// time suspended.
+	table.clockJumped(time.Hour)
+	if strings.Contains(item.CreatedOn().String(), "m=") || strings.Contains(item.AccessedOn().String(), "m=") {
+		t.Error("Expected timestamps to drop their monotonic reading")
+	}
+	if !table.Exists(k) {
+		t.Error("Expected item not to expire prematurely")
+	}
+
+	// Expiry keeps working after the timers got re-armed.
+	time.Sleep(100 * time.Millisecond)
+	if table.Exists(k) {
+		t.Error("Expected item to expire")
+	}
+
+	// Timestamps can be read while they get adjusted.
+	item = table.Add(k, 0, v)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			table.clockJumped(time.Hour)
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		item.CreatedOn()
+	}
+	<-done
+}
+
+func TestPauseExpiry(t *testing.T) {
+	table := Cache("testPauseExpiry")
+	table.Add(k, 20*time.Millisecond, v)
+	table.PauseExpiry()
+	table.Add("later", 20*time.Millisecond, v)
+
+	time.Sleep(50 * time.Millisecond)
+	if !table.Exists(k) || !table.Exists("later") {
+		t.Error("Expected expiry to be deferred while paused")
+	}
+
+	table.ResumeExpiry()
+	if table.Exists(k) || table.Exists("later") {
+		t.Error("Expected expired items to be removed after resuming")
+	}
+
+	table.Add(k, 20*time.Millisecond, v)
+	time.Sleep(50 * time.Millisecond)
+	if table.Exists(k) {
+		t.Error("Expected expiry to work again after resuming")
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	table := Cache("testDeterministic")
+	table.SetDeterministic(true)
+
+	var removed []interface{}
+	table.SetAboutToDeleteItemCallback(func(item *CacheItem) {
+		removed = append(removed, item.Key())
+	})
+	table.Add(k, time.Nanosecond, v)
+	table.Add("later", time.Hour, v)
+
+	time.Sleep(time.Millisecond)
+	if !table.Exists(k) || len(removed) != 0 {
+		t.Error("Expected expiry to wait for RunPending")
+	}
+
+	table.RunPending()
+	if table.Exists(k) || !table.Exists("later") {
+		t.Error("Expected RunPending to remove only expired items")
+	}
+	if len(removed) != 1 || removed[0] != k {
+		t.Error("Expected callbacks to run before RunPending returns, got", removed)
+	}
+
+	table.Add(k, time.Nanosecond, v)
+	table.SetDeterministic(false)
+	if table.Exists(k) {
+		t.Error("Expected expired items to be removed when leaving deterministic mode")
+	}
+}
+
+func TestFaultInjection(t *testing.T) {
+	table := Cache("testFaultInjection")
+	errInjected := errors.New("injected")
+
+	table.SetFaultInjector(InjectFailure(FaultStore, errInjected))
+	if _, err := table.AddCtx(context.Background(), k, 0, v); err != errInjected {
+		t.Error("Expected injected add failure, got", err)
+	}
+	if _, err := table.Value(k); err != errInjected {
+		t.Error("Expected injected lookup failure, got", err)
+	}
+	table.SetFaultInjector(nil)
+	table.Add(k, 0, v)
+	if _, err := table.Value(k); err != nil {
+		t.Error("Expected lookups to succeed after removing the injector, got", err)
+	}
+
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		return NewCacheItem(key, 0, v)
+	})
+	table.SetFaultInjector(InjectFailure(FaultLoader, errInjected))
+	if _, err := table.Value("missing"); err != errInjected {
+		t.Error("Expected injected loader failure, got", err)
+	}
+
+	table.SetFaultInjector(InjectDelay(FaultLoader, 20*time.Millisecond))
+	start := time.Now()
+	if _, err := table.Value("slow"); err != nil || time.Since(start) < 20*time.Millisecond {
+		t.Error("Expected injected loader delay", err)
+	}
+
+	table.SetFaultInjector(InjectFailure(FaultTimer, errInjected))
+	table.Add("expiring", 10*time.Millisecond, v)
+	time.Sleep(30 * time.Millisecond)
+	if !table.Exists("expiring") {
+		t.Error("Expected injected timer failure to stall expiry")
+	}
+	table.SetFaultInjector(nil)
+	table.Add("sooner", time.Nanosecond, v)
+	if table.Exists("expiring") {
+		t.Error("Expected expiry to catch up once the timer got re-armed")
+	}
+}
+
+func TestOperationTimeout(t *testing.T) {
+	table := Cache("testOperationTimeout")
+	table.Add(k, 0, v)
+	table.SetOperationTimeout(20 * time.Millisecond)
+
+	release := make(chan struct{})
+	table.Lock()
+	go func() {
+		<-release
+		table.Unlock()
+	}()
+
+	if _, err := table.Value(k); err != ErrTimeout {
+		t.Error("Expected lookup to time out, got", err)
+	}
+	if _, err := table.AddCtx(context.Background(), k, 0, v); err != ErrTimeout {
+		t.Error("Expected add to time out, got", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := table.ValueCtx(ctx, k); err != context.Canceled {
+		t.Error("Expected lookup to give up on cancellation, got", err)
+	}
+	close(release)
+
+	if _, err := table.Value(k); err != nil {
+		t.Error("Expected lookup to succeed once the table got unlocked, got", err)
+	}
+
+	// Uncontended locks are taken without waiting on a goroutine.
+	allocs := testing.AllocsPerRun(100, func() {
+		if table.lockCtx(context.Background(), false) == nil {
+			table.RUnlock()
+		}
+	})
+	if allocs != 0 {
+		t.Error("Expected uncontended lock not to allocate, got", allocs)
+	}
+
+	loading := make(chan struct{})
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		close(loading)
+		<-release
+		time.Sleep(50 * time.Millisecond)
+		return NewCacheItem(key, 0, v)
+	})
+	done := make(chan error)
+	go func() {
+		_, err := table.Value("slow")
+		done <- err
+	}()
+	<-loading
+	if _, err := table.Value("slow"); err != ErrTimeout {
+		t.Error("Expected waiting for a concurrent load to time out, got", err)
+	}
+	if err := <-done; err != nil {
+		t.Error("Expected the load itself not to time out, got", err)
+	}
+}
+
+func TestLockDiagnostics(t *testing.T) {
+	table := Cache("testLockDiagnostics")
+	var buf bytes.Buffer
+	table.SetLogger(log.New(&buf, "", 0))
+	table.SetLockDiagnostics(true, 10*time.Millisecond)
+
+	table.Add(k, 0, v)
+	table.Value(k)
+	table.Lock()
+	time.Sleep(20 * time.Millisecond)
+	table.Unlock()
+
+	s := table.Stats()
+	if s.LockWait.Count() == 0 || s.LockHold.Count() == 0 {
+		t.Error("Expected lock durations to be recorded, got", s.LockWait, s.LockHold)
+	}
+	if s.LockHold.Quantile(1) < 20*time.Millisecond || s.LockHold.Sum < 20*time.Millisecond {
+		t.Error("Expected long hold to be recorded, got", s.LockHold)
+	}
+	if !strings.Contains(buf.String(), "TestLockDiagnostics") {
+		t.Error("Expected long hold to be logged with a stack trace, got", buf.String())
+	}
+	if g := GlobalStats(); g.LockHold.Count() < s.LockHold.Count() {
+		t.Error("Expected lock durations to be aggregated, got", g.LockHold)
+	}
+
+	table.SetLockDiagnostics(false, 0)
+	table.ResetStats(false)
+	table.Value(k)
+	if s := table.Stats(); s.LockWait.Count() != 0 {
+		t.Error("Expected no lock durations without diagnostics, got", s.LockWait)
+	}
+}
+
+func TestImmortals(t *testing.T) {
+	table := Cache("testImmortals")
+	table.Add("old", 0, v)
+	table.Add("expiring", time.Hour, v)
+	time.Sleep(20 * time.Millisecond)
+	table.Add("young", 0, v)
+
+	items := table.Immortals(10 * time.Millisecond)
+	if len(items) != 1 || items[0].Key() != "old" {
+		t.Error("Expected only old immortal item, got", items)
+	}
+	if items := table.Immortals(0); len(items) != 2 || items[0].Key() != "old" {
+		t.Error("Expected all immortal items oldest first, got", items)
+	}
+
+	found := make(chan []*CacheItem, 1)
+	stop := table.WatchImmortals(10*time.Millisecond, 5*time.Millisecond, func(items []*CacheItem) {
+		select {
+		case found <- items:
+		default:
+		}
+	})
+	defer stop()
+	select {
+	case items := <-found:
+		if len(items) == 0 {
+			t.Error("Expected watcher to report immortal items")
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected watcher to report immortal items")
+	}
+}
+
+func TestChurnStats(t *testing.T) {
+	table := Cache("testChurnStats")
+	if s := table.ChurnStats(); s.Window != 0 || s.Added != 0 {
+		t.Error("Expected no churn stats unless enabled, got", s)
+	}
+	table.SetChurnWindow(time.Minute)
+
+	for i := 0; i < 10; i++ {
+		table.Add(i, 0, v)
+	}
+	table.Add("short", 10*time.Millisecond, v)
+	time.Sleep(30 * time.Millisecond)
+	table.Delete(0)
+	table.Delete(1)
+
+	s := table.ChurnStats()
+	if s.Window != time.Minute || s.Added != 11 {
+		t.Error("Expected 11 added items, got", s)
+	}
+	if s.Removed[RemovalDeleted] != 2 || s.Removed[RemovalExpired] != 1 {
+		t.Error("Expected 2 deleted and 1 expired item, got", s.Removed)
+	}
+	if s.AvgLifetime < 10*time.Millisecond || s.AvgLifetime > time.Second {
+		t.Error("Unexpected average lifetime", s.AvgLifetime)
+	}
+	if r := s.Rate(s.Added); r != 11.0/60 {
+		t.Error("Unexpected add rate", r)
+	}
+
+	table.SetChurnWindow(10 * time.Millisecond)
+	table.Add("new", 0, v)
+	time.Sleep(20 * time.Millisecond)
+	if s := table.ChurnStats(); s.Added != 0 {
+		t.Error("Expected churn outside the window to be dropped, got", s)
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	table := Cache("testReconfigure")
+	for i := 0; i < 10; i++ {
+		table.Add(i, 0, v)
+	}
+
+	opts := table.Options()
+	opts.DefaultLifeSpan = time.Minute
+	opts.MaxItems = 5
+	opts.EarlyRefresh = 1
+	table.Reconfigure(opts)
+
+	if got := table.Options(); got != opts {
+		t.Error("Expected options to be applied, got", got)
+	}
+	if table.Info().DefaultLifeSpan != time.Minute {
+		t.Error("Expected default lifespan to be applied")
+	}
+	if table.Count() != 5 {
+		t.Error("Expected excess items to be evicted, got", table.Count())
+	}
+
+	table.Reconfigure(Options{})
+	for i := 10; i < 20; i++ {
+		table.Add(i, 0, v)
+	}
+	if table.Count() != 15 {
+		t.Error("Expected capacity to be unbounded again, got", table.Count())
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	os.Setenv("CACHE2GO_MAX_ITEMS", "3")
+	os.Setenv("CACHE2GO_DEFAULT_LIFESPAN", "1m")
+	defer os.Unsetenv("CACHE2GO_MAX_ITEMS")
+	defer os.Unsetenv("CACHE2GO_DEFAULT_LIFESPAN")
+
+	opts, err := OptionsFromEnv(Options{MaxItems: 10, EarlyRefresh: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts != (Options{DefaultLifeSpan: time.Minute, MaxItems: 3, EarlyRefresh: 1}) {
+		t.Error("Expected environment to override options, got", opts)
+	}
+
+	SetDefaults(opts)
+	defer SetDefaults(Options{})
+	table := Cache("testDefaults")
+	for i := 0; i < 5; i++ {
+		table.Add(i, 0, v)
+	}
+	if table.Count() != 3 || table.Options() != opts {
+		t.Error("Expected new tables to start with the defaults, got", table.Options())
+	}
+	tt := NewTemplate(TemplateOptions{Info: Info{Owner: "test"}}).Cache("testDefaultsTemplate")
+	if tt.Info().DefaultLifeSpan != time.Minute {
+		t.Error("Expected templates to keep the default lifespan")
+	}
+
+	os.Setenv("CACHE2GO_MAX_ITEMS", "many")
+	if _, err := OptionsFromEnv(Options{}); err == nil {
+		t.Error("Expected error for malformed environment variable")
+	}
+}
+
+func TestHash(t *testing.T) {
+	table := Cache("testHash")
+	table.Flush()
+	if _, err := table.HValues(k); err != ErrKeyNotFound {
+		t.Error("Expected ErrKeyNotFound for missing hash, got", err)
+	}
+
+	if err := table.HSet(k, 0, "a", 1); err != nil {
+		t.Error("Error setting hash field", err)
+	}
+	if err := table.HSetMulti(k, 0, map[interface{}]interface{}{"b": 2, "c": 3}); err != nil {
+		t.Error("Error setting hash fields", err)
+	}
+	if hv, err := table.HGet(k, "b"); err != nil || hv != 2 {
+		t.Error("Error retrieving hash field", hv, err)
+	}
+	if _, err := table.HGet(k, "x"); err != ErrKeyNotFound {
+		t.Error("Expected ErrKeyNotFound for missing field, got", err)
+	}
+
+	fields, err := table.HValues(k, "a", "c", "x")
+	if err != nil || len(fields) != 2 || fields["a"] != 1 || fields["c"] != 3 {
+		t.Error("Error retrieving hash fields", fields, err)
+	}
+	if fields, _ := table.HValues(k); len(fields) != 3 {
+		t.Error("Expected all hash fields, got", fields)
+	}
+
+	if n, err := table.HDel(k, "a", "x"); err != nil || n != 1 {
+		t.Error("Error deleting hash fields", n, err)
+	}
+
+	table.Add("plain", 0, v)
+	if err := table.HSet("plain", 0, "a", 1); err != ErrWrongType {
+		t.Error("Expected ErrWrongType, got", err)
+	}
+
+	// concurrent readers never see a partial multi-field write
+	table.HSetMulti(k, 0, map[interface{}]interface{}{"b": 0, "c": 0})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			table.HSetMulti(k, 0, map[interface{}]interface{}{"b": i, "c": i})
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		fields, _ := table.HValues(k, "b", "c")
+		if fields["b"] != fields["c"] {
+			t.Fatal("Expected atomic multi-field access, got", fields)
+		}
+	}
+	wg.Wait()
+}
+
+func TestHashAdmission(t *testing.T) {
+	table := Cache("testHashAdmission")
+	table.Flush()
+
+	// creating hashes is subject to the checks of Add
+	errInvalid := errors.New("invalid")
+	table.SetValidator(func(key, data interface{}) error {
+		if key == "invalid" {
+			return errInvalid
+		}
+		return nil
+	})
+	defer table.SetValidator(nil)
+	if err := table.HSet("invalid", 0, "a", 1); err != errInvalid || table.Exists("invalid") {
+		t.Error("Expected validator to reject the hash, got", err)
+	}
+
+	table.Add("deleted", 0, v)
+	table.SoftDelete("deleted", time.Minute)
+	if err := table.HSet("deleted", 0, "a", 1); err != ErrTombstoned || table.Exists("deleted") {
+		t.Error("Expected tombstone to reject the hash, got", err)
+	}
+
+	table.HSet(k, 0, "a", 1)
+	table.SetReadOnly(true)
+	defer table.SetReadOnly(false)
+	if err := table.HSet(k+"2", 0, "a", 1); err != ErrReadOnly || table.Exists(k+"2") {
+		t.Error("Expected read-only table to reject new hashes, got", err)
+	}
+	if err := table.HSet(k, 0, "a", 2); err != ErrReadOnly {
+		t.Error("Expected read-only table to reject hash writes, got", err)
+	}
+	if _, err := table.HDel(k, "a"); err != ErrReadOnly {
+		t.Error("Expected read-only table to reject hash deletes, got", err)
+	}
+	if hv, err := table.HGet(k, "a"); err != nil || hv != 1 {
+		t.Error("Expected hash to be readable and unchanged", hv, err)
+	}
+}
+
+func TestHashFieldTTL(t *testing.T) {
+	table := Cache("testHashFieldTTL")
+	table.Flush()
+	table.HSet(k, 0, "long", 1)
+	if err := table.HAddWithTTL(k, "short", 2, 20*time.Millisecond); err != nil {
+		t.Error("Error adding hash field", err)
+	}
+	if hv, err := table.HGet(k, "short"); err != nil || hv != 2 {
+		t.Error("Error retrieving hash field", hv, err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if _, err := table.HGet(k, "short"); err != ErrKeyNotFound {
+		t.Error("Expected expired field to be gone, got", err)
+	}
+	fields, _ := table.HValues(k)
+	if len(fields) != 1 || fields["long"] != 1 {
+		t.Error("Expected other fields to remain, got", fields)
+	}
+
+	// setting a field again removes its TTL
+	table.HAddWithTTL(k, "kept", 3, 20*time.Millisecond)
+	table.HSet(k, 0, "kept", 3)
+
+	// hashes whose last fields expired get removed, unlike hashes emptied
+	// via HDel
+	table.HAddWithTTL("session", "token", v, 20*time.Millisecond)
+	table.HAddWithTTL("emptied", "token", v, time.Minute)
+	table.HDel("emptied", "token")
+	time.Sleep(50 * time.Millisecond)
+	if table.Exists("session") {
+		t.Error("Expected hash without fields to be removed")
+	}
+	if !table.Exists("emptied") {
+		t.Error("Expected hash emptied via HDel to stay")
+	}
+	if hv, err := table.HGet(k, "kept"); err != nil || hv != 3 {
+		t.Error("Expected field without TTL to remain", hv, err)
+	}
+}
+
+func TestList(t *testing.T) {
+	table := Cache("testList")
+	table.Flush()
+	if _, err := table.LPop(k); err != ErrKeyNotFound {
+		t.Error("Expected ErrKeyNotFound for missing list, got", err)
+	}
+
+	table.RPush(k, 0, 2, 3)
+	table.LPush(k, 0, 0, 1)
+	for i := 0; i < 4; i++ {
+		if value, err := table.LPop(k); err != nil || value != i {
+			t.Error("Expected", i, "got", value, err)
+		}
+	}
+	if _, err := table.LPop(k); err != ErrKeyNotFound {
+		t.Error("Expected ErrKeyNotFound for empty list, got", err)
+	}
+
+	table.Add("plain", 0, v)
+	if err := table.RPush("plain", 0, 1); err != ErrWrongType {
+		t.Error("Expected ErrWrongType, got", err)
+	}
+}
+
+func TestListReadOnly(t *testing.T) {
+	table := Cache("testListReadOnly")
+	table.Flush()
+	table.RPush(k, 0, "a")
+
+	table.Add("deleted", 0, v)
+	table.SoftDelete("deleted", time.Minute)
+	if err := table.RPush("deleted", 0, "a"); err != ErrTombstoned || table.Exists("deleted") {
+		t.Error("Expected tombstone to reject the list, got", err)
+	}
+
+	table.SetReadOnly(true)
+	defer table.SetReadOnly(false)
+	if err := table.LPush(k+"2", 0, "a"); err != ErrReadOnly || table.Exists(k+"2") {
+		t.Error("Expected read-only table to reject new lists, got", err)
+	}
+	if err := table.RPush(k, 0, "b"); err != ErrReadOnly {
+		t.Error("Expected read-only table to reject pushes, got", err)
+	}
+	if _, err := table.LPop(k); err != ErrReadOnly {
+		t.Error("Expected read-only table to reject pops, got", err)
+	}
+	if _, _, err := table.LPopInvisible(k, time.Minute); err != ErrReadOnly {
+		t.Error("Expected read-only table to reject invisible pops, got", err)
+	}
+	if err := table.LAck(k, 1); err != ErrReadOnly {
+		t.Error("Expected read-only table to reject acknowledgements, got", err)
+	}
+
+	table.SetReadOnly(false)
+	if value, err := table.LPop(k); err != nil || value != "a" {
+		t.Error("Expected list to be unchanged", value, err)
+	}
+}
+
+func TestListVisibilityTimeout(t *testing.T) {
+	table := Cache("testListVisibilityTimeout")
+	table.Flush()
+	table.RPush(k, 0, "a", "b", "c")
+
+	a, ra, _ := table.LPopInvisible(k, 20*time.Millisecond)
+	b, rb, _ := table.LPopInvisible(k, 20*time.Millisecond)
+	if a != "a" || b != "b" {
+		t.Error("Unexpected values", a, b)
+	}
+	if err := table.LAck(k, rb); err != nil {
+		t.Error("Error acknowledging value", err)
+	}
+	if err := table.LAck(k, rb); err != ErrNotInFlight {
+		t.Error("Expected ErrNotInFlight for acknowledged value, got", err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if err := table.LAck(k, ra); err != ErrNotInFlight {
+		t.Error("Expected ErrNotInFlight after visibility timeout, got", err)
+	}
+	if value, _ := table.LPop(k); value != "a" {
+		t.Error("Expected unacknowledged value to be redelivered first, got", value)
+	}
+	if value, _ := table.LPop(k); value != "c" {
+		t.Error("Expected c, got", value)
+	}
+}
+
+func TestPriorityQueue(t *testing.T) {
+	table := Cache("testPriorityQueue")
+	table.Flush()
+	if _, _, err := table.PQPop(k); err != ErrKeyNotFound {
+		t.Error("Expected ErrKeyNotFound for missing queue, got", err)
+	}
+
+	table.PQPush(k, 0, "low", 1)
+	table.PQPush(k, 0, "high", 10)
+	table.PQPush(k, 0, "medium1", 5)
+	table.PQPush(k, 0, "medium2", 5)
+
+	for _, expected := range []string{"high", "medium1", "medium2", "low"} {
+		if value, _, err := table.PQPop(k); err != nil || value != expected {
+			t.Error("Expected", expected, "got", value, err)
+		}
+	}
+	if _, _, err := table.PQPop(k); err != ErrKeyNotFound {
+		t.Error("Expected ErrKeyNotFound for empty queue, got", err)
+	}
+
+	table.RPush("list", 0, 1)
+	if err := table.PQPush("list", 0, 1, 1); err != ErrWrongType {
+		t.Error("Expected ErrWrongType, got", err)
+	}
+}
+
+func TestPriorityQueueReadOnly(t *testing.T) {
+	table := Cache("testPriorityQueueReadOnly")
+	table.Flush()
+	table.PQPush(k, 0, "a", 1)
+
+	table.SetReadOnly(true)
+	defer table.SetReadOnly(false)
+	if err := table.PQPush(k+"2", 0, "a", 1); err != ErrReadOnly || table.Exists(k+"2") {
+		t.Error("Expected read-only table to reject new priority queues, got", err)
+	}
+	if err := table.PQPush(k, 0, "b", 2); err != ErrReadOnly {
+		t.Error("Expected read-only table to reject pushes, got", err)
+	}
+	if _, _, err := table.PQPop(k); err != ErrReadOnly {
+		t.Error("Expected read-only table to reject pops, got", err)
+	}
+
+	table.SetReadOnly(false)
+	if value, _, err := table.PQPop(k); err != nil || value != "a" {
+		t.Error("Expected priority queue to be unchanged", value, err)
+	}
+}
+
+func TestSetLifeSpan(t *testing.T) {
+	table := Cache("testSetLifeSpan")
+	item := table.Add(k, 0, v)
+
+	item.SetLifeSpan(20 * time.Millisecond)
+	if item.LifeSpan() != 20*time.Millisecond {
+		t.Error("Expected lifespan to change, got", item.LifeSpan())
+	}
+	time.Sleep(50 * time.Millisecond)
+	if table.Exists(k) {
+		t.Error("Expected item to expire after getting a lifespan")
+	}
+
+	item = table.Add(k, 20*time.Millisecond, v)
+	item.SetLifeSpan(0)
+	time.Sleep(50 * time.Millisecond)
+	if !table.Exists(k) {
+		t.Error("Expected pinned item not to expire")
+	}
+
+	// shortening the lifespan re-arms the timer
+	table.Add("other", time.Hour, v)
+	item.SetLifeSpan(time.Hour)
+	item.SetLifeSpan(20 * time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	if table.Exists(k) || !table.Exists("other") {
+		t.Error("Expected only the item with the shortened lifespan to expire")
+	}
+}
+
+func TestDefaultAboutToExpireCallback(t *testing.T) {
+	table := Cache("testDefaultAboutToExpireCallback")
+	table.Add("before", 0, v)
+
+	var expired []interface{}
+	table.SetDefaultAboutToExpireCallback(func(key interface{}) {
+		expired = append(expired, key)
+	})
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		return NewCacheItem(key, 0, v)
+	})
+	table.Add(k, 0, v)
+	table.Value("loaded")
+	table.NotFoundAdd("notFound", 0, v)
+	content := table.AddContent([]byte("content"), 0)
+	item := table.Add("removed", 0, v)
+	item.RemoveAboutToExpireCallback()
+
+	for _, key := range []interface{}{"before", k, "loaded", "notFound", content, "removed"} {
+		table.Delete(key)
+	}
+	if len(expired) != 4 || expired[0] != k || expired[1] != "loaded" || expired[2] != "notFound" || expired[3] != content {
+		t.Error("Expected default callback for items added afterwards, got", expired)
+	}
+}
+
+func TestPeek(t *testing.T) {
+	table := Cache("testPeek")
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		return NewCacheItem(key, 0, v)
+	})
+	added := table.Add(k, 50*time.Millisecond, v)
+	accessedOn := added.AccessedOn()
+	hits := table.Stats().Hits
+
+	time.Sleep(10 * time.Millisecond)
+	item, err := table.Peek(k)
+	if err != nil || item != added {
+		t.Error("Error peeking at item", err)
+	}
+	if item.AccessedOn() != accessedOn || item.AccessCount() != 0 || table.Stats().Hits != hits {
+		t.Error("Expected peek not to touch the item")
+	}
+	if _, err := table.Peek("missing"); err != ErrKeyNotFound || table.Exists("missing") {
+		t.Error("Expected peek not to try the data-loader, got", err)
+	}
+}
+
+func TestValueWithInfo(t *testing.T) {
+	table := Cache("testValueWithInfo")
+	table.Flush()
+	fail := false
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		if fail {
+			return nil
+		}
+		// nested lookups don't affect the reported source
+		table.Value("nested")
+		time.Sleep(time.Millisecond)
+		return NewCacheItem(key, time.Hour, v)
+	})
+
+	table.Add("nested", 0, v)
+	if _, source, err := table.ValueWithInfo(k); err != nil || source != SourceLoaded {
+		t.Error("Expected freshly loaded item, got", source, err)
+	}
+	if _, source, err := table.ValueWithInfo(k); err != nil || source != SourceHit {
+		t.Error("Expected cache hit, got", source, err)
+	}
+
+	table.SetEarlyRefresh(1e12)
+	fail = true
+	if _, source, err := table.ValueWithInfo(k); err != nil || source != SourceStale {
+		t.Error("Expected stale item after failed refresh, got", source, err)
+	}
+}
+
+func TestEvictionCandidates(t *testing.T) {
+	table := Cache("testEvictionCandidates")
+	table.Flush()
+	for i := 0; i < 5; i++ {
+		table.Add(i, 0, v)
+		time.Sleep(time.Millisecond)
+	}
+	table.Value(0)
+
+	keys := func(items []*CacheItem) []interface{} {
+		var r []interface{}
+		for _, item := range items {
+			r = append(r, item.Key())
+		}
+		return r
+	}
+	if c := keys(table.EvictionCandidates(2)); fmt.Sprint(c) != "[1 2]" {
+		t.Error("Expected least recently used items of unbounded table, got", c)
+	}
+
+	// Items being removed are left out.
+	var during []interface{}
+	table.SetAboutToDeleteItemCallback(func(item *CacheItem) {
+		during = keys(table.EvictionCandidates(1))
+	})
+	table.Delete(1)
+	table.RemoveAboutToDeleteItemCallback()
+	if fmt.Sprint(during) != "[2]" {
+		t.Error("Expected item being removed to be left out, got", during)
+	}
+	table.Add(1, 0, v)
+
+	table.SetMaxItems(10)
+	defer table.SetMaxItems(0)
+	table.Value(1)
+	if c := keys(table.EvictionCandidates(10)); fmt.Sprint(c) != "[2 3 4 0 1]" {
+		t.Error("Expected items in eviction order, got", c)
+	}
+	if table.Count() != 5 {
+		t.Error("Expected preview not to evict anything")
+	}
+
+	// Policies report what they would evict.
+	table.SetEvictionPolicy(SIEVE)
+	defer table.SetEvictionPolicy(nil)
+	table.Value(3)
+	table.Value(2)
+	if c := keys(table.EvictionCandidates(10)); fmt.Sprint(c) != "[4 0 1 2 3]" {
+		t.Error("Expected items in SIEVE's eviction order, got", c)
+	}
+	if c := keys(table.EvictionCandidates(10)); fmt.Sprint(c) != "[4 0 1 2 3]" {
+		t.Error("Expected preview not to change SIEVE's state, got", c)
+	}
+	table.SetEvictionPolicy(func() EvictionPolicy { return &newestPolicy{} })
+	if c := table.EvictionCandidates(10); c != nil {
+		t.Error("Expected no candidates from policy without preview, got", keys(c))
+	}
+}
+
+// Evicts the most recently added item, to tell custom from built-in eviction.
+type newestPolicy struct {
+	sync.Mutex
+	items []*CacheItem
+}
+
+func (p *newestPolicy) OnAdd(item *CacheItem) {
+	p.Lock()
+	defer p.Unlock()
+	p.items = append(p.items, item)
+}
+
+func (p *newestPolicy) OnAccess(item *CacheItem) {}
+
+func (p *newestPolicy) OnRemove(item *CacheItem) {
+	p.Lock()
+	defer p.Unlock()
+	for i, it := range p.items {
+		if it == item {
+			p.items = append(p.items[:i], p.items[i+1:]...)
+			return
+		}
+	}
+}
+
+func (p *newestPolicy) Victim() *CacheItem {
+	p.Lock()
+	defer p.Unlock()
+	if len(p.items) == 0 {
+		return nil
+	}
+	return p.items[len(p.items)-1]
+}
+
+func TestEvictionPolicy(t *testing.T) {
+	table := Cache("testEvictionPolicy")
+	table.Flush()
+	var evicted []interface{}
+	table.AddAboutToDeleteItemCallbackCtx(func(ctx context.Context, item *CacheItem) {
+		if reason, ok := RemovalReasonFromContext(ctx); ok && reason == RemovalEvicted {
+			evicted = append(evicted, item.Key())
+		}
+	})
+
+	table.SetEvictionPolicy(LRU)
+	table.SetMaxItems(3)
+	for i := 0; i < 3; i++ {
+		table.Add(i, 0, v)
+	}
+	table.Value(0)
+	table.Add(3, 0, v)
+	if table.Exists(1) || !table.Exists(0) {
+		t.Error("Expected LRU policy to evict the least recently used item")
+	}
+
+	table.SetEvictionPolicy(func() EvictionPolicy { return &newestPolicy{} })
+	table.Add(4, 0, v)
+	if table.Exists(4) || table.Count() != 3 {
+		t.Error("Expected custom policy to pick the victim")
+	}
+	table.Delete(0)
+
+	if fmt.Sprint(evicted) != "[1 4]" {
+		t.Error("Expected callbacks to see evictions, got", evicted)
+	}
+}
+
+func TestEvictTo(t *testing.T) {
+	table := Cache("testEvictTo")
+	table.Flush()
+	for i := 0; i < 10; i++ {
+		table.Add(i, 0, make([]byte, 100))
+		time.Sleep(time.Millisecond)
+	}
+	table.Value(0)
+
+	if n := table.EvictTo(5); n != 5 || table.Count() != 5 {
+		t.Error("Expected 5 items to be evicted, got", n, table.Count())
+	}
+	if !table.Exists(0) || table.Exists(1) {
+		t.Error("Expected least recently used items to be evicted")
+	}
+
+	table.SetMaxItems(10)
+	if freed := table.EvictBytes(150); freed < 150 || table.Count() != 3 {
+		t.Error("Expected 2 items to be evicted, got", freed, table.Count())
+	}
+	if table.Exists(6) || !table.Exists(0) {
+		t.Error("Expected eviction to follow the table's policy")
+	}
+	if n := table.EvictTo(0); n != 3 || table.Count() != 0 {
+		t.Error("Expected all items to be evicted, got", n)
+	}
+}
+
+func TestMaxMemory(t *testing.T) {
+	table := Cache("testMaxMemory")
+	table.Flush()
+	for i := 0; i < 4; i++ {
+		table.NewItem(i, v).WithSize(100).Add()
+		time.Sleep(time.Millisecond)
+	}
+	if n := table.MemoryUsage(); n != 400 {
+		t.Error("Expected memory usage of 400 bytes, got", n)
+	}
+
+	table.SetMaxMemory(300)
+	if table.Count() != 3 || table.Exists(0) {
+		t.Error("Expected oldest item to be evicted, got", table.Count())
+	}
+	table.Value(1)
+	table.NewItem(4, v).WithSize(150).Add()
+	if table.Exists(2) || table.Exists(3) || !table.Exists(1) {
+		t.Error("Expected least recently used items to be evicted")
+	}
+	if n := table.MemoryUsage(); n != 250 {
+		t.Error("Expected memory usage of 250 bytes, got", n)
+	}
+
+	table.NewItem(1, v).WithSize(50).Add()
+	table.Delete(4)
+	if n := table.MemoryUsage(); n != 50 {
+		t.Error("Expected memory usage of 50 bytes, got", n)
+	}
+	table.Flush()
+	if n := table.MemoryUsage(); n != 0 {
+		t.Error("Expected no memory usage after flush, got", n)
+	}
+	table.SetMaxMemory(0)
+}
+
+func TestMemoryUsageConcurrentWrites(t *testing.T) {
+	table := Cache("testMemoryUsageConcurrentWrites")
+	table.Flush()
+	defer table.SetMaxMemory(0)
+	item := table.Add(k, 0, map[int]int{})
+	table.HSet(k+"hash", 0, 0, 0)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			item.WithLock(func(data interface{}) {
+				data.(map[int]int)[i] = i
+			})
+			table.HSet(k+"hash", 0, i, i)
+		}
+	}()
+
+	// Estimating sizes must not read the data while it gets written.
+	for i := 0; i < 100; i++ {
+		table.MemoryUsage()
+		table.SetMaxMemory(1 << 30)
+		table.SetMaxMemory(0)
+	}
+	<-done
+	if table.MemoryUsage() <= EstimateSize(map[int]int{}) {
+		t.Error("Expected memory usage to account for written data")
+	}
+}
+
+func TestSIEVE(t *testing.T) {
+	table := Cache("testSIEVE")
+	table.Flush()
+	table.SetEvictionPolicy(SIEVE)
+	table.SetMaxItems(3)
+
+	for i := 0; i < 3; i++ {
+		table.Add(i, 0, v)
+	}
+	table.Value(0)
+	table.Value(2)
+
+	// the hand skips and unmarks 0, evicts 1
+	table.Add(3, 0, v)
+	if table.Exists(1) || !table.Exists(0) {
+		t.Error("Expected the oldest unvisited item to be evicted")
+	}
+	// the hand continues with 2, which is marked, then evicts 3
+	table.Add(4, 0, v)
+	if table.Exists(3) || !table.Exists(2) {
+		t.Error("Expected the hand to continue where it stopped")
+	}
+	// the hand moves on towards newer items before wrapping around
+	table.Add(5, 0, v)
+	if table.Exists(4) || !table.Exists(0) || table.Count() != 3 {
+		t.Error("Expected the hand to move towards newer items")
+	}
+}
+
+func TestOnHitCallback(t *testing.T) {
+	table := Cache("testOnHitCallback")
+	table.Flush()
+	defer table.SetOnHitCallback(nil)
+	defer table.SetDataLoader(nil)
+
+	var tableHits, itemHits int32
+	table.SetOnHitCallback(func(item *CacheItem) {
+		atomic.AddInt32(&tableHits, 1)
+	})
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		return NewCacheItem(key, 0, v)
+	})
+
+	item := table.Add(k, 0, v)
+	item.SetOnHitCallback(func(item *CacheItem) {
+		if item.Key() != k {
+			t.Error("Expected OnHit callback to receive", k, "got", item.Key())
+		}
+		atomic.AddInt32(&itemHits, 1)
+	})
+
+	for i := 0; i < 3; i++ {
+		if _, err := table.Value(k); err != nil {
+			t.Fatal("Error retrieving data from cache", err)
+		}
+	}
+	if _, err := table.ValueWithMode(k, AccessPeek); err != nil {
+		t.Fatal("Error retrieving data from cache", err)
+	}
+	// Neither loaded items nor Peek count as hits.
+	if _, err := table.Value(k + "loaded"); err != nil {
+		t.Fatal("Error loading data", err)
+	}
+	if _, err := table.Peek(k); err != nil {
+		t.Fatal("Error peeking at data", err)
+	}
+	if n := atomic.LoadInt32(&tableHits); n != 4 {
+		t.Error("Expected table OnHit callback to run 4 times, ran", n, "times")
+	}
+	if n := atomic.LoadInt32(&itemHits); n != 4 {
+		t.Error("Expected item OnHit callback to run 4 times, ran", n, "times")
+	}
+
+	item.SetOnHitCallback(nil)
+	table.SetOnHitCallback(nil)
+	table.Value(k)
+	if atomic.LoadInt32(&tableHits) != 4 || atomic.LoadInt32(&itemHits) != 4 {
+		t.Error("Expected OnHit callbacks to be removed")
+	}
+}
+
+func TestValueCtxCancelLoad(t *testing.T) {
+	table := Cache("testValueCtxCancelLoad")
+	table.Flush()
+	defer table.SetDataLoader(nil)
+
+	release := make(chan struct{})
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		<-release
+		return NewCacheItem(key, 0, v)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := table.ValueCtx(ctx, k); err != context.DeadlineExceeded {
+		t.Error("Expected lookup to give up on the slow data-loader, got", err)
+	}
+
+	// The abandoned load keeps running and gets shared with later lookups.
+	done := make(chan error)
+	go func() {
+		_, err := table.Value(k)
+		done <- err
+	}()
+	close(release)
+	if err := <-done; err != nil {
+		t.Error("Expected lookup to share the abandoned load, got", err)
+	}
+	if !table.Exists(k) {
+		t.Error("Expected item of the abandoned load to be cached")
+	}
+
+	// Data-loaders watching the context stop early.
+	table.SetDataLoaderCtx(func(ctx context.Context, key interface{}, args ...interface{}) *CacheItem {
+		<-ctx.Done()
+		return nil
+	})
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, err := table.ValueCtx(ctx, k+"cancelled"); err != context.Canceled {
+		t.Error("Expected lookup to give up on cancellation, got", err)
+	}
+}
+
+func TestLayered(t *testing.T) {
+	l1 := Cache("testLayeredL1")
+	l2 := Cache("testLayeredL2")
+	l1.Flush()
+	l2.Flush()
+	c := NewLayered(l1, l2, time.Minute)
+
+	l2.Add(k, 0, v)
+	if item, err := c.Value(k); err != nil || item.Data() != v {
+		t.Error("Error retrieving data from L2", err)
+	}
+	if item, err := l1.Value(k); err != nil || item.LifeSpan() != time.Minute {
+		t.Error("Expected L2 hit to be copied into L1 with its lifespan", err)
+	}
+
+	c.Add(k+"2", 0, v)
+	if !l1.Exists(k+"2") || !l2.Exists(k+"2") {
+		t.Error("Expected add to write both levels")
+	}
+	if c.NotFoundAdd(k+"2", 0, v) {
+		t.Error("Expected NotFoundAdd to leave existing key alone")
+	}
+	if _, err := c.Delete(k + "2"); err != nil || c.Exists(k+"2") {
+		t.Error("Expected delete to remove both levels", err)
+	}
+	if _, err := c.Delete(k + "2"); err != ErrKeyNotFound {
+		t.Error("Expected ErrKeyNotFound deleting missing key, got", err)
+	}
+
+	c.Flush()
+	if l1.Count() != 0 || l2.Count() != 0 {
+		t.Error("Expected flush to empty both levels")
+	}
+}
+
+func TestLayeredStrategies(t *testing.T) {
+	l1 := Cache("testLayeredStrategiesL1")
+	l2 := Cache("testLayeredStrategiesL2")
+	l1.Flush()
+	l2.Flush()
+	c := NewLayered(l1, l2, 0)
+
+	l2.Add(k, 0, v)
+	c.SetReadStrategy(ReadL1Only)
+	if _, err := c.Value(k); err != ErrKeyNotFound {
+		t.Error("Expected L1-only read to miss, got", err)
+	}
+
+	c.SetReadStrategy(ReadFastest)
+	if item, err := c.Value(k); err != nil || item.Data() != v {
+		t.Error("Error retrieving data with fastest read", err)
+	}
+	if _, err := c.Value(k + "missing"); err != ErrKeyNotFound {
+		t.Error("Expected ErrKeyNotFound for missing key, got", err)
+	}
+
+	c.SetWriteStrategy(WriteL1Async)
+	for i := 0; i < 100; i++ {
+		c.Add(k+"async", 0, i)
+	}
+	if item, err := l1.Value(k + "async"); err != nil || item.Data() != 99 {
+		t.Error("Expected async write to update L1 right away", err)
+	}
+	c.Delete(k)
+	c.Sync()
+	if item, err := l2.Value(k + "async"); err != nil || item.Data() != 99 {
+		t.Error("Expected async writes to reach L2 in order", err)
+	}
+	if l2.Exists(k) {
+		t.Error("Expected async delete to reach L2")
+	}
+
+	if s := ReadFastest.String(); s != "fastest" {
+		t.Error("Unexpected read strategy name", s)
+	}
+	if s := WriteL1Async.String(); s != "l1-async" {
+		t.Error("Unexpected write strategy name", s)
+	}
+}
@@ -8,7 +8,9 @@
 package cache2go
 
 import (
+	"container/list"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,12 +19,27 @@ import (
 type CacheItem struct {
 	sync.RWMutex
 
+	// Fingerprint of data for race checks, accessed atomically.
+	fingerprint uint64
+	// Number of WithLock calls in progress, accessed atomically.
+	mutating int32
+
 	// The item's key.
 	key interface{}
 	// The item's data.
 	data interface{}
+	// Guards the contents of data for WithLock and WithRLock. It is separate
+	// from the item's own mutex, so holding it never blocks the table.
+	dataMu sync.RWMutex
 	// How long will the item live in the cache when not being accessed/kept alive.
 	lifeSpan time.Duration
+	// How long will the item live in the cache at most, regardless of accesses.
+	maxLifeSpan time.Duration
+	// When the item expires at the latest, regardless of accesses.
+	expiresAt time.Time
+	// Whether lifeSpan counts from the item's creation instead of its last
+	// access.
+	afterWrite bool
 
 	// Creation timestamp.
 	createdOn time.Time
@@ -30,20 +47,62 @@ type CacheItem struct {
 	accessedOn time.Time
 	// How often the item was accessed.
 	accessCount int64
+	// Aliases referring to the item, guarded by the table-mutex.
+	aliases []*CacheItem
+	// Number of references to content added via AddContent.
+	refs int
+	// Version of the change which stored the item, for replication.
+	version HLC
+	// Tags attached to the item.
+	tags []string
+	// Validator of the item's data at its origin, for revalidation.
+	etag string
+	// When a data-loader last confirmed the data to be unchanged.
+	validatedOn time.Time
+	// How long the data-loader took to produce this item.
+	loadDuration time.Duration
+	// Which loader produced this item, if any.
+	origin string
+	// Whether the item got added while its key was tombstoned.
+	resurrected bool
+	// Callback run whenever a lookup serves the item, if any.
+	onHit func(*CacheItem)
+	// Whether deleteInternal is removing the item, guarded by the
+	// table-mutex.
+	removing bool
+	// Fencing token the item got added with, if any.
+	token uint64
+	// Size of data as given via ItemBuilder.WithSize, 0 to estimate it.
+	sizeHint int64
+	// Estimated size of data for memory and namespace accounting, guarded
+	// by the table-mutex.
+	size int64
+	// Generation the item expires with, if the table uses generational
+	// expiry.
+	generation *generation
+	// Position in the table's eviction segments, guarded by their mutex.
+	segment *list.Element
+	// Whether the item is in the protected segment, guarded likewise.
+	protected bool
+	// Position in the table's store, guarded by the table-mutex.
+	slot int
+	// The table the item got added to, nil if it was never added.
+	owner *CacheTable
 
 	// Callback method triggered right before removing the item from the cache
-	aboutToExpire []func(key interface{})
+	aboutToExpire []itemCallback
 }
 
 // NewCacheItem returns a newly created CacheItem.
-// Parameter key is the item's cache-key.
+// Parameter key is the item's cache-key. []byte keys get copied, so the
+// caller may reuse the slice.
 // Parameter lifeSpan determines after which time period without an access the item
 // will get removed from the cache.
 // Parameter data is the item's value.
 func NewCacheItem(key interface{}, lifeSpan time.Duration, data interface{}) *CacheItem {
 	t := time.Now()
 	return &CacheItem{
-		key:           key,
+		key:           ownKey(key),
 		lifeSpan:      lifeSpan,
 		createdOn:     t,
 		accessedOn:    t,
@@ -63,10 +122,79 @@ func (item *CacheItem) KeepAlive() {
 
 // LifeSpan returns this item's expiration duration.
 func (item *CacheItem) LifeSpan() time.Duration {
-	// immutable
+	item.RLock()
+	defer item.RUnlock()
 	return item.lifeSpan
 }
 
+// SetLifeSpan changes this item's expiration duration, which still counts
+// from its last access, or from its creation for tables expiring items
+// ExpireAfterWrite. A lifespan of 0 pins the item until it gets deleted
+// or its lifespan changes again. The table holding the item re-arms its
+// expiration check as needed, so the item expires on time.
+func (item *CacheItem) SetLifeSpan(lifeSpan time.Duration) {
+	item.Lock()
+	item.lifeSpan = lifeSpan
+	table := item.owner
+	item.Unlock()
+
+	if table != nil {
+		table.lifeSpanChanged(item)
+	}
+}
+
+// MaxLifeSpan returns this item's maximum lifetime since its creation, or 0 if
+// its lifetime is only limited by its lifespan.
+func (item *CacheItem) MaxLifeSpan() time.Duration {
+	// immutable
+	return item.maxLifeSpan
+}
+
+// ExpiresAt returns the point in time this item expires at the latest, or the
+// zero time if its lifetime is only limited by its lifespans.
+func (item *CacheItem) ExpiresAt() time.Time {
+	// immutable
+	return item.expiresAt
+}
+
+// Returns how long the item has left until it expires, whichever of its
+// lifespan, maximum lifetime or expiry time comes first, and false if it
+// never expires.
+// Careful: do not run this method unless the item is at least read-locked!
+func (item *CacheItem) remaining(now time.Time) (time.Duration, bool) {
+	if item.generation != nil {
+		return item.generation.end.Sub(now), true
+	}
+
+	var d time.Duration
+	expires := false
+	if item.lifeSpan > 0 {
+		from := item.accessedOn
+		if item.afterWrite {
+			// Revalidation by the data-loader counts as a write.
+			from = item.createdOn
+			if item.validatedOn.After(from) {
+				from = item.validatedOn
+			}
+		}
+		d = item.lifeSpan - now.Sub(from)
+		expires = true
+	}
+	if item.maxLifeSpan > 0 {
+		if m := item.maxLifeSpan - now.Sub(item.createdOn); !expires || m < d {
+			d = m
+		}
+		expires = true
+	}
+	if !item.expiresAt.IsZero() {
+		if m := item.expiresAt.Sub(now); !expires || m < d {
+			d = m
+		}
+		expires = true
+	}
+	return d, expires
+}
+
 // AccessedOn returns when this item was last accessed.
 func (item *CacheItem) AccessedOn() time.Time {
 	item.RLock()
@@ -76,7 +204,9 @@ func (item *CacheItem) AccessedOn() time.Time {
 
 // CreatedOn returns when this item was added to the cache.
 func (item *CacheItem) CreatedOn() time.Time {
-	// immutable
+	// Only changes when the wall clock jumps, see clockJumped.
+	item.RLock()
+	defer item.RUnlock()
 	return item.createdOn
 }
 
@@ -89,32 +219,169 @@ func (item *CacheItem) AccessCount() int64 {
 
 // Key returns the key of this cached item.
 func (item *CacheItem) Key() interface{} {
-	// immutable
+	// Only changes when an alias takes over for a deleted key.
+	item.RLock()
+	defer item.RUnlock()
 	return item.key
 }
 
+// Tags returns the tags attached to this item.
+func (item *CacheItem) Tags() []string {
+	item.RLock()
+	defer item.RUnlock()
+	return item.tags
+}
+
+// OriginLoader is the origin of items produced by a table's data-loader
+// which don't name one of their own.
+const OriginLoader = "loader"
+
+// LoadDuration returns how long the data-loader took to produce this item, or
+// 0 if it got added directly.
+func (item *CacheItem) LoadDuration() time.Duration {
+	// immutable
+	return item.loadDuration
+}
+
+// Origin returns the name of the loader which produced this item, as set via
+// ItemBuilder.WithOrigin. Items produced by a data-loader without an origin of
+// their own default to OriginLoader, items added directly have none.
+func (item *CacheItem) Origin() string {
+	// immutable
+	return item.origin
+}
+
+// ETag returns the validator of this item's data at its origin, e.g. an HTTP
+// entity tag, which data-loaders use to revalidate the item.
+func (item *CacheItem) ETag() string {
+	item.RLock()
+	defer item.RUnlock()
+	return item.etag
+}
+
 // Data returns the value of this cached item.
 func (item *CacheItem) Data() interface{} {
+	if raceChecksEnabled() {
+		if atomic.LoadInt32(&item.mutating) > 0 {
+			raceReport(item, "Data called while WithLock is modifying the data")
+		} else {
+			item.dataMu.RLock()
+			item.checkFingerprint("Data")
+			item.dataMu.RUnlock()
+		}
+	}
+
 	// immutable
 	return item.data
 }
 
+// WithLock calls f with the item's data while holding an exclusive lock on
+// it, so f can safely modify mutable data like maps or slices. This lock is
+// only taken by WithLock, WithRLock and CacheTable.View, never by the table
+// itself, so f may use the table, but must not call WithLock or WithRLock on
+// the same item again.
+func (item *CacheItem) WithLock(f func(data interface{})) {
+	item.dataMu.Lock()
+	defer item.dataMu.Unlock()
+
+	if raceChecksEnabled() {
+		item.checkFingerprint("WithLock")
+		atomic.AddInt32(&item.mutating, 1)
+		defer func() {
+			atomic.StoreUint64(&item.fingerprint, item.dataFingerprint())
+			atomic.AddInt32(&item.mutating, -1)
+		}()
+	}
+	f(item.data)
+}
+
+// WithRLock calls f with the item's data while holding a shared lock on it,
+// so f can safely read mutable data others modify via WithLock.
+func (item *CacheItem) WithRLock(f func(data interface{})) {
+	item.dataMu.RLock()
+	defer item.dataMu.RUnlock()
+
+	if raceChecksEnabled() {
+		item.checkFingerprint("WithRLock")
+		defer func() {
+			if atomic.LoadUint64(&item.fingerprint) != item.dataFingerprint() {
+				raceReport(item, "data changed within WithRLock")
+			}
+		}()
+	}
+	f(item.data)
+}
+
+// ResetStats zeroes the item's access counter. If resetAccessedOn is set, its
+// access timestamp gets reset to now as well, which also restarts its
+// lifespan.
+func (item *CacheItem) ResetStats(resetAccessedOn bool) {
+	item.Lock()
+	defer item.Unlock()
+	item.accessCount = 0
+	if resetAccessedOn {
+		item.accessedOn = time.Now()
+	}
+}
+
+// Clone returns a copy of this item detached from its table. It carries the
+// item's key, data, lifespans and access metadata, but none of its callbacks.
+// The copy shares the data with the original, use CloneWith to copy mutable
+// data as well.
+func (item *CacheItem) Clone() *CacheItem {
+	return item.CloneWith(nil)
+}
+
+// CloneWith works like Clone, but passes the item's data through copyData,
+// e.g. to deep-copy it, while holding a shared lock on the data like
+// WithRLock.
+func (item *CacheItem) CloneWith(copyData func(data interface{}) interface{}) *CacheItem {
+	item.RLock()
+	c := &CacheItem{
+		key:          item.key,
+		data:         item.data,
+		lifeSpan:     item.lifeSpan,
+		maxLifeSpan:  item.maxLifeSpan,
+		expiresAt:    item.expiresAt,
+		afterWrite:   item.afterWrite,
+		createdOn:    item.createdOn,
+		accessedOn:   item.accessedOn,
+		accessCount:  item.accessCount,
+		loadDuration: item.loadDuration,
+		origin:       item.origin,
+		tags:         append([]string(nil), item.tags...),
+		etag:         item.etag,
+		validatedOn:  item.validatedOn,
+		sizeHint:     item.sizeHint,
+	}
+	item.RUnlock()
+
+	if copyData != nil {
+		item.dataMu.RLock()
+		c.data = copyData(item.data)
+		item.dataMu.RUnlock()
+	}
+
+	return c
+}
+
 // SetAboutToExpireCallback configures a callback, which will be called right
 // before the item is about to be removed from the cache.
 func (item *CacheItem) SetAboutToExpireCallback(f func(interface{})) {
 	if len(item.aboutToExpire) > 0 {
 		item.RemoveAboutToExpireCallback()
 	}
-	item.Lock()
-	defer item.Unlock()
-	item.aboutToExpire = append(item.aboutToExpire, f)
+	item.AddAboutToExpireCallback(f)
 }
 
-// AddAboutToExpireCallback appends a new callback to the AboutToExpire queue
-func (item *CacheItem) AddAboutToExpireCallback(f func(interface{})) {
+// AddAboutToExpireCallback appends a new callback to the AboutToExpire queue.
+// The returned handle can be passed to RemoveCallback to remove it again.
+func (item *CacheItem) AddAboutToExpireCallback(f func(interface{})) CallbackHandle {
 	item.Lock()
 	defer item.Unlock()
-	item.aboutToExpire = append(item.aboutToExpire, f)
+	cb := itemCallback{handle: newCallbackHandle(), fn: f}
+	item.aboutToExpire = append(item.aboutToExpire, cb)
+	return cb.handle
 }
 
 // RemoveAboutToExpireCallback empties the about to expire callback queue
@@ -123,3 +390,15 @@ func (item *CacheItem) RemoveAboutToExpireCallback() {
 	defer item.Unlock()
 	item.aboutToExpire = nil
 }
+
+// RemoveCallback removes a single AboutToExpire callback, identified by the
+// handle returned when it was added. It returns false if no such callback is
+// registered with this item.
+func (item *CacheItem) RemoveCallback(h CallbackHandle) bool {
+	item.Lock()
+	defer item.Unlock()
+
+	var ok bool
+	item.aboutToExpire, ok = removeItemCallback(item.aboutToExpire, h)
+	return ok
+}
@@ -0,0 +1,26 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"time"
+)
+
+// Cacher covers the main operations of a cache table. Code depending on it
+// instead of *CacheTable can be tested with a fake, like the one provided by
+// the cachetest package.
+type Cacher interface {
+	Value(key interface{}, args ...interface{}) (*CacheItem, error)
+	Add(key interface{}, lifeSpan time.Duration, data interface{}) *CacheItem
+	NotFoundAdd(key interface{}, lifeSpan time.Duration, data interface{}) bool
+	Delete(key interface{}) (*CacheItem, error)
+	Exists(key interface{}) bool
+	Flush()
+}
+
+var _ Cacher = (*CacheTable)(nil)
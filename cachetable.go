@@ -8,42 +8,220 @@
 package cache2go
 
 import (
+	"context"
+	"io"
 	"log"
+	"reflect"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // CacheTable is a table within the cache
 type CacheTable struct {
+	// Number of items, kept first to guarantee 64-bit alignment for atomic
+	// access.
+	itemCount int64
+	// Number of lookups served from the cache.
+	hits int64
+	// Number of lookups not served from the cache.
+	misses int64
+	// Number of items the data-loader produced.
+	loads int64
+	// Number of items removed because they expired, got evicted or got
+	// deleted.
+	expirations int64
+	evictions   int64
+	deletes     int64
+	// Read-lock wait in nanoseconds after which reads degrade, 0 if never.
+	degradeAfter int64
+	// How long a degraded read view gets served, in nanoseconds.
+	degradeFor int64
+	// How long operations wait for the table in nanoseconds, 0 if unbounded.
+	opTimeout int64
+	// Durations the table-mutex was waited for and write-locked, if lock
+	// diagnostics are enabled.
+	lockWait histogram
+	lockHold histogram
+	// Write lock hold time in nanoseconds after which holders get logged.
+	lockLongHold int64
+	// Set if lookups skip the access bookkeeping.
+	noAccessTracking int32
+	// Set while a degraded read view is being built.
+	degradeBuilding int32
+	// Set if lock durations get recorded.
+	lockDiagnostics int32
+
 	sync.RWMutex
+	// When the table-mutex got write-locked, if lock diagnostics are enabled.
+	lockedAt time.Time
+	// Number and memory usage of the items deleteInternal is running the
+	// callbacks for, which count as gone for eviction.
+	removingItems int
+	removingSize  int64
 
 	// The table's name.
 	name string
+	// Creation timestamp.
+	createdOn time.Time
+	// Descriptive metadata.
+	info Info
 	// All cached items.
-	items map[interface{}]*CacheItem
+	items *store
+	// Custom hashing and equality for keys, if any.
+	hasher Hasher
 
 	// Timer responsible for triggering cleanup.
 	cleanupTimer *time.Timer
 	// Current timer duration.
 	cleanupInterval time.Duration
+	// Whether the removal of expired items is deferred.
+	expiryPaused bool
+	// Whether expired items only get removed by RunPending.
+	deterministic bool
 
 	// The logger used for this table.
 	logger *log.Logger
 
+	// Maximum number of items, 0 if unbounded.
+	maxItems int
+	// Fraction of the capacity reserved for the protected segment.
+	protectedRatio float64
+	// Eviction order of the items, nil if unbounded or sampled.
+	segments *segments
+	// Number of items sampled per eviction, 0 for strict LRU eviction.
+	evictionSamples int
+	// Creates custom eviction policies, nil for the built-in eviction.
+	newPolicy func() EvictionPolicy
+	// Custom eviction policy in use, nil if unbounded or built-in.
+	policy EvictionPolicy
+	// Maximum estimated size of the items' data in bytes, 0 if unbounded.
+	maxMemory int64
+	// Estimated size of the items' data, only tracked while maxMemory is set.
+	memoryUsage int64
+
 	// Callback method triggered when trying to load a non-existing key.
-	loadData func(key interface{}, args ...interface{}) *CacheItem
+	loadData func(ctx context.Context, key interface{}, args ...interface{}) *CacheItem
+	// Data-loaders for keys matching templates, tried before loadData.
+	keyLoaders []keyLoader
+	// Probabilistic early refresh factor, 0 when disabled.
+	earlyRefreshBeta float64
+	// Maximum age of served items, 0 if unbounded.
+	maxStaleness time.Duration
+	// What the lifespans of newly added items count from.
+	expirationMode ExpirationMode
+	// Maximum lifetime of newly added items, 0 if unbounded.
+	maxLifeSpan time.Duration
+	// Filter remembering keys the data-loader failed to load.
+	missFilter *missFilter
 	// Callback method triggered when adding a new item to the cache.
-	addedItem []func(item *CacheItem)
+	addedItem []tableCallback
 	// Callback method triggered before deleting an item from the cache.
-	aboutToDeleteItem []func(item *CacheItem)
+	aboutToDeleteItem []tableCallback
+	// Callback method attached to every added item.
+	defaultAboutToExpire func(key interface{})
+	// Callback method validating data before it gets added to the cache.
+	validator func(key, data interface{}) error
+
+	// Maximum key size and the function calculating it.
+	maxKeySize int64
+	keySize    func(key interface{}) int64
+	// Maximum value size and the function calculating it.
+	maxValueSize int64
+	valueSize    func(data interface{}) int64
+
+	// Currently granted leases.
+	leases *store
+	// Tombstones of soft-deleted keys.
+	tombstones *store
+	// Newest fencing tokens of keys, wrapped in items.
+	fences *store
+	// The last fencing token handed out.
+	lastToken uint64
+	// Fencing tokens drawn before the table got flushed.
+	tokenFloor uint64
+	// The newest token of the fences pruned so far, see pruneFence.
+	fenceFloor uint64
+	// What adding a soft-deleted key does.
+	tombstonePolicy TombstonePolicy
+	// Aliases of stored items.
+	aliases *store
+	// Index of path-like keys, if enabled.
+	paths *pathIndex
+	// Namespaces the items are grouped into, if any, with their quotas.
+	namespaces *namespaces
+	// Generations of expiring items, if generational expiry is enabled.
+	generations *generations
+	// Whether to reject nil keys and nil data.
+	rejectNilKeys bool
+	rejectNilData bool
+	// Whether modifications get rejected, e.g. for mirrors.
+	readOnly bool
+	// Subscribers to changes of this table.
+	changeSubscribers []changeCallback
+	// Issues versions for changes, if replication is enabled.
+	clock *hlcClock
+	// Merges concurrently replicated values.
+	replicationMerge func(key, local, remote interface{}) interface{}
+	// Serializes keys for persistence and wire protocols.
+	keyCodec KeyCodec
+	// What Add does if the key already exists.
+	conflictPolicy ConflictPolicy
+	mergeFunc      func(key, existing, added interface{}) interface{}
+
+	// Callback method mapping keys to their canonical form.
+	normalizeKeyFunc func(key interface{}) interface{}
+
+	// Middleware wrapped around Value, Add and Delete.
+	middleware []Middleware
+	// Handler composed from all middleware.
+	chain Handler
+
+	// Ring buffer of recently removed items.
+	history []RemovedItem
+	// Next write position in the history ring buffer.
+	historyPos int
+	// Number of valid entries in the history ring buffer.
+	historyLen int
+	// Rolling counters of added and removed items, if enabled.
+	churn *churn
+	// Hash items with expiring fields.
+	fieldTTLs map[*CacheItem]struct{}
+
+	// Writer receiving audit records, if any.
+	auditWriter io.Writer
+	// Format of the audit records.
+	auditFormat AuditFormat
+	// Receives damaged records of restored snapshots, if in repair mode.
+	snapshotRepair func(CorruptRecord)
+
+	// Read-only copy of the items served while the table is contended.
+	readView atomic.Value
+	// FaultInjector installed for testing, if any.
+	faults atomic.Value
+	// Callback run for every lookup served from the cache, if any.
+	onHit atomic.Value
 }
 
 // Count returns how many items are currently stored in the cache.
 func (table *CacheTable) Count() int {
 	table.RLock()
 	defer table.RUnlock()
-	return len(table.items)
+	return table.items.len()
+}
+
+// CountApprox returns how many items are currently stored in the cache. Unlike
+// Count it doesn't need to lock the table, so it never contends with writers,
+// but it may lag behind concurrent changes.
+func (table *CacheTable) CountApprox() int {
+	return int(atomic.LoadInt64(&table.itemCount))
+}
+
+// Publishes the current item count for CountApprox.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) updateCount() {
+	atomic.StoreInt64(&table.itemCount, int64(table.items.len()))
 }
 
 // Foreach all items
@@ -51,15 +229,28 @@ func (table *CacheTable) Foreach(trans func(key interface{}, item *CacheItem)) {
 	table.RLock()
 	defer table.RUnlock()
 
-	for k, v := range table.items {
-		trans(k, v)
-	}
+	table.items.each(func(item *CacheItem) {
+		trans(item.key, item)
+	})
 }
 
 // SetDataLoader configures a data-loader callback, which will be called when
 // trying to access a non-existing key. The key and 0...n additional arguments
 // are passed to the callback function.
 func (table *CacheTable) SetDataLoader(f func(interface{}, ...interface{}) *CacheItem) {
+	if f == nil {
+		table.SetDataLoaderCtx(nil)
+		return
+	}
+	table.SetDataLoaderCtx(func(_ context.Context, key interface{}, args ...interface{}) *CacheItem {
+		return f(key, args...)
+	})
+}
+
+// SetDataLoaderCtx configures a context-aware data-loader callback. It
+// receives the context passed to ValueCtx, or context.Background() for
+// calls to Value.
+func (table *CacheTable) SetDataLoaderCtx(f func(context.Context, interface{}, ...interface{}) *CacheItem) {
 	table.Lock()
 	defer table.Unlock()
 	table.loadData = f
@@ -71,16 +262,26 @@ func (table *CacheTable) SetAddedItemCallback(f func(*CacheItem)) {
 	if len(table.addedItem) > 0 {
 		table.RemoveAddedItemCallbacks()
 	}
-	table.Lock()
-	defer table.Unlock()
-	table.addedItem = append(table.addedItem, f)
+	table.AddAddedItemCallback(f)
 }
 
-//AddAddedItemCallback appends a new callback to the addedItem queue
-func (table *CacheTable) AddAddedItemCallback(f func(*CacheItem)) {
+//AddAddedItemCallback appends a new callback to the addedItem queue. The
+// returned handle can be passed to RemoveCallback to remove it again.
+func (table *CacheTable) AddAddedItemCallback(f func(*CacheItem)) CallbackHandle {
+	return table.AddAddedItemCallbackCtx(func(_ context.Context, item *CacheItem) {
+		f(item)
+	})
+}
+
+// AddAddedItemCallbackCtx appends a new context-aware callback to the
+// addedItem queue. It receives the context passed to AddCtx, or
+// context.Background() for calls without a context.
+func (table *CacheTable) AddAddedItemCallbackCtx(f func(context.Context, *CacheItem)) CallbackHandle {
 	table.Lock()
 	defer table.Unlock()
-	table.addedItem = append(table.addedItem, f)
+	cb := tableCallback{handle: newCallbackHandle(), fn: f}
+	table.addedItem = append(table.addedItem, cb)
+	return cb.handle
 }
 
 // RemoveAddedItemCallbacks empties the added item callback queue
@@ -96,16 +297,27 @@ func (table *CacheTable) SetAboutToDeleteItemCallback(f func(*CacheItem)) {
 	if len(table.aboutToDeleteItem) > 0 {
 		table.RemoveAboutToDeleteItemCallback()
 	}
-	table.Lock()
-	defer table.Unlock()
-	table.aboutToDeleteItem = append(table.aboutToDeleteItem, f)
+	table.AddAboutToDeleteItemCallback(f)
 }
 
-// AddAboutToDeleteItemCallback appends a new callback to the AboutToDeleteItem queue
-func (table *CacheTable) AddAboutToDeleteItemCallback(f func(*CacheItem)) {
+// AddAboutToDeleteItemCallback appends a new callback to the AboutToDeleteItem
+// queue. The returned handle can be passed to RemoveCallback to remove it again.
+func (table *CacheTable) AddAboutToDeleteItemCallback(f func(*CacheItem)) CallbackHandle {
+	return table.AddAboutToDeleteItemCallbackCtx(func(_ context.Context, item *CacheItem) {
+		f(item)
+	})
+}
+
+// AddAboutToDeleteItemCallbackCtx appends a new context-aware callback to the
+// AboutToDeleteItem queue. It receives the context passed to DeleteCtx, or
+// context.Background() for expirations and calls without a context, along
+// with the reason for the removal, see RemovalReasonFromContext.
+func (table *CacheTable) AddAboutToDeleteItemCallbackCtx(f func(context.Context, *CacheItem)) CallbackHandle {
 	table.Lock()
 	defer table.Unlock()
-	table.aboutToDeleteItem = append(table.aboutToDeleteItem, f)
+	cb := tableCallback{handle: newCallbackHandle(), fn: f}
+	table.aboutToDeleteItem = append(table.aboutToDeleteItem, cb)
+	return cb.handle
 }
 
 // RemoveAboutToDeleteItemCallback empties the about to delete item callback queue
@@ -115,6 +327,113 @@ func (table *CacheTable) RemoveAboutToDeleteItemCallback() {
 	table.aboutToDeleteItem = nil
 }
 
+// SetDefaultAboutToExpireCallback configures a callback, which gets attached
+// to every item added from now on via Add, NotFoundAdd, AddContent, the
+// hash commands or the data-loader, as if AddAboutToExpireCallback was called
+// on each of them. Items added before are left as they are. Pass nil to stop
+// attaching it.
+func (table *CacheTable) SetDefaultAboutToExpireCallback(f func(key interface{})) {
+	table.Lock()
+	defer table.Unlock()
+	table.defaultAboutToExpire = f
+}
+
+// RemoveCallback removes a single AddedItem or AboutToDeleteItem callback,
+// identified by the handle returned when it was added. It returns false if
+// no such callback is registered with this table.
+func (table *CacheTable) RemoveCallback(h CallbackHandle) bool {
+	table.Lock()
+	defer table.Unlock()
+
+	var ok bool
+	if table.addedItem, ok = removeTableCallback(table.addedItem, h); ok {
+		return true
+	}
+	if table.aboutToDeleteItem, ok = removeTableCallback(table.aboutToDeleteItem, h); ok {
+		return true
+	}
+	table.changeSubscribers, ok = removeChangeCallback(table.changeSubscribers, h)
+	return ok
+}
+
+// SetValidator configures a callback, which gets called before an item is
+// added to the cache. If it returns an error, the item won't be added and
+// AddCtx, NotFoundAddCtx and Value return this error. Add returns nil and
+// NotFoundAdd returns false in that case.
+func (table *CacheTable) SetValidator(f func(key, data interface{}) error) {
+	table.Lock()
+	defer table.Unlock()
+	table.validator = f
+}
+
+// SetRejectNil configures whether items with nil keys and nil data get
+// rejected with ErrNilKey and ErrNilData. Data counts as nil if it is nil
+// itself or a nil pointer, map, slice, channel or function.
+func (table *CacheTable) SetRejectNil(keys, data bool) {
+	table.Lock()
+	defer table.Unlock()
+	table.rejectNilKeys = keys
+	table.rejectNilData = data
+}
+
+// Runs the configured nil and size checks and validator, if any.
+func (table *CacheTable) validate(key, data interface{}) error {
+	table.RLock()
+	check := table.admission()
+	table.RUnlock()
+
+	return check(key, data)
+}
+
+// Returns a function running the checks of validate with the table's current
+// configuration, which doesn't need the table-mutex.
+// Careful: do not run this method unless the table-mutex is at least
+// read-locked!
+func (table *CacheTable) admission() func(key, data interface{}) error {
+	validator := table.validator
+	rejectNilKeys, rejectNilData := table.rejectNilKeys, table.rejectNilData
+	maxKeySize, keySize := table.maxKeySize, table.keySize
+	maxValueSize, valueSize := table.maxValueSize, table.valueSize
+
+	return func(key, data interface{}) error {
+		if rejectNilKeys && isNil(key) {
+			return ErrNilKey
+		}
+		if rejectNilData && isNil(data) {
+			return ErrNilData
+		}
+
+		if maxKeySize > 0 {
+			if n := keySize(key); n > maxKeySize {
+				return &SizeError{Key: key, Size: n, Limit: maxKeySize, err: ErrKeyTooLarge}
+			}
+		}
+		if maxValueSize > 0 {
+			if n := valueSize(data); n > maxValueSize {
+				return &SizeError{Key: key, Size: n, Limit: maxValueSize, err: ErrValueTooLarge}
+			}
+		}
+
+		if validator == nil {
+			return nil
+		}
+		return validator(key, data)
+	}
+}
+
+// Reports whether v is nil or holds a nil pointer, map, slice, channel,
+// function or interface.
+func isNil(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	switch rv := reflect.ValueOf(v); rv.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Chan, reflect.Func, reflect.Interface:
+		return rv.IsNil()
+	}
+	return false
+}
+
 // SetLogger sets the logger to be used by this cache table.
 func (table *CacheTable) SetLogger(logger *log.Logger) {
 	table.Lock()
@@ -122,73 +441,218 @@ func (table *CacheTable) SetLogger(logger *log.Logger) {
 	table.logger = logger
 }
 
+// PauseExpiry defers the removal of expired items, e.g. during latency
+// critical phases, until ResumeExpiry gets called. Meanwhile expired items
+// stay in the table and keep getting served.
+func (table *CacheTable) PauseExpiry() {
+	table.Lock()
+	defer table.Unlock()
+	table.expiryPaused = true
+	if table.cleanupTimer != nil {
+		table.cleanupTimer.Stop()
+	}
+}
+
+// ResumeExpiry resumes the removal of expired items after PauseExpiry,
+// catching up on the items which expired meanwhile.
+func (table *CacheTable) ResumeExpiry() {
+	table.Lock()
+	table.expiryPaused = false
+	table.Unlock()
+
+	table.expirationCheck()
+}
+
+// SetDeterministic enables a single-threaded mode for reproducible tests:
+// expired items no longer get removed in the background, but only when
+// RunPending gets called, on the calling goroutine, including all callbacks
+// this triggers. Meanwhile expired items stay in the table and keep getting
+// served. Disabling the mode catches up on the items which expired meanwhile.
+func (table *CacheTable) SetDeterministic(enabled bool) {
+	table.Lock()
+	table.deterministic = enabled
+	if table.cleanupTimer != nil {
+		table.cleanupTimer.Stop()
+	}
+	table.Unlock()
+
+	if !enabled {
+		table.expirationCheck()
+	}
+}
+
+// RunPending synchronously removes all expired items, like the background
+// expiration check would, and returns once all their callbacks returned. It
+// is meant for tables in deterministic mode, see SetDeterministic.
+func (table *CacheTable) RunPending() {
+	table.Lock()
+	table.runExpiry()
+}
+
 // Expiration check loop, triggered by a self-adjusting timer.
 func (table *CacheTable) expirationCheck() {
 	table.Lock()
+	if table.deterministic {
+		table.Unlock()
+		return
+	}
+	table.runExpiry()
+}
+
+// Runs the expiration check on behalf of the expiration timer.
+func (table *CacheTable) expirationTimerFired() {
+	if err := table.fault(FaultTimer, nil); err != nil {
+		table.log("Skipping expiration check of table", table.name, "due to injected fault:", err)
+		return
+	}
+	table.expirationCheck()
+}
+
+// Removes expired items and re-arms the expiration timer, unless the table is
+// in deterministic mode.
+// Careful: do not run this method unless the table-mutex is locked!
+// It will unlock it for the caller.
+func (table *CacheTable) runExpiry() {
 	if table.cleanupTimer != nil {
 		table.cleanupTimer.Stop()
 	}
+	if table.expiryPaused {
+		table.Unlock()
+		return
+	}
 	if table.cleanupInterval > 0 {
 		table.log("Expiration check triggered after", table.cleanupInterval, "for table", table.name)
 	} else {
 		table.log("Expiration check installed for table", table.name)
 	}
 
+	// Hash fields expire independently of their hashes.
+	nextField := table.expireHashFields(time.Now())
+
+	if table.generations != nil {
+		table.cleanupInterval = table.expireGenerations()
+		if nextField > 0 && (table.cleanupInterval == 0 || nextField < table.cleanupInterval) {
+			table.cleanupInterval = nextField
+		}
+		if table.cleanupInterval > 0 && !table.deterministic {
+			table.cleanupTimer = time.AfterFunc(table.cleanupInterval, func() {
+				go table.expirationTimerFired()
+			})
+		}
+		table.Unlock()
+		return
+	}
+
 	// To be more accurate with timers, we would need to update 'now' on every
 	// loop iteration. Not sure it's really efficient though.
 	now := time.Now()
-	smallestDuration := 0 * time.Second
-	for key, item := range table.items {
+	smallestDuration := nextField
+	table.items.each(func(item *CacheItem) {
+		if item.removing {
+			return
+		}
 		// Cache values so we don't keep blocking the mutex.
 		item.RLock()
-		lifeSpan := item.lifeSpan
-		accessedOn := item.accessedOn
+		remaining, expires := item.remaining(now)
 		item.RUnlock()
 
-		if lifeSpan == 0 {
-			continue
+		if !expires {
+			return
 		}
-		if now.Sub(accessedOn) >= lifeSpan {
+		if remaining <= 0 {
 			// Item has excessed its lifespan.
-			table.deleteInternal(key)
+			table.deleteInternal(context.Background(), item.key, RemovalExpired)
 		} else {
 			// Find the item chronologically closest to its end-of-lifespan.
-			if smallestDuration == 0 || lifeSpan-now.Sub(accessedOn) < smallestDuration {
-				smallestDuration = lifeSpan - now.Sub(accessedOn)
+			if smallestDuration == 0 || remaining < smallestDuration {
+				smallestDuration = remaining
 			}
 		}
-	}
+	})
 
 	// Setup the interval for the next cleanup run.
 	table.cleanupInterval = smallestDuration
-	if smallestDuration > 0 {
+	if smallestDuration > 0 && !table.deterministic {
 		table.cleanupTimer = time.AfterFunc(smallestDuration, func() {
-			go table.expirationCheck()
+			go table.expirationTimerFired()
 		})
 	}
 	table.Unlock()
 }
 
-func (table *CacheTable) addInternal(item *CacheItem) {
+func (table *CacheTable) addInternal(ctx context.Context, item *CacheItem) {
 	// Careful: do not run this method unless the table-mutex is locked!
 	// It will unlock it for the caller before running the callbacks and checks
 	table.log("Adding item with key", item.key, "and lifespan of", item.lifeSpan, "to table", table.name)
-	table.items[item.key] = item
+	table.applyExpiration(item)
+	old, replaced := table.items.get(item.key)
+	if replaced {
+		table.audit(ctx, AuditUpdated, item)
+		if !old.removing {
+			// Items being removed left the segments already.
+			table.segmentsRemove(old)
+		}
+		table.generationRemove(old)
+		item.aliases = old.aliases
+	} else {
+		table.audit(ctx, AuditAdded, item)
+	}
+	if item.version.IsZero() {
+		item.version = table.versionFor(ctx)
+	}
+	table.generationAdd(item)
+	item.owner = table
+	table.items.set(item)
+	table.indexPath(item.key)
+	table.churnAdded()
+	table.updateCount()
+	table.segmentsAdd(item)
+	if table.tracksSizes() {
+		item.size = item.estimatedSize()
+	}
+	table.memoryAdd(item, old)
+	table.namespaceAdd(ctx, item, old)
+	table.evictInternal(ctx)
 
 	// Cache values so we don't keep blocking the mutex.
 	expDur := table.cleanupInterval
 	addedItem := table.addedItem
+	changeSubscribers := table.changeSubscribers
 	table.Unlock()
 
 	// Trigger callback after adding an item to cache.
 	if addedItem != nil {
 		for _, callback := range addedItem {
-			callback(item)
+			callback.fn(ctx, item)
 		}
 	}
+	table.publish(changeSubscribers, Change{Op: ChangeSet, Key: item.key, Data: item.data, LifeSpan: item.lifeSpan, Time: item.CreatedOn(), Version: item.version})
 
 	// If we haven't set up any expiration check timer or found a more imminent item.
-	if item.lifeSpan > 0 && (expDur == 0 || item.lifeSpan < expDur) {
+	item.RLock()
+	remaining, expires := item.remaining(time.Now())
+	item.RUnlock()
+	if expires && (expDur == 0 || remaining < expDur) {
+		table.expirationCheck()
+	}
+}
+
+// Reschedules the expiration of item after its lifespan changed.
+func (table *CacheTable) lifeSpanChanged(item *CacheItem) {
+	table.Lock()
+	if cur, ok := table.items.get(item.key); !ok || cur != item {
+		table.Unlock()
+		return
+	}
+	table.generationRemove(item)
+	table.generationAdd(item)
+	expDur := table.cleanupInterval
+	table.Unlock()
+
+	item.RLock()
+	remaining, expires := item.remaining(time.Now())
+	item.RUnlock()
+	if expires && (expDur == 0 || remaining < expDur) {
 		table.expirationCheck()
 	}
 }
@@ -198,106 +662,449 @@ func (table *CacheTable) addInternal(item *CacheItem) {
 // Parameter lifeSpan determines after which time period without an access the item
 // will get removed from the cache.
 // Parameter data is the item's value.
+// If the key already exists, the table's ConflictPolicy decides the outcome.
 func (table *CacheTable) Add(key interface{}, lifeSpan time.Duration, data interface{}) *CacheItem {
-	item := NewCacheItem(key, lifeSpan, data)
+	item, _ := table.AddCtx(context.Background(), key, lifeSpan, data)
+	return item
+}
+
+// AddCtx works like Add, but passes ctx on to the AddedItem callbacks. It
+// returns the context's error without adding anything if ctx is already done.
+func (table *CacheTable) AddCtx(ctx context.Context, key interface{}, lifeSpan time.Duration, data interface{}) (*CacheItem, error) {
+	return table.handle(ctx, &Request{Op: OpAdd, Key: key, LifeSpan: lifeSpan, Data: data})
+}
+
+func (table *CacheTable) doAdd(ctx context.Context, key interface{}, lifeSpan time.Duration, data interface{}, template *CacheItem, load *loadResult) (*CacheItem, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := table.checkWritable(); err != nil {
+		return nil, err
+	}
+	key, err := table.resolveKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := table.fault(FaultStore, key); err != nil {
+		return nil, err
+	}
+	if err := table.validate(key, data); err != nil {
+		return nil, err
+	}
+	item := NewCacheItem(key, lifeSpanFor(lifeSpan, data), data)
+	if template != nil {
+		item.tags = template.tags
+		item.etag = template.etag
+		item.origin = template.origin
+		item.maxLifeSpan = template.maxLifeSpan
+		item.expiresAt = template.expiresAt
+		item.sizeHint = template.sizeHint
+	}
+	if load != nil {
+		item.loadDuration = load.duration
+		if item.origin == "" {
+			item.origin = OriginLoader
+		}
+	}
 
 	// Add item to cache.
-	table.Lock()
-	table.addInternal(item)
+	if err := table.lockCtx(ctx, true); err != nil {
+		return nil, err
+	}
+	if err := table.checkTombstone(item, load); err != nil {
+		table.Unlock()
+		return nil, err
+	}
+	if load != nil {
+		// Another item got added while the data-loader was running. It is
+		// at least as fresh as the loaded one, so keep it.
+		if cur, ok := table.items.get(key); ok && cur != load.replaces {
+			table.Unlock()
+			return cur, nil
+		}
+	} else if r, skip, err := table.resolveConflict(item); skip {
+		table.Unlock()
+		return r, err
+	}
+	if template != nil && template.token != 0 {
+		if err := table.checkFence(item, template.token); err != nil {
+			table.Unlock()
+			return nil, err
+		}
+	}
+	if table.defaultAboutToExpire != nil {
+		item.aboutToExpire = append(item.aboutToExpire, itemCallback{handle: newCallbackHandle(), fn: table.defaultAboutToExpire})
+	}
+	table.addInternal(ctx, item)
 
-	return item
+	return item, nil
 }
 
-func (table *CacheTable) deleteInternal(key interface{}) (*CacheItem, error) {
-	r, ok := table.items[key]
-	if !ok {
+func (table *CacheTable) deleteInternal(ctx context.Context, key interface{}, reason RemovalReason) (*CacheItem, error) {
+	if reason == RemovalDeleted {
+		table.fenceDeleted(key)
+	}
+	r, ok := table.items.get(key)
+	if !ok || r.removing {
+		// Items whose callbacks are running already count as removed, so
+		// concurrent removals and removals triggered by the callbacks
+		// themselves don't run them again.
 		return nil, ErrKeyNotFound
 	}
+	// The item must not be picked for eviction again while the callbacks
+	// run, e.g. when they add items to the table themselves.
+	r.removing = true
+	table.segmentsRemove(r)
+	table.namespaceRemoving(r)
+	size := r.size
+	table.removingItems++
+	table.removingSize += size
+	defer func() {
+		r.removing = false
+		table.namespaceRemoved(r)
+		table.removingItems--
+		table.removingSize -= size
+	}()
 
 	// Cache value so we don't keep blocking the mutex.
 	aboutToDeleteItem := table.aboutToDeleteItem
+	changeSubscribers := table.changeSubscribers
+	version := table.versionFor(ctx)
 	table.Unlock()
 
 	// Trigger callbacks before deleting an item from cache.
 	if aboutToDeleteItem != nil {
+		cbCtx := context.WithValue(ctx, removalReasonKey{}, reason)
 		for _, callback := range aboutToDeleteItem {
-			callback(r)
+			callback.fn(cbCtx, r)
 		}
 	}
+	table.publish(changeSubscribers, Change{Op: ChangeDelete, Key: key, Version: version, Reason: reason})
 
 	r.RLock()
 	defer r.RUnlock()
 	if r.aboutToExpire != nil {
 		for _, callback := range r.aboutToExpire {
-			callback(key)
+			callback.fn(key)
 		}
 	}
 
 	table.Lock()
+	if cur, _ := table.items.get(key); cur != r {
+		// The item got removed or replaced while we weren't holding the lock.
+		return r, nil
+	}
+	r.RLock()
 	table.log("Deleting item with key", key, "created on", r.createdOn, "and hit", r.accessCount, "times from table", table.name)
-	delete(table.items, key)
+	table.recordRemoval(r, reason)
+	table.audit(ctx, auditEventForRemoval(reason), r)
+	r.RUnlock()
+	table.removeAliases(r)
+	table.items.remove(key)
+	table.unindexPath(key)
+	table.pruneFence(key)
+	table.memoryRemove(r)
+	table.namespaceRemove(r)
+	table.generationRemove(r)
+	table.updateCount()
 
 	return r, nil
 }
 
 // Delete an item from the cache.
 func (table *CacheTable) Delete(key interface{}) (*CacheItem, error) {
+	return table.DeleteCtx(context.Background(), key)
+}
+
+// DeleteCtx works like Delete, but passes ctx on to the AboutToDeleteItem
+// callbacks. It returns the context's error without deleting anything if ctx
+// is already done.
+func (table *CacheTable) DeleteCtx(ctx context.Context, key interface{}) (*CacheItem, error) {
+	return table.handle(ctx, &Request{Op: OpDelete, Key: key})
+}
+
+func (table *CacheTable) doDelete(ctx context.Context, key interface{}) (*CacheItem, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := table.checkWritable(); err != nil {
+		return nil, err
+	}
+	key, err := table.normalizeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := table.fault(FaultStore, key); err != nil {
+		return nil, err
+	}
+
 	table.Lock()
 	defer table.Unlock()
 
-	return table.deleteInternal(key)
+	if target, ok := table.unalias(key); ok {
+		// Deleting an alias only drops that reference.
+		r, _ := table.items.get(target)
+		table.removeAlias(key)
+		return r, nil
+	}
+	if r, ok := table.items.get(key); ok && len(r.aliases) > 0 && !r.removing {
+		// The item lives on under its aliases.
+		table.promoteAlias(ctx, r)
+		return r, nil
+	}
+	return table.deleteInternal(ctx, key, RemovalDeleted)
+}
+
+// View calls visitor with the data stored under key and marks the item to be
+// kept alive. While the visitor runs, the item can neither be replaced nor
+// removed, so the visitor must not modify the table. The data is read-locked
+// just like by CacheItem.WithRLock. Unlike Value, View
+// doesn't try to fetch missing data via the loadData callback. It returns
+// ErrKeyNotFound for missing keys, otherwise the visitor's error.
+func (table *CacheTable) View(key interface{}, visitor func(data interface{}) error) error {
+	key, err := table.resolveKey(key)
+	if err != nil {
+		return err
+	}
+
+	table.RLock()
+	r, ok := table.items.get(key)
+	table.countLookup(table.namespaces, key, ok)
+	if !ok {
+		table.RUnlock()
+		return ErrKeyNotFound
+	}
+	r.dataMu.RLock()
+	err = visitor(r.data)
+	r.dataMu.RUnlock()
+	table.RUnlock()
+
+	table.access(r, AccessDefault)
+
+	return err
 }
 
 // Exists returns whether an item exists in the cache. Unlike the Value method
 // Exists neither tries to fetch data via the loadData callback nor does it
 // keep the item alive in the cache.
 func (table *CacheTable) Exists(key interface{}) bool {
-	table.RLock()
+	if v := table.degradedView(); v != nil {
+		if _, ok := v.get(key); ok {
+			return true
+		}
+	}
+
+	key, err := table.resolveKey(key)
+	if err != nil {
+		return false
+	}
+
+	table.rlockMeasured()
 	defer table.RUnlock()
-	_, ok := table.items[key]
+	_, ok := table.items.get(key)
 
 	return ok
 }
 
+// Get returns the data stored under key and whether it was found, keeping the
+// item alive. Unlike Value it neither runs middleware nor tries the data-loader,
+// making it a cheap lookup for hot paths.
+func (table *CacheTable) Get(key interface{}) (interface{}, bool) {
+	if v := table.degradedView(); v != nil {
+		if r, ok := v.get(key); ok {
+			table.countLookup(v.namespaces, r.key, true)
+			if table.tracksAccess() {
+				r.KeepAlive()
+			}
+			return r.data, true
+		}
+	}
+
+	table.rlockMeasured()
+	if table.normalizeKeyFunc != nil {
+		key = table.normalizeKeyFunc(key)
+	}
+	if table.items.check(key) != nil {
+		table.RUnlock()
+		return nil, false
+	}
+	key, _ = table.unalias(key)
+	r, ok := table.items.get(key)
+	maxStaleness := table.maxStaleness
+	namespaces := table.namespaces
+	table.RUnlock()
+
+	if !ok || r.stale(maxStaleness) {
+		table.countLookup(namespaces, key, false)
+		return nil, false
+	}
+	table.countLookup(namespaces, key, true)
+
+	table.access(r, AccessDefault)
+	return r.data, true
+}
+
 // NotFoundAdd checks whether an item is not yet cached. Unlike the Exists
 // method this also adds data if the key could not be found.
 func (table *CacheTable) NotFoundAdd(key interface{}, lifeSpan time.Duration, data interface{}) bool {
+	added, _ := table.NotFoundAddCtx(context.Background(), key, lifeSpan, data)
+	return added
+}
+
+// NotFoundAddCtx works like NotFoundAdd, but passes ctx on to the AddedItem
+// callbacks and returns an error if the data could not be added.
+func (table *CacheTable) NotFoundAddCtx(ctx context.Context, key interface{}, lifeSpan time.Duration, data interface{}) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	if err := table.checkWritable(); err != nil {
+		return false, err
+	}
+	key, err := table.resolveKey(key)
+	if err != nil {
+		return false, err
+	}
+	if err := table.validate(key, data); err != nil {
+		return false, err
+	}
+
 	table.Lock()
 
-	if _, ok := table.items[key]; ok {
+	if _, ok := table.items.get(key); ok {
 		table.Unlock()
-		return false
+		return false, nil
 	}
 
-	item := NewCacheItem(key, lifeSpan, data)
-	table.addInternal(item)
+	item := NewCacheItem(key, lifeSpanFor(lifeSpan, data), data)
+	if err := table.checkTombstone(item, nil); err != nil {
+		table.Unlock()
+		return false, err
+	}
+	if table.defaultAboutToExpire != nil {
+		item.aboutToExpire = append(item.aboutToExpire, itemCallback{handle: newCallbackHandle(), fn: table.defaultAboutToExpire})
+	}
+	table.addInternal(ctx, item)
 
-	return true
+	return true, nil
 }
 
 // Value returns an item from the cache and marks it to be kept alive. You can
 // pass additional arguments to your DataLoader callback function.
+// Items produced by the DataLoader get added to the table and the stored item
+// is returned. If the key got added by someone else while the DataLoader was
+// running, that item is kept and returned instead. Concurrent lookups of the
+// same key share a single DataLoader call, made with the arguments of the
+// first one.
 func (table *CacheTable) Value(key interface{}, args ...interface{}) (*CacheItem, error) {
-	table.RLock()
-	r, ok := table.items[key]
-	loadData := table.loadData
+	return table.ValueCtx(context.Background(), key, args...)
+}
+
+// ValueCtx works like Value, but passes ctx on to the data-loader callback.
+// It gives up with ctx's error once ctx is done, even while the data-loader
+// is still running. The data-loader should watch ctx itself to stop early,
+// otherwise it completes in the background and its item still gets cached.
+func (table *CacheTable) ValueCtx(ctx context.Context, key interface{}, args ...interface{}) (*CacheItem, error) {
+	return table.handle(ctx, &Request{Op: OpValue, Key: key, Args: args, Mode: AccessDefault})
+}
+
+func (table *CacheTable) doValue(ctx context.Context, key interface{}, mode AccessMode, args ...interface{}) (*CacheItem, error) {
+	if v := table.degradedView(); v != nil {
+		if r, ok := v.get(key); ok {
+			table.countLookup(v.namespaces, r.key, true)
+			if table.tracksAccess() {
+				r.touch(mode)
+			}
+			reportSource(ctx, SourceHit)
+			table.hit(r)
+			return r, nil
+		}
+	}
+
+	key, err := table.resolveKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := table.fault(FaultStore, key); err != nil {
+		return nil, err
+	}
+
+	if err := table.rlockMeasuredCtx(ctx); err != nil {
+		return nil, err
+	}
+	r, ok := table.items.get(key)
+	loadData := table.dataLoader()
+	missFilter := table.missFilter
+	earlyRefreshBeta := table.earlyRefreshBeta
+	maxStaleness := table.maxStaleness
+	namespaces := table.namespaces
 	table.RUnlock()
 
-	if ok {
+	// Items exceeding the maximum staleness must not be served.
+	stale := ok && r.stale(maxStaleness)
+	table.countLookup(namespaces, key, ok && !stale)
+
+	if ok && !stale && (loadData == nil || !r.refreshEarly(earlyRefreshBeta)) {
 		// Update access counter and timestamp.
-		r.KeepAlive()
+		table.access(r, mode)
+		reportSource(ctx, SourceHit)
+		table.hit(r)
 		return r, nil
 	}
 
 	// Item doesn't exist in cache. Try and fetch it with a data-loader.
 	if loadData != nil {
-		item := loadData(key, args...)
-		if item != nil {
-			table.Add(key, item.lifeSpan, item.data)
-			return item, nil
+		if !ok && missFilter != nil && missFilter.contains(key) {
+			return nil, ErrKeyNotFoundOrLoadable
 		}
 
-		return nil, ErrKeyNotFoundOrLoadable
+		// Concurrent loads of the same key share a single data-loader call.
+		item, err := table.loadShared(ctx, key, func() (*CacheItem, error) {
+			if err := table.fault(FaultLoader, key); err != nil {
+				return nil, err
+			}
+			start := time.Now()
+			loadCtx := ctx
+			if ok {
+				loadCtx = context.WithValue(ctx, staleItemKey{}, r)
+			}
+			if loadCtx.Value(sourceKey{}) != nil {
+				// Lookups by the data-loader must not report their source
+				// as the one of this lookup.
+				loadCtx = context.WithValue(loadCtx, sourceKey{}, nil)
+			}
+			item := loadData(loadCtx, key, args...)
+			if item != nil {
+				atomic.AddInt64(&table.loads, 1)
+			}
+			if ok && item == r {
+				r.revalidated()
+				table.lifeSpanChanged(r)
+				return r, nil
+			}
+			if item == nil {
+				if !ok && missFilter != nil {
+					missFilter.add(key)
+				}
+				return nil, ErrKeyNotFoundOrLoadable
+			}
+
+			load := &loadResult{duration: time.Since(start)}
+			if ok {
+				load.replaces = r
+			}
+			// Lookups sharing the load must get its item, even if the
+			// lookup which started it gave up meanwhile.
+			return table.handle(detachedContext{ctx}, &Request{Op: OpAdd, Key: key, LifeSpan: item.lifeSpan, Data: item.data, template: item, load: load})
+		})
+		if err == ErrKeyNotFoundOrLoadable && ok && !stale {
+			// Early refresh failed, keep serving the cached item.
+			table.access(r, mode)
+			reportSource(ctx, SourceStale)
+			table.hit(r)
+			return r, nil
+		}
+		reportSource(ctx, SourceLoaded)
+		return item, err
 	}
 
 	return nil, ErrKeyNotFound
@@ -305,12 +1112,39 @@ func (table *CacheTable) Value(key interface{}, args ...interface{}) (*CacheItem
 
 // Flush deletes all items from this cache table.
 func (table *CacheTable) Flush() {
+	table.flush(context.Background())
+}
+
+// Works like Flush, versioning the change like the other changes made with
+// ctx.
+func (table *CacheTable) flush(ctx context.Context) {
 	table.Lock()
+	changeSubscribers := table.changeSubscribers
+	defer table.publish(changeSubscribers, Change{Op: ChangeFlush, Version: table.versionFor(ctx)})
 	defer table.Unlock()
 
 	table.log("Flushing table", table.name)
 
-	table.items = make(map[interface{}]*CacheItem)
+	if len(table.history) > 0 || table.churn != nil || table.auditWriter != nil {
+		table.items.each(func(item *CacheItem) {
+			item.RLock()
+			table.recordRemoval(item, RemovalFlushed)
+			table.audit(context.Background(), AuditFlushed, item)
+			item.RUnlock()
+		})
+	}
+
+	table.items = newStore(table.hasher)
+	table.aliases = nil
+	table.tombstones = nil
+	table.fences = nil
+	table.tokenFloor = table.lastToken
+	table.rebuildPathIndex()
+	table.rebuildNamespaces(nil)
+	table.rebuildMemory(nil)
+	table.updateCount()
+	table.resetSegments()
+	table.rebuildGenerations()
 	table.cleanupInterval = 0
 	if table.cleanupTimer != nil {
 		table.cleanupTimer.Stop()
@@ -336,12 +1170,12 @@ func (table *CacheTable) MostAccessed(count int64) []*CacheItem {
 	table.RLock()
 	defer table.RUnlock()
 
-	p := make(CacheItemPairList, len(table.items))
+	p := make(CacheItemPairList, table.items.len())
 	i := 0
-	for k, v := range table.items {
-		p[i] = CacheItemPair{k, v.accessCount}
+	table.items.each(func(item *CacheItem) {
+		p[i] = CacheItemPair{item.key, item.accessCount}
 		i++
-	}
+	})
 	sort.Sort(p)
 
 	var r []*CacheItem
@@ -351,7 +1185,7 @@ func (table *CacheTable) MostAccessed(count int64) []*CacheItem {
 			break
 		}
 
-		item, ok := table.items[v.Key]
+		item, ok := table.items.get(v.Key)
 		if ok {
 			r = append(r, item)
 		}
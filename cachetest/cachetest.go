@@ -0,0 +1,250 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+// Package cachetest provides a concurrent stress harness for cache2go
+// tables, so applications can check their table configurations, callbacks
+// and data-loaders under load.
+package cachetest
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/muesli/cache2go"
+)
+
+// Config configures Stress. Zero values select the defaults.
+type Config struct {
+	// Workers is the number of goroutines running operations concurrently.
+	// It defaults to 8.
+	Workers int
+	// Operations is the number of operations each worker runs. It defaults
+	// to 1000.
+	Operations int
+	// Keys is the size of the key space the operations pick from. It
+	// defaults to 64.
+	Keys int
+	// MaxLifeSpan is the upper bound of the random lifespans of added items.
+	// It defaults to 50ms, a negative value adds items which never expire.
+	MaxLifeSpan time.Duration
+	// ExpiryGrace is how long items may be returned past their expiry, as
+	// the cleanup runs asynchronously. It defaults to 100ms.
+	ExpiryGrace time.Duration
+	// Seed seeds the random operations, for reproducing failures. It
+	// defaults to the current time.
+	Seed int64
+	// Flushes enables occasional flushes of the table.
+	Flushes bool
+}
+
+// Result summarizes a stress run.
+type Result struct {
+	Seed       int64
+	Operations map[string]int64
+	// Violations describes every broken invariant.
+	Violations []string
+}
+
+// The data stored by the harness, identifying the key it was stored under.
+type value struct {
+	key int
+	seq int64
+}
+
+type harness struct {
+	cfg   Config
+	table *cache2go.CacheTable
+	seq   int64
+
+	mu         sync.Mutex
+	ops        map[string]int64
+	violations []string
+	added      map[*cache2go.CacheItem]int
+	deleted    map[*cache2go.CacheItem]int
+}
+
+// Stress runs random mixed operations against table from several goroutines
+// and reports every broken invariant as a test error:
+//
+//   - lookups never return items which expired longer than ExpiryGrace ago
+//   - lookups only return data stored under the requested key
+//   - the AddedItem callbacks run exactly once per added item
+//   - the AboutToDeleteItem callbacks run at most once per item
+//   - the table's count matches its items once all workers finished
+//
+// The table gets flushed before and after the run. Callbacks registered by
+// the harness get removed again afterwards.
+func Stress(t testing.TB, table *cache2go.CacheTable, cfg Config) Result {
+	t.Helper()
+	if cfg.Workers <= 0 {
+		cfg.Workers = 8
+	}
+	if cfg.Operations <= 0 {
+		cfg.Operations = 1000
+	}
+	if cfg.Keys <= 0 {
+		cfg.Keys = 64
+	}
+	if cfg.MaxLifeSpan == 0 {
+		cfg.MaxLifeSpan = 50 * time.Millisecond
+	}
+	if cfg.ExpiryGrace <= 0 {
+		cfg.ExpiryGrace = 100 * time.Millisecond
+	}
+	if cfg.Seed == 0 {
+		cfg.Seed = time.Now().UnixNano()
+	}
+
+	h := &harness{
+		cfg:     cfg,
+		table:   table,
+		ops:     make(map[string]int64),
+		added:   make(map[*cache2go.CacheItem]int),
+		deleted: make(map[*cache2go.CacheItem]int),
+	}
+
+	table.Flush()
+	addedHandle := table.AddAddedItemCallback(func(item *cache2go.CacheItem) {
+		h.mu.Lock()
+		h.added[item]++
+		h.mu.Unlock()
+	})
+	deletedHandle := table.AddAboutToDeleteItemCallback(func(item *cache2go.CacheItem) {
+		h.mu.Lock()
+		h.deleted[item]++
+		h.mu.Unlock()
+	})
+
+	var wg sync.WaitGroup
+	for w := 0; w < cfg.Workers; w++ {
+		wg.Add(1)
+		go func(rnd *rand.Rand) {
+			defer wg.Done()
+			for i := 0; i < cfg.Operations; i++ {
+				h.step(rnd)
+			}
+		}(rand.New(rand.NewSource(cfg.Seed + int64(w))))
+	}
+	wg.Wait()
+
+	n := 0
+	table.Foreach(func(key interface{}, item *cache2go.CacheItem) {
+		n++
+	})
+	if c := table.Count(); c != n {
+		h.violate("Count returned %d, but the table holds %d items", c, n)
+	}
+
+	table.RemoveCallback(addedHandle)
+	table.RemoveCallback(deletedHandle)
+	table.Flush()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for item, calls := range h.added {
+		if calls != 1 {
+			h.violations = append(h.violations, fmt.Sprintf("AddedItem callbacks ran %d times for item %v", calls, item.Key()))
+		}
+	}
+	for item, calls := range h.deleted {
+		if calls > 1 {
+			h.violations = append(h.violations, fmt.Sprintf("AboutToDeleteItem callbacks ran %d times for item %v", calls, item.Key()))
+		}
+	}
+
+	for _, v := range h.violations {
+		t.Errorf("cachetest: %s (seed %d)", v, cfg.Seed)
+	}
+	return Result{Seed: cfg.Seed, Operations: h.ops, Violations: h.violations}
+}
+
+// Runs a single random operation.
+func (h *harness) step(rnd *rand.Rand) {
+	key := rnd.Intn(h.cfg.Keys)
+
+	var op string
+	switch p := rnd.Intn(100); {
+	case p < 30:
+		op = "add"
+		h.table.Add(key, h.lifeSpan(rnd), h.value(key))
+	case p < 35:
+		op = "notfoundadd"
+		h.table.NotFoundAdd(key, h.lifeSpan(rnd), h.value(key))
+	case p < 55:
+		op = "value"
+		if item, err := h.table.ValueWithMode(key, cache2go.AccessPeek); err == nil {
+			h.checkItem(key, item)
+		}
+	case p < 75:
+		op = "get"
+		if data, ok := h.table.Get(key); ok {
+			h.checkData(key, data)
+		}
+	case p < 80:
+		op = "exists"
+		h.table.Exists(key)
+	case p < 95:
+		op = "delete"
+		h.table.Delete(key)
+	case p < 99 || !h.cfg.Flushes:
+		op = "foreach"
+		h.table.Foreach(func(key interface{}, item *cache2go.CacheItem) {
+			h.checkData(key.(int), item.Data())
+		})
+	default:
+		op = "flush"
+		h.table.Flush()
+	}
+
+	h.mu.Lock()
+	h.ops[op]++
+	h.mu.Unlock()
+}
+
+func (h *harness) lifeSpan(rnd *rand.Rand) time.Duration {
+	if h.cfg.MaxLifeSpan < 0 {
+		return 0
+	}
+	return time.Duration(rnd.Int63n(int64(h.cfg.MaxLifeSpan))) + time.Millisecond
+}
+
+func (h *harness) value(key int) *value {
+	return &value{key: key, seq: atomic.AddInt64(&h.seq, 1)}
+}
+
+// Checks an item returned by a lookup.
+func (h *harness) checkItem(key int, item *cache2go.CacheItem) {
+	h.checkData(key, item.Data())
+
+	if ls := item.LifeSpan(); ls > 0 {
+		if late := time.Since(item.AccessedOn()) - ls; late > h.cfg.ExpiryGrace {
+			h.violate("item %v returned %v after it expired", key, late)
+		}
+	}
+}
+
+// Checks data returned by a lookup.
+func (h *harness) checkData(key int, data interface{}) {
+	v, ok := data.(*value)
+	if !ok {
+		h.violate("lookup of key %v returned foreign data %v", key, data)
+		return
+	}
+	if v.key != key {
+		h.violate("lookup of key %v returned data stored under key %v", key, v.key)
+	}
+}
+
+func (h *harness) violate(format string, args ...interface{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.violations = append(h.violations, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,79 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cachetest
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/muesli/cache2go"
+)
+
+func TestStress(t *testing.T) {
+	r := Stress(t, cache2go.Cache("testStress"), Config{Flushes: true})
+	if r.Operations["add"] == 0 || r.Operations["get"] == 0 {
+		t.Error("Expected mixed operations to run, got", r.Operations)
+	}
+}
+
+func TestStressBounded(t *testing.T) {
+	table := cache2go.Cache("testStressBounded")
+	table.SetMaxItems(16)
+	table.SetSegmented(0.5)
+	Stress(t, table, Config{Keys: 128})
+}
+
+func TestFake(t *testing.T) {
+	var c cache2go.Cacher = NewFake()
+	f := c.(*Fake)
+
+	c.Add("a", 0, 1)
+	if item, err := c.Value("a"); err != nil || item.Data() != 1 {
+		t.Error("Error retrieving data from fake", err)
+	}
+	if c.NotFoundAdd("a", 0, 2) || !c.NotFoundAdd("b", 0, 2) {
+		t.Error("Expected NotFoundAdd to only add missing keys")
+	}
+
+	errUnavailable := errors.New("unavailable")
+	f.Fail(cache2go.OpValue, "a", errUnavailable)
+	f.Fail(cache2go.OpAdd, nil, errUnavailable)
+	if _, err := c.Value("a"); err != errUnavailable {
+		t.Error("Expected scripted failure, got", err)
+	}
+	if _, err := c.Value("b"); err != nil {
+		t.Error("Expected other keys not to fail, got", err)
+	}
+	c.Add("c", 0, 3)
+	if c.Exists("c") {
+		t.Error("Expected failing add not to store anything")
+	}
+
+	f.Fail(cache2go.OpValue, "a", nil)
+	if _, err := c.Value("a"); err != nil {
+		t.Error("Expected cleared failure not to fail, got", err)
+	}
+
+	f.SetDataLoader(func(key interface{}, args ...interface{}) *cache2go.CacheItem {
+		return cache2go.NewCacheItem(key, 0, "loaded")
+	})
+	if item, err := c.Value("d"); err != nil || item.Data() != "loaded" {
+		t.Error("Expected fake to use the data-loader", err)
+	}
+
+	if _, err := c.Delete("a"); err != nil || c.Exists("a") {
+		t.Error("Error deleting from fake", err)
+	}
+	c.Flush()
+	if c.Exists("b") {
+		t.Error("Expected flush to remove all items")
+	}
+	if calls := f.Calls(); len(calls) != 9 || calls[0] != (Call{Op: cache2go.OpAdd, Key: "a"}) {
+		t.Error("Expected calls to be recorded, got", calls)
+	}
+}
@@ -0,0 +1,181 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cachetest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/muesli/cache2go"
+)
+
+// Call is an operation recorded by a Fake.
+type Call struct {
+	Op  cache2go.Op
+	Key interface{}
+}
+
+// Fake is an in-memory cache2go.Cacher for unit tests of code using
+// cache2go, with scriptable failures. Items expire lazily on lookup.
+type Fake struct {
+	mu     sync.Mutex
+	items  map[interface{}]*cache2go.CacheItem
+	errs   map[cache2go.Op]map[interface{}]error
+	calls  []Call
+	loader func(key interface{}, args ...interface{}) *cache2go.CacheItem
+}
+
+var _ cache2go.Cacher = (*Fake)(nil)
+
+// NewFake returns an empty Fake.
+func NewFake() *Fake {
+	return &Fake{
+		items: make(map[interface{}]*cache2go.CacheItem),
+		errs:  make(map[cache2go.Op]map[interface{}]error),
+	}
+}
+
+// SetDataLoader configures a data-loader called by Value for missing keys,
+// like CacheTable.SetDataLoader.
+func (f *Fake) SetDataLoader(loader func(key interface{}, args ...interface{}) *cache2go.CacheItem) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.loader = loader
+}
+
+// Fail makes operations of the given kind on key fail with err, until
+// cleared by passing a nil err. A nil key applies to all keys. Failing Value
+// and Delete calls return err, failing Add and NotFoundAdd calls don't store
+// anything.
+func (f *Fake) Fail(op cache2go.Op, key interface{}, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err == nil {
+		delete(f.errs[op], key)
+		return
+	}
+	if f.errs[op] == nil {
+		f.errs[op] = make(map[interface{}]error)
+	}
+	f.errs[op][key] = err
+}
+
+// Calls returns the Value, Add and Delete operations run so far, including
+// those of NotFoundAdd, in order.
+func (f *Fake) Calls() []Call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Call(nil), f.calls...)
+}
+
+// Records a call and returns the error scripted for it, if any.
+// Careful: do not run this method unless the fake's mutex is locked!
+func (f *Fake) call(op cache2go.Op, key interface{}) error {
+	f.calls = append(f.calls, Call{Op: op, Key: key})
+	if err, ok := f.errs[op][key]; ok {
+		return err
+	}
+	return f.errs[op][nil]
+}
+
+// Returns the item stored under key, unless it expired.
+// Careful: do not run this method unless the fake's mutex is locked!
+func (f *Fake) get(key interface{}) (*cache2go.CacheItem, bool) {
+	item, ok := f.items[key]
+	if !ok {
+		return nil, false
+	}
+	if ls := item.LifeSpan(); ls > 0 && time.Since(item.AccessedOn()) > ls {
+		delete(f.items, key)
+		return nil, false
+	}
+	return item, true
+}
+
+// Value returns the item stored under key, or tries the data-loader.
+func (f *Fake) Value(key interface{}, args ...interface{}) (*cache2go.CacheItem, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call(cache2go.OpValue, key); err != nil {
+		return nil, err
+	}
+	if item, ok := f.get(key); ok {
+		item.KeepAlive()
+		return item, nil
+	}
+	if f.loader == nil {
+		return nil, cache2go.ErrKeyNotFound
+	}
+
+	item := f.loader(key, args...)
+	if item == nil {
+		return nil, cache2go.ErrKeyNotFoundOrLoadable
+	}
+	f.items[key] = item
+	return item, nil
+}
+
+// Add stores data under key.
+func (f *Fake) Add(key interface{}, lifeSpan time.Duration, data interface{}) *cache2go.CacheItem {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	item := cache2go.NewCacheItem(key, lifeSpan, data)
+	if f.call(cache2go.OpAdd, key) == nil {
+		f.items[key] = item
+	}
+	return item
+}
+
+// NotFoundAdd stores data under key, unless the key exists already.
+func (f *Fake) NotFoundAdd(key interface{}, lifeSpan time.Duration, data interface{}) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.get(key); ok {
+		return false
+	}
+	if f.call(cache2go.OpAdd, key) != nil {
+		return false
+	}
+	f.items[key] = cache2go.NewCacheItem(key, lifeSpan, data)
+	return true
+}
+
+// Delete removes the item stored under key.
+func (f *Fake) Delete(key interface{}) (*cache2go.CacheItem, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call(cache2go.OpDelete, key); err != nil {
+		return nil, err
+	}
+	item, ok := f.get(key)
+	if !ok {
+		return nil, cache2go.ErrKeyNotFound
+	}
+	delete(f.items, key)
+	return item, nil
+}
+
+// Exists reports whether an item is stored under key.
+func (f *Fake) Exists(key interface{}) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.get(key)
+	return ok
+}
+
+// Flush removes all items.
+func (f *Fake) Flush() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.items = make(map[interface{}]*cache2go.CacheItem)
+}
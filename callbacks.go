@@ -0,0 +1,75 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// CallbackHandle identifies a registered callback, so it can be removed
+// again later on without affecting any other callbacks.
+type CallbackHandle uint64
+
+var lastCallbackHandle uint64
+
+func newCallbackHandle() CallbackHandle {
+	return CallbackHandle(atomic.AddUint64(&lastCallbackHandle, 1))
+}
+
+// A callback registered with a table.
+type tableCallback struct {
+	handle CallbackHandle
+	fn     func(ctx context.Context, item *CacheItem)
+}
+
+// A callback registered with an item.
+type itemCallback struct {
+	handle CallbackHandle
+	fn     func(key interface{})
+}
+
+// Returns a copy of callbacks without the one identified by h. The slice gets
+// copied, as the old one may still be iterated outside of the table-mutex.
+func removeTableCallback(callbacks []tableCallback, h CallbackHandle) ([]tableCallback, bool) {
+	for i, cb := range callbacks {
+		if cb.handle == h {
+			r := make([]tableCallback, 0, len(callbacks)-1)
+			r = append(r, callbacks[:i]...)
+			return append(r, callbacks[i+1:]...), true
+		}
+	}
+
+	return callbacks, false
+}
+
+// Returns a copy of callbacks without the one identified by h.
+func removeChangeCallback(callbacks []changeCallback, h CallbackHandle) ([]changeCallback, bool) {
+	for i, cb := range callbacks {
+		if cb.handle == h {
+			r := make([]changeCallback, 0, len(callbacks)-1)
+			r = append(r, callbacks[:i]...)
+			return append(r, callbacks[i+1:]...), true
+		}
+	}
+
+	return callbacks, false
+}
+
+// Returns a copy of callbacks without the one identified by h.
+func removeItemCallback(callbacks []itemCallback, h CallbackHandle) ([]itemCallback, bool) {
+	for i, cb := range callbacks {
+		if cb.handle == h {
+			r := make([]itemCallback, 0, len(callbacks)-1)
+			r = append(r, callbacks[:i]...)
+			return append(r, callbacks[i+1:]...), true
+		}
+	}
+
+	return callbacks, false
+}
@@ -0,0 +1,144 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"time"
+)
+
+// Number of buckets the churn window is divided into. The window slides in
+// steps of one bucket.
+const churnBuckets = 10
+
+// ChurnStats reports how many items were added to and removed from a table
+// within a recent window. Many expirations of short-lived items hint at too
+// short lifespans, causing items to be reloaded constantly, while long
+// lifetimes hint at stale data being retained.
+type ChurnStats struct {
+	// Window is the time span the counters cover.
+	Window time.Duration
+	// Added counts the items added, including replacements.
+	Added int64
+	// Removed counts the items removed, by reason.
+	Removed map[RemovalReason]int64
+	// AvgLifetime is the average time the removed items spent in the table.
+	AvgLifetime time.Duration
+}
+
+// Rate returns the number of events n per second within the window, e.g.
+// s.Rate(s.Removed[RemovalExpired]).
+func (s ChurnStats) Rate(n int64) float64 {
+	if s.Window <= 0 {
+		return 0
+	}
+	return float64(n) / s.Window.Seconds()
+}
+
+// Churn counters of one step of the window.
+type churnBucket struct {
+	// Number of the step since the epoch the counters belong to.
+	step     int64
+	added    int64
+	removed  map[RemovalReason]int64
+	lifetime time.Duration
+}
+
+// Rolling churn counters of a table.
+type churn struct {
+	window  time.Duration
+	buckets [churnBuckets]churnBucket
+}
+
+// SetChurnWindow configures the window ChurnStats reports on. A window of 0
+// disables the churn counters, which is the default.
+func (table *CacheTable) SetChurnWindow(window time.Duration) {
+	table.Lock()
+	defer table.Unlock()
+
+	table.churn = nil
+	if window > 0 {
+		table.churn = &churn{window: window}
+	}
+}
+
+// ChurnStats returns the item churn within the window configured via
+// SetChurnWindow.
+func (table *CacheTable) ChurnStats() ChurnStats {
+	table.RLock()
+	defer table.RUnlock()
+
+	s := ChurnStats{Removed: make(map[RemovalReason]int64)}
+	if table.churn == nil {
+		return s
+	}
+	s.Window = table.churn.window
+
+	var removed int64
+	var lifetime time.Duration
+	oldest := table.churn.stepAt(time.Now()) - churnBuckets + 1
+	for _, b := range table.churn.buckets {
+		if b.step < oldest {
+			continue
+		}
+		s.Added += b.added
+		for reason, n := range b.removed {
+			s.Removed[reason] += n
+			removed += n
+		}
+		lifetime += b.lifetime
+	}
+	if removed > 0 {
+		s.AvgLifetime = lifetime / time.Duration(removed)
+	}
+	return s
+}
+
+// Returns the number of the window step t falls into.
+func (c *churn) stepAt(t time.Time) int64 {
+	step := int64(c.window / churnBuckets)
+	if step == 0 {
+		step = 1
+	}
+	return t.UnixNano() / step
+}
+
+// Returns the bucket of the current step, resetting it if it belonged to an
+// earlier one.
+func (c *churn) current() *churnBucket {
+	step := c.stepAt(time.Now())
+	b := &c.buckets[step%churnBuckets]
+	if b.step != step {
+		*b = churnBucket{step: step}
+	}
+	return b
+}
+
+// Counts an added item.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) churnAdded() {
+	if table.churn == nil {
+		return
+	}
+	table.churn.current().added++
+}
+
+// Counts a removed item.
+// Careful: do not run this method unless the table-mutex is locked and the
+// item is at least read-locked!
+func (table *CacheTable) churnRemoved(item *CacheItem, reason RemovalReason) {
+	if table.churn == nil {
+		return
+	}
+
+	b := table.churn.current()
+	if b.removed == nil {
+		b.removed = make(map[RemovalReason]int64)
+	}
+	b.removed[reason]++
+	b.lifetime += time.Since(item.createdOn)
+}
@@ -0,0 +1,71 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"sync"
+	"time"
+)
+
+// Lifespans get measured with the monotonic clock, so steps of the wall
+// clock, e.g. NTP corrections, neither expire items en masse nor keep them
+// around for too long. The monotonic clock however stops while the system
+// is suspended, which would keep items alive for the duration of a suspend.
+// A watcher compares both clocks periodically and treats the wall clock
+// advancing more than the monotonic one as a suspend: the timestamps of all
+// items then drop their monotonic reading, making their age include the
+// time suspended, and the expiration timers get re-armed.
+const (
+	clockCheckInterval = time.Second
+	clockJumpThreshold = 2 * time.Second
+)
+
+var clockWatcherOnce sync.Once
+
+// Starts the clock watcher, unless it is running already.
+func watchClock() {
+	clockWatcherOnce.Do(func() {
+		go func() {
+			last := time.Now()
+			for range time.Tick(clockCheckInterval) {
+				now := time.Now()
+				// Round(0) strips the monotonic reading, comparing wall
+				// clocks.
+				jump := now.Round(0).Sub(last.Round(0)) - now.Sub(last)
+				last = now
+
+				if jump > clockJumpThreshold || jump < -clockJumpThreshold {
+					ForEachTable(func(table *CacheTable) {
+						table.clockJumped(jump)
+					})
+				}
+			}
+		}()
+	})
+}
+
+// Adapts the table to a jump of the wall clock relative to the monotonic
+// clock.
+func (table *CacheTable) clockJumped(jump time.Duration) {
+	table.log("Wall clock jumped by", jump, "re-arming expiration timer of table", table.name)
+
+	if jump > 0 {
+		table.Lock()
+		table.items.each(func(item *CacheItem) {
+			item.Lock()
+			item.createdOn = item.createdOn.Round(0)
+			item.accessedOn = item.accessedOn.Round(0)
+			item.validatedOn = item.validatedOn.Round(0)
+			item.Unlock()
+		})
+		table.rebuildGenerations()
+		table.Unlock()
+	}
+
+	table.expirationCheck()
+}
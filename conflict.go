@@ -0,0 +1,68 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+// ConflictPolicy determines what Add does if the key already exists.
+type ConflictPolicy int
+
+const (
+	// ConflictOverwrite replaces the existing item, which is the default.
+	ConflictOverwrite ConflictPolicy = iota
+	// ConflictError keeps the existing item and makes AddCtx return
+	// ErrKeyExists.
+	ConflictError
+	// ConflictKeepOriginal keeps and returns the existing item.
+	ConflictKeepOriginal
+	// ConflictMerge replaces the existing item with one holding the data
+	// returned by the table's merge function.
+	ConflictMerge
+)
+
+// SetConflictPolicy configures what Add does if the key already exists. The
+// merge function is only used by ConflictMerge and gets called with the key,
+// the existing and the added data. ConflictMerge without a merge function
+// returns ErrNoMergeFunc and leaves the policy unchanged. The merged data
+// has to pass the same checks as added data, see SetValidator. Both the
+// merge function and the validator run while the table is locked then, so
+// they must not access the table themselves. Items stored by the
+// data-loader always replace the existing ones.
+func (table *CacheTable) SetConflictPolicy(policy ConflictPolicy, merge func(key, existing, added interface{}) interface{}) error {
+	if policy == ConflictMerge && merge == nil {
+		return ErrNoMergeFunc
+	}
+
+	table.Lock()
+	defer table.Unlock()
+	table.conflictPolicy = policy
+	table.mergeFunc = merge
+	return nil
+}
+
+// Applies the conflict policy to the item about to be added. It returns the
+// item to return from Add and whether to skip adding.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) resolveConflict(item *CacheItem) (*CacheItem, bool, error) {
+	old, ok := table.items.get(item.key)
+	if !ok {
+		return item, false, nil
+	}
+
+	switch table.conflictPolicy {
+	case ConflictError:
+		return nil, true, ErrKeyExists
+	case ConflictKeepOriginal:
+		return old, true, nil
+	case ConflictMerge:
+		data := table.mergeFunc(item.key, old.data, item.data)
+		if err := table.admission()(item.key, data); err != nil {
+			return nil, true, err
+		}
+		item.data = data
+	}
+	return item, false, nil
+}
@@ -0,0 +1,102 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// ContentKey returns the key AddContent stores data under.
+func ContentKey(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// AddContent stores data keyed by its content hash and returns that key.
+// Identical data is only stored once: adding it again just keeps the existing
+// item alive and increments its reference count. Each AddContent should be
+// paired with a ReleaseContent. The data must not be modified afterwards.
+func (table *CacheTable) AddContent(data []byte, lifeSpan time.Duration) string {
+	key, _ := table.AddContentCtx(context.Background(), data, lifeSpan)
+	return key
+}
+
+// AddContentCtx works like AddContent, but passes ctx on to the AddedItem
+// callbacks. It returns an error if the data fails validation.
+func (table *CacheTable) AddContentCtx(ctx context.Context, data []byte, lifeSpan time.Duration) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if err := table.checkWritable(); err != nil {
+		return "", err
+	}
+	key := ContentKey(data)
+
+	table.Lock()
+	if r, ok := table.items.get(key); ok {
+		table.Unlock()
+		r.Lock()
+		r.refs++
+		r.Unlock()
+		table.access(r, AccessDefault)
+		return key, nil
+	}
+	table.Unlock()
+
+	if err := table.validate(key, data); err != nil {
+		return "", err
+	}
+	item := NewCacheItem(key, lifeSpan, data)
+	item.refs = 1
+
+	table.Lock()
+	if r, ok := table.items.get(key); ok {
+		// Someone else added the same content in the meantime.
+		table.Unlock()
+		r.Lock()
+		r.refs++
+		r.Unlock()
+		table.access(r, AccessDefault)
+		return key, nil
+	}
+	if table.defaultAboutToExpire != nil {
+		item.aboutToExpire = append(item.aboutToExpire, itemCallback{handle: newCallbackHandle(), fn: table.defaultAboutToExpire})
+	}
+	table.addInternal(ctx, item)
+
+	return key, nil
+}
+
+// ReleaseContent drops a reference to content added via AddContent. The
+// content gets deleted once its last reference is released.
+func (table *CacheTable) ReleaseContent(key string) error {
+	if err := table.checkWritable(); err != nil {
+		return err
+	}
+	table.Lock()
+	defer table.Unlock()
+
+	r, ok := table.items.get(key)
+	if !ok {
+		return ErrKeyNotFound
+	}
+
+	r.Lock()
+	r.refs--
+	refs := r.refs
+	r.Unlock()
+	if refs > 0 {
+		return nil
+	}
+
+	_, err := table.deleteInternal(context.Background(), key, RemovalDeleted)
+	return err
+}
@@ -0,0 +1,135 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// A read-only copy of a table's items, served without locking while the
+// table is contended.
+type readView struct {
+	items     *store
+	aliases   *store
+	normalize func(key interface{}) interface{}
+	chain     Handler
+	// Maximum age of served items, 0 if unbounded.
+	maxStaleness time.Duration
+	namespaces   *namespaces
+	// Time until which the view may be served.
+	until time.Time
+}
+
+// SetDegradedReads enables best effort reads under lock contention. Once a
+// read waited longer than threshold for the table-mutex, e.g. during a bulk
+// load, Get, Exists and Value serve a read-only copy of the table's items
+// without locking for the duration of staleness, keeping read latency
+// bounded. Such reads may miss changes made meanwhile and don't promote
+// items in the eviction order. Keys missing from the copy are looked up as
+// usual. A threshold of 0 disables degraded reads, which is the default.
+func (table *CacheTable) SetDegradedReads(threshold, staleness time.Duration) {
+	atomic.StoreInt64(&table.degradeFor, int64(staleness))
+	atomic.StoreInt64(&table.degradeAfter, int64(threshold))
+	table.readView.Store((*readView)(nil))
+}
+
+// Degraded reports whether reads are currently served from a read-only copy
+// of the table's items.
+func (table *CacheTable) Degraded() bool {
+	return table.degradedView() != nil
+}
+
+// Returns the read view if reads are currently degraded.
+func (table *CacheTable) degradedView() *readView {
+	if atomic.LoadInt64(&table.degradeAfter) == 0 {
+		return nil
+	}
+	v, _ := table.readView.Load().(*readView)
+	if v == nil || time.Now().After(v.until) {
+		return nil
+	}
+	return v
+}
+
+// Read-locks the table. If that took longer than the degraded reads
+// threshold, a read view gets built for the following reads.
+func (table *CacheTable) rlockMeasured() {
+	if atomic.LoadInt64(&table.degradeAfter) == 0 {
+		table.RLock()
+		return
+	}
+
+	start := time.Now()
+	table.RLock()
+	table.measuredRead(start)
+}
+
+// Works like rlockMeasured, but gives up like lockCtx.
+func (table *CacheTable) rlockMeasuredCtx(ctx context.Context) error {
+	if atomic.LoadInt64(&table.degradeAfter) == 0 {
+		return table.lockCtx(ctx, false)
+	}
+
+	start := time.Now()
+	if err := table.lockCtx(ctx, false); err != nil {
+		return err
+	}
+	table.measuredRead(start)
+	return nil
+}
+
+// Builds a read view if acquiring the read lock at start took longer than
+// the degraded reads threshold.
+// Careful: do not run this method unless the table-mutex is read-locked!
+func (table *CacheTable) measuredRead(start time.Time) {
+	threshold := atomic.LoadInt64(&table.degradeAfter)
+	if threshold == 0 || time.Since(start) <= time.Duration(threshold) {
+		return
+	}
+
+	// Only one of the waiting readers builds the view.
+	if !atomic.CompareAndSwapInt32(&table.degradeBuilding, 0, 1) {
+		return
+	}
+	v := &readView{
+		items:        table.items.clone(),
+		normalize:    table.normalizeKeyFunc,
+		chain:        table.chain,
+		maxStaleness: table.maxStaleness,
+		namespaces:   table.namespaces,
+		until:        time.Now().Add(time.Duration(atomic.LoadInt64(&table.degradeFor))),
+	}
+	if table.aliases != nil {
+		v.aliases = table.aliases.clone()
+	}
+	table.readView.Store(v)
+	atomic.StoreInt32(&table.degradeBuilding, 0)
+	table.log("Degrading reads of table", table.name, "after waiting", time.Since(start), "for the lock")
+}
+
+// Looks up an item in the view. Stale items are left to the regular lookup.
+func (v *readView) get(key interface{}) (*CacheItem, bool) {
+	if v.normalize != nil {
+		key = v.normalize(key)
+	}
+	if v.items.check(key) != nil {
+		return nil, false
+	}
+	if v.aliases != nil {
+		if a, ok := v.aliases.get(key); ok {
+			key = a.data
+		}
+	}
+	r, ok := v.items.get(key)
+	if !ok || r.stale(v.maxStaleness) {
+		return nil, false
+	}
+	return r, true
+}
@@ -0,0 +1,278 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventType is the kind of lifecycle change an Event describes.
+type EventType string
+
+const (
+	// EventSet is emitted when an item got added or replaced.
+	EventSet EventType = "set"
+	// EventDelete is emitted when an item got deleted.
+	EventDelete EventType = "delete"
+	// EventExpire is emitted when an item exceeded its lifespan.
+	EventExpire EventType = "expire"
+	// EventEvict is emitted when an item got evicted due to capacity.
+	EventEvict EventType = "evict"
+	// EventFlush is emitted when the table got flushed.
+	EventFlush EventType = "flush"
+)
+
+// Event is a cache lifecycle event as delivered by an Emitter.
+type Event struct {
+	Table string    `json:"table"`
+	Type  EventType `json:"type"`
+	Key   string    `json:"key,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// EventSink receives batches of events, e.g. by posting them to a webhook or
+// publishing them on a message bus. A failed batch gets retried, so sinks
+// should tolerate duplicates.
+type EventSink interface {
+	Emit(ctx context.Context, events []Event) error
+}
+
+// EmitterConfig configures an Emitter. Zero values select the defaults.
+type EmitterConfig struct {
+	// BatchSize is the maximum number of events per batch. It defaults to
+	// 100.
+	BatchSize int
+	// FlushInterval is how long events may wait for a batch to fill up. It
+	// defaults to one second.
+	FlushInterval time.Duration
+	// MaxRetries is how often a failed batch gets retried before it is
+	// dropped. It defaults to 3.
+	MaxRetries int
+	// RetryBackoff is the delay before the first retry, doubling with every
+	// further attempt. It defaults to 100ms.
+	RetryBackoff time.Duration
+	// Timeout is how long a single delivery attempt may take before it
+	// counts as failed, so a stuck sink can't block Close forever. It
+	// defaults to 10 seconds.
+	Timeout time.Duration
+	// BufferSize is how many events may be queued. Events exceeding it get
+	// dropped, so a slow sink never blocks the table. It defaults to 1024.
+	BufferSize int
+}
+
+// Emitter delivers a table's lifecycle events to an EventSink in batches,
+// retrying failed deliveries.
+type Emitter struct {
+	dropped int64
+	table   *CacheTable
+	sink    EventSink
+	cfg     EmitterConfig
+	handle  CallbackHandle
+
+	mu     sync.RWMutex
+	closed bool
+	events chan Event
+	done   chan struct{}
+}
+
+// NewEmitter starts delivering the lifecycle events of this table to sink.
+// Call Close to stop.
+func (table *CacheTable) NewEmitter(sink EventSink, cfg EmitterConfig) *Emitter {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = time.Second
+	}
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = 3
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = 100 * time.Millisecond
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = 1024
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+
+	e := &Emitter{
+		table:  table,
+		sink:   sink,
+		cfg:    cfg,
+		events: make(chan Event, cfg.BufferSize),
+		done:   make(chan struct{}),
+	}
+	e.handle = table.Subscribe(e.enqueue)
+	go e.run()
+	return e
+}
+
+// Dropped returns how many events got dropped, either because the queue was
+// full or because their batch kept failing.
+func (e *Emitter) Dropped() int64 {
+	return atomic.LoadInt64(&e.dropped)
+}
+
+// Close stops the emitter after delivering the queued events.
+func (e *Emitter) Close() {
+	e.table.RemoveCallback(e.handle)
+
+	e.mu.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.events)
+	}
+	e.mu.Unlock()
+	<-e.done
+}
+
+// Queues the event describing a change, without blocking.
+func (e *Emitter) enqueue(c Change) {
+	ev := Event{Table: c.Table, Type: EventSet, Time: c.Time}
+	switch c.Op {
+	case ChangeDelete:
+		switch c.Reason {
+		case RemovalExpired:
+			ev.Type = EventExpire
+		case RemovalEvicted:
+			ev.Type = EventEvict
+		default:
+			ev.Type = EventDelete
+		}
+	case ChangeFlush:
+		ev.Type = EventFlush
+	}
+	if c.Op != ChangeFlush {
+		ev.Key = fmt.Sprint(c.Key)
+	}
+
+	// The emitter may get closed while a change is being published.
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.closed {
+		return
+	}
+	select {
+	case e.events <- ev:
+	default:
+		atomic.AddInt64(&e.dropped, 1)
+	}
+}
+
+// Collects events into batches and delivers them.
+func (e *Emitter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Event, 0, e.cfg.BatchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			e.deliver(batch)
+			batch = make([]Event, 0, e.cfg.BatchSize)
+		}
+	}
+
+	for {
+		select {
+		case ev, ok := <-e.events:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, ev)
+			if len(batch) >= e.cfg.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Sends a batch to the sink, retrying with exponential backoff.
+func (e *Emitter) deliver(batch []Event) {
+	backoff := e.cfg.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), e.cfg.Timeout)
+		err := e.sink.Emit(ctx, batch)
+		cancel()
+		if err == nil {
+			return
+		}
+		if attempt >= e.cfg.MaxRetries {
+			e.table.log("Dropping", len(batch), "events of table", e.table.name, ":", err)
+			atomic.AddInt64(&e.dropped, int64(len(batch)))
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// ChanEventSink is an EventSink delivering batches on a channel.
+type ChanEventSink chan<- []Event
+
+// Emit sends the batch on the channel, blocking until it is received or the
+// context gets cancelled.
+func (s ChanEventSink) Emit(ctx context.Context, events []Event) error {
+	select {
+	case s <- events:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WebhookSink is an EventSink posting batches as JSON arrays to a URL.
+type WebhookSink struct {
+	URL    string
+	Client *http.Client
+	// Header holds additional request headers, e.g. for authentication.
+	Header http.Header
+}
+
+// Emit posts the batch. Responses other than 2xx count as failures.
+func (s *WebhookSink) Emit(ctx context.Context, events []Event) error {
+	body, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range s.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook %s: %s", s.URL, resp.Status)
+	}
+	return nil
+}
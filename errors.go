@@ -17,4 +17,60 @@ var (
 	// ErrKeyNotFoundOrLoadable gets returned when a specific key couldn't be
 	// found and loading via the data-loader callback also failed
 	ErrKeyNotFoundOrLoadable = errors.New("Key not found and could not be loaded into cache")
+	// ErrKeyExists gets returned when a key is already in use
+	ErrKeyExists = errors.New("Key already exists in cache")
+	// ErrNilKey gets returned when adding a nil key to a table rejecting them
+	ErrNilKey = errors.New("Key is nil")
+	// ErrNilData gets returned when adding nil data to a table rejecting it
+	ErrNilData = errors.New("Data is nil")
+	// ErrKeyTooLarge gets returned when a key exceeds the table's size limit
+	ErrKeyTooLarge = errors.New("Key exceeds maximum key size")
+	// ErrValueTooLarge gets returned when a value exceeds the table's size limit
+	ErrValueTooLarge = errors.New("Value exceeds maximum value size")
+	// ErrUnhashableKey gets returned when a key can't be hashed, e.g. because
+	// it is a map and the table uses no custom Hasher
+	ErrUnhashableKey = errors.New("Key is not hashable")
+	// ErrReadOnly gets returned when modifying a read-only table
+	ErrReadOnly = errors.New("Table is read-only")
+	// ErrCorruptSnapshot gets returned when reading a persisted snapshot or
+	// log which is damaged or of an unknown format
+	ErrCorruptSnapshot = errors.New("Snapshot is corrupt or of an unknown format")
+	// ErrUnsupportedKey gets returned when a KeyCodec can't encode or decode
+	// a key
+	ErrUnsupportedKey = errors.New("Key type not supported by codec")
+	// ErrLeased gets returned when a key is already leased by another holder
+	ErrLeased = errors.New("Key is leased by another holder")
+	// ErrLeaseExpired gets returned when using a lease that expired or has
+	// already been released
+	ErrLeaseExpired = errors.New("Lease has expired or was released")
+	// ErrWrongType gets returned when an item's data is not of the type
+	// required by the operation
+	ErrWrongType = errors.New("Item holds data of the wrong type")
+	// ErrSemaphoreFull gets returned when a semaphore lacks the requested
+	// capacity
+	ErrSemaphoreFull = errors.New("Semaphore capacity exhausted")
+	// ErrSemaphoreRelease gets returned when releasing more semaphore units
+	// than have been acquired
+	ErrSemaphoreRelease = errors.New("Released more semaphore units than acquired")
+	// ErrSemaphoreUnits gets returned when acquiring or releasing less than
+	// one semaphore unit
+	ErrSemaphoreUnits = errors.New("Semaphore units must be positive")
+	// ErrNotInFlight gets returned when acknowledging a list value which is
+	// no longer in flight
+	ErrNotInFlight = errors.New("Value is not in flight")
+	// ErrTimeout gets returned when an operation exceeds the table's
+	// operation timeout
+	ErrTimeout = errors.New("Operation timed out")
+	// ErrInvalidKeyTemplate gets returned when registering a malformed or
+	// conflicting key template
+	ErrInvalidKeyTemplate = errors.New("Invalid key template")
+	// ErrTombstoned gets returned when adding a key which got soft-deleted
+	// and whose tombstone still lasts
+	ErrTombstoned = errors.New("Key was soft-deleted recently")
+	// ErrStaleToken gets returned when adding an item with a fencing token
+	// older than the key's last fill or deletion
+	ErrStaleToken = errors.New("Fencing token is stale")
+	// ErrNoMergeFunc gets returned when setting the ConflictMerge policy
+	// without a merge function
+	ErrNoMergeFunc = errors.New("Conflict policy requires a merge function")
 )
@@ -0,0 +1,385 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"container/list"
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Keeps track of the order in which items get evicted from a
+// capacity-bounded table. Items enter the probation segment and get promoted
+// to the protected segment when accessed again. Items demoted from the
+// protected segment re-enter the probation segment. Without a protected
+// segment this degrades to a plain LRU.
+type segments struct {
+	sync.Mutex
+
+	probation    *list.List
+	protected    *list.List
+	protectedCap int
+	// Set once the segments got replaced.
+	retired bool
+}
+
+func newSegments(protectedCap int) *segments {
+	return &segments{
+		probation:    list.New(),
+		protected:    list.New(),
+		protectedCap: protectedCap,
+	}
+}
+
+// SetMaxItems limits the number of items this table holds. Once the limit is
+// exceeded, the least recently used item gets evicted, unless another
+// EvictionPolicy is configured. The AboutToDeleteItem callbacks see
+// RemovalEvicted as the reason. A limit of 0, which is the default, lets the
+// table grow without bounds.
+func (table *CacheTable) SetMaxItems(max int) {
+	table.Lock()
+	table.maxItems = max
+	table.resetSegments()
+	table.evictInternal(context.Background())
+	table.Unlock()
+}
+
+// SetSegmented enables segmented LRU eviction for capacity-bounded tables.
+// New items enter a probation segment and are only promoted to the protected
+// segment, which takes up the given fraction of the table's capacity, once
+// they get accessed again. This keeps one-off scans from evicting the
+// frequently used items. A fraction of 0 disables segmentation again.
+func (table *CacheTable) SetSegmented(protected float64) {
+	table.Lock()
+	defer table.Unlock()
+	table.protectedRatio = protected
+	table.resetSegments()
+}
+
+// SetEvictionSamples switches capacity-bounded tables to sampled eviction:
+// instead of keeping all items in a strictly ordered LRU list, the least
+// recently accessed of samples randomly picked items gets evicted, like Redis
+// does. This saves memory and list maintenance on every access for very
+// large tables, at the cost of only approximating LRU. More samples get
+// closer to LRU, 5 is a sensible default. Segmented eviction doesn't apply
+// while sampling. A value of 0 restores strict LRU eviction.
+func (table *CacheTable) SetEvictionSamples(samples int) {
+	table.Lock()
+	defer table.Unlock()
+	table.evictionSamples = samples
+	table.resetSegments()
+}
+
+// Rebuilds the eviction segments from scratch, with all items ordered by
+// their last access.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) resetSegments() {
+	if old := table.segments; old != nil {
+		// Keep concurrent accesses from touching the items meanwhile.
+		old.Lock()
+		defer old.Unlock()
+		old.retired = true
+	}
+	table.segments = nil
+	table.policy = nil
+	if (table.maxItems <= 0 && table.maxMemory <= 0) || (table.evictionSamples > 0 && table.newPolicy == nil) {
+		return
+	}
+
+	items := make([]*CacheItem, 0, table.items.len())
+	table.items.each(func(item *CacheItem) {
+		if !item.removing {
+			items = append(items, item)
+		}
+	})
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].AccessedOn().Before(items[j].AccessedOn())
+	})
+
+	if table.newPolicy != nil {
+		p := table.newPolicy()
+		for _, item := range items {
+			p.OnAdd(item)
+		}
+		table.policy = p
+		return
+	}
+
+	s := newSegments(int(table.protectedRatio * float64(table.maxItems)))
+	for _, item := range items {
+		item.segment = s.probation.PushFront(item)
+		item.protected = false
+	}
+	table.segments = s
+}
+
+// Registers a newly added item with the eviction segments.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) segmentsAdd(item *CacheItem) {
+	if table.policy != nil {
+		table.policy.OnAdd(item)
+		return
+	}
+	s := table.segments
+	if s == nil {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	item.segment = s.probation.PushFront(item)
+}
+
+// Unregisters a removed item from the eviction segments.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) segmentsRemove(item *CacheItem) {
+	if table.policy != nil {
+		table.policy.OnRemove(item)
+		return
+	}
+	s := table.segments
+	if s == nil {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if item.segment == nil {
+		return
+	}
+	if item.protected {
+		s.protected.Remove(item.segment)
+	} else {
+		s.probation.Remove(item.segment)
+	}
+	item.segment = nil
+	item.protected = false
+}
+
+// Updates the eviction segments after an item got accessed.
+func (table *CacheTable) segmentsAccess(item *CacheItem) {
+	table.RLock()
+	s := table.segments
+	p := table.policy
+	table.RUnlock()
+	if p != nil {
+		p.OnAccess(item)
+		return
+	}
+	if s == nil {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	e := item.segment
+	if e == nil || s.retired {
+		// Item or segments have been removed meanwhile.
+		return
+	}
+
+	if item.protected {
+		s.protected.MoveToFront(e)
+	} else {
+		// Item was on probation and gets promoted.
+		s.probation.Remove(e)
+		item.segment = s.protected.PushFront(item)
+		item.protected = true
+	}
+
+	for s.protected.Len() > s.protectedCap {
+		demoted := s.protected.Remove(s.protected.Back()).(*CacheItem)
+		demoted.segment = s.probation.PushFront(demoted)
+		demoted.protected = false
+	}
+}
+
+// Returns the item which should be evicted next.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) evictionVictim() *CacheItem {
+	if table.policy != nil {
+		return table.policy.Victim()
+	}
+	if table.evictionSamples > 0 {
+		return table.sampledVictim()
+	}
+
+	s := table.segments
+	if s == nil {
+		return nil
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if e := s.probation.Back(); e != nil {
+		return e.Value.(*CacheItem)
+	}
+	if e := s.protected.Back(); e != nil {
+		return e.Value.(*CacheItem)
+	}
+	return nil
+}
+
+// Returns the least recently accessed of randomly sampled items.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) sampledVictim() *CacheItem {
+	n := table.items.len()
+	if n == 0 {
+		return nil
+	}
+
+	var victim *CacheItem
+	var victimAccessedOn time.Time
+	for i := 0; i < table.evictionSamples; i++ {
+		item := table.items.at(rand.Intn(n))
+		if item.removing {
+			continue
+		}
+		item.RLock()
+		accessedOn := item.accessedOn
+		item.RUnlock()
+		if victim == nil || accessedOn.Before(victimAccessedOn) {
+			victim, victimAccessedOn = item, accessedOn
+		}
+	}
+	return victim
+}
+
+// Evicts items until the table is within its capacity and memory budget
+// again.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) evictInternal(ctx context.Context) {
+	for table.maxItems > 0 && table.items.len()-table.removingItems > table.maxItems {
+		victim := table.evictionVictim()
+		if victim == nil {
+			return
+		}
+		table.deleteInternal(ctx, victim.key, RemovalEvicted)
+	}
+	for table.exceedsMemory() {
+		victim := table.manualVictim()
+		if victim == nil {
+			return
+		}
+		table.deleteInternal(ctx, victim.key, RemovalEvicted)
+	}
+}
+
+// EvictTo synchronously evicts items until at most targetItems are left,
+// e.g. from memory-pressure handlers, and returns how many it evicted. The
+// items get picked like by the table's capacity limit, or least recently
+// accessed first if the table has none.
+func (table *CacheTable) EvictTo(targetItems int) int {
+	table.Lock()
+	defer table.Unlock()
+
+	n := 0
+	for table.items.len()-table.removingItems > targetItems {
+		victim := table.manualVictim()
+		if victim == nil {
+			break
+		}
+		table.deleteInternal(context.Background(), victim.key, RemovalEvicted)
+		n++
+	}
+	return n
+}
+
+// EvictBytes synchronously evicts items until their sizes, as given via
+// ItemBuilder.WithSize or estimated with EstimateSize, add up to at least n
+// bytes or the table is empty.
+// It picks the items like EvictTo and returns how many bytes it evicted.
+func (table *CacheTable) EvictBytes(n int64) int64 {
+	table.Lock()
+	defer table.Unlock()
+
+	var freed int64
+	for freed < n {
+		victim := table.manualVictim()
+		if victim == nil {
+			break
+		}
+		if _, err := table.deleteInternal(context.Background(), victim.key, RemovalEvicted); err == nil {
+			freed += victim.estimatedSize()
+		}
+	}
+	return freed
+}
+
+// Returns the item to evict next on request, falling back to the least
+// recently accessed item for tables without a capacity limit.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) manualVictim() *CacheItem {
+	if victim := table.evictionVictim(); victim != nil {
+		return victim
+	}
+
+	var victim *CacheItem
+	table.items.each(func(item *CacheItem) {
+		if item.removing {
+			return
+		}
+		item.RLock()
+		older := victim == nil || item.accessedOn.Before(victim.accessedOn)
+		item.RUnlock()
+		if older {
+			victim = item
+		}
+	})
+	return victim
+}
+
+// EvictionCandidates returns up to n items in the order they would get
+// evicted next, without evicting them, e.g. to check the eviction settings
+// against production data before enabling a capacity limit. Tables without
+// a limit and tables using sampled eviction report the least recently
+// accessed items, which sampled eviction approximates. Tables using a
+// custom EvictionPolicy report its candidates if it implements
+// EvictionPreviewer, and nothing otherwise. Items being removed are left out.
+func (table *CacheTable) EvictionCandidates(n int) []*CacheItem {
+	table.RLock()
+	defer table.RUnlock()
+
+	if n <= 0 {
+		return nil
+	}
+	if table.policy != nil {
+		if p, ok := table.policy.(EvictionPreviewer); ok {
+			return p.Candidates(n)
+		}
+		return nil
+	}
+	var r []*CacheItem
+	if s := table.segments; s != nil {
+		s.Lock()
+		defer s.Unlock()
+		for _, l := range []*list.List{s.probation, s.protected} {
+			for e := l.Back(); e != nil && len(r) < n; e = e.Prev() {
+				r = append(r, e.Value.(*CacheItem))
+			}
+		}
+		return r
+	}
+
+	r = make([]*CacheItem, 0, table.items.len())
+	table.items.each(func(item *CacheItem) {
+		if !item.removing {
+			r = append(r, item)
+		}
+	})
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].AccessedOn().Before(r[j].AccessedOn())
+	})
+	if len(r) > n {
+		r = r[:n]
+	}
+	return r
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/muesli/cache2go"
+)
+
+// S3Store is a cache2go.SnapshotStore keeping snapshots in an S3 bucket. It
+// signs requests with AWS Signature Version 4 and only depends on the
+// standard library. Snapshots are buffered in memory before uploading, as S3
+// requires the payload's size and hash up front.
+type S3Store struct {
+	Endpoint  string // e.g. https://s3.eu-central-1.amazonaws.com
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Client    *http.Client
+}
+
+func (s *S3Store) Put(ctx context.Context, name string, r io.Reader) error {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, http.MethodPut, "/"+s.Bucket+"/"+name, nil, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Store) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, "/"+s.Bucket+"/"+name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3Store) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := s.do(ctx, http.MethodGet, "/"+s.Bucket, q, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range result.Contents {
+			names = append(names, c.Key)
+		}
+		if !result.IsTruncated {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// Sends a signed request and fails on non-2xx responses.
+func (s *S3Store) do(ctx context.Context, method, path string, query url.Values, body []byte) (*http.Response, error) {
+	u := s.Endpoint + path
+	if len(query) > 0 {
+		u += "?" + strings.Replace(query.Encode(), "+", "%20", -1)
+	}
+	req, err := http.NewRequest(method, u, strings.NewReader(string(body)))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	s.sign(req, body, time.Now().UTC())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", method, path, resp.Status, msg)
+	}
+	return resp, nil
+}
+
+// Adds an AWS Signature Version 4 to the request.
+func (s *S3Store) sign(req *http.Request, body []byte, now time.Time) {
+	date := now.Format("20060102")
+	stamp := now.Format("20060102T150405Z")
+	payload := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(payload[:])
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	headers := ""
+	for _, h := range signed {
+		headers += h + ":" + strings.TrimSpace(req.Header.Get(h)) + "\n"
+	}
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		headers,
+		strings.Join(signed, ";"),
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + s.SecretKey)
+	for _, part := range []string{date, s.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.AccessKey+"/"+scope+
+		", SignedHeaders="+strings.Join(signed, ";")+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func main() {
+	store := &S3Store{
+		Endpoint:  os.Getenv("S3_ENDPOINT"),
+		Region:    os.Getenv("S3_REGION"),
+		Bucket:    os.Getenv("S3_BUCKET"),
+		AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+	}
+	ctx := context.Background()
+	cache := cache2go.Cache("myCache")
+
+	// New instances bootstrap from the latest snapshot instead of starting
+	// cold.
+	name, err := cache.BootstrapSnapshot(ctx, store)
+	switch err {
+	case nil:
+		fmt.Println("Bootstrapped", cache.Count(), "items from", name)
+	case cache2go.ErrKeyNotFound:
+		fmt.Println("No snapshot yet, starting cold")
+	default:
+		fmt.Println("Error bootstrapping:", err)
+		return
+	}
+
+	cache.Add("someKey", 0, "This is a test!")
+
+	// Upload a snapshot, e.g. periodically or on shutdown.
+	name, err = cache.UploadSnapshot(ctx, store)
+	if err != nil {
+		fmt.Println("Error uploading snapshot:", err)
+		return
+	}
+	fmt.Println("Uploaded snapshot", name)
+}
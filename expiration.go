@@ -0,0 +1,86 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"time"
+)
+
+// ExpirationMode determines what the lifespans of a table's items count
+// from.
+type ExpirationMode int
+
+const (
+	// ExpireAfterAccess counts lifespans from the items' last access, so items
+	// only expire once they haven't been used for their lifespan. This is the
+	// default.
+	ExpireAfterAccess ExpirationMode = iota
+	// ExpireAfterWrite counts lifespans from the items' creation, so even
+	// frequently accessed items expire and get reloaded eventually.
+	ExpireAfterWrite
+)
+
+func (m ExpirationMode) String() string {
+	switch m {
+	case ExpireAfterAccess:
+		return "after-access"
+	case ExpireAfterWrite:
+		return "after-write"
+	}
+	return "unknown"
+}
+
+// ExpiryProvider can be implemented by values which carry their own caching
+// policy. Adding such a value to a table, directly or via the data-loader,
+// stores it with the lifespan returned by CacheTTL instead of the lifespan
+// passed along. A CacheTTL of 0 or less keeps the passed lifespan.
+type ExpiryProvider interface {
+	CacheTTL() time.Duration
+}
+
+// Returns the lifespan to store data with, as requested by the data itself
+// or else the given one.
+func lifeSpanFor(lifeSpan time.Duration, data interface{}) time.Duration {
+	if p, ok := data.(ExpiryProvider); ok {
+		if ttl := p.CacheTTL(); ttl > 0 {
+			return ttl
+		}
+	}
+	return lifeSpan
+}
+
+// SetExpirationMode configures what the lifespans of items added from now on
+// count from. To expire single items a fixed time after their creation
+// instead, build them with ItemBuilder.WithMaxLifeSpan.
+func (table *CacheTable) SetExpirationMode(mode ExpirationMode) {
+	table.Lock()
+	defer table.Unlock()
+	table.expirationMode = mode
+}
+
+// SetMaxLifeSpan caps the lifetime of items added from now on since their
+// creation, no matter how often they get accessed, like
+// ItemBuilder.WithMaxLifeSpan does for single items. Together with the
+// default ExpireAfterAccess mode, items expire after being idle for their
+// lifespan or once they reach the maximum lifetime, whichever comes first.
+// Items built with a maximum lifetime of their own keep it. A maximum of 0,
+// which is the default, leaves the items' lifetime unbounded.
+func (table *CacheTable) SetMaxLifeSpan(maxLifeSpan time.Duration) {
+	table.Lock()
+	defer table.Unlock()
+	table.maxLifeSpan = maxLifeSpan
+}
+
+// Applies the table's expiration settings to a newly added item.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) applyExpiration(item *CacheItem) {
+	item.afterWrite = table.expirationMode == ExpireAfterWrite
+	if item.maxLifeSpan == 0 {
+		item.maxLifeSpan = table.maxLifeSpan
+	}
+}
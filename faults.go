@@ -0,0 +1,99 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"time"
+)
+
+// FaultPoint identifies a place where a FaultInjector can interfere.
+type FaultPoint int
+
+const (
+	// FaultStore is hit before Value, Add and Delete access the table's
+	// items. Injected errors get returned by the operation.
+	FaultStore FaultPoint = iota
+	// FaultLoader is hit before the data-loader gets called. Injected errors
+	// get returned instead of loading the item.
+	FaultLoader
+	// FaultTimer is hit whenever the expiration timer fires. Injected errors
+	// skip that expiration check, stalling expiry until the timer gets
+	// re-armed, e.g. by adding an item expiring sooner.
+	FaultTimer
+)
+
+// String returns a human readable representation of the fault point.
+func (p FaultPoint) String() string {
+	switch p {
+	case FaultStore:
+		return "store"
+	case FaultLoader:
+		return "loader"
+	case FaultTimer:
+		return "timer"
+	}
+	return "unknown"
+}
+
+// FaultInjector lets tests simulate a slow or failing cache. Fault gets
+// called at each fault point with the key involved, nil for FaultTimer.
+// Blocking delays the operation, returning an error makes it fail. Fault
+// never gets called with the table-mutex held and must be safe for
+// concurrent use.
+type FaultInjector interface {
+	Fault(point FaultPoint, key interface{}) error
+}
+
+// FaultFunc adapts a function to a FaultInjector.
+type FaultFunc func(point FaultPoint, key interface{}) error
+
+// Fault calls f.
+func (f FaultFunc) Fault(point FaultPoint, key interface{}) error {
+	return f(point, key)
+}
+
+// InjectDelay returns a FaultInjector delaying every hit of point by d.
+func InjectDelay(point FaultPoint, d time.Duration) FaultInjector {
+	return FaultFunc(func(p FaultPoint, key interface{}) error {
+		if p == point {
+			time.Sleep(d)
+		}
+		return nil
+	})
+}
+
+// InjectFailure returns a FaultInjector failing every hit of point with err.
+func InjectFailure(point FaultPoint, err error) FaultInjector {
+	return FaultFunc(func(p FaultPoint, key interface{}) error {
+		if p == point {
+			return err
+		}
+		return nil
+	})
+}
+
+// Holds a FaultInjector, so it can be stored in an atomic.Value.
+type faultInjector struct {
+	FaultInjector
+}
+
+// SetFaultInjector installs f on this table, meant for testing how
+// applications cope with cache slowness and janitor stalls. Pass nil to
+// remove it again.
+func (table *CacheTable) SetFaultInjector(f FaultInjector) {
+	table.faults.Store(faultInjector{f})
+}
+
+// Hits a fault point, returning the injected error, if any.
+func (table *CacheTable) fault(point FaultPoint, key interface{}) error {
+	f, _ := table.faults.Load().(faultInjector)
+	if f.FaultInjector == nil {
+		return nil
+	}
+	return f.Fault(point, key)
+}
@@ -0,0 +1,108 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"context"
+	"time"
+)
+
+// NextToken returns a new fencing token for key. Tokens increase
+// monotonically, so drawing one before reading data from its source and
+// passing it to AddIfTokenNewer orders racing cache fills: data read earlier
+// can't overwrite data read later. Deleting the key fences out all tokens
+// drawn for it before, so fills racing with an invalidation get rejected as
+// well. The table remembers the newest token of a key until its item gets
+// removed and no token drawn for it is left unused, or the table gets
+// flushed.
+func (table *CacheTable) NextToken(key interface{}) uint64 {
+	key, err := table.resolveKey(key)
+
+	table.Lock()
+	defer table.Unlock()
+
+	table.lastToken++
+	if err == nil && table.items.check(key) == nil {
+		if table.fences == nil {
+			table.fences = newStore(table.hasher)
+		}
+		f, ok := table.fences.get(key)
+		if !ok {
+			// Fences are kept in a store of their own, wrapped in items
+			// holding the newest token drawn for their key.
+			f = &CacheItem{key: ownKey(key)}
+			table.fences.set(f)
+		}
+		f.data = table.lastToken
+	}
+	return table.lastToken
+}
+
+// AddIfTokenNewer adds a key/value pair like Add, but only if token, as
+// returned by NextToken, is newer than the token of the key's last fill or
+// deletion. Otherwise it fails with ErrStaleToken and leaves the table
+// untouched.
+func (table *CacheTable) AddIfTokenNewer(key interface{}, token uint64, lifeSpan time.Duration, data interface{}) (*CacheItem, error) {
+	return table.handle(context.Background(), &Request{Op: OpAdd, Key: key, LifeSpan: lifeSpan, Data: data, template: &CacheItem{token: token}})
+}
+
+// Checks the token of an item about to be added against the fence of its
+// key, and advances the fence on success.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) checkFence(item *CacheItem, token uint64) error {
+	if token <= table.tokenFloor {
+		return ErrStaleToken
+	}
+	if table.fences == nil {
+		table.fences = newStore(table.hasher)
+	}
+	f, ok := table.fences.get(item.key)
+	if !ok {
+		if token <= table.fenceFloor {
+			// The key's fence might have been pruned.
+			return ErrStaleToken
+		}
+		f = &CacheItem{key: item.key, data: uint64(0)}
+		table.fences.set(f)
+	}
+	if token <= f.token {
+		return ErrStaleToken
+	}
+	f.token = token
+	item.token = token
+	return nil
+}
+
+// Fences out all tokens drawn for a deleted key so far.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) fenceDeleted(key interface{}) {
+	if table.fences == nil {
+		return
+	}
+	if f, ok := table.fences.get(key); ok {
+		f.token = table.lastToken
+	}
+}
+
+// Drops the fence of a key whose item got removed, unless tokens drawn for
+// it are still outstanding. Keys without a fence reject the tokens it
+// fenced out, like the tokens drawn before a flush.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) pruneFence(key interface{}) {
+	if table.fences == nil {
+		return
+	}
+	f, ok := table.fences.get(key)
+	if !ok || f.data.(uint64) > f.token {
+		return
+	}
+	table.fences.remove(key)
+	if f.token > table.fenceFloor {
+		table.fenceFloor = f.token
+	}
+}
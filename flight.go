@@ -0,0 +1,98 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// An in-flight load of a single key.
+type flight struct {
+	done chan struct{}
+	item *CacheItem
+	err  error
+}
+
+var (
+	flightMu sync.Mutex
+	// In-flight loads per table. Loads are kept in a store per table, wrapped
+	// in items, so keys are matched just like the table matches them.
+	flights = make(map[*CacheTable]*store)
+)
+
+// Runs load for key, unless a load for the same key of this table is
+// already in flight, no matter via which code path. In that case it waits
+// for and shares the result of that load instead, unless ctx is done or the
+// operation timeout passes first. If ctx can be cancelled, load runs on its
+// own goroutine, so we can stop waiting for it as well once ctx is done. A
+// load we gave up on keeps running, so concurrent and later lookups of the
+// key can still share its result. The key must already be resolved.
+func (table *CacheTable) loadShared(ctx context.Context, key interface{}, load func() (*CacheItem, error)) (*CacheItem, error) {
+	table.RLock()
+	hasher := table.hasher
+	table.RUnlock()
+
+	flightMu.Lock()
+	s, ok := flights[table]
+	if !ok {
+		s = newStore(hasher)
+		flights[table] = s
+	}
+	if f, ok := s.get(key); ok {
+		flightMu.Unlock()
+		fl := f.data.(*flight)
+		if err := table.wait(ctx, table.operationTimeout(), fl.done); err != nil {
+			return nil, err
+		}
+		return fl.item, fl.err
+	}
+	fl := &flight{done: make(chan struct{}), err: ErrKeyNotFoundOrLoadable}
+	// The load may outlive the caller, who might reuse a []byte key.
+	key = ownKey(key)
+	f := &CacheItem{key: key, data: fl}
+	s.set(f)
+	flightMu.Unlock()
+
+	run := func() {
+		defer func() {
+			flightMu.Lock()
+			if cur, ok := s.get(key); ok && cur == f {
+				s.remove(key)
+			}
+			if s.len() == 0 && flights[table] == s {
+				delete(flights, table)
+			}
+			flightMu.Unlock()
+			close(fl.done)
+		}()
+
+		fl.item, fl.err = load()
+	}
+	if ctx.Done() == nil {
+		run()
+		return fl.item, fl.err
+	}
+
+	go run()
+	if err := table.wait(ctx, 0, fl.done); err != nil {
+		return nil, err
+	}
+	return fl.item, fl.err
+}
+
+// Carries the values of a context, but not its cancellation, so a load can be
+// completed after the lookup which started it gave up.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
@@ -0,0 +1,149 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// Items expiring within the same window of time.
+type generation struct {
+	end   time.Time
+	items map[*CacheItem]struct{}
+}
+
+// Buckets the expiring items of a table into generations.
+type generations struct {
+	window time.Duration
+	byEnd  map[int64]*generation
+	// End times of all generations in ascending order.
+	ends []int64
+}
+
+func newGenerations(window time.Duration) *generations {
+	return &generations{window: window, byEnd: make(map[int64]*generation)}
+}
+
+// SetGenerations switches this table to generational expiry for fixed-TTL
+// workloads like per-minute rollups. Expiring items get bucketed into
+// generations by the window of the given length their expiry falls into, and
+// expire together at the window's end, regardless of accesses. Expiring a
+// generation only touches its own items, instead of scanning the whole table
+// for expired ones. A window of 0 restores per-item expiry.
+func (table *CacheTable) SetGenerations(window time.Duration) {
+	table.Lock()
+	table.generations = nil
+	if window > 0 {
+		table.generations = newGenerations(window)
+	}
+	table.rebuildGenerations()
+	table.Unlock()
+
+	table.expirationCheck()
+}
+
+// Assigns an item to the generation its expiry falls into, if the table uses
+// generational expiry and the item expires at all.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) generationAdd(item *CacheItem) {
+	g := table.generations
+	if g == nil {
+		return
+	}
+
+	item.Lock()
+	defer item.Unlock()
+	item.generation = nil
+	now := time.Now()
+	remaining, expires := item.remaining(now)
+	if !expires {
+		return
+	}
+
+	end := now.Add(remaining).Truncate(g.window)
+	if end.Before(now.Add(remaining)) {
+		end = end.Add(g.window)
+	}
+	gen := g.byEnd[end.UnixNano()]
+	if gen == nil {
+		gen = &generation{end: end, items: make(map[*CacheItem]struct{})}
+		g.byEnd[end.UnixNano()] = gen
+		i := sort.Search(len(g.ends), func(i int) bool { return g.ends[i] >= end.UnixNano() })
+		g.ends = append(g.ends, 0)
+		copy(g.ends[i+1:], g.ends[i:])
+		g.ends[i] = end.UnixNano()
+	}
+	gen.items[item] = struct{}{}
+	item.generation = gen
+}
+
+// Removes an item from its generation.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) generationRemove(item *CacheItem) {
+	if table.generations == nil {
+		return
+	}
+	item.RLock()
+	gen := item.generation
+	item.RUnlock()
+	if gen != nil {
+		delete(gen.items, item)
+	}
+}
+
+// Reassigns all items to generations, or detaches them from their
+// generations if generational expiry got disabled.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) rebuildGenerations() {
+	if table.generations != nil {
+		table.generations = newGenerations(table.generations.window)
+	}
+	table.items.each(func(item *CacheItem) {
+		if table.generations != nil {
+			table.generationAdd(item)
+			return
+		}
+		item.Lock()
+		item.generation = nil
+		item.Unlock()
+	})
+}
+
+// Drops all generations which ended and returns the time until the next one
+// ends, or 0 if there is none.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) expireGenerations() time.Duration {
+	now := time.Now()
+	for {
+		// The table may get reconfigured while the mutex is released.
+		g := table.generations
+		if g == nil || len(g.ends) == 0 {
+			return 0
+		}
+		gen := g.byEnd[g.ends[0]]
+		if gen.end.After(now) {
+			return gen.end.Sub(now)
+		}
+
+		delete(g.byEnd, g.ends[0])
+		g.ends = g.ends[1:]
+		table.log("Expiring generation of", len(gen.items), "items ending", gen.end, "in table", table.name)
+
+		items := make([]*CacheItem, 0, len(gen.items))
+		for item := range gen.items {
+			if !item.removing {
+				items = append(items, item)
+			}
+		}
+		for _, item := range items {
+			table.deleteInternal(context.Background(), item.key, RemovalExpired)
+		}
+	}
+}
@@ -0,0 +1,419 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemberState describes whether a cluster member is reachable.
+type MemberState int
+
+const (
+	// MemberAlive means the member recently sent heartbeats.
+	MemberAlive MemberState = iota
+	// MemberFailed means no heartbeats were seen for the failure timeout.
+	MemberFailed
+	// MemberLeft means the member left the cluster voluntarily.
+	MemberLeft
+)
+
+// String returns a human readable representation of the member state.
+func (s MemberState) String() string {
+	switch s {
+	case MemberAlive:
+		return "alive"
+	case MemberFailed:
+		return "failed"
+	case MemberLeft:
+		return "left"
+	}
+	return "unknown"
+}
+
+// Member is a node of a gossip cluster.
+type Member struct {
+	Name  string
+	Addr  string
+	State MemberState
+}
+
+// GossipTransport delivers gossip messages between nodes, e.g. via UDP.
+type GossipTransport interface {
+	// Addr returns the address other nodes reach this one at.
+	Addr() string
+	// Send delivers a message to the node at addr, on a best effort basis.
+	Send(addr string, msg []byte) error
+	// Messages returns the channel incoming messages are delivered on. It
+	// gets closed when the transport is closed.
+	Messages() <-chan []byte
+	Close() error
+}
+
+// GossipConfig configures a node of a gossip cluster.
+type GossipConfig struct {
+	// Name uniquely identifies the node within the cluster.
+	Name string
+	// Interval determines how often the node gossips, 200ms by default.
+	Interval time.Duration
+	// FailureTimeout determines after how long without heartbeats a member
+	// is considered failed, ten intervals by default.
+	FailureTimeout time.Duration
+	// Fanout is the number of members gossiped to per interval, 3 by default.
+	Fanout int
+	// OnJoin and OnLeave, if set, get called when a member joins, or when it
+	// leaves or fails. They must not block.
+	OnJoin  func(m Member)
+	OnLeave func(m Member)
+}
+
+// Gossip maintains the membership of a self-organizing cluster, e.g. to find
+// the peers to replicate tables to, without static configuration. Nodes
+// periodically exchange their member lists with heartbeat counters, members
+// whose heartbeats stop are detected as failed.
+type Gossip struct {
+	sync.Mutex
+	cfg       GossipConfig
+	transport GossipTransport
+	heartbeat uint64
+	members   map[string]*gossipMember
+	left      bool
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+type gossipMember struct {
+	Member
+	heartbeat uint64
+	updated   time.Time
+}
+
+// The wire format of gossip messages.
+type gossipEntry struct {
+	Name      string `json:"name"`
+	Addr      string `json:"addr"`
+	Heartbeat uint64 `json:"heartbeat"`
+	Left      bool   `json:"left,omitempty"`
+}
+
+// NewGossip starts a cluster node communicating via transport. Call Join to
+// contact other nodes.
+func NewGossip(cfg GossipConfig, transport GossipTransport) *Gossip {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 200 * time.Millisecond
+	}
+	if cfg.FailureTimeout <= 0 {
+		cfg.FailureTimeout = 10 * cfg.Interval
+	}
+	if cfg.Fanout <= 0 {
+		cfg.Fanout = 3
+	}
+
+	g := &Gossip{
+		cfg:       cfg,
+		transport: transport,
+		// Starting with the current time makes sure a restarted node's
+		// heartbeats supersede the ones of its previous incarnation.
+		heartbeat: uint64(time.Now().UnixNano()),
+		members:   make(map[string]*gossipMember),
+		done:      make(chan struct{}),
+	}
+	g.wg.Add(2)
+	go g.receive()
+	go g.run()
+
+	return g
+}
+
+// Join contacts the nodes at the given addresses. It fails only if none of
+// them could be contacted.
+func (g *Gossip) Join(addrs ...string) error {
+	msg := g.message()
+	var err error
+	joined := false
+	for _, addr := range addrs {
+		if e := g.transport.Send(addr, msg); e != nil {
+			err = e
+		} else {
+			joined = true
+		}
+	}
+	if !joined && err != nil {
+		return err
+	}
+	return nil
+}
+
+// Leave announces to all members that this node leaves the cluster, and
+// stops it.
+func (g *Gossip) Leave() error {
+	g.Lock()
+	g.left = true
+	g.Unlock()
+
+	msg := g.message()
+	for _, m := range g.Members() {
+		if m.State == MemberAlive {
+			g.transport.Send(m.Addr, msg)
+		}
+	}
+	return g.Close()
+}
+
+// Close stops this node without announcing it, other members will detect it
+// as failed.
+func (g *Gossip) Close() error {
+	g.Lock()
+	select {
+	case <-g.done:
+		g.Unlock()
+		return errors.New("Gossip node already closed")
+	default:
+	}
+	close(g.done)
+	g.Unlock()
+
+	err := g.transport.Close()
+	g.wg.Wait()
+	return err
+}
+
+// LocalMember returns this node.
+func (g *Gossip) LocalMember() Member {
+	g.Lock()
+	defer g.Unlock()
+
+	m := Member{Name: g.cfg.Name, Addr: g.transport.Addr()}
+	if g.left {
+		m.State = MemberLeft
+	}
+	return m
+}
+
+// Members returns the other members known to this node, sorted by name.
+func (g *Gossip) Members() []Member {
+	g.Lock()
+	defer g.Unlock()
+
+	r := make([]Member, 0, len(g.members))
+	for _, m := range g.members {
+		r = append(r, m.Member)
+	}
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].Name < r[j].Name
+	})
+	return r
+}
+
+// Encodes this node's view of the cluster.
+func (g *Gossip) message() []byte {
+	g.Lock()
+	defer g.Unlock()
+
+	entries := []gossipEntry{{Name: g.cfg.Name, Addr: g.transport.Addr(), Heartbeat: g.heartbeat, Left: g.left}}
+	for _, m := range g.members {
+		if m.State != MemberFailed {
+			entries = append(entries, gossipEntry{Name: m.Name, Addr: m.Addr, Heartbeat: m.heartbeat, Left: m.State == MemberLeft})
+		}
+	}
+
+	b, _ := json.Marshal(entries)
+	return b
+}
+
+// Periodically sends heartbeats and detects failed members.
+func (g *Gossip) run() {
+	defer g.wg.Done()
+
+	ticker := time.NewTicker(g.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			g.tick()
+		case <-g.done:
+			return
+		}
+	}
+}
+
+func (g *Gossip) tick() {
+	g.Lock()
+	g.heartbeat++
+	now := time.Now()
+	var failed []Member
+	var peers []string
+	for name, m := range g.members {
+		switch {
+		case m.State == MemberAlive && now.Sub(m.updated) > g.cfg.FailureTimeout:
+			m.State = MemberFailed
+			failed = append(failed, m.Member)
+		case m.State != MemberAlive && now.Sub(m.updated) > 10*g.cfg.FailureTimeout:
+			// Forget about members which are gone for good.
+			delete(g.members, name)
+		case m.State == MemberAlive:
+			peers = append(peers, m.Addr)
+		}
+	}
+	g.Unlock()
+
+	for _, m := range failed {
+		if g.cfg.OnLeave != nil {
+			g.cfg.OnLeave(m)
+		}
+	}
+
+	rand.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+	if len(peers) > g.cfg.Fanout {
+		peers = peers[:g.cfg.Fanout]
+	}
+	msg := g.message()
+	for _, addr := range peers {
+		g.transport.Send(addr, msg)
+	}
+}
+
+// Merges incoming member lists.
+func (g *Gossip) receive() {
+	defer g.wg.Done()
+
+	for msg := range g.transport.Messages() {
+		var entries []gossipEntry
+		if err := json.Unmarshal(msg, &entries); err != nil {
+			continue
+		}
+		g.merge(entries)
+	}
+}
+
+func (g *Gossip) merge(entries []gossipEntry) {
+	var joined, left []Member
+
+	g.Lock()
+	now := time.Now()
+	for _, e := range entries {
+		if e.Name == g.cfg.Name {
+			continue
+		}
+
+		m, ok := g.members[e.Name]
+		if !ok {
+			if e.Left {
+				continue
+			}
+			m = &gossipMember{Member: Member{Name: e.Name, Addr: e.Addr}, heartbeat: e.Heartbeat, updated: now}
+			g.members[e.Name] = m
+			joined = append(joined, m.Member)
+			continue
+		}
+		if e.Heartbeat < m.heartbeat || (e.Heartbeat == m.heartbeat && !e.Left) {
+			continue
+		}
+
+		m.heartbeat = e.Heartbeat
+		m.Addr = e.Addr
+		m.updated = now
+		switch {
+		case e.Left && m.State != MemberLeft:
+			wasAlive := m.State == MemberAlive
+			m.State = MemberLeft
+			if wasAlive {
+				left = append(left, m.Member)
+			}
+		case !e.Left && m.State != MemberAlive:
+			m.State = MemberAlive
+			joined = append(joined, m.Member)
+		}
+	}
+	g.Unlock()
+
+	for _, m := range joined {
+		if g.cfg.OnJoin != nil {
+			g.cfg.OnJoin(m)
+		}
+	}
+	for _, m := range left {
+		if g.cfg.OnLeave != nil {
+			g.cfg.OnLeave(m)
+		}
+	}
+}
+
+// A GossipTransport using UDP.
+type udpTransport struct {
+	conn     *net.UDPConn
+	addr     string
+	messages chan []byte
+}
+
+// NewUDPTransport returns a GossipTransport sending and receiving UDP
+// datagrams on the given listen address, e.g. ":7946". Other nodes learn
+// about this one via advertiseAddr, e.g. "10.0.0.1:7946". It may be empty if
+// the listen address names a specific host, which then gets advertised
+// instead. Wildcard listen addresses like ":7946" can't be reached by others,
+// so they require an advertise address.
+func NewUDPTransport(listenAddr, advertiseAddr string) (GossipTransport, error) {
+	a, err := net.ResolveUDPAddr("udp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	if advertiseAddr == "" && (a.IP == nil || a.IP.IsUnspecified()) {
+		return nil, errors.New("Wildcard listen address requires an advertise address")
+	}
+	conn, err := net.ListenUDP("udp", a)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &udpTransport{conn: conn, addr: advertiseAddr, messages: make(chan []byte, 64)}
+	if t.addr == "" {
+		t.addr = conn.LocalAddr().String()
+	}
+	go func() {
+		defer close(t.messages)
+		buf := make([]byte, 65536)
+		for {
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			t.messages <- append([]byte(nil), buf[:n]...)
+		}
+	}()
+
+	return t, nil
+}
+
+func (t *udpTransport) Addr() string {
+	return t.addr
+}
+
+func (t *udpTransport) Send(addr string, msg []byte) error {
+	a, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	_, err = t.conn.WriteToUDP(msg, a)
+	return err
+}
+
+func (t *udpTransport) Messages() <-chan []byte {
+	return t.messages
+}
+
+func (t *udpTransport) Close() error {
+	return t.conn.Close()
+}
@@ -0,0 +1,318 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Hash is a map of fields stored as the data of a cache item, like a Redis
+// hash. It gets created by CacheTable.HSet or HSetMulti and vanishes once its
+// item expires. All its fields get read and written under the hash's own
+// lock, so multi-field operations are atomic.
+type Hash struct {
+	mu     sync.RWMutex
+	fields map[interface{}]interface{}
+	// When fields with a TTL expire, nil if none has one.
+	expires map[interface{}]time.Time
+}
+
+// Len returns the number of fields in this hash, including expired ones
+// which weren't removed yet.
+func (h *Hash) Len() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.fields)
+}
+
+// Estimates the size of this hash while holding its lock, see EstimateSize.
+func (h *Hash) estimateSize() int64 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return reflectSize(h)
+}
+
+// Returns the value of a field, unless it is missing or expired.
+// Careful: do not run this method unless the hash is at least read-locked!
+func (h *Hash) get(hkey interface{}, now time.Time) (interface{}, bool) {
+	hvalue, ok := h.fields[hkey]
+	if !ok {
+		return nil, false
+	}
+	if exp, ok := h.expires[hkey]; ok && !now.Before(exp) {
+		return nil, false
+	}
+	return hvalue, true
+}
+
+// Returns the item stored under key, keeping it alive. If there is none and
+// create is set, an item holding the data returned by create gets added with
+// the given lifespan, subject to the same checks as items added via Add.
+// Since create is only set for writes, read-only tables reject it right
+// away. Used by the helpers for structured data like hashes.
+func (table *CacheTable) container(key interface{}, lifeSpan time.Duration, create func() interface{}) (*CacheItem, error) {
+	if create != nil {
+		if err := table.checkWritable(); err != nil {
+			return nil, err
+		}
+	}
+	key, err := table.resolveKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	table.RLock()
+	item, ok := table.items.get(key)
+	table.RUnlock()
+	if !ok {
+		if create == nil {
+			return nil, ErrKeyNotFound
+		}
+		if item, err = table.addContainer(key, lifeSpan, create()); err != nil {
+			return nil, err
+		}
+	}
+	table.access(item, AccessDefault)
+
+	return item, nil
+}
+
+// Adds an item holding the container data under key, unless another item got
+// added meanwhile, and returns the item stored under key.
+func (table *CacheTable) addContainer(key interface{}, lifeSpan time.Duration, data interface{}) (*CacheItem, error) {
+	if err := table.validate(key, data); err != nil {
+		return nil, err
+	}
+	item := NewCacheItem(key, lifeSpan, data)
+
+	table.Lock()
+	if cur, ok := table.items.get(key); ok {
+		table.Unlock()
+		return cur, nil
+	}
+	if err := table.checkTombstone(item, nil); err != nil {
+		table.Unlock()
+		return nil, err
+	}
+	if table.defaultAboutToExpire != nil {
+		item.aboutToExpire = append(item.aboutToExpire, itemCallback{handle: newCallbackHandle(), fn: table.defaultAboutToExpire})
+	}
+	table.addInternal(context.Background(), item)
+	return item, nil
+}
+
+// Returns the hash stored under key and its item, keeping it alive. If there
+// is none and create is set, a hash with the given lifespan gets added.
+func (table *CacheTable) hash(key interface{}, lifeSpan time.Duration, create bool) (*CacheItem, *Hash, error) {
+	var newHash func() interface{}
+	if create {
+		newHash = func() interface{} {
+			return &Hash{fields: make(map[interface{}]interface{})}
+		}
+	}
+	item, err := table.container(key, lifeSpan, newHash)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	h, ok := item.data.(*Hash)
+	if !ok {
+		return nil, nil, ErrWrongType
+	}
+
+	return item, h, nil
+}
+
+// HSet sets a single field of the hash stored under key, creating the hash
+// with the given lifespan if it does not exist yet. It returns ErrWrongType
+// if key holds something other than a hash.
+func (table *CacheTable) HSet(key interface{}, lifeSpan time.Duration, hkey, hvalue interface{}) error {
+	return table.HSetMulti(key, lifeSpan, map[interface{}]interface{}{hkey: hvalue})
+}
+
+// HSetMulti atomically sets several fields of the hash stored under key, so
+// concurrent readers see either none or all of them. It works like HSet
+// otherwise.
+func (table *CacheTable) HSetMulti(key interface{}, lifeSpan time.Duration, fields map[interface{}]interface{}) error {
+	_, h, err := table.hash(key, lifeSpan, true)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for hkey, hvalue := range fields {
+		h.fields[hkey] = hvalue
+		delete(h.expires, hkey)
+	}
+
+	return nil
+}
+
+// HAddWithTTL sets a single field of the hash stored under key, which
+// expires after ttl independently of the hash and its other fields, like
+// Redis hash-field TTLs. Setting the field again via HSet or HSetMulti
+// removes its TTL. A hash that does not exist yet gets created without a
+// lifespan. Once all its fields expired, it gets removed though. It returns
+// ErrWrongType if key holds something other than a hash.
+func (table *CacheTable) HAddWithTTL(key, hkey, hvalue interface{}, ttl time.Duration) error {
+	item, h, err := table.hash(key, 0, true)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	h.fields[hkey] = hvalue
+	if h.expires == nil {
+		h.expires = make(map[interface{}]time.Time)
+	}
+	h.expires[hkey] = time.Now().Add(ttl)
+	h.mu.Unlock()
+
+	table.Lock()
+	if cur, ok := table.items.get(item.key); !ok || cur != item {
+		// The hash got removed meanwhile.
+		table.Unlock()
+		return nil
+	}
+	if table.fieldTTLs == nil {
+		table.fieldTTLs = make(map[*CacheItem]struct{})
+	}
+	table.fieldTTLs[item] = struct{}{}
+	expDur := table.cleanupInterval
+	table.Unlock()
+
+	// Re-arm the expiration timer if the field expires before the next check.
+	if expDur == 0 || ttl < expDur {
+		table.expirationCheck()
+	}
+
+	return nil
+}
+
+// Removes the expired fields of all hashes with field TTLs, and hashes whose
+// last fields expired, and returns the time until the next field expires, or 0
+// if none does.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) expireHashFields(now time.Time) time.Duration {
+	var next time.Duration
+	var empty []*CacheItem
+	for item := range table.fieldTTLs {
+		if cur, ok := table.items.get(item.key); !ok || cur != item {
+			delete(table.fieldTTLs, item)
+			continue
+		}
+		if item.removing {
+			continue
+		}
+
+		h := item.data.(*Hash)
+		h.mu.Lock()
+		expired := false
+		for hkey, exp := range h.expires {
+			if remaining := exp.Sub(now); remaining <= 0 {
+				delete(h.fields, hkey)
+				delete(h.expires, hkey)
+				expired = true
+			} else if next == 0 || remaining < next {
+				next = remaining
+			}
+		}
+		if len(h.expires) == 0 {
+			delete(table.fieldTTLs, item)
+		}
+		if expired && len(h.fields) == 0 {
+			// Hashes emptied via HDel stay.
+			empty = append(empty, item)
+		}
+		h.mu.Unlock()
+	}
+
+	for _, item := range empty {
+		table.deleteInternal(context.Background(), item.key, RemovalExpired)
+	}
+
+	return next
+}
+
+// HGet returns a single field of the hash stored under key. It returns
+// ErrKeyNotFound if the hash or the field does not exist.
+func (table *CacheTable) HGet(key, hkey interface{}) (interface{}, error) {
+	_, h, err := table.hash(key, 0, false)
+	if err != nil {
+		return nil, err
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	hvalue, ok := h.get(hkey, time.Now())
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+
+	return hvalue, nil
+}
+
+// HValues atomically returns several fields of the hash stored under key, or
+// all of them if no hkeys are given. Missing fields are left out of the
+// result. It returns ErrKeyNotFound if the hash does not exist.
+func (table *CacheTable) HValues(key interface{}, hkeys ...interface{}) (map[interface{}]interface{}, error) {
+	_, h, err := table.hash(key, 0, false)
+	if err != nil {
+		return nil, err
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	now := time.Now()
+	if len(hkeys) == 0 {
+		r := make(map[interface{}]interface{}, len(h.fields))
+		for hkey := range h.fields {
+			if hvalue, ok := h.get(hkey, now); ok {
+				r[hkey] = hvalue
+			}
+		}
+		return r, nil
+	}
+
+	r := make(map[interface{}]interface{}, len(hkeys))
+	for _, hkey := range hkeys {
+		if hvalue, ok := h.get(hkey, now); ok {
+			r[hkey] = hvalue
+		}
+	}
+
+	return r, nil
+}
+
+// HDel atomically removes fields from the hash stored under key and returns
+// how many of them existed. The hash itself stays, even if it is empty.
+func (table *CacheTable) HDel(key interface{}, hkeys ...interface{}) (int, error) {
+	if err := table.checkWritable(); err != nil {
+		return 0, err
+	}
+	_, h, err := table.hash(key, 0, false)
+	if err != nil {
+		return 0, err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := 0
+	for _, hkey := range hkeys {
+		if _, ok := h.fields[hkey]; ok {
+			delete(h.fields, hkey)
+			delete(h.expires, hkey)
+			n++
+		}
+	}
+
+	return n, nil
+}
@@ -0,0 +1,130 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// RemovalReason describes why an item got removed from a cache table.
+type RemovalReason int
+
+const (
+	// RemovalDeleted means the item was explicitly deleted.
+	RemovalDeleted RemovalReason = iota
+	// RemovalExpired means the item exceeded its lifespan.
+	RemovalExpired
+	// RemovalFlushed means the item was dropped when its table got flushed.
+	RemovalFlushed
+	// RemovalEvicted means the item was evicted to stay within the table's
+	// capacity.
+	RemovalEvicted
+)
+
+// String returns a human readable representation of the removal reason.
+func (r RemovalReason) String() string {
+	switch r {
+	case RemovalDeleted:
+		return "deleted"
+	case RemovalExpired:
+		return "expired"
+	case RemovalFlushed:
+		return "flushed"
+	case RemovalEvicted:
+		return "evicted"
+	}
+	return "unknown"
+}
+
+type removalReasonKey struct{}
+
+// RemovalReasonFromContext returns why an item gets removed, from the
+// context passed to AboutToDeleteItem callbacks added via
+// AddAboutToDeleteItemCallbackCtx.
+func RemovalReasonFromContext(ctx context.Context) (RemovalReason, bool) {
+	reason, ok := ctx.Value(removalReasonKey{}).(RemovalReason)
+	return reason, ok
+}
+
+// RemovedItem is a record of an item that got removed from a cache table.
+type RemovedItem struct {
+	Key        interface{}
+	CreatedOn  time.Time
+	AccessedOn time.Time
+	RemovedOn  time.Time
+	Reason     RemovalReason
+}
+
+// SetRemovedHistorySize configures how many removed items this table
+// remembers. A size of 0 disables the history, which is the default.
+func (table *CacheTable) SetRemovedHistorySize(size int) {
+	table.Lock()
+	defer table.Unlock()
+
+	table.history = nil
+	table.historyPos = 0
+	table.historyLen = 0
+	if size > 0 {
+		table.history = make([]RemovedItem, size)
+	}
+}
+
+// RecentlyRemoved returns up to count of the most recently removed items,
+// starting with the latest removal.
+func (table *CacheTable) RecentlyRemoved(count int) []RemovedItem {
+	table.RLock()
+	defer table.RUnlock()
+
+	if count > table.historyLen {
+		count = table.historyLen
+	}
+	if count <= 0 {
+		return nil
+	}
+
+	r := make([]RemovedItem, count)
+	for i := 0; i < count; i++ {
+		idx := (table.historyPos - 1 - i + len(table.history)) % len(table.history)
+		r[i] = table.history[idx]
+	}
+
+	return r
+}
+
+// Records a removed item in the history ring buffer and the churn counters.
+// Careful: do not run this method unless the table-mutex is locked and the
+// item is at least read-locked!
+func (table *CacheTable) recordRemoval(item *CacheItem, reason RemovalReason) {
+	switch reason {
+	case RemovalExpired:
+		atomic.AddInt64(&table.expirations, 1)
+	case RemovalEvicted:
+		atomic.AddInt64(&table.evictions, 1)
+	case RemovalDeleted:
+		atomic.AddInt64(&table.deletes, 1)
+	}
+	table.churnRemoved(item, reason)
+	if len(table.history) == 0 {
+		return
+	}
+
+	table.history[table.historyPos] = RemovedItem{
+		Key:        item.key,
+		CreatedOn:  item.createdOn,
+		AccessedOn: item.accessedOn,
+		RemovedOn:  time.Now(),
+		Reason:     reason,
+	}
+
+	table.historyPos = (table.historyPos + 1) % len(table.history)
+	if table.historyLen < len(table.history) {
+		table.historyLen++
+	}
+}
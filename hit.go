@@ -0,0 +1,45 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+// Holds a hit callback, so it can be stored in an atomic.Value.
+type hitCallback struct {
+	fn func(*CacheItem)
+}
+
+// SetOnHitCallback configures a callback, which will be called every time
+// Value or one of its variants serves an item straight from this table,
+// e.g. for usage billing. Items produced by the data-loader don't count as
+// hits. The callback runs on the caller's goroutine after the lookup
+// completed, so it must not block. Pass nil to remove it again.
+func (table *CacheTable) SetOnHitCallback(f func(*CacheItem)) {
+	table.onHit.Store(hitCallback{f})
+}
+
+// SetOnHitCallback configures a callback, which will be called every time
+// Value or one of its variants serves this item straight from the cache,
+// after the table's OnHit callback. Pass nil to remove it again.
+func (item *CacheItem) SetOnHitCallback(f func(*CacheItem)) {
+	item.Lock()
+	defer item.Unlock()
+	item.onHit = f
+}
+
+// Runs the OnHit callbacks for item.
+func (table *CacheTable) hit(item *CacheItem) {
+	if cb, _ := table.onHit.Load().(hitCallback); cb.fn != nil {
+		cb.fn(item)
+	}
+
+	item.RLock()
+	onHit := item.onHit
+	item.RUnlock()
+	if onHit != nil {
+		onHit(item)
+	}
+}
@@ -0,0 +1,135 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// HLC is a hybrid logical clock timestamp, versioning changes of replicated
+// tables. Timestamps are totally ordered: by wall clock, then logical
+// counter, then the ID of the replica that issued them.
+type HLC struct {
+	Wall    int64
+	Logical uint32
+	Node    string
+}
+
+// IsZero reports whether h is the zero timestamp.
+func (h HLC) IsZero() bool {
+	return h == HLC{}
+}
+
+// Less reports whether h is ordered before o.
+func (h HLC) Less(o HLC) bool {
+	if h.Wall != o.Wall {
+		return h.Wall < o.Wall
+	}
+	if h.Logical != o.Logical {
+		return h.Logical < o.Logical
+	}
+	return h.Node < o.Node
+}
+
+// Issues HLC timestamps for a replica.
+type hlcClock struct {
+	sync.Mutex
+	node string
+	last HLC
+}
+
+// Returns a timestamp for a local change.
+func (c *hlcClock) now() HLC {
+	c.Lock()
+	defer c.Unlock()
+
+	if wall := time.Now().UnixNano(); wall > c.last.Wall {
+		c.last = HLC{Wall: wall}
+	} else {
+		c.last.Logical++
+	}
+	c.last.Node = c.node
+	return c.last
+}
+
+// Advances the clock past a timestamp received from another replica.
+func (c *hlcClock) update(r HLC) {
+	c.Lock()
+	defer c.Unlock()
+
+	wall := time.Now().UnixNano()
+	switch {
+	case wall > c.last.Wall && wall > r.Wall:
+		c.last = HLC{Wall: wall}
+	case c.last.Wall == r.Wall:
+		if r.Logical > c.last.Logical {
+			c.last.Logical = r.Logical
+		}
+		c.last.Logical++
+	case c.last.Wall > r.Wall:
+		c.last.Logical++
+	default:
+		c.last = HLC{Wall: r.Wall, Logical: r.Logical + 1}
+	}
+	c.last.Node = c.node
+}
+
+// SetReplicaID enables versioning of this table's changes with hybrid logical
+// clock timestamps issued under the given replica ID, which must be unique
+// among the replicas of the table. Replicas then resolve concurrent writes to
+// the same key deterministically, by default the write with the later
+// timestamp wins. Replicate only sends changes made by this replica, so
+// replicas can exchange changes in both directions.
+func (table *CacheTable) SetReplicaID(id string) {
+	table.Lock()
+	defer table.Unlock()
+
+	table.clock = nil
+	if id != "" {
+		table.clock = &hlcClock{node: id}
+	}
+}
+
+// SetReplicationMerge configures a function merging the local and a
+// replicated value of a key, instead of keeping the one with the later
+// timestamp. For replicas to converge, the function must be commutative,
+// associative and idempotent, like a set union or a maximum.
+func (table *CacheTable) SetReplicationMerge(f func(key, local, remote interface{}) interface{}) {
+	table.Lock()
+	defer table.Unlock()
+	table.replicationMerge = f
+}
+
+// Version returns the HLC timestamp of the change which stored this item, if
+// its table has a replica ID.
+func (item *CacheItem) Version() HLC {
+	// immutable
+	return item.version
+}
+
+type changeVersionKey struct{}
+
+// Returns the version a replicated change carried, if ctx belongs to one.
+func changeVersion(ctx context.Context) (HLC, bool) {
+	v, ok := ctx.Value(changeVersionKey{}).(HLC)
+	return v, ok
+}
+
+// Returns the version for a change made with ctx.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) versionFor(ctx context.Context) HLC {
+	if v, ok := changeVersion(ctx); ok {
+		return v
+	}
+	if table.clock == nil {
+		return HLC{}
+	}
+	return table.clock.now()
+}
@@ -0,0 +1,68 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Immortals returns the items which never expire and were added longer than
+// olderThan ago, oldest first. Items without any lifespan stay in the table
+// until deleted explicitly, making them a common cause of slowly growing
+// memory usage.
+func (table *CacheTable) Immortals(olderThan time.Duration) []*CacheItem {
+	table.RLock()
+	defer table.RUnlock()
+
+	now := time.Now()
+	var r []*CacheItem
+	table.items.each(func(item *CacheItem) {
+		item.RLock()
+		_, expires := item.remaining(now)
+		item.RUnlock()
+
+		if !expires && now.Sub(item.createdOn) > olderThan {
+			r = append(r, item)
+		}
+	})
+
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].createdOn.Before(r[j].createdOn)
+	})
+	return r
+}
+
+// WatchImmortals checks for immortal items older than olderThan every
+// interval and calls f with them, if there are any, e.g. to log a warning.
+// Call the returned function to stop.
+func (table *CacheTable) WatchImmortals(olderThan, interval time.Duration, f func([]*CacheItem)) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if items := table.Immortals(olderThan); len(items) > 0 {
+					f(items)
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	var once int32
+	return func() {
+		if atomic.CompareAndSwapInt32(&once, 0, 1) {
+			close(done)
+		}
+	}
+}
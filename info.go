@@ -0,0 +1,124 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"sort"
+	"time"
+)
+
+// Info describes a cache table, so tables can be attributed to their owners
+// in processes with many of them.
+type Info struct {
+	// Owner is the team or component responsible for the table.
+	Owner string
+	// Purpose describes what the table caches.
+	Purpose string
+	// DefaultLifeSpan documents the lifespan items usually get.
+	DefaultLifeSpan time.Duration
+	// CreatedOn is when the table got created. It is set by the table.
+	CreatedOn time.Time
+}
+
+// Name returns the name of this table.
+func (table *CacheTable) Name() string {
+	// immutable
+	return table.name
+}
+
+// SetInfo attaches descriptive metadata to this table. Its CreatedOn field
+// gets ignored.
+func (table *CacheTable) SetInfo(info Info) {
+	table.Lock()
+	defer table.Unlock()
+	table.info = info
+}
+
+// Info returns the metadata attached to this table.
+func (table *CacheTable) Info() Info {
+	table.RLock()
+	defer table.RUnlock()
+
+	info := table.info
+	info.CreatedOn = table.createdOn
+	return info
+}
+
+// TableInfo summarizes the state of a cache table.
+type TableInfo struct {
+	Name string
+	Info Info
+	// Count is the number of items in the table.
+	Count int
+	// Hits and Misses count the lookups which were served, or not served,
+	// from the cache.
+	Hits   int64
+	Misses int64
+	// HitRatio is the fraction of lookups served from the cache.
+	HitRatio float64
+	// MemoryEstimate is a rough estimate of the memory used by the table's
+	// keys and values in bytes, extrapolated from a sample of items.
+	MemoryEstimate int64
+}
+
+// Number of items sampled to estimate a table's memory usage.
+const memorySampleSize = 64
+
+// ForEachTable calls f for every existing cache table, sorted by name.
+func ForEachTable(f func(table *CacheTable)) {
+	mutex.RLock()
+	tables := make([]*CacheTable, 0, len(cache))
+	for _, t := range cache {
+		tables = append(tables, t)
+	}
+	mutex.RUnlock()
+
+	sort.Slice(tables, func(i, j int) bool {
+		return tables[i].name < tables[j].name
+	})
+	for _, t := range tables {
+		f(t)
+	}
+}
+
+// TablesInfo returns a summary of every existing cache table, sorted by name.
+func TablesInfo() []TableInfo {
+	var r []TableInfo
+	ForEachTable(func(table *CacheTable) {
+		r = append(r, table.TableInfo())
+	})
+
+	return r
+}
+
+// TableInfo returns a summary of this table's state.
+func (table *CacheTable) TableInfo() TableInfo {
+	s := table.Stats()
+	ti := TableInfo{
+		Name:     table.name,
+		Info:     table.Info(),
+		Count:    s.Items,
+		Hits:     s.Hits,
+		Misses:   s.Misses,
+		HitRatio: s.HitRatio(),
+	}
+
+	sample := table.Sample(memorySampleSize)
+	if len(sample) > 0 {
+		var size int64
+		for _, item := range sample {
+			size += EstimateSize(item.key)
+			item.WithRLock(func(data interface{}) {
+				size += EstimateSize(data)
+			})
+		}
+		ti.MemoryEstimate = size * int64(ti.Count) / int64(len(sample))
+	}
+
+	return ti
+}
@@ -0,0 +1,194 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Message is a single record consumed from a message stream, such as a Kafka
+// partition or a NATS JetStream subject.
+type Message struct {
+	// Offset is the position of the message in the stream.
+	Offset int64
+	Key    []byte
+	// Value is the message's payload. A nil value is a tombstone, deleting
+	// the key.
+	Value []byte
+}
+
+// MessageStream is a stream of messages which can be resumed from an offset.
+// Adapters for Kafka, NATS or other message buses implement it.
+type MessageStream interface {
+	// Resume positions the stream so the next message returned has an offset
+	// of at least offset.
+	Resume(offset int64) error
+	// Next blocks until the next message is available. It returns io.EOF
+	// at the end of a finite stream.
+	Next(ctx context.Context) (Message, error)
+}
+
+// OffsetStore remembers how far a consumer got in a message stream, so
+// ingestion can resume where it left off.
+type OffsetStore interface {
+	// LoadOffset returns the offset stored under name, or ErrKeyNotFound.
+	LoadOffset(name string) (int64, error)
+	// SaveOffset stores offset under name.
+	SaveOffset(name string, offset int64) error
+}
+
+// IngestConfig configures Ingest.
+type IngestConfig struct {
+	// Offsets persists the offset of the next message to consume. Without
+	// it, ingestion always starts at offset 0.
+	Offsets OffsetStore
+	// Name is the name the offset gets stored under. It defaults to the
+	// table's name.
+	Name string
+	// CommitEvery is how many messages get applied between saving offsets.
+	// It defaults to 1.
+	CommitEvery int
+	// Decode turns a message into the change to apply. By default keys
+	// become strings, values get stored as []byte with the DefaultLifeSpan
+	// of the table's Info and nil values delete the key.
+	Decode func(m Message) (Change, error)
+}
+
+// Ingest applies the upserts and deletes consumed from stream to this table,
+// turning it into a continuously warmed read model. Like ApplyChanges it
+// bypasses the read-only check, so the table may be read-only for everyone
+// else. Messages that fail to decode get logged and skipped.
+//
+// It blocks until the stream ends, the context gets cancelled or the stream
+// fails, saving the offset before returning. It returns nil once the stream
+// returns io.EOF.
+func (table *CacheTable) Ingest(ctx context.Context, stream MessageStream, cfg IngestConfig) error {
+	if cfg.Name == "" {
+		cfg.Name = table.name
+	}
+	if cfg.CommitEvery <= 0 {
+		cfg.CommitEvery = 1
+	}
+	if cfg.Decode == nil {
+		cfg.Decode = table.decodeMessage
+	}
+
+	var offset int64
+	if cfg.Offsets != nil {
+		o, err := cfg.Offsets.LoadOffset(cfg.Name)
+		switch {
+		case err == nil:
+			offset = o
+		case err != ErrKeyNotFound:
+			return err
+		}
+	}
+	if err := stream.Resume(offset); err != nil {
+		return err
+	}
+
+	committed := offset
+	commit := func() error {
+		if cfg.Offsets == nil || offset == committed {
+			return nil
+		}
+		if err := cfg.Offsets.SaveOffset(cfg.Name, offset); err != nil {
+			return err
+		}
+		committed = offset
+		return nil
+	}
+
+	for pending := 0; ; pending++ {
+		if pending >= cfg.CommitEvery {
+			if err := commit(); err != nil {
+				return err
+			}
+			pending = 0
+		}
+
+		m, err := stream.Next(ctx)
+		if err == nil {
+			err = ctx.Err()
+		}
+		if err != nil {
+			if cerr := commit(); cerr != nil {
+				return cerr
+			}
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		c, err := cfg.Decode(m)
+		if err != nil {
+			table.log("Skipping message", m.Offset, "ingested by table", table.name, ":", err)
+		} else {
+			table.apply(c)
+		}
+		offset = m.Offset + 1
+	}
+}
+
+// The default message decoder.
+func (table *CacheTable) decodeMessage(m Message) (Change, error) {
+	key := string(m.Key)
+	if m.Value == nil {
+		return Change{Op: ChangeDelete, Key: key}, nil
+	}
+	return Change{Op: ChangeSet, Key: key, Data: m.Value, LifeSpan: table.Info().DefaultLifeSpan, Time: time.Now()}, nil
+}
+
+// DirOffsetStore is an OffsetStore keeping each offset in a file of its own
+// in a directory.
+type DirOffsetStore string
+
+// LoadOffset reads the offset from its file.
+func (d DirOffsetStore) LoadOffset(name string) (int64, error) {
+	b, err := ioutil.ReadFile(d.path(name))
+	if os.IsNotExist(err) {
+		return 0, ErrKeyNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+}
+
+// SaveOffset atomically replaces the offset's file.
+func (d DirOffsetStore) SaveOffset(name string, offset int64) error {
+	if err := os.MkdirAll(string(d), 0o755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(string(d), ".offset-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(strconv.FormatInt(offset, 10) + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), d.path(name))
+}
+
+func (d DirOffsetStore) path(name string) string {
+	return filepath.Join(string(d), filepath.Base(name)+".offset")
+}
@@ -0,0 +1,175 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// KeyCodec serializes keys for persistence and wire protocols. Encoding must
+// be deterministic, so equal keys always produce the same bytes, and decoding
+// must restore a key equal to the encoded one.
+type KeyCodec interface {
+	EncodeKey(key interface{}) ([]byte, error)
+	DecodeKey(b []byte) (interface{}, error)
+}
+
+// TypedKeyCodec is a KeyCodec prefixing every key with its type, so strings,
+// byte slices, booleans and all integer and float types round-trip with their
+// exact type. Other types, like structs, must be registered by name and get
+// encoded as JSON.
+type TypedKeyCodec struct {
+	mu    sync.RWMutex
+	names map[reflect.Type]string
+	types map[string]reflect.Type
+}
+
+// DefaultKeyCodec is the KeyCodec tables use unless configured otherwise.
+var DefaultKeyCodec = NewTypedKeyCodec()
+
+// NewTypedKeyCodec returns a new TypedKeyCodec.
+func NewTypedKeyCodec() *TypedKeyCodec {
+	return &TypedKeyCodec{
+		names: make(map[reflect.Type]string),
+		types: make(map[string]reflect.Type),
+	}
+}
+
+// Register makes keys of the prototype's type encodable under the given name.
+// The name must be stable across processes and versions.
+func (c *TypedKeyCodec) Register(name string, prototype interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := reflect.TypeOf(prototype)
+	c.names[t] = name
+	c.types[name] = t
+}
+
+// EncodeKey encodes key as its type name, a colon and the value.
+func (c *TypedKeyCodec) EncodeKey(key interface{}) ([]byte, error) {
+	var name, value string
+	switch k := key.(type) {
+	case string:
+		name, value = "string", k
+	case []byte:
+		name, value = "bytes", string(k)
+	case bool:
+		name, value = "bool", strconv.FormatBool(k)
+	case int, int8, int16, int32, int64:
+		name, value = reflect.TypeOf(k).String(), strconv.FormatInt(reflect.ValueOf(k).Int(), 10)
+	case uint, uint8, uint16, uint32, uint64, uintptr:
+		name, value = reflect.TypeOf(k).String(), strconv.FormatUint(reflect.ValueOf(k).Uint(), 10)
+	case float32:
+		name, value = "float32", strconv.FormatFloat(float64(k), 'g', -1, 32)
+	case float64:
+		name, value = "float64", strconv.FormatFloat(k, 'g', -1, 64)
+	default:
+		c.mu.RLock()
+		n, ok := c.names[reflect.TypeOf(key)]
+		c.mu.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("%w: %T", ErrUnsupportedKey, key)
+		}
+		b, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		name, value = "json."+n, string(b)
+	}
+
+	return []byte(name + ":" + value), nil
+}
+
+// DecodeKey decodes a key encoded by EncodeKey.
+func (c *TypedKeyCodec) DecodeKey(b []byte) (interface{}, error) {
+	i := bytes.IndexByte(b, ':')
+	if i < 0 {
+		return nil, fmt.Errorf("%w: missing type", ErrUnsupportedKey)
+	}
+	name, value := string(b[:i]), string(b[i+1:])
+
+	var k interface{}
+	var err error
+	switch name {
+	case "string":
+		return value, nil
+	case "bytes":
+		return []byte(value), nil
+	case "bool":
+		k, err = strconv.ParseBool(value)
+	case "int", "int8", "int16", "int32", "int64":
+		var n int64
+		n, err = strconv.ParseInt(value, 10, intTypes[name].Bits())
+		k = reflect.ValueOf(n).Convert(intTypes[name]).Interface()
+	case "uint", "uint8", "uint16", "uint32", "uint64", "uintptr":
+		var n uint64
+		n, err = strconv.ParseUint(value, 10, intTypes[name].Bits())
+		k = reflect.ValueOf(n).Convert(intTypes[name]).Interface()
+	case "float32":
+		var f float64
+		f, err = strconv.ParseFloat(value, 32)
+		k = float32(f)
+	case "float64":
+		k, err = strconv.ParseFloat(value, 64)
+	default:
+		c.mu.RLock()
+		t, ok := c.types[strings.TrimPrefix(name, "json.")]
+		c.mu.RUnlock()
+		if !ok || !strings.HasPrefix(name, "json.") {
+			return nil, fmt.Errorf("%w: unknown type %q", ErrUnsupportedKey, name)
+		}
+		p := reflect.New(t)
+		err = json.Unmarshal([]byte(value), p.Interface())
+		k = p.Elem().Interface()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// The integer types supported by TypedKeyCodec, by name.
+var intTypes = map[string]reflect.Type{
+	"int":     reflect.TypeOf(int(0)),
+	"int8":    reflect.TypeOf(int8(0)),
+	"int16":   reflect.TypeOf(int16(0)),
+	"int32":   reflect.TypeOf(int32(0)),
+	"int64":   reflect.TypeOf(int64(0)),
+	"uint":    reflect.TypeOf(uint(0)),
+	"uint8":   reflect.TypeOf(uint8(0)),
+	"uint16":  reflect.TypeOf(uint16(0)),
+	"uint32":  reflect.TypeOf(uint32(0)),
+	"uint64":  reflect.TypeOf(uint64(0)),
+	"uintptr": reflect.TypeOf(uintptr(0)),
+}
+
+// SetKeyCodec configures how this table serializes keys for persistence and
+// wire protocols. Pass nil to use DefaultKeyCodec.
+func (table *CacheTable) SetKeyCodec(c KeyCodec) {
+	table.Lock()
+	defer table.Unlock()
+	table.keyCodec = c
+}
+
+// KeyCodec returns the KeyCodec this table serializes keys with.
+func (table *CacheTable) KeyCodec() KeyCodec {
+	table.RLock()
+	defer table.RUnlock()
+	if table.keyCodec == nil {
+		return DefaultKeyCodec
+	}
+	return table.keyCodec
+}
@@ -0,0 +1,194 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// KeyTemplate is a pattern for string keys like "user:{id}:profile". Each
+// placeholder in braces matches the non-empty text up to the literal text
+// following it in the pattern.
+type KeyTemplate struct {
+	pattern string
+	// Literal text surrounding the placeholders, one more than params.
+	literals []string
+	params   []string
+}
+
+// ParseKeyTemplate parses a key template. Placeholders need unique,
+// non-empty names and must be separated by literal text, so every key
+// matches in only one way.
+func ParseKeyTemplate(pattern string) (*KeyTemplate, error) {
+	t := &KeyTemplate{pattern: pattern}
+	seen := make(map[string]bool)
+	rest := pattern
+	for {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			break
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("%w %q: unterminated placeholder", ErrInvalidKeyTemplate, pattern)
+		}
+		literal, name := rest[:open], rest[open+1:open+end]
+		switch {
+		case strings.ContainsAny(literal, "}"):
+			return nil, fmt.Errorf("%w %q: unbalanced braces", ErrInvalidKeyTemplate, pattern)
+		case name == "" || strings.ContainsAny(name, "{"):
+			return nil, fmt.Errorf("%w %q: invalid placeholder name %q", ErrInvalidKeyTemplate, pattern, name)
+		case seen[name]:
+			return nil, fmt.Errorf("%w %q: duplicate placeholder %q", ErrInvalidKeyTemplate, pattern, name)
+		case literal == "" && len(t.params) > 0:
+			return nil, fmt.Errorf("%w %q: placeholders %q and %q are not separated", ErrInvalidKeyTemplate, pattern, t.params[len(t.params)-1], name)
+		}
+		seen[name] = true
+		t.literals = append(t.literals, literal)
+		t.params = append(t.params, name)
+		rest = rest[open+end+1:]
+	}
+	if strings.ContainsAny(rest, "}") {
+		return nil, fmt.Errorf("%w %q: unbalanced braces", ErrInvalidKeyTemplate, pattern)
+	}
+	t.literals = append(t.literals, rest)
+	return t, nil
+}
+
+// String returns the template's pattern.
+func (t *KeyTemplate) String() string {
+	return t.pattern
+}
+
+// Params returns the names of the template's placeholders in the order they
+// appear in.
+func (t *KeyTemplate) Params() []string {
+	return append([]string(nil), t.params...)
+}
+
+// Match reports whether key matches the template and returns the values of
+// its placeholders.
+func (t *KeyTemplate) Match(key string) (map[string]string, bool) {
+	if !strings.HasPrefix(key, t.literals[0]) {
+		return nil, false
+	}
+	rest := key[len(t.literals[0]):]
+	params := make(map[string]string, len(t.params))
+	for i, name := range t.params {
+		literal := t.literals[i+1]
+		var n int
+		if i == len(t.params)-1 {
+			// The last placeholder extends up to the trailing literal.
+			if !strings.HasSuffix(rest, literal) {
+				return nil, false
+			}
+			n = len(rest) - len(literal)
+		} else if n = strings.Index(rest, literal); n < 0 {
+			return nil, false
+		}
+		if n == 0 {
+			return nil, false
+		}
+		params[name] = rest[:n]
+		rest = rest[n+len(literal):]
+	}
+	if len(t.params) == 0 && rest != "" {
+		return nil, false
+	}
+	return params, true
+}
+
+// Reports whether both templates consist of the same literal text, so
+// they match the very same keys.
+func (t *KeyTemplate) conflicts(o *KeyTemplate) bool {
+	if len(t.literals) != len(o.literals) {
+		return false
+	}
+	for i := range t.literals {
+		if t.literals[i] != o.literals[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// KeyLoaderFunc loads the item for a key matching a template registered via
+// AddKeyLoader. It receives the values of the template's placeholders, so it
+// doesn't need to parse the key itself.
+type KeyLoaderFunc func(ctx context.Context, key string, params map[string]string, args ...interface{}) *CacheItem
+
+// A data-loader registered for a key template.
+type keyLoader struct {
+	template *KeyTemplate
+	load     KeyLoaderFunc
+}
+
+// AddKeyLoader registers a data-loader for the string keys matching the
+// template pattern, see ParseKeyTemplate. Lookups of missing keys try the
+// key loaders in the order they got registered and fall back to the loader
+// configured via SetDataLoader for keys matching none of them. Invalid
+// patterns, as well as patterns matching the same keys as an already
+// registered one, fail with an error wrapping ErrInvalidKeyTemplate.
+func (table *CacheTable) AddKeyLoader(pattern string, f KeyLoaderFunc) error {
+	t, err := ParseKeyTemplate(pattern)
+	if err != nil {
+		return err
+	}
+
+	table.Lock()
+	defer table.Unlock()
+	for _, l := range table.keyLoaders {
+		if t.conflicts(l.template) {
+			return fmt.Errorf("%w %q: conflicts with %q", ErrInvalidKeyTemplate, pattern, l.template.pattern)
+		}
+	}
+	table.keyLoaders = append(table.keyLoaders, keyLoader{template: t, load: f})
+	return nil
+}
+
+// RemoveKeyLoader removes the data-loader registered for pattern. It returns
+// false if there is none.
+func (table *CacheTable) RemoveKeyLoader(pattern string) bool {
+	table.Lock()
+	defer table.Unlock()
+	for i, l := range table.keyLoaders {
+		if l.template.pattern == pattern {
+			table.keyLoaders = append(table.keyLoaders[:i:i], table.keyLoaders[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the data-loader for lookups, trying the key loaders before the
+// table's data-loader.
+// Careful: do not run this method unless the table-mutex is at least
+// read-locked!
+func (table *CacheTable) dataLoader() func(context.Context, interface{}, ...interface{}) *CacheItem {
+	loadData := table.loadData
+	keyLoaders := table.keyLoaders
+	if len(keyLoaders) == 0 {
+		return loadData
+	}
+
+	return func(ctx context.Context, key interface{}, args ...interface{}) *CacheItem {
+		if s, ok := key.(string); ok {
+			for _, l := range keyLoaders {
+				if params, ok := l.template.Match(s); ok {
+					return l.load(ctx, s, params, args...)
+				}
+			}
+		}
+		if loadData == nil {
+			return nil
+		}
+		return loadData(ctx, key, args...)
+	}
+}
@@ -0,0 +1,118 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+// SetKeyNormalizer configures a callback, which maps every key passed to
+// this table to its canonical form before it gets used, e.g. to lower-case
+// strings. Items are stored under their normalized key, so data-loaders,
+// validators and callbacks all see the normalized key. The normalizer must
+// not access the table itself.
+func (table *CacheTable) SetKeyNormalizer(f func(key interface{}) interface{}) {
+	table.Lock()
+	defer table.Unlock()
+	table.normalizeKeyFunc = f
+}
+
+// SetHasher configures custom hashing and equality for the keys of this
+// table. Items already in the table get rehashed; of several items with keys
+// that are equal according to the new Hasher only one is kept. Pass nil to
+// restore Go's map semantics.
+func (table *CacheTable) SetHasher(h Hasher) {
+	table.Lock()
+	defer table.Unlock()
+
+	items := newStore(h)
+	table.items.each(func(item *CacheItem) {
+		if items.check(item.key) == nil {
+			items.set(item)
+		}
+	})
+	sizes := table.currentSizes()
+	table.items = items
+	table.rebuildPathIndex()
+	table.rebuildNamespaces(sizes)
+	table.rebuildMemory(sizes)
+	table.updateCount()
+	table.hasher = h
+
+	if table.leases != nil {
+		leases := newStore(h)
+		table.leases.each(func(item *CacheItem) {
+			if leases.check(item.key) == nil {
+				leases.set(item)
+			}
+		})
+		table.leases = leases
+	}
+	if table.fences != nil {
+		fences := newStore(h)
+		table.fences.each(func(item *CacheItem) {
+			if fences.check(item.key) == nil {
+				fences.set(item)
+			}
+		})
+		table.fences = fences
+	}
+	if table.tombstones != nil {
+		tombstones := newStore(h)
+		table.tombstones.each(func(item *CacheItem) {
+			if tombstones.check(item.key) == nil {
+				tombstones.set(item)
+			}
+		})
+		table.tombstones = tombstones
+	}
+	if table.aliases != nil {
+		aliases := newStore(h)
+		table.aliases.each(func(item *CacheItem) {
+			if aliases.check(item.key) == nil {
+				aliases.set(item)
+			}
+		})
+		table.aliases = aliases
+	}
+	table.resetSegments()
+}
+
+// Maps key to its canonical form, using the configured normalizer, and
+// verifies that it can be used with this table. Without a custom Hasher,
+// keys must be valid Go map keys, otherwise ErrUnhashableKey is returned.
+func (table *CacheTable) normalizeKey(key interface{}) (interface{}, error) {
+	table.RLock()
+	normalize := table.normalizeKeyFunc
+	items := table.items
+	table.RUnlock()
+
+	if normalize != nil {
+		key = normalize(key)
+	}
+	return key, items.check(key)
+}
+
+// Works like normalizeKey, but additionally maps aliases to the key of the
+// item they refer to.
+func (table *CacheTable) resolveKey(key interface{}) (interface{}, error) {
+	key, err := table.normalizeKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	table.RLock()
+	defer table.RUnlock()
+	key, _ = table.unalias(key)
+	return key, nil
+}
+
+// Returns key, copying it if it's a []byte, so items don't share the
+// caller's slice. Network code in particular tends to reuse its buffers.
+func ownKey(key interface{}) interface{} {
+	if b, ok := key.([]byte); ok {
+		return append([]byte(nil), b...)
+	}
+	return key
+}
@@ -0,0 +1,296 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ReadStrategy determines which levels of a Layered cache lookups consult.
+type ReadStrategy int
+
+const (
+	// ReadThrough tries L1 first and L2 second. This is the default.
+	ReadThrough ReadStrategy = iota
+	// ReadL1Only only consults L1, for data where a miss is cheaper than the
+	// latency of L2.
+	ReadL1Only
+	// ReadFastest queries both levels in parallel and returns whichever hit
+	// arrives first, for data where latency matters more than the load on L2.
+	ReadFastest
+)
+
+func (s ReadStrategy) String() string {
+	switch s {
+	case ReadThrough:
+		return "read-through"
+	case ReadL1Only:
+		return "l1-only"
+	case ReadFastest:
+		return "fastest"
+	}
+	return "unknown"
+}
+
+// WriteStrategy determines how writes to a Layered cache reach its levels.
+type WriteStrategy int
+
+const (
+	// WriteBoth writes L2 and then L1 before returning. This is the default.
+	WriteBoth WriteStrategy = iota
+	// WriteL1Async writes L1 before returning and L2 in the background, in
+	// the order the writes happened. Until then, L2 and other processes
+	// sharing it may miss the writes.
+	WriteL1Async
+)
+
+func (s WriteStrategy) String() string {
+	switch s {
+	case WriteBoth:
+		return "both"
+	case WriteL1Async:
+		return "l1-async"
+	}
+	return "unknown"
+}
+
+// Layered stacks two caches: a small and fast one in front (L1), e.g. a
+// local table, and a larger or shared one behind it (L2), e.g. a mirror of
+// a central writer. By default, lookups try L1 first and copy hits from L2
+// into it, writes go to both levels. Since datasets differ in the
+// consistency and latency they need, this can be changed per Layered cache
+// via SetReadStrategy and SetWriteStrategy. Layered implements Cacher
+// itself, so code using a single table can use a layered cache just as well.
+type Layered struct {
+	l1, l2 Cacher
+	// How long items copied into L1 live there, 0 to keep their lifespan.
+	l1LifeSpan time.Duration
+	// The ReadStrategy and WriteStrategy, for atomic access.
+	read, write int32
+
+	mu sync.Mutex
+	// Writes to L2 queued by WriteL1Async, and whether a goroutine is
+	// running them.
+	pending []func()
+	writing bool
+	// Signaled once all queued writes ran.
+	idle *sync.Cond
+}
+
+var _ Cacher = (*Layered)(nil)
+
+// NewLayered returns a Layered cache with l1 in front of l2. Items get kept
+// in l1 for at most l1LifeSpan, so l1 catches up with changes made to l2
+// behind its back. Pass 0 to keep items in l1 for as long as in l2.
+func NewLayered(l1, l2 Cacher, l1LifeSpan time.Duration) *Layered {
+	c := &Layered{l1: l1, l2: l2, l1LifeSpan: l1LifeSpan}
+	c.idle = sync.NewCond(&c.mu)
+	return c
+}
+
+// SetReadStrategy configures which levels lookups consult.
+func (c *Layered) SetReadStrategy(s ReadStrategy) {
+	atomic.StoreInt32(&c.read, int32(s))
+}
+
+// SetWriteStrategy configures how writes reach the levels. Writes queued
+// before switching to WriteBoth still complete in the background, see Sync.
+func (c *Layered) SetWriteStrategy(s WriteStrategy) {
+	atomic.StoreInt32(&c.write, int32(s))
+}
+
+// Reports whether writes to L2 happen in the background.
+func (c *Layered) writesAsync() bool {
+	return WriteStrategy(atomic.LoadInt32(&c.write)) == WriteL1Async
+}
+
+// Sync waits until the writes to L2 queued by WriteL1Async completed.
+func (c *Layered) Sync() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.writing {
+		c.idle.Wait()
+	}
+}
+
+// Queues a write to L2. The queued writes run in order on a goroutine of
+// their own, which exits once there are none left.
+func (c *Layered) enqueue(write func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending = append(c.pending, write)
+	if !c.writing {
+		c.writing = true
+		go c.drain()
+	}
+}
+
+// Runs the queued writes to L2.
+func (c *Layered) drain() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.pending) > 0 {
+		write := c.pending[0]
+		c.pending[0] = nil
+		c.pending = c.pending[1:]
+		c.mu.Unlock()
+		write()
+		c.mu.Lock()
+	}
+	c.writing = false
+	c.idle.Broadcast()
+}
+
+// L1 returns the front level of this cache.
+func (c *Layered) L1() Cacher {
+	return c.l1
+}
+
+// L2 returns the back level of this cache.
+func (c *Layered) L2() Cacher {
+	return c.l2
+}
+
+// Returns how long an item with the given lifespan lives in L1.
+func (c *Layered) lifeSpanL1(lifeSpan time.Duration) time.Duration {
+	if c.l1LifeSpan > 0 && (lifeSpan <= 0 || c.l1LifeSpan < lifeSpan) {
+		return c.l1LifeSpan
+	}
+	return lifeSpan
+}
+
+// Copies an item found in L2 into L1, unless L1 got a newer one meanwhile.
+func (c *Layered) promote(item *CacheItem) {
+	c.l1.NotFoundAdd(item.Key(), c.lifeSpanL1(item.LifeSpan()), item.Data())
+}
+
+// Value returns the item stored under key from the levels the read strategy
+// consults. Items found in L2 get copied into L1.
+func (c *Layered) Value(key interface{}, args ...interface{}) (*CacheItem, error) {
+	switch ReadStrategy(atomic.LoadInt32(&c.read)) {
+	case ReadL1Only:
+		return c.l1.Value(key, args...)
+	case ReadFastest:
+		return c.valueFastest(key, args...)
+	}
+
+	if item, err := c.l1.Value(key, args...); err == nil {
+		return item, nil
+	}
+	item, err := c.l2.Value(key, args...)
+	if err != nil {
+		return nil, err
+	}
+	c.promote(item)
+	return item, nil
+}
+
+// Looks key up in both levels in parallel, returning the first hit. If both
+// miss, the error of L2 gets returned.
+func (c *Layered) valueFastest(key interface{}, args ...interface{}) (*CacheItem, error) {
+	type result struct {
+		l2   bool
+		item *CacheItem
+		err  error
+	}
+	results := make(chan result, 2)
+	for _, l2 := range []bool{false, true} {
+		go func(l2 bool) {
+			level := c.l1
+			if l2 {
+				level = c.l2
+			}
+			item, err := level.Value(key, args...)
+			results <- result{l2: l2, item: item, err: err}
+		}(l2)
+	}
+
+	var err error
+	for i := 0; i < 2; i++ {
+		r := <-results
+		if r.err != nil {
+			if err == nil || r.l2 {
+				err = r.err
+			}
+			continue
+		}
+		if r.l2 {
+			c.promote(r.item)
+		}
+		return r.item, nil
+	}
+	return nil, err
+}
+
+// Add stores data in L2 and then in L1, so L1 never holds data L2 misses.
+// With WriteL1Async, L2 gets written in the background instead. It returns
+// the item added to L1.
+func (c *Layered) Add(key interface{}, lifeSpan time.Duration, data interface{}) *CacheItem {
+	if c.writesAsync() {
+		item := c.l1.Add(key, c.lifeSpanL1(lifeSpan), data)
+		c.enqueue(func() { c.l2.Add(key, lifeSpan, data) })
+		return item
+	}
+
+	c.l2.Add(key, lifeSpan, data)
+	return c.l1.Add(key, c.lifeSpanL1(lifeSpan), data)
+}
+
+// NotFoundAdd adds data to both levels unless key exists in L2 already, or
+// in L1 with WriteL1Async. It returns whether data got added.
+func (c *Layered) NotFoundAdd(key interface{}, lifeSpan time.Duration, data interface{}) bool {
+	if c.writesAsync() {
+		if !c.l1.NotFoundAdd(key, c.lifeSpanL1(lifeSpan), data) {
+			return false
+		}
+		c.enqueue(func() { c.l2.NotFoundAdd(key, lifeSpan, data) })
+		return true
+	}
+
+	if !c.l2.NotFoundAdd(key, lifeSpan, data) {
+		return false
+	}
+	c.l1.Add(key, c.lifeSpanL1(lifeSpan), data)
+	return true
+}
+
+// Delete removes key from both levels. It returns the item removed from L2,
+// or from L1 if L2 didn't hold it. With WriteL1Async, it returns the item
+// removed from L1 and L2 gets updated in the background.
+func (c *Layered) Delete(key interface{}) (*CacheItem, error) {
+	if c.writesAsync() {
+		item, err := c.l1.Delete(key)
+		c.enqueue(func() { c.l2.Delete(key) })
+		return item, err
+	}
+
+	item, err := c.l2.Delete(key)
+	if r, err1 := c.l1.Delete(key); err != nil {
+		return r, err1
+	}
+	return item, nil
+}
+
+// Exists returns whether key exists in either level.
+func (c *Layered) Exists(key interface{}) bool {
+	return c.l1.Exists(key) || c.l2.Exists(key)
+}
+
+// Flush deletes all items from both levels.
+func (c *Layered) Flush() {
+	if c.writesAsync() {
+		c.l1.Flush()
+		c.enqueue(c.l2.Flush)
+		return
+	}
+
+	c.l2.Flush()
+	c.l1.Flush()
+}
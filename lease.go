@@ -0,0 +1,134 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"time"
+)
+
+// Lease grants its holder exclusive ownership of a key in a cache table for
+// a limited time. Leases are independent of the items cached in a table.
+type Lease struct {
+	table *CacheTable
+	key   interface{}
+
+	// Protected by the table-mutex.
+	expiresOn time.Time
+	timer     *time.Timer
+}
+
+// Lease grants exclusive ownership of key until ttl passed or the lease gets
+// released. It returns ErrLeased if another holder currently owns the key.
+// A ttl of 0 means the lease never expires and must be released explicitly.
+func (table *CacheTable) Lease(key interface{}, ttl time.Duration) (*Lease, error) {
+	key, err := table.resolveKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	table.Lock()
+	defer table.Unlock()
+
+	if table.leases == nil {
+		table.leases = newStore(table.hasher)
+	}
+	if _, ok := table.leases.get(key); ok {
+		return nil, ErrLeased
+	}
+
+	l := &Lease{table: table, key: ownKey(key)}
+	l.arm(ttl)
+	// Leases are kept in a store of their own, wrapped in items.
+	table.leases.set(&CacheItem{key: l.key, data: l})
+	table.log("Leased key", key, "for", ttl, "in table", table.name)
+
+	return l, nil
+}
+
+// Key returns the key this lease was granted for.
+func (l *Lease) Key() interface{} {
+	return l.key
+}
+
+// ExpiresOn returns when this lease expires. It returns the zero time for
+// leases that never expire.
+func (l *Lease) ExpiresOn() time.Time {
+	l.table.RLock()
+	defer l.table.RUnlock()
+	return l.expiresOn
+}
+
+// Renew extends the lease to expire ttl from now. It returns ErrLeaseExpired
+// if the lease already expired or got released.
+func (l *Lease) Renew(ttl time.Duration) error {
+	l.table.Lock()
+	defer l.table.Unlock()
+
+	if !l.current() {
+		return ErrLeaseExpired
+	}
+	l.arm(ttl)
+
+	return nil
+}
+
+// Release gives up ownership of the key. It returns ErrLeaseExpired if the
+// lease already expired or got released.
+func (l *Lease) Release() error {
+	l.table.Lock()
+	defer l.table.Unlock()
+
+	if !l.current() {
+		return ErrLeaseExpired
+	}
+	l.disarm()
+	l.table.leases.remove(l.key)
+
+	return nil
+}
+
+// Returns whether this is the lease currently granted for its key.
+// Careful: do not run this method unless the table-mutex is locked!
+func (l *Lease) current() bool {
+	if l.table.leases == nil {
+		return false
+	}
+	item, ok := l.table.leases.get(l.key)
+	return ok && item.data == l
+}
+
+// Sets up the expiration of this lease.
+// Careful: do not run this method unless the table-mutex is locked!
+func (l *Lease) arm(ttl time.Duration) {
+	l.disarm()
+	if ttl <= 0 {
+		l.expiresOn = time.Time{}
+		return
+	}
+
+	l.expiresOn = time.Now().Add(ttl)
+	l.timer = time.AfterFunc(ttl, func() {
+		l.table.Lock()
+		defer l.table.Unlock()
+
+		// The lease may have been renewed or released meanwhile.
+		if l.current() && !l.expiresOn.After(time.Now()) {
+			l.table.log("Lease for key", l.key, "expired in table", l.table.name)
+			l.table.leases.remove(l.key)
+		}
+	})
+}
+
+// Stops the expiration timer of this lease.
+// Careful: do not run this method unless the table-mutex is locked!
+func (l *Lease) disarm() {
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+}
@@ -0,0 +1,105 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"sync"
+)
+
+var (
+	lifecycleMu sync.RWMutex
+	// Callbacks triggered when a table got created.
+	tableCreatedHooks []tableHook
+	// Callbacks triggered when a table got removed.
+	tableRemovedHooks []tableHook
+)
+
+// A package-level table lifecycle callback.
+type tableHook struct {
+	handle  CallbackHandle
+	created func(table *CacheTable)
+	removed func(name string)
+}
+
+// OnTableCreated calls f for every cache table created from now on, e.g. to
+// attach metrics, loggers or limits to tables created by any component. It
+// runs right after the table got registered, so the table may already be in
+// use meanwhile. Use RemoveLifecycleCallback with the returned handle to
+// remove the callback again.
+func OnTableCreated(f func(table *CacheTable)) CallbackHandle {
+	return addTableHook(&tableCreatedHooks, tableHook{created: f})
+}
+
+// OnTableRemoved calls f with the name of every cache table removed via
+// RemoveTable from now on. Use RemoveLifecycleCallback with the returned
+// handle to remove the callback again.
+func OnTableRemoved(f func(name string)) CallbackHandle {
+	return addTableHook(&tableRemovedHooks, tableHook{removed: f})
+}
+
+// RemoveLifecycleCallback removes a single OnTableCreated or OnTableRemoved
+// callback, identified by the handle returned when it was added. It returns
+// false if no such callback is registered.
+func RemoveLifecycleCallback(h CallbackHandle) bool {
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+
+	var ok bool
+	if tableCreatedHooks, ok = removeTableHook(tableCreatedHooks, h); ok {
+		return true
+	}
+	tableRemovedHooks, ok = removeTableHook(tableRemovedHooks, h)
+	return ok
+}
+
+func addTableHook(hooks *[]tableHook, h tableHook) CallbackHandle {
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+
+	h.handle = newCallbackHandle()
+	*hooks = append(*hooks, h)
+	return h.handle
+}
+
+// Returns a copy of hooks without the one identified by h. The slice gets
+// copied, as the old one may still be iterated outside of the package mutex.
+func removeTableHook(hooks []tableHook, h CallbackHandle) ([]tableHook, bool) {
+	for i, o := range hooks {
+		if o.handle == h {
+			r := make([]tableHook, 0, len(hooks)-1)
+			r = append(r, hooks[:i]...)
+			return append(r, hooks[i+1:]...), true
+		}
+	}
+
+	return hooks, false
+}
+
+// Calls the OnTableCreated callbacks.
+// Careful: do not run this method while holding the package mutex!
+func tableCreated(table *CacheTable) {
+	lifecycleMu.RLock()
+	hooks := tableCreatedHooks
+	lifecycleMu.RUnlock()
+
+	for _, h := range hooks {
+		h.created(table)
+	}
+}
+
+// Calls the OnTableRemoved callbacks.
+// Careful: do not run this method while holding the package mutex!
+func tableRemoved(name string) {
+	lifecycleMu.RLock()
+	hooks := tableRemovedHooks
+	lifecycleMu.RUnlock()
+
+	for _, h := range hooks {
+		h.removed(name)
+	}
+}
@@ -0,0 +1,207 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// List is a sequence of values stored as the data of a cache item, like a
+// Redis list, e.g. to be used as an in-process queue. It gets created by
+// CacheTable.LPush or RPush and vanishes once its item expires.
+type List struct {
+	mu     sync.Mutex
+	values []interface{}
+	// Values popped via LPopInvisible which weren't acknowledged yet.
+	inFlight    map[Receipt]inFlight
+	nextReceipt Receipt
+}
+
+// Receipt identifies a value popped via LPopInvisible, to acknowledge it.
+type Receipt uint64
+
+// A popped value awaiting its acknowledgement.
+type inFlight struct {
+	value    interface{}
+	deadline time.Time
+}
+
+// Len returns the number of values in this list, not counting values in
+// flight.
+func (l *List) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.redeliver(time.Now())
+	return len(l.values)
+}
+
+// Estimates the size of this list while holding its lock, see EstimateSize.
+func (l *List) estimateSize() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return reflectSize(l)
+}
+
+// Returns values whose visibility timeout passed to the head of the list, in
+// the order they were popped.
+// Careful: do not run this method unless the list is locked!
+func (l *List) redeliver(now time.Time) {
+	var expired []Receipt
+	for r, f := range l.inFlight {
+		if !now.Before(f.deadline) {
+			expired = append(expired, r)
+		}
+	}
+	if len(expired) == 0 {
+		return
+	}
+
+	sort.Slice(expired, func(i, j int) bool { return expired[i] < expired[j] })
+	values := make([]interface{}, 0, len(expired)+len(l.values))
+	for _, r := range expired {
+		values = append(values, l.inFlight[r].value)
+		delete(l.inFlight, r)
+	}
+	l.values = append(values, l.values...)
+}
+
+// Returns the list stored under key, keeping its item alive. If there is
+// none and create is set, a list with the given lifespan gets added.
+func (table *CacheTable) list(key interface{}, lifeSpan time.Duration, create bool) (*List, error) {
+	var newList func() interface{}
+	if create {
+		newList = func() interface{} {
+			return &List{}
+		}
+	}
+	item, err := table.container(key, lifeSpan, newList)
+	if err != nil {
+		return nil, err
+	}
+
+	l, ok := item.data.(*List)
+	if !ok {
+		return nil, ErrWrongType
+	}
+
+	return l, nil
+}
+
+// LPush prepends values to the list stored under key, creating the list with
+// the given lifespan if it does not exist yet. The values end up in the
+// same order as given. It returns ErrWrongType if key holds something other
+// than a list.
+func (table *CacheTable) LPush(key interface{}, lifeSpan time.Duration, values ...interface{}) error {
+	l, err := table.list(key, lifeSpan, true)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.values = append(append([]interface{}(nil), values...), l.values...)
+
+	return nil
+}
+
+// RPush appends values to the list stored under key. It works like LPush
+// otherwise.
+func (table *CacheTable) RPush(key interface{}, lifeSpan time.Duration, values ...interface{}) error {
+	l, err := table.list(key, lifeSpan, true)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.values = append(l.values, values...)
+
+	return nil
+}
+
+// LPop removes and returns the first value of the list stored under key. It
+// returns ErrKeyNotFound if the list does not exist or is empty.
+func (table *CacheTable) LPop(key interface{}) (interface{}, error) {
+	if err := table.checkWritable(); err != nil {
+		return nil, err
+	}
+	l, err := table.list(key, 0, false)
+	if err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.redeliver(time.Now())
+	if len(l.values) == 0 {
+		return nil, ErrKeyNotFound
+	}
+	value := l.values[0]
+	l.values[0] = nil
+	l.values = l.values[1:]
+
+	return value, nil
+}
+
+// LPopInvisible works like LPop, but only hides the value for the given
+// visibility timeout. Unless it gets acknowledged via LAck within that time,
+// it returns to the head of the list to be popped again, which makes for
+// at-least-once delivery to consumers which may fail.
+func (table *CacheTable) LPopInvisible(key interface{}, timeout time.Duration) (interface{}, Receipt, error) {
+	if err := table.checkWritable(); err != nil {
+		return nil, 0, err
+	}
+	l, err := table.list(key, 0, false)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.redeliver(now)
+	if len(l.values) == 0 {
+		return nil, 0, ErrKeyNotFound
+	}
+	value := l.values[0]
+	l.values[0] = nil
+	l.values = l.values[1:]
+
+	if l.inFlight == nil {
+		l.inFlight = make(map[Receipt]inFlight)
+	}
+	l.nextReceipt++
+	l.inFlight[l.nextReceipt] = inFlight{value: value, deadline: now.Add(timeout)}
+
+	return value, l.nextReceipt, nil
+}
+
+// LAck acknowledges a value popped via LPopInvisible, removing it for good.
+// It returns ErrNotInFlight if its visibility timeout passed already, so it
+// may be delivered again.
+func (table *CacheTable) LAck(key interface{}, r Receipt) error {
+	if err := table.checkWritable(); err != nil {
+		return err
+	}
+	l, err := table.list(key, 0, false)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.redeliver(time.Now())
+	if _, ok := l.inFlight[r]; !ok {
+		return ErrNotInFlight
+	}
+	delete(l.inFlight, r)
+
+	return nil
+}
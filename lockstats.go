@@ -0,0 +1,221 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds of the DurationHistogram buckets, growing by a factor of 4.
+// The last bucket counts all durations exceeding the last bound.
+var histogramBounds = [...]time.Duration{
+	time.Microsecond,
+	4 * time.Microsecond,
+	16 * time.Microsecond,
+	64 * time.Microsecond,
+	256 * time.Microsecond,
+	time.Millisecond,
+	4 * time.Millisecond,
+	16 * time.Millisecond,
+	64 * time.Millisecond,
+	256 * time.Millisecond,
+	time.Second,
+}
+
+// DurationHistogram is a snapshot of durations counted in exponential
+// buckets. Counts[i] is the number of durations up to Bounds[i], the last
+// count is the number of durations exceeding all bounds.
+type DurationHistogram struct {
+	Bounds []time.Duration
+	Counts []int64
+	// Sum is the total of all counted durations.
+	Sum time.Duration
+}
+
+// Count returns the number of counted durations.
+func (h DurationHistogram) Count() int64 {
+	var n int64
+	for _, c := range h.Counts {
+		n += c
+	}
+	return n
+}
+
+// Mean returns the average of the counted durations.
+func (h DurationHistogram) Mean() time.Duration {
+	n := h.Count()
+	if n == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(n)
+}
+
+// Quantile returns an upper bound of the q-quantile of the counted
+// durations, e.g. 0.99 for the 99th percentile. Beyond the last bound it
+// returns the largest possible duration.
+func (h DurationHistogram) Quantile(q float64) time.Duration {
+	n := h.Count()
+	if n == 0 {
+		return 0
+	}
+	rank := int64(q * float64(n))
+	var seen int64
+	for i, c := range h.Counts {
+		seen += c
+		if seen > rank && i < len(h.Bounds) {
+			return h.Bounds[i]
+		}
+	}
+	return 1<<63 - 1
+}
+
+// Adds the counts of o to h.
+func (h *DurationHistogram) add(o DurationHistogram) {
+	if len(o.Counts) == 0 {
+		return
+	}
+	if len(h.Counts) == 0 {
+		h.Bounds = o.Bounds
+		h.Counts = make([]int64, len(o.Counts))
+	}
+	for i, c := range o.Counts {
+		h.Counts[i] += c
+	}
+	h.Sum += o.Sum
+}
+
+// Counts durations in the buckets given by histogramBounds, accessed
+// atomically.
+type histogram struct {
+	sum    int64
+	counts [len(histogramBounds) + 1]int64
+}
+
+// Counts the duration d.
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(histogramBounds) && d > histogramBounds[i] {
+		i++
+	}
+	atomic.AddInt64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+// Returns a snapshot of the histogram.
+func (h *histogram) snapshot() DurationHistogram {
+	s := DurationHistogram{
+		Bounds: append([]time.Duration(nil), histogramBounds[:]...),
+		Counts: make([]int64, len(h.counts)),
+		Sum:    time.Duration(atomic.LoadInt64(&h.sum)),
+	}
+	for i := range h.counts {
+		s.Counts[i] = atomic.LoadInt64(&h.counts[i])
+	}
+	return s
+}
+
+// Zeroes the histogram.
+func (h *histogram) reset() {
+	for i := range h.counts {
+		atomic.StoreInt64(&h.counts[i], 0)
+	}
+	atomic.StoreInt64(&h.sum, 0)
+}
+
+// SetLockDiagnostics configures whether this table records how long its
+// mutex gets waited for and held, e.g. to attribute contention to tables
+// without mutex profiling. The durations show up in the table's Stats: wait
+// durations for read and write locks, hold durations for write locks only.
+// If longHold is positive, each write lock held longer than that gets logged
+// along with the stack trace of the goroutine releasing it. Recording costs
+// two clock readings per lock.
+func (table *CacheTable) SetLockDiagnostics(enabled bool, longHold time.Duration) {
+	atomic.StoreInt64(&table.lockLongHold, int64(longHold))
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&table.lockDiagnostics, v)
+}
+
+// Reports whether lock durations get recorded.
+func (table *CacheTable) diagnosesLocks() bool {
+	return atomic.LoadInt32(&table.lockDiagnostics) != 0
+}
+
+// Lock locks the table-mutex for writing.
+func (table *CacheTable) Lock() {
+	if !table.diagnosesLocks() {
+		table.RWMutex.Lock()
+		return
+	}
+
+	start := time.Now()
+	table.RWMutex.Lock()
+	table.lockedAt = time.Now()
+	table.lockWait.observe(table.lockedAt.Sub(start))
+}
+
+// TryLock tries to lock the table-mutex for writing without waiting and
+// reports whether it succeeded.
+func (table *CacheTable) TryLock() bool {
+	if !table.RWMutex.TryLock() {
+		return false
+	}
+	if table.diagnosesLocks() {
+		table.lockedAt = time.Now()
+		table.lockWait.observe(0)
+	}
+	return true
+}
+
+// Unlock unlocks the table-mutex for writing.
+func (table *CacheTable) Unlock() {
+	lockedAt := table.lockedAt
+	if lockedAt.IsZero() {
+		table.RWMutex.Unlock()
+		return
+	}
+
+	table.lockedAt = time.Time{}
+	table.RWMutex.Unlock()
+
+	held := time.Since(lockedAt)
+	table.lockHold.observe(held)
+	if longHold := time.Duration(atomic.LoadInt64(&table.lockLongHold)); longHold > 0 && held > longHold {
+		buf := make([]byte, 4096)
+		buf = buf[:runtime.Stack(buf, false)]
+		table.log("Table", table.name, "was locked for", held, "by\n"+string(buf))
+	}
+}
+
+// RLock locks the table-mutex for reading.
+func (table *CacheTable) RLock() {
+	if !table.diagnosesLocks() {
+		table.RWMutex.RLock()
+		return
+	}
+
+	start := time.Now()
+	table.RWMutex.RLock()
+	table.lockWait.observe(time.Since(start))
+}
+
+// TryRLock tries to lock the table-mutex for reading without waiting and
+// reports whether it succeeded.
+func (table *CacheTable) TryRLock() bool {
+	if !table.RWMutex.TryRLock() {
+		return false
+	}
+	if table.diagnosesLocks() {
+		table.lockWait.observe(0)
+	}
+	return true
+}
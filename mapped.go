@@ -0,0 +1,180 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Mapped snapshots start with this magic and format version.
+var mappedMagic = []byte("C2GM\x01")
+
+// Size of a mapped snapshot's header and of each index entry: key offset,
+// key length, value offset and value length.
+const (
+	mappedHeaderSize = 5 + 4
+	mappedEntrySize  = 8 + 4 + 8 + 4
+)
+
+// SaveMapped writes the table's items in a flat format suitable for
+// OpenMapped. Keys get encoded with the table's KeyCodec, values must be
+// byte slices or strings, otherwise ErrWrongType is returned.
+func (table *CacheTable) SaveMapped(w io.Writer) error {
+	codec := table.KeyCodec()
+	type entry struct{ key, value []byte }
+
+	var entries []entry
+	for _, item := range table.Snapshot().Items() {
+		key, err := codec.EncodeKey(item.key)
+		if err != nil {
+			return err
+		}
+		var value []byte
+		switch v := item.data.(type) {
+		case []byte:
+			value = v
+		case string:
+			value = []byte(v)
+		default:
+			return fmt.Errorf("%w: %T for key %v", ErrWrongType, item.data, item.key)
+		}
+		entries = append(entries, entry{key, value})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].key, entries[j].key) < 0
+	})
+
+	bw := bufio.NewWriter(w)
+	bw.Write(mappedMagic)
+	binary.Write(bw, binary.BigEndian, uint32(len(entries)))
+
+	off := uint64(mappedHeaderSize + len(entries)*mappedEntrySize)
+	for _, e := range entries {
+		binary.Write(bw, binary.BigEndian, off)
+		binary.Write(bw, binary.BigEndian, uint32(len(e.key)))
+		off += uint64(len(e.key))
+		binary.Write(bw, binary.BigEndian, off)
+		binary.Write(bw, binary.BigEndian, uint32(len(e.value)))
+		off += uint64(len(e.value))
+	}
+	for _, e := range entries {
+		bw.Write(e.key)
+		bw.Write(e.value)
+	}
+	return bw.Flush()
+}
+
+// MappedTable is a read-only table backed by a snapshot written by
+// SaveMapped. Where supported, the file gets memory-mapped, so several
+// processes opening the same snapshot share its pages instead of each
+// holding a private copy.
+type MappedTable struct {
+	data  []byte
+	count int
+	codec KeyCodec
+	unmap func() error
+}
+
+// OpenMapped opens a snapshot written by SaveMapped, decoding keys with
+// codec. Pass a nil codec to use DefaultKeyCodec.
+func OpenMapped(path string, codec KeyCodec) (*MappedTable, error) {
+	if codec == nil {
+		codec = DefaultKeyCodec
+	}
+	data, unmap, err := mapFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &MappedTable{data: data, codec: codec, unmap: unmap}
+	if err := m.check(); err != nil {
+		unmap()
+		return nil, err
+	}
+	return m, nil
+}
+
+// Verifies the header and index bounds.
+func (m *MappedTable) check() error {
+	if len(m.data) < mappedHeaderSize || !bytes.Equal(m.data[:len(mappedMagic)], mappedMagic) {
+		return fmt.Errorf("%w: bad header", ErrCorruptSnapshot)
+	}
+	m.count = int(binary.BigEndian.Uint32(m.data[len(mappedMagic):]))
+	if uint64(len(m.data)) < uint64(mappedHeaderSize)+uint64(m.count)*mappedEntrySize {
+		return fmt.Errorf("%w: truncated index", ErrCorruptSnapshot)
+	}
+	for i := 0; i < m.count; i++ {
+		e := m.data[mappedHeaderSize+i*mappedEntrySize:]
+		for _, f := range [][]byte{e[:12], e[12:24]} {
+			off, n := binary.BigEndian.Uint64(f), uint64(binary.BigEndian.Uint32(f[8:]))
+			if off+n < off || off+n > uint64(len(m.data)) {
+				return fmt.Errorf("%w: entry out of bounds", ErrCorruptSnapshot)
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the key and value of the i-th entry.
+func (m *MappedTable) entry(i int) (key, value []byte) {
+	e := m.data[mappedHeaderSize+i*mappedEntrySize:]
+	field := func(f []byte) []byte {
+		off, n := binary.BigEndian.Uint64(f), binary.BigEndian.Uint32(f[8:])
+		return m.data[off : off+uint64(n) : off+uint64(n)]
+	}
+	return field(e[:12]), field(e[12:24])
+}
+
+// Len returns the number of items.
+func (m *MappedTable) Len() int {
+	return m.count
+}
+
+// Value returns the value stored under key. The returned slice points into
+// the mapped file, it must not be modified and not be used after Close.
+func (m *MappedTable) Value(key interface{}) ([]byte, error) {
+	k, err := m.codec.EncodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	i := sort.Search(m.count, func(i int) bool {
+		ek, _ := m.entry(i)
+		return bytes.Compare(ek, k) >= 0
+	})
+	if i < m.count {
+		if ek, v := m.entry(i); bytes.Equal(ek, k) {
+			return v, nil
+		}
+	}
+	return nil, ErrKeyNotFound
+}
+
+// Foreach calls trans for every item, in the order of their encoded keys.
+func (m *MappedTable) Foreach(trans func(key interface{}, value []byte)) error {
+	for i := 0; i < m.count; i++ {
+		k, v := m.entry(i)
+		key, err := m.codec.DecodeKey(k)
+		if err != nil {
+			return err
+		}
+		trans(key, v)
+	}
+	return nil
+}
+
+// Close releases the mapping.
+func (m *MappedTable) Close() error {
+	m.data = nil
+	return m.unmap()
+}
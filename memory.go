@@ -0,0 +1,159 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"context"
+)
+
+// SetMaxMemory limits the estimated size of the data this table holds to the
+// given number of bytes. Each item accounts for the size given via
+// ItemBuilder.WithSize, or else for the size EstimateSize calculates for its
+// data. Once the budget is exceeded, items get evicted in the order of the
+// table's eviction settings, least recently used first by default, and the
+// AboutToDeleteItem callbacks see RemovalEvicted as the reason. A budget of
+// 0, which is the default, disables the limit.
+func (table *CacheTable) SetMaxMemory(bytes int64) {
+	var sizes map[*CacheItem]int64
+	if bytes > 0 {
+		sizes = table.estimateSizes()
+	}
+
+	table.Lock()
+	defer table.Unlock()
+
+	table.maxMemory = bytes
+	table.rebuildMemory(sizes)
+	table.resetSegments()
+	table.evictInternal(context.Background())
+}
+
+// MemoryUsage returns the estimated size of the data this table holds in
+// bytes, as accounted for by SetMaxMemory. Without a memory budget, the
+// sizes get estimated on every call.
+func (table *CacheTable) MemoryUsage() int64 {
+	table.RLock()
+	if table.maxMemory > 0 {
+		defer table.RUnlock()
+		return table.memoryUsage
+	}
+	items := make([]*CacheItem, 0, table.items.len())
+	table.items.each(func(item *CacheItem) {
+		items = append(items, item)
+	})
+	table.RUnlock()
+
+	var n int64
+	for _, item := range items {
+		n += item.estimatedSize()
+	}
+	return n
+}
+
+// Returns the size item accounts for in memory budgets and namespace quotas,
+// read-locking its data like WithRLock. Since WithLock holds that lock while
+// its callback may use the table, only run this while holding the
+// table-mutex for items which just got added.
+func (item *CacheItem) estimatedSize() int64 {
+	if item.sizeHint > 0 {
+		return item.sizeHint
+	}
+	var n int64
+	item.WithRLock(func(data interface{}) {
+		n = EstimateSize(data)
+	})
+	return n
+}
+
+// Estimates the sizes of all stored items ahead of rebuilding the memory
+// usage or namespace usages, see estimatedSize.
+// Careful: do not run this method while holding the table-mutex!
+func (table *CacheTable) estimateSizes() map[*CacheItem]int64 {
+	table.RLock()
+	items := make([]*CacheItem, 0, table.items.len())
+	table.items.each(func(item *CacheItem) {
+		items = append(items, item)
+	})
+	table.RUnlock()
+
+	sizes := make(map[*CacheItem]int64, len(items))
+	for _, item := range items {
+		sizes[item] = item.estimatedSize()
+	}
+	return sizes
+}
+
+// Returns the sizes the stored items account for right now, to keep them
+// when rebuilding the memory usage or namespace usages.
+// Careful: do not run this method unless the table-mutex is at least
+// read-locked!
+func (table *CacheTable) currentSizes() map[*CacheItem]int64 {
+	sizes := make(map[*CacheItem]int64, table.items.len())
+	table.items.each(func(item *CacheItem) {
+		sizes[item] = item.size
+	})
+	return sizes
+}
+
+// Returns the size of item given in sizes, or else estimates it.
+func sizeFrom(sizes map[*CacheItem]int64, item *CacheItem) int64 {
+	if size, ok := sizes[item]; ok {
+		return size
+	}
+	return item.estimatedSize()
+}
+
+// Reports whether the table exceeds its memory budget.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) exceedsMemory() bool {
+	return table.maxMemory > 0 && table.memoryUsage-table.removingSize > table.maxMemory
+}
+
+// Reports whether the table keeps track of the items' sizes, for its memory
+// budget or namespaces.
+// Careful: do not run this method unless the table-mutex is at least
+// read-locked!
+func (table *CacheTable) tracksSizes() bool {
+	return table.maxMemory > 0 || (table.namespaces != nil && table.namespaces.of != nil)
+}
+
+// Accounts for a newly added item, replacing old if it's not nil. The item's
+// size must be set already.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) memoryAdd(item, old *CacheItem) {
+	if table.maxMemory <= 0 {
+		return
+	}
+	if old != nil {
+		table.memoryUsage -= old.size
+	}
+	table.memoryUsage += item.size
+}
+
+// Accounts for a removed item.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) memoryRemove(item *CacheItem) {
+	if table.maxMemory <= 0 {
+		return
+	}
+	table.memoryUsage -= item.size
+}
+
+// Recalculates the memory usage from the stored items, using the sizes
+// given for them, if any, see estimateSizes.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) rebuildMemory(sizes map[*CacheItem]int64) {
+	table.memoryUsage = 0
+	if table.maxMemory <= 0 {
+		return
+	}
+	table.items.each(func(item *CacheItem) {
+		item.size = sizeFrom(sizes, item)
+		table.memoryUsage += item.size
+	})
+}
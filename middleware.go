@@ -0,0 +1,115 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"context"
+	"time"
+)
+
+// Op identifies a table operation passing through the middleware chain.
+type Op int
+
+const (
+	// OpValue is a lookup via Value or ValueCtx.
+	OpValue Op = iota
+	// OpAdd is an insertion via Add or AddCtx.
+	OpAdd
+	// OpDelete is a removal via Delete or DeleteCtx.
+	OpDelete
+)
+
+// String returns a human readable representation of the operation.
+func (op Op) String() string {
+	switch op {
+	case OpValue:
+		return "value"
+	case OpAdd:
+		return "add"
+	case OpDelete:
+		return "delete"
+	}
+	return "unknown"
+}
+
+// Request describes a single table operation. LifeSpan and Data are only
+// used by OpAdd, Args and Mode only by OpValue. Middleware may modify the
+// request before passing it on.
+type Request struct {
+	Op       Op
+	Key      interface{}
+	LifeSpan time.Duration
+	Data     interface{}
+	Args     []interface{}
+	Mode     AccessMode
+
+	// Item whose tags and lifetime limits an added item inherits.
+	template *CacheItem
+	// Set when adding an item produced by the data-loader.
+	load *loadResult
+}
+
+// Describes an item produced by the data-loader.
+type loadResult struct {
+	// How long the data-loader took.
+	duration time.Duration
+	// The item being refreshed, nil if the key was missing.
+	replaces *CacheItem
+}
+
+// Handler executes a table operation.
+type Handler func(ctx context.Context, req *Request) (*CacheItem, error)
+
+// Middleware wraps a Handler, e.g. to add metrics, tracing or validation
+// around every table operation.
+type Middleware func(next Handler) Handler
+
+// Use appends middleware to this table's chain. Middleware that got added
+// first is the outermost one, i.e. it sees each request first and each
+// result last.
+func (table *CacheTable) Use(mw ...Middleware) {
+	table.Lock()
+	defer table.Unlock()
+
+	table.middleware = append(table.middleware, mw...)
+	h := table.execute
+	for i := len(table.middleware) - 1; i >= 0; i-- {
+		h = table.middleware[i](h)
+	}
+	table.chain = h
+}
+
+// Runs a request through the middleware chain.
+func (table *CacheTable) handle(ctx context.Context, req *Request) (*CacheItem, error) {
+	var h Handler
+	if v := table.degradedView(); v != nil {
+		h = v.chain
+	} else {
+		if err := table.lockCtx(ctx, false); err != nil {
+			return nil, err
+		}
+		h = table.chain
+		table.RUnlock()
+	}
+
+	if h == nil {
+		return table.execute(ctx, req)
+	}
+	return h(ctx, req)
+}
+
+// The innermost handler, actually executing a request on the table.
+func (table *CacheTable) execute(ctx context.Context, req *Request) (*CacheItem, error) {
+	switch req.Op {
+	case OpAdd:
+		return table.doAdd(ctx, req.Key, req.LifeSpan, req.Data, req.template, req.load)
+	case OpDelete:
+		return table.doDelete(ctx, req.Key)
+	}
+	return table.doValue(ctx, req.Key, req.Mode, req.Args...)
+}
@@ -0,0 +1,386 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// NamespaceQuota limits the share of a table a namespace may take up.
+type NamespaceQuota struct {
+	// MaxItems is the maximum number of items, 0 if unbounded.
+	MaxItems int
+	// MaxBytes is the maximum estimated size of the items' data, see
+	// EstimateSize, 0 if unbounded.
+	MaxBytes int64
+}
+
+// NamespaceUsage is how much of a table a namespace takes up, and how well
+// it is served.
+type NamespaceUsage struct {
+	Items int
+	// Bytes is the estimated size of the items' data, see EstimateSize.
+	Bytes  int64
+	Hits   int64
+	Misses int64
+}
+
+// HitRatio returns the fraction of the namespace's lookups served from the
+// cache.
+func (u NamespaceUsage) HitRatio() float64 {
+	if u.Hits+u.Misses == 0 {
+		return 0
+	}
+	return float64(u.Hits) / float64(u.Hits+u.Misses)
+}
+
+// Groups the items of a table into namespaces with quotas.
+type namespaces struct {
+	of     func(key interface{}) string
+	quotas map[string]NamespaceQuota
+	usage  map[string]*NamespaceUsage
+	// The namespaces of the items deleteInternal is running the callbacks
+	// for, which count as gone for the quotas.
+	removing map[*CacheItem]string
+
+	// Lookup counters, which readers update without the table-mutex.
+	lookupsMu sync.Mutex
+	lookups   map[string]*namespaceLookups
+}
+
+type namespaceLookups struct {
+	hits   int64
+	misses int64
+}
+
+// SetNamespaceFunc groups the items of this table into namespaces, e.g. by
+// key prefix or by tenant, so components or customers sharing the table can
+// be observed via NamespaceUsage and bounded via SetNamespaceQuota. Pass nil
+// to disable namespaces.
+func (table *CacheTable) SetNamespaceFunc(f func(key interface{}) string) {
+	var sizes map[*CacheItem]int64
+	if f != nil {
+		sizes = table.estimateSizes()
+	}
+
+	table.Lock()
+	defer table.Unlock()
+
+	if f == nil {
+		table.namespaces = nil
+		return
+	}
+	quotas := make(map[string]NamespaceQuota)
+	if table.namespaces != nil {
+		quotas = table.namespaces.quotas
+	}
+	table.namespaces = &namespaces{of: f, quotas: quotas, lookups: make(map[string]*namespaceLookups)}
+	table.rebuildNamespaces(sizes)
+	table.rebuildMemory(sizes)
+	table.enforceQuotas(context.Background())
+}
+
+// SetNamespaceQuota limits how many items, or how many bytes of data, the
+// namespace may hold. Once exceeded, the namespace's least recently used
+// items get evicted, leaving the items of other namespaces untouched. Pass
+// a zero quota to lift the limits. Quotas only apply once a namespace
+// function got configured via SetNamespaceFunc.
+func (table *CacheTable) SetNamespaceQuota(namespace string, quota NamespaceQuota) {
+	table.Lock()
+	defer table.Unlock()
+
+	if table.namespaces == nil {
+		table.namespaces = &namespaces{quotas: make(map[string]NamespaceQuota)}
+	}
+	if quota == (NamespaceQuota{}) {
+		delete(table.namespaces.quotas, namespace)
+	} else {
+		table.namespaces.quotas[namespace] = quota
+	}
+	table.enforceQuotas(context.Background())
+}
+
+// NamespaceUsage returns how much of this table the namespace takes up.
+func (table *CacheTable) NamespaceUsage(namespace string) NamespaceUsage {
+	table.RLock()
+	defer table.RUnlock()
+
+	ns := table.namespaces
+	if ns == nil || ns.of == nil {
+		return NamespaceUsage{}
+	}
+	var u NamespaceUsage
+	if p, ok := ns.usage[namespace]; ok {
+		u = *p
+	}
+	u.Hits, u.Misses = ns.lookupCounts(namespace)
+	return u
+}
+
+// NamespaceUsages returns the usage of all namespaces which hold items or got
+// looked up.
+func (table *CacheTable) NamespaceUsages() map[string]NamespaceUsage {
+	table.RLock()
+	defer table.RUnlock()
+
+	r := make(map[string]NamespaceUsage)
+	ns := table.namespaces
+	if ns == nil || ns.of == nil {
+		return r
+	}
+	for name, u := range ns.usage {
+		r[name] = *u
+	}
+	ns.lookupsMu.Lock()
+	names := make([]string, 0, len(ns.lookups))
+	for name := range ns.lookups {
+		names = append(names, name)
+	}
+	ns.lookupsMu.Unlock()
+	for _, name := range names {
+		u := r[name]
+		u.Hits, u.Misses = ns.lookupCounts(name)
+		r[name] = u
+	}
+	return r
+}
+
+// Counts a lookup of key towards the table's and its namespace's hits or
+// misses.
+func (table *CacheTable) countLookup(ns *namespaces, key interface{}, hit bool) {
+	if hit {
+		atomic.AddInt64(&table.hits, 1)
+	} else {
+		atomic.AddInt64(&table.misses, 1)
+	}
+	if ns == nil || ns.of == nil {
+		return
+	}
+
+	name := ns.of(key)
+	ns.lookupsMu.Lock()
+	l := ns.lookups[name]
+	if l == nil {
+		l = &namespaceLookups{}
+		ns.lookups[name] = l
+	}
+	ns.lookupsMu.Unlock()
+
+	if hit {
+		atomic.AddInt64(&l.hits, 1)
+	} else {
+		atomic.AddInt64(&l.misses, 1)
+	}
+}
+
+// Returns the hits and misses of the namespace.
+func (ns *namespaces) lookupCounts(name string) (int64, int64) {
+	ns.lookupsMu.Lock()
+	l := ns.lookups[name]
+	ns.lookupsMu.Unlock()
+	if l == nil {
+		return 0, 0
+	}
+	return atomic.LoadInt64(&l.hits), atomic.LoadInt64(&l.misses)
+}
+
+// Zeroes the lookup counters of all namespaces.
+func (ns *namespaces) resetLookups() {
+	ns.lookupsMu.Lock()
+	defer ns.lookupsMu.Unlock()
+	ns.lookups = make(map[string]*namespaceLookups)
+}
+
+// Accounts for an added item, replacing old if not nil, and evicts items of
+// its namespace exceeding the quota.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) namespaceAdd(ctx context.Context, item, old *CacheItem) {
+	ns := table.namespaces
+	if ns == nil || ns.of == nil {
+		return
+	}
+	if old != nil {
+		table.namespaceRemove(old)
+	}
+
+	name := ns.of(item.key)
+	u := ns.usage[name]
+	if u == nil {
+		u = &NamespaceUsage{}
+		ns.usage[name] = u
+	}
+	u.Items++
+	u.Bytes += item.size
+
+	table.enforceQuota(ctx, name)
+}
+
+// Accounts for a removed item.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) namespaceRemove(item *CacheItem) {
+	ns := table.namespaces
+	if ns == nil || ns.of == nil {
+		return
+	}
+
+	name := ns.of(item.key)
+	if u := ns.usage[name]; u != nil {
+		u.Items--
+		u.Bytes -= item.size
+		if u.Items <= 0 {
+			delete(ns.usage, name)
+		}
+	}
+}
+
+// Recalculates the usage of all namespaces from the stored items, using the
+// sizes given for them, if any, see estimateSizes.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) rebuildNamespaces(sizes map[*CacheItem]int64) {
+	ns := table.namespaces
+	if ns == nil || ns.of == nil {
+		return
+	}
+
+	ns.usage = make(map[string]*NamespaceUsage)
+	ns.removing = nil
+	table.items.each(func(item *CacheItem) {
+		item.size = sizeFrom(sizes, item)
+
+		name := ns.of(item.key)
+		if item.removing {
+			if ns.removing == nil {
+				ns.removing = make(map[*CacheItem]string)
+			}
+			ns.removing[item] = name
+		}
+		u := ns.usage[name]
+		if u == nil {
+			u = &NamespaceUsage{}
+			ns.usage[name] = u
+		}
+		u.Items++
+		u.Bytes += item.size
+	})
+}
+
+// Marks the item as being removed, so it no longer counts towards the quota
+// of its namespace.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) namespaceRemoving(item *CacheItem) {
+	ns := table.namespaces
+	if ns == nil || ns.of == nil {
+		return
+	}
+	if ns.removing == nil {
+		ns.removing = make(map[*CacheItem]string)
+	}
+	ns.removing[item] = ns.of(item.key)
+}
+
+// Undoes namespaceRemoving once the item's removal completed or got
+// abandoned.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) namespaceRemoved(item *CacheItem) {
+	if ns := table.namespaces; ns != nil {
+		delete(ns.removing, item)
+	}
+}
+
+// Returns how many items, and how many bytes, of the namespace are being
+// removed.
+// Careful: do not run this method unless the table-mutex is locked!
+func (ns *namespaces) removingUsage(name string) (int, int64) {
+	var items int
+	var bytes int64
+	for item, n := range ns.removing {
+		if n == name {
+			items++
+			bytes += item.size
+		}
+	}
+	return items, bytes
+}
+
+// Evicts items of all namespaces exceeding their quotas.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) enforceQuotas(ctx context.Context) {
+	if table.namespaces == nil || table.namespaces.of == nil {
+		return
+	}
+	for name := range table.namespaces.quotas {
+		table.enforceQuota(ctx, name)
+	}
+}
+
+// Evicts the least recently used items of the namespace until it is within
+// its quota again.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) enforceQuota(ctx context.Context, name string) {
+	for {
+		// Namespaces may get reconfigured while the mutex is released.
+		ns := table.namespaces
+		if ns == nil || ns.of == nil {
+			return
+		}
+		q, ok := ns.quotas[name]
+		u := ns.usage[name]
+		if !ok || u == nil {
+			return
+		}
+		removingItems, removingBytes := ns.removingUsage(name)
+		items, bytes := u.Items-removingItems, u.Bytes-removingBytes
+		if (q.MaxItems <= 0 || items <= q.MaxItems) && (q.MaxBytes <= 0 || bytes <= q.MaxBytes) {
+			return
+		}
+
+		victim := table.namespaceVictim(name)
+		if victim == nil {
+			return
+		}
+		table.deleteInternal(ctx, victim.key, RemovalEvicted)
+	}
+}
+
+// Returns the least recently used item of the namespace. The eviction
+// segments of capacity-bounded tables are used if possible, otherwise all
+// items get scanned.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) namespaceVictim(name string) *CacheItem {
+	of := table.namespaces.of
+
+	if s := table.segments; s != nil {
+		s.Lock()
+		defer s.Unlock()
+		for _, l := range []*list.List{s.probation, s.protected} {
+			for e := l.Back(); e != nil; e = e.Prev() {
+				if item := e.Value.(*CacheItem); of(item.key) == name {
+					return item
+				}
+			}
+		}
+		return nil
+	}
+
+	var victim *CacheItem
+	table.items.each(func(item *CacheItem) {
+		if item.removing || of(item.key) != name {
+			return
+		}
+		item.RLock()
+		older := victim == nil || item.accessedOn.Before(victim.accessedOn)
+		item.RUnlock()
+		if older {
+			victim = item
+		}
+	})
+	return victim
+}
@@ -0,0 +1,135 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	defaultsMutex sync.RWMutex
+	defaults      Options
+)
+
+// Options are the table parameters which can be tuned at runtime, e.g. when
+// a configuration service pushes new settings. Zero values disable the
+// respective feature, just like passing them to the individual setters.
+type Options struct {
+	// DefaultLifeSpan is the lifespan of items built without one, see
+	// Info.DefaultLifeSpan.
+	DefaultLifeSpan time.Duration
+	// MaxItems limits the number of items, see SetMaxItems.
+	MaxItems int
+	// EarlyRefresh is the factor of probabilistic early refreshes, see
+	// SetEarlyRefresh.
+	EarlyRefresh float64
+	// MaxStaleness bounds the age of served items, see SetMaxStaleness.
+	MaxStaleness time.Duration
+	// ExpirationMode determines what lifespans count from, see
+	// SetExpirationMode.
+	ExpirationMode ExpirationMode
+	// MaxLifeSpan caps the lifetime of added items, see SetMaxLifeSpan.
+	MaxLifeSpan time.Duration
+}
+
+// SetDefaults configures the options all tables created from now on start
+// with, e.g. for platform-wide limits. Existing tables are left as they are.
+func SetDefaults(opts Options) {
+	defaultsMutex.Lock()
+	defer defaultsMutex.Unlock()
+	defaults = opts
+}
+
+// Defaults returns the options new tables start with.
+func Defaults() Options {
+	defaultsMutex.RLock()
+	defer defaultsMutex.RUnlock()
+	return defaults
+}
+
+// The environment variables OptionsFromEnv reads, and how they get applied.
+var optionsEnv = []struct {
+	name  string
+	apply func(opts *Options, value string) error
+}{
+	{"CACHE2GO_DEFAULT_LIFESPAN", func(opts *Options, value string) (err error) {
+		opts.DefaultLifeSpan, err = time.ParseDuration(value)
+		return err
+	}},
+	{"CACHE2GO_MAX_ITEMS", func(opts *Options, value string) (err error) {
+		opts.MaxItems, err = strconv.Atoi(value)
+		return err
+	}},
+	{"CACHE2GO_EARLY_REFRESH", func(opts *Options, value string) (err error) {
+		opts.EarlyRefresh, err = strconv.ParseFloat(value, 64)
+		return err
+	}},
+	{"CACHE2GO_MAX_STALENESS", func(opts *Options, value string) (err error) {
+		opts.MaxStaleness, err = time.ParseDuration(value)
+		return err
+	}},
+}
+
+// OptionsFromEnv returns opts with the fields overridden which are set in
+// the environment: CACHE2GO_DEFAULT_LIFESPAN and CACHE2GO_MAX_STALENESS as
+// durations like "5m", CACHE2GO_MAX_ITEMS as an integer and
+// CACHE2GO_EARLY_REFRESH as a float. Pass the result to SetDefaults to let
+// deployments adjust the defaults without code changes.
+func OptionsFromEnv(opts Options) (Options, error) {
+	for _, e := range optionsEnv {
+		value, ok := os.LookupEnv(e.name)
+		if !ok {
+			continue
+		}
+		if err := e.apply(&opts, value); err != nil {
+			return opts, fmt.Errorf("invalid %s: %w", e.name, err)
+		}
+	}
+	return opts, nil
+}
+
+// Options returns the table's current tunable parameters.
+func (table *CacheTable) Options() Options {
+	table.RLock()
+	defer table.RUnlock()
+
+	return Options{
+		DefaultLifeSpan: table.info.DefaultLifeSpan,
+		MaxItems:        table.maxItems,
+		EarlyRefresh:    table.earlyRefreshBeta,
+		MaxStaleness:    table.maxStaleness,
+		ExpirationMode:  table.expirationMode,
+		MaxLifeSpan:     table.maxLifeSpan,
+	}
+}
+
+// Reconfigure applies all of opts at once, so concurrent operations see
+// either the previous or the new parameters, never a mix. To change single
+// parameters, modify the result of Options. Shrinking MaxItems evicts the
+// excess items right away.
+func (table *CacheTable) Reconfigure(opts Options) {
+	table.Lock()
+	defer table.Unlock()
+
+	table.log("Reconfiguring table", table.name, "with", opts)
+	table.info.DefaultLifeSpan = opts.DefaultLifeSpan
+	table.earlyRefreshBeta = opts.EarlyRefresh
+	table.maxStaleness = opts.MaxStaleness
+	table.expirationMode = opts.ExpirationMode
+	table.maxLifeSpan = opts.MaxLifeSpan
+	if opts.MaxItems != table.maxItems {
+		table.maxItems = opts.MaxItems
+		table.resetSegments()
+		table.evictInternal(context.Background())
+	}
+}
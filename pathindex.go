@@ -0,0 +1,180 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"context"
+	"strings"
+)
+
+// DefaultPathSeparator separates the segments of path-like keys, unless
+// configured otherwise via SetPathIndex.
+const DefaultPathSeparator = "/"
+
+// A trie of path-like string keys, split at a separator.
+type pathIndex struct {
+	sep  string
+	root pathNode
+}
+
+type pathNode struct {
+	children map[string]*pathNode
+	// Whether a key ends at this node.
+	leaf bool
+}
+
+func newPathIndex(sep string) *pathIndex {
+	return &pathIndex{sep: sep}
+}
+
+func (p *pathIndex) add(key string) {
+	n := &p.root
+	for _, seg := range strings.Split(key, p.sep) {
+		c, ok := n.children[seg]
+		if !ok {
+			if n.children == nil {
+				n.children = make(map[string]*pathNode)
+			}
+			c = &pathNode{}
+			n.children[seg] = c
+		}
+		n = c
+	}
+	n.leaf = true
+}
+
+func (p *pathIndex) remove(key string) {
+	p.root.remove(strings.Split(key, p.sep))
+}
+
+// Removes the key made of segs below n and prunes nodes left empty. Returns
+// whether n itself became empty.
+func (n *pathNode) remove(segs []string) bool {
+	if len(segs) == 0 {
+		n.leaf = false
+	} else if c, ok := n.children[segs[0]]; ok && c.remove(segs[1:]) {
+		delete(n.children, segs[0])
+	}
+	return !n.leaf && len(n.children) == 0
+}
+
+// Returns key and all keys nested below it.
+func (p *pathIndex) subtree(key string) []string {
+	n := &p.root
+	for _, seg := range strings.Split(key, p.sep) {
+		if n = n.children[seg]; n == nil {
+			return nil
+		}
+	}
+
+	var keys []string
+	var walk func(n *pathNode, key string)
+	walk = func(n *pathNode, key string) {
+		if n.leaf {
+			keys = append(keys, key)
+		}
+		for seg, c := range n.children {
+			walk(c, key+p.sep+seg)
+		}
+	}
+	walk(n, key)
+
+	return keys
+}
+
+// SetPathIndex maintains an index of this table's string keys, treating them
+// as paths split at sep, e.g. "user/42/orders/7" for the separator "/". This
+// makes InvalidateSubtree cost O(subtree) instead of O(n). Pass an empty
+// separator to drop the index.
+func (table *CacheTable) SetPathIndex(sep string) {
+	table.Lock()
+	defer table.Unlock()
+
+	table.paths = nil
+	if sep != "" {
+		table.paths = newPathIndex(sep)
+		table.rebuildPathIndex()
+	}
+}
+
+// InvalidateSubtree deletes the item stored under the path-like key as well
+// as all items nested below it, e.g. "user/42" wipes "user/42/orders/7" but
+// not "user/420". It returns the number of deleted items, which is 0 for
+// read-only tables.
+func (table *CacheTable) InvalidateSubtree(key string) int {
+	if table.checkWritable() != nil {
+		return 0
+	}
+	k, err := table.normalizeKey(key)
+	if err != nil {
+		return 0
+	}
+	key, ok := k.(string)
+	if !ok {
+		return 0
+	}
+
+	table.Lock()
+	defer table.Unlock()
+
+	var keys []string
+	if table.paths != nil {
+		keys = table.paths.subtree(key)
+	} else {
+		prefix := key + DefaultPathSeparator
+		table.items.each(func(item *CacheItem) {
+			if k, ok := item.key.(string); ok && (k == key || strings.HasPrefix(k, prefix)) {
+				keys = append(keys, k)
+			}
+		})
+	}
+
+	n := 0
+	for _, k := range keys {
+		if _, err := table.deleteInternal(context.Background(), k, RemovalDeleted); err == nil {
+			n++
+		}
+	}
+	table.log("Invalidated", n, "items below", key, "in table", table.name)
+
+	return n
+}
+
+// Adds the key to the path index, if any.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) indexPath(key interface{}) {
+	if table.paths == nil {
+		return
+	}
+	if k, ok := key.(string); ok {
+		table.paths.add(k)
+	}
+}
+
+// Removes the key from the path index, if any.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) unindexPath(key interface{}) {
+	if table.paths == nil {
+		return
+	}
+	if k, ok := key.(string); ok {
+		table.paths.remove(k)
+	}
+}
+
+// Rebuilds the path index, if any, from the stored items.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) rebuildPathIndex() {
+	if table.paths == nil {
+		return
+	}
+	table.paths = newPathIndex(table.paths.sep)
+	table.items.each(func(item *CacheItem) {
+		table.indexPath(item.key)
+	})
+}
@@ -0,0 +1,501 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Persisted files start with this magic, followed by their format version.
+var persistMagic = []byte("C2GO")
+
+// Format versions of persisted files.
+const (
+	// Records are prefixed with their length.
+	persistV1 = 1
+	// Records additionally carry a CRC-32 checksum of their length and
+	// content.
+	persistV2 = 2
+
+	persistVersion    = persistV2
+	persistHeaderSize = 5
+)
+
+// Writes the header identifying a persisted file.
+func writePersistHeader(w io.Writer) error {
+	_, err := w.Write(append(persistMagic[:len(persistMagic):len(persistMagic)], persistVersion))
+	return err
+}
+
+// CorruptRecord describes a damaged record skipped while restoring a
+// persisted snapshot or log in repair mode, see SetSnapshotRepair.
+type CorruptRecord struct {
+	// Offset is the position of the record within the file.
+	Offset int64
+	// Err tells what is wrong with the record. It wraps ErrCorruptSnapshot.
+	Err error
+}
+
+// SetSnapshotRepair enables repair mode for LoadSnapshot and Persist: instead
+// of failing the whole restore, damaged records get skipped and passed to
+// report, so a single corrupt record doesn't cost the entire cache. Persist
+// rewrites the files it repaired. Pass nil to fail on damaged records again,
+// which is the default.
+func (table *CacheTable) SetSnapshotRepair(report func(CorruptRecord)) {
+	table.Lock()
+	defer table.Unlock()
+	table.snapshotRepair = report
+}
+
+// Returns the function receiving corrupt records, nil if not in repair mode.
+func (table *CacheTable) repairMode() func(CorruptRecord) {
+	table.RLock()
+	defer table.RUnlock()
+	return table.snapshotRepair
+}
+
+// Writes a change as a length-prefixed record with a checksum. Every record
+// is encoded on its own, so records can be appended to a file across
+// restarts.
+func writeRecord(w io.Writer, c Change, codec KeyCodec) error {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 8))
+	if err := NewChangeEncoder(&buf, codec).Send(c); err != nil {
+		return err
+	}
+
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b[:4], uint32(len(b)-8))
+	binary.BigEndian.PutUint32(b[4:8], recordChecksum(b[:4], b[8:]))
+	_, err := w.Write(b)
+	return err
+}
+
+// Returns the checksum of a record's length prefix and content.
+func recordChecksum(n, content []byte) uint32 {
+	return crc32.Update(crc32.ChecksumIEEE(n), crc32.IEEETable, content)
+}
+
+// Reads the records of a persisted file, verifying their checksums.
+type recordReader struct {
+	r     io.Reader
+	codec KeyCodec
+	// Format version of the file.
+	version byte
+	// Bytes read ahead, starting at offset off of the file.
+	buf []byte
+	off int64
+	// Receives damaged records to skip them, nil to fail on them instead.
+	repair func(CorruptRecord)
+	// Whether damaged records got skipped.
+	repaired bool
+}
+
+// Returns a reader for the persisted file r, after verifying its header.
+func newRecordReader(r io.Reader, codec KeyCodec, repair func(CorruptRecord)) (*recordReader, error) {
+	rr := &recordReader{r: r, codec: codec, repair: repair}
+	if err := rr.fill(persistHeaderSize); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptSnapshot, err)
+	}
+	if !bytes.Equal(rr.buf[:len(persistMagic)], persistMagic) {
+		return nil, fmt.Errorf("%w: bad header", ErrCorruptSnapshot)
+	}
+	rr.version = rr.buf[len(persistMagic)]
+	if rr.version < persistV1 || rr.version > persistVersion {
+		return nil, fmt.Errorf("%w: unsupported format version %d", ErrCorruptSnapshot, rr.version)
+	}
+	rr.skip(persistHeaderSize)
+	return rr, nil
+}
+
+// Makes sure at least n bytes are read ahead. It returns io.EOF if the file
+// ended before the first of them and io.ErrUnexpectedEOF if it ended within.
+func (rr *recordReader) fill(n int) error {
+	for len(rr.buf) < n {
+		// Read in chunks, so a damaged length doesn't allocate gigabytes.
+		chunk := n - len(rr.buf)
+		if chunk > 64<<10 {
+			chunk = 64 << 10
+		}
+		b := make([]byte, chunk)
+		m, err := io.ReadFull(rr.r, b)
+		rr.buf = append(rr.buf, b[:m]...)
+		if err == io.EOF && len(rr.buf) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Consumes n bytes read ahead.
+func (rr *recordReader) skip(n int) {
+	rr.buf = rr.buf[n:]
+	rr.off += int64(n)
+}
+
+// Errors of records failing their integrity check.
+var errChecksum = errors.New("checksum mismatch")
+
+// Returns the content of the record at the current offset and its size
+// including the prefix, without consuming it.
+func (rr *recordReader) frame() ([]byte, int, error) {
+	prefix := 4
+	if rr.version >= persistV2 {
+		prefix = 8
+	}
+	if err := rr.fill(prefix); err != nil {
+		return nil, 0, err
+	}
+	n := prefix + int(binary.BigEndian.Uint32(rr.buf[:4]))
+	if err := rr.fill(n); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	content := rr.buf[prefix:n]
+	if rr.version >= persistV2 && binary.BigEndian.Uint32(rr.buf[4:8]) != recordChecksum(rr.buf[:4], content) {
+		return nil, 0, errChecksum
+	}
+	return content, n, nil
+}
+
+// Returns the next record. It returns io.EOF at the end of the file and
+// io.ErrUnexpectedEOF for a record torn by a crash. In repair mode, damaged
+// records get reported and skipped, otherwise they fail with an error
+// wrapping ErrCorruptSnapshot.
+func (rr *recordReader) next() (Change, error) {
+	for {
+		off := rr.off
+		content, n, err := rr.frame()
+		if err == io.EOF {
+			return Change{}, err
+		}
+		if err == nil {
+			rr.skip(n)
+			var c Change
+			if c, err = NewChangeDecoder(bytes.NewReader(content), rr.codec).Next(); err == nil {
+				return c, nil
+			}
+		} else if err == io.ErrUnexpectedEOF {
+			// The record is torn, unless its length prefix is damaged and
+			// intact records follow.
+			if !rr.resync() {
+				return Change{}, err
+			}
+			err = errors.New("damaged length")
+		}
+
+		err = fmt.Errorf("%w: record at offset %d: %v", ErrCorruptSnapshot, off, err)
+		if err := rr.report(off, err); err != nil {
+			return Change{}, err
+		}
+		if rr.off == off && !rr.resync() {
+			// The length prefix can't be trusted and nothing intact follows.
+			rr.skip(len(rr.buf))
+		}
+	}
+}
+
+// Skips ahead to the next intact record in repair mode. It reports false,
+// without skipping anything, if no intact record follows. Only files with
+// checksums can be resynchronized.
+func (rr *recordReader) resync() bool {
+	if rr.repair == nil || rr.version < persistV2 {
+		return false
+	}
+
+	buf, off := rr.buf, rr.off
+	for len(rr.buf) > 0 {
+		rr.skip(1)
+		if _, _, err := rr.frame(); err == nil {
+			return true
+		}
+	}
+	rr.buf, rr.off = buf, off
+	return false
+}
+
+// Reports a damaged record in repair mode, otherwise it returns err.
+func (rr *recordReader) report(off int64, err error) error {
+	if rr.repair == nil {
+		return err
+	}
+	rr.repair(CorruptRecord{Offset: off, Err: err})
+	rr.repaired = true
+	return nil
+}
+
+// SaveSnapshot writes all items of this table to w.
+func (table *CacheTable) SaveSnapshot(w io.Writer) error {
+	codec := table.KeyCodec()
+	bw := bufio.NewWriter(w)
+	if err := writePersistHeader(bw); err != nil {
+		return err
+	}
+	for _, item := range table.Snapshot().Items() {
+		c := Change{Table: table.name, Op: ChangeSet, Key: item.key, Data: item.data,
+			LifeSpan: item.lifeSpan, Time: item.createdOn, Version: item.version}
+		if err := writeRecord(bw, c, codec); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// LoadSnapshot adds the items of a snapshot written by SaveSnapshot to this
+// table, after verifying the snapshot's format version and the checksums of
+// its records. Damaged snapshots fail with an error wrapping
+// ErrCorruptSnapshot, unless the table is in repair mode, see
+// SetSnapshotRepair.
+func (table *CacheTable) LoadSnapshot(r io.Reader) error {
+	_, err := table.loadSnapshot(r)
+	return err
+}
+
+// Works like LoadSnapshot, but also reports whether damaged records got
+// skipped.
+func (table *CacheTable) loadSnapshot(r io.Reader) (bool, error) {
+	rr, err := newRecordReader(bufio.NewReader(r), table.KeyCodec(), table.repairMode())
+	if err != nil {
+		return false, err
+	}
+	for {
+		c, err := rr.next()
+		if err == io.EOF {
+			return rr.repaired, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("%w: record at offset %d: truncated", ErrCorruptSnapshot, rr.off)
+			if err = rr.report(rr.off, err); err == nil {
+				return true, nil
+			}
+		}
+		if err != nil {
+			return false, err
+		}
+		table.apply(c)
+	}
+}
+
+// Persistence keeps a table on disk as a full snapshot plus an append-only
+// log of the changes made since, so persisting doesn't rewrite the whole
+// table. Compact folds the log into a new snapshot.
+type Persistence struct {
+	sync.Mutex
+	table  *CacheTable
+	dir    string
+	wal    *os.File
+	size   int64
+	handle CallbackHandle
+	// Compact automatically once the log exceeds this many bytes.
+	compactAt int64
+}
+
+// Names of the files in a persistence directory.
+const (
+	snapshotFile = "snapshot"
+	walFile      = "wal"
+)
+
+// Persist recovers the table from the snapshot and log in dir, if any, and
+// from then on logs every change to it. A log torn by a crash is replayed up
+// to its last complete record. Damaged records fail the recovery with an
+// error wrapping ErrCorruptSnapshot, unless the table is in repair mode, see
+// SetSnapshotRepair.
+func (table *CacheTable) Persist(dir string) (*Persistence, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	p := &Persistence{table: table, dir: dir}
+	rewrite, err := p.recover()
+	if err != nil {
+		return nil, err
+	}
+
+	wal, err := os.OpenFile(filepath.Join(dir, walFile), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if p.size, err = wal.Seek(0, io.SeekEnd); err != nil {
+		wal.Close()
+		return nil, err
+	}
+	p.wal = wal
+	if p.size == 0 {
+		err = p.resetLog()
+	} else if rewrite {
+		// Replace repaired files or those of an older format version.
+		err = p.compact()
+	}
+	if err != nil {
+		wal.Close()
+		return nil, err
+	}
+	p.handle = table.Subscribe(p.log)
+
+	return p, nil
+}
+
+// Loads the snapshot and replays the log. It reports whether the files need
+// to be rewritten, because they got repaired or are of an older format
+// version.
+func (p *Persistence) recover() (bool, error) {
+	var rewrite bool
+	f, err := os.Open(filepath.Join(p.dir, snapshotFile))
+	if err == nil {
+		rewrite, err = p.table.loadSnapshot(f)
+		f.Close()
+		if err != nil {
+			return false, err
+		}
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+
+	f, err = os.OpenFile(filepath.Join(p.dir, walFile), os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return rewrite, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	rr, err := newRecordReader(bufio.NewReader(f), p.table.KeyCodec(), p.table.repairMode())
+	if err != nil {
+		return false, err
+	}
+	for {
+		c, err := rr.next()
+		if err == io.EOF {
+			return rewrite || rr.repaired || rr.version != persistVersion, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			// Cut off the torn tail, so new records can be appended.
+			p.table.log("Truncating torn log of table", p.table.name, "at", rr.off, "bytes")
+			return rewrite || rr.repaired || rr.version != persistVersion, f.Truncate(rr.off)
+		}
+		if err != nil {
+			return false, err
+		}
+		p.table.apply(c)
+	}
+}
+
+// SetCompactThreshold makes the log get compacted automatically once it
+// exceeds the given size in bytes. A size of 0 disables automatic compaction.
+func (p *Persistence) SetCompactThreshold(bytes int64) {
+	p.Lock()
+	defer p.Unlock()
+	p.compactAt = bytes
+}
+
+// Appends a change to the log.
+func (p *Persistence) log(c Change) {
+	p.Lock()
+	defer p.Unlock()
+	if p.wal == nil {
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := writeRecord(&buf, c, p.table.KeyCodec()); err != nil {
+		p.table.log("Logging change of table", p.table.name, "failed:", err)
+		return
+	}
+	n, err := p.wal.Write(buf.Bytes())
+	p.size += int64(n)
+	if err != nil {
+		p.table.log("Logging change of table", p.table.name, "failed:", err)
+		return
+	}
+
+	if p.compactAt > 0 && p.size > p.compactAt {
+		if err := p.compact(); err != nil {
+			p.table.log("Compacting log of table", p.table.name, "failed:", err)
+		}
+	}
+}
+
+// Compact writes a new snapshot of the table and truncates the log.
+func (p *Persistence) Compact() error {
+	p.Lock()
+	defer p.Unlock()
+	if p.wal == nil {
+		return os.ErrClosed
+	}
+	return p.compact()
+}
+
+// Careful: do not run this method unless the persistence-mutex is locked!
+func (p *Persistence) compact() error {
+	tmp, err := ioutil.TempFile(p.dir, snapshotFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := p.table.SaveSnapshot(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(p.dir, snapshotFile)); err != nil {
+		return err
+	}
+
+	return p.resetLog()
+}
+
+// Empties the log, leaving only its header.
+// Careful: do not run this method unless the persistence-mutex is locked!
+func (p *Persistence) resetLog() error {
+	if err := p.wal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := p.wal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	p.size = persistHeaderSize
+	return writePersistHeader(p.wal)
+}
+
+// Close stops logging changes and closes the log.
+func (p *Persistence) Close() error {
+	p.table.RemoveCallback(p.handle)
+
+	p.Lock()
+	defer p.Unlock()
+	if p.wal == nil {
+		return os.ErrClosed
+	}
+	err := p.wal.Close()
+	p.wal = nil
+	return err
+}
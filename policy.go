@@ -0,0 +1,220 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"container/list"
+	"sync"
+)
+
+// EvictionPolicy decides which item a capacity-bounded table evicts once it
+// exceeds its maximum number of items, see SetMaxItems. The table reports
+// every item it adds, accesses and removes. Accesses get reported
+// concurrently with each other, so implementations must be safe for
+// concurrent use.
+type EvictionPolicy interface {
+	// OnAdd registers an item added to the table.
+	OnAdd(item *CacheItem)
+	// OnAccess records an access to an item registered before.
+	OnAccess(item *CacheItem)
+	// OnRemove unregisters an item removed from the table.
+	OnRemove(item *CacheItem)
+	// Victim returns the item to evict next, nil if there is none.
+	Victim() *CacheItem
+}
+
+// EvictionPreviewer can be implemented by an EvictionPolicy to report which
+// items it would evict next, see CacheTable.EvictionCandidates.
+type EvictionPreviewer interface {
+	// Candidates returns up to n items in the order Victim would return
+	// them if they got evicted one after another, without changing the
+	// policy's state.
+	Candidates(n int) []*CacheItem
+}
+
+// SetEvictionPolicy makes capacity-bounded tables evict according to
+// policies created by newPolicy, e.g. LRU. The table creates a new policy
+// whenever its capacity changes and registers all its items with it, least
+// recently accessed first. Pass nil to restore the built-in eviction, which
+// supports SetSegmented and SetEvictionSamples.
+func (table *CacheTable) SetEvictionPolicy(newPolicy func() EvictionPolicy) {
+	table.Lock()
+	defer table.Unlock()
+	table.newPolicy = newPolicy
+	table.resetSegments()
+}
+
+// LRU returns an EvictionPolicy evicting the least recently used item.
+func LRU() EvictionPolicy {
+	return &lru{
+		order:    list.New(),
+		elements: make(map[*CacheItem]*list.Element),
+	}
+}
+
+type lru struct {
+	sync.Mutex
+	// Items from most to least recently used.
+	order    *list.List
+	elements map[*CacheItem]*list.Element
+}
+
+func (p *lru) OnAdd(item *CacheItem) {
+	p.Lock()
+	defer p.Unlock()
+	p.elements[item] = p.order.PushFront(item)
+}
+
+func (p *lru) OnAccess(item *CacheItem) {
+	p.Lock()
+	defer p.Unlock()
+	if e, ok := p.elements[item]; ok {
+		p.order.MoveToFront(e)
+	}
+}
+
+func (p *lru) OnRemove(item *CacheItem) {
+	p.Lock()
+	defer p.Unlock()
+	if e, ok := p.elements[item]; ok {
+		p.order.Remove(e)
+		delete(p.elements, item)
+	}
+}
+
+func (p *lru) Victim() *CacheItem {
+	p.Lock()
+	defer p.Unlock()
+	if e := p.order.Back(); e != nil {
+		return e.Value.(*CacheItem)
+	}
+	return nil
+}
+
+func (p *lru) Candidates(n int) []*CacheItem {
+	p.Lock()
+	defer p.Unlock()
+	var r []*CacheItem
+	for e := p.order.Back(); e != nil && len(r) < n; e = e.Prev() {
+		r = append(r, e.Value.(*CacheItem))
+	}
+	return r
+}
+
+// SIEVE returns an EvictionPolicy implementing the SIEVE algorithm: items
+// are kept in insertion order and get marked when accessed. A hand sweeps
+// from the oldest to the newest item, unmarking marked items and evicting
+// the first unmarked one. It is simpler than LRU, as accesses don't reorder
+// items, and tends to keep more popular items on skewed workloads.
+func SIEVE() EvictionPolicy {
+	return &sieve{
+		order: list.New(),
+		nodes: make(map[*CacheItem]*sieveNode),
+	}
+}
+
+type sieve struct {
+	sync.Mutex
+	// Items from newest to oldest, as *sieveNode.
+	order *list.List
+	nodes map[*CacheItem]*sieveNode
+	// Next element to be examined, nil to start at the oldest one.
+	hand *list.Element
+}
+
+type sieveNode struct {
+	item    *CacheItem
+	element *list.Element
+	visited bool
+}
+
+func (p *sieve) OnAdd(item *CacheItem) {
+	p.Lock()
+	defer p.Unlock()
+	n := &sieveNode{item: item}
+	n.element = p.order.PushFront(n)
+	p.nodes[item] = n
+}
+
+func (p *sieve) OnAccess(item *CacheItem) {
+	p.Lock()
+	defer p.Unlock()
+	if n, ok := p.nodes[item]; ok {
+		n.visited = true
+	}
+}
+
+func (p *sieve) OnRemove(item *CacheItem) {
+	p.Lock()
+	defer p.Unlock()
+	n, ok := p.nodes[item]
+	if !ok {
+		return
+	}
+	if p.hand == n.element {
+		p.hand = n.element.Prev()
+	}
+	p.order.Remove(n.element)
+	delete(p.nodes, item)
+}
+
+func (p *sieve) Victim() *CacheItem {
+	p.Lock()
+	defer p.Unlock()
+	if p.order.Len() == 0 {
+		return nil
+	}
+
+	e := p.hand
+	if e == nil {
+		e = p.order.Back()
+	}
+	for {
+		n := e.Value.(*sieveNode)
+		if !n.visited {
+			p.hand = e
+			return n.item
+		}
+		n.visited = false
+		if e = e.Prev(); e == nil {
+			e = p.order.Back()
+		}
+	}
+}
+
+func (p *sieve) Candidates(n int) []*CacheItem {
+	p.Lock()
+	defer p.Unlock()
+	if n > p.order.Len() {
+		n = p.order.Len()
+	}
+
+	// Sweep like Victim would, tracking the marks it would clear and the
+	// items it would evict on the side.
+	var r []*CacheItem
+	unmarked := make(map[*list.Element]bool)
+	evicted := make(map[*list.Element]bool)
+	e := p.hand
+	if e == nil {
+		e = p.order.Back()
+	}
+	for len(r) < n {
+		if !evicted[e] {
+			if node := e.Value.(*sieveNode); node.visited && !unmarked[e] {
+				unmarked[e] = true
+			} else {
+				evicted[e] = true
+				r = append(r, node.item)
+			}
+		}
+		if e = e.Prev(); e == nil {
+			e = p.order.Back()
+		}
+	}
+	return r
+}
@@ -0,0 +1,128 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// PriorityQueue is a heap of prioritized values stored as the data of a
+// cache item. It gets created by CacheTable.PQPush and vanishes once its
+// item expires.
+type PriorityQueue struct {
+	mu      sync.Mutex
+	entries pqHeap
+	// Number of values pushed so far, to pop equal priorities in order.
+	seq uint64
+}
+
+type pqEntry struct {
+	value    interface{}
+	priority int64
+	seq      uint64
+}
+
+// Orders the entries by descending priority, then by insertion.
+type pqHeap []pqEntry
+
+func (h pqHeap) Len() int      { return len(h) }
+func (h pqHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h pqHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+func (h *pqHeap) Push(x interface{}) { *h = append(*h, x.(pqEntry)) }
+func (h *pqHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = pqEntry{}
+	*h = old[:len(old)-1]
+	return e
+}
+
+// Len returns the number of values in this queue.
+func (q *PriorityQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.entries)
+}
+
+// Estimates the size of this queue while holding its lock, see EstimateSize.
+func (q *PriorityQueue) estimateSize() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return reflectSize(q)
+}
+
+// Returns the priority queue stored under key, keeping its item alive. If
+// there is none and create is set, a queue with the given lifespan gets
+// added.
+func (table *CacheTable) priorityQueue(key interface{}, lifeSpan time.Duration, create bool) (*PriorityQueue, error) {
+	var newQueue func() interface{}
+	if create {
+		newQueue = func() interface{} {
+			return &PriorityQueue{}
+		}
+	}
+	item, err := table.container(key, lifeSpan, newQueue)
+	if err != nil {
+		return nil, err
+	}
+
+	q, ok := item.data.(*PriorityQueue)
+	if !ok {
+		return nil, ErrWrongType
+	}
+
+	return q, nil
+}
+
+// PQPush adds value with the given priority to the priority queue stored
+// under key, creating the queue with the given lifespan if it does not
+// exist yet. It returns ErrWrongType if key holds something other than a
+// priority queue.
+func (table *CacheTable) PQPush(key interface{}, lifeSpan time.Duration, value interface{}, priority int64) error {
+	q, err := table.priorityQueue(key, lifeSpan, true)
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.seq++
+	heap.Push(&q.entries, pqEntry{value: value, priority: priority, seq: q.seq})
+
+	return nil
+}
+
+// PQPop removes and returns the value with the highest priority from the
+// priority queue stored under key, along with its priority. Values of equal
+// priority get popped in the order they were pushed. It returns
+// ErrKeyNotFound if the queue does not exist or is empty.
+func (table *CacheTable) PQPop(key interface{}) (interface{}, int64, error) {
+	if err := table.checkWritable(); err != nil {
+		return nil, 0, err
+	}
+	q, err := table.priorityQueue(key, 0, false)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.entries) == 0 {
+		return nil, 0, ErrKeyNotFound
+	}
+	e := heap.Pop(&q.entries).(pqEntry)
+
+	return e.value, e.priority, nil
+}
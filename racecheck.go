@@ -0,0 +1,69 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sync/atomic"
+)
+
+// Whether race checks are enabled, accessed atomically.
+var raceChecks int32
+
+// EnableRaceChecks turns on a debug mode which helps finding unsynchronized
+// access to mutable item data. Cache items hand out their data as is, so
+// callers sharing e.g. a map between goroutines must only modify it via
+// CacheItem.WithLock. In this mode items fingerprint their data and log,
+// via the standard logger, when:
+//
+//   - the data changed without WithLock, e.g. after being modified through a
+//     reference obtained from Data,
+//   - the data changed within WithRLock,
+//   - Data is called while another goroutine modifies the data in WithLock.
+//
+// Fingerprinting formats the data on every access, so this mode is slow and
+// meant for tests and debugging only. Detection is best effort.
+func EnableRaceChecks() {
+	atomic.StoreInt32(&raceChecks, 1)
+}
+
+// DisableRaceChecks turns off the debug mode enabled by EnableRaceChecks.
+func DisableRaceChecks() {
+	atomic.StoreInt32(&raceChecks, 0)
+}
+
+func raceChecksEnabled() bool {
+	return atomic.LoadInt32(&raceChecks) != 0
+}
+
+// Returns a fingerprint of the item's data. It is never 0, which marks an
+// item without fingerprint.
+// Careful: do not run this method unless the data-mutex is at least
+// read-locked!
+func (item *CacheItem) dataFingerprint() uint64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%#v", item.data)
+	return h.Sum64() | 1
+}
+
+// Compares the item's data with its last fingerprint and stores the current
+// one.
+// Careful: do not run this method unless the data-mutex is at least
+// read-locked!
+func (item *CacheItem) checkFingerprint(op string) {
+	fp := item.dataFingerprint()
+	if old := atomic.SwapUint64(&item.fingerprint, fp); old != 0 && old != fp {
+		raceReport(item, "data changed without WithLock, detected by "+op)
+	}
+}
+
+func raceReport(item *CacheItem, msg string) {
+	log.Printf("cache2go: race check: item %v: %s", item.key, msg)
+}
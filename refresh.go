@@ -0,0 +1,71 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// SetEarlyRefresh enables probabilistic early refreshes of items loaded by
+// the data-loader. As an item approaches the end of its lifespan, Value
+// occasionally treats it as a miss and reloads it, spreading reloads of
+// popular keys over time instead of having them all miss at once. The
+// probability grows with beta and with how long the item took to load;
+// a beta of 1 is a sensible default, 0 disables early refreshes.
+func (table *CacheTable) SetEarlyRefresh(beta float64) {
+	table.Lock()
+	defer table.Unlock()
+	table.earlyRefreshBeta = beta
+}
+
+// SetMaxStaleness puts a hard bound on the age of the data this table
+// serves. Items added or revalidated longer than d ago get reloaded by the
+// data-loader on access, even if their sliding lifespan keeps getting renewed. If the
+// data-loader fails or there is none, such items are treated as missing
+// instead of being served. A d of 0 disables the bound, which is the default.
+func (table *CacheTable) SetMaxStaleness(d time.Duration) {
+	table.Lock()
+	defer table.Unlock()
+	table.maxStaleness = d
+}
+
+// Reports whether this item is older than maxStaleness allows.
+func (item *CacheItem) stale(maxStaleness time.Duration) bool {
+	if maxStaleness <= 0 {
+		return false
+	}
+	item.RLock()
+	defer item.RUnlock()
+	t := item.createdOn
+	if item.validatedOn.After(t) {
+		t = item.validatedOn
+	}
+	return time.Since(t) > maxStaleness
+}
+
+// Decides whether this item should get refreshed ahead of its expiration,
+// using the XFetch algorithm.
+func (item *CacheItem) refreshEarly(beta float64) bool {
+	if beta <= 0 {
+		return false
+	}
+
+	item.RLock()
+	remaining, expires := item.remaining(time.Now())
+	delta := item.loadDuration
+	item.RUnlock()
+
+	if !expires || delta == 0 {
+		return false
+	}
+
+	gap := -float64(delta) * beta * math.Log(1-rand.Float64())
+	return gap >= float64(remaining)
+}
@@ -0,0 +1,148 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"context"
+	"reflect"
+	"time"
+)
+
+// Reload replaces the entire content of this table with the items loader
+// adds. The new content gets built in a shadow structure and swapped in
+// atomically, so readers never see an empty or half-filled table. If loader
+// or one of its adds fails, the table is left untouched.
+//
+// Afterwards the AddedItem callbacks run for every added or changed item and
+// the AboutToDeleteItem callbacks for every item missing from the new
+// content. Items whose lifespan and data are unchanged keep their access
+// statistics and trigger no callbacks.
+func (table *CacheTable) Reload(loader func(add func(key interface{}, lifeSpan time.Duration, data interface{})) error) error {
+	return table.ReloadCtx(context.Background(), loader)
+}
+
+// ReloadCtx works like Reload, but passes ctx on to the callbacks.
+func (table *CacheTable) ReloadCtx(ctx context.Context, loader func(add func(key interface{}, lifeSpan time.Duration, data interface{})) error) error {
+	if err := table.checkWritable(); err != nil {
+		return err
+	}
+
+	table.RLock()
+	start := table.items
+	shadow := newStore(start.hasher)
+	table.RUnlock()
+
+	var addErr error
+	err := loader(func(key interface{}, lifeSpan time.Duration, data interface{}) {
+		if addErr != nil {
+			return
+		}
+		key, err := table.normalizeKey(key)
+		if err == nil {
+			err = table.validate(key, data)
+		}
+		if err != nil {
+			addErr = err
+			return
+		}
+		shadow.set(NewCacheItem(key, lifeSpanFor(lifeSpan, data), data))
+	})
+	if err == nil {
+		err = addErr
+	}
+	if err != nil {
+		return err
+	}
+
+	table.Lock()
+	old := table.items
+	if old != start {
+		// The table got flushed or its hasher changed meanwhile.
+		fresh := newStore(old.hasher)
+		shadow.each(fresh.set)
+		shadow = fresh
+	}
+
+	var removed, changed, unchanged []*CacheItem
+	old.each(func(item *CacheItem) {
+		if _, ok := shadow.get(item.key); !ok {
+			removed = append(removed, item)
+		}
+	})
+	shadow.each(func(item *CacheItem) {
+		o, ok := old.get(item.key)
+		if !ok {
+			table.audit(ctx, AuditAdded, item)
+		} else if o.LifeSpan() == item.lifeSpan && reflect.DeepEqual(o.data, item.data) {
+			unchanged = append(unchanged, o)
+			return
+		} else {
+			table.audit(ctx, AuditUpdated, item)
+			item.aliases = o.aliases
+		}
+		table.applyExpiration(item)
+		item.version = table.versionFor(ctx)
+		table.churnAdded()
+		item.owner = table
+		changed = append(changed, item)
+	})
+	// Unchanged items keep their sizes, the new ones get estimated.
+	sizes := make(map[*CacheItem]int64, len(unchanged))
+	for _, item := range unchanged {
+		shadow.set(item)
+		sizes[item] = item.size
+	}
+	removedVersions := make([]HLC, len(removed))
+	for i, item := range removed {
+		removedVersions[i] = table.versionFor(ctx)
+		item.RLock()
+		table.recordRemoval(item, RemovalDeleted)
+		table.audit(ctx, AuditDeleted, item)
+		item.RUnlock()
+		table.removeAliases(item)
+	}
+
+	table.log("Reloaded table", table.name, "with", len(changed), "changed and", len(removed), "removed items")
+	table.items = shadow
+	table.rebuildPathIndex()
+	table.rebuildNamespaces(sizes)
+	table.rebuildMemory(sizes)
+	table.rebuildGenerations()
+	table.updateCount()
+	table.resetSegments()
+	table.enforceQuotas(ctx)
+	table.evictInternal(ctx)
+
+	// Cache values so we don't keep blocking the mutex.
+	addedItem := table.addedItem
+	aboutToDeleteItem := table.aboutToDeleteItem
+	changeSubscribers := table.changeSubscribers
+	table.Unlock()
+
+	for i, item := range removed {
+		for _, callback := range aboutToDeleteItem {
+			callback.fn(ctx, item)
+		}
+		table.publish(changeSubscribers, Change{Op: ChangeDelete, Key: item.key, Version: removedVersions[i], Reason: RemovalDeleted})
+
+		item.RLock()
+		for _, callback := range item.aboutToExpire {
+			callback.fn(item.key)
+		}
+		item.RUnlock()
+	}
+	for _, item := range changed {
+		for _, callback := range addedItem {
+			callback.fn(ctx, item)
+		}
+		table.publish(changeSubscribers, Change{Op: ChangeSet, Key: item.key, Data: item.data, LifeSpan: item.lifeSpan, Time: item.CreatedOn(), Version: item.version})
+	}
+
+	table.expirationCheck()
+	return nil
+}
@@ -0,0 +1,288 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"context"
+	"encoding/gob"
+	"io"
+	"time"
+)
+
+// ChangeOp is the kind of modification a Change describes.
+type ChangeOp int
+
+const (
+	// ChangeSet means an item got added or replaced.
+	ChangeSet ChangeOp = iota
+	// ChangeDelete means an item got removed.
+	ChangeDelete
+	// ChangeFlush means the table got flushed.
+	ChangeFlush
+)
+
+// Change describes a single modification of a cache table, as published to
+// its subscribers and replicated to other tables.
+type Change struct {
+	Table    string
+	Op       ChangeOp
+	Key      interface{}
+	Data     interface{}
+	LifeSpan time.Duration
+	Time     time.Time
+	// Version orders the change among those of all replicas, if the table
+	// has a replica ID.
+	Version HLC
+	// Reason is why the item got removed, for ChangeDelete.
+	Reason RemovalReason
+}
+
+// ChangeSink consumes a stream of changes, e.g. by sending them to another
+// process.
+type ChangeSink interface {
+	Send(c Change) error
+}
+
+// ChangeSource produces a stream of changes, e.g. received from another
+// process. Next returns io.EOF at the end of the stream.
+type ChangeSource interface {
+	Next() (Change, error)
+}
+
+// A change subscriber registered with a table.
+type changeCallback struct {
+	handle CallbackHandle
+	fn     func(c Change)
+}
+
+// Subscribe calls f for every change to this table. Like the AddedItem and
+// AboutToDeleteItem callbacks, f runs synchronously and must not block. Use
+// RemoveCallback with the returned handle to unsubscribe.
+func (table *CacheTable) Subscribe(f func(c Change)) CallbackHandle {
+	table.Lock()
+	defer table.Unlock()
+	h := newCallbackHandle()
+	table.changeSubscribers = append(table.changeSubscribers, changeCallback{handle: h, fn: f})
+	return h
+}
+
+// Replicate sends every change to this table to sink. If the table has a
+// replica ID, changes replicated from other replicas are skipped. Errors
+// sending a change get logged. Use RemoveCallback with the returned handle
+// to stop.
+func (table *CacheTable) Replicate(sink ChangeSink) CallbackHandle {
+	return table.Subscribe(func(c Change) {
+		table.RLock()
+		clock := table.clock
+		table.RUnlock()
+		if clock != nil && c.Version.Node != clock.node {
+			return
+		}
+
+		if err := sink.Send(c); err != nil {
+			table.log("Replicating change of table", table.name, "failed:", err)
+		}
+	})
+}
+
+// Calls the change subscribers.
+// Careful: do not run this method while holding the table-mutex!
+func (table *CacheTable) publish(subscribers []changeCallback, c Change) {
+	if len(subscribers) == 0 {
+		return
+	}
+	c.Table = table.name
+	if c.Time.IsZero() {
+		c.Time = time.Now()
+	}
+	for _, s := range subscribers {
+		s.fn(c)
+	}
+}
+
+// SetReadOnly configures whether this table rejects modifications with
+// ErrReadOnly. This covers Add, NotFoundAdd and their variants, Delete,
+// SoftDelete, Reload, Alias, AddContent and ReleaseContent, the hash, list
+// and priority queue helpers as well as Acquire and Release, while
+// InvalidateSubtree deletes nothing. Expiry, eviction and Flush still apply,
+// as do changes applied via ApplyChanges, Ingest and LoadSnapshot.
+func (table *CacheTable) SetReadOnly(readOnly bool) {
+	table.Lock()
+	defer table.Unlock()
+	table.readOnly = readOnly
+}
+
+// Returns ErrReadOnly if the table rejects modifications.
+func (table *CacheTable) checkWritable() error {
+	table.RLock()
+	defer table.RUnlock()
+	if table.readOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// Mirror turns this table into a read-only copy of another table, applying
+// the changes read from src until it is exhausted. It blocks, so it is
+// usually run in a goroutine of its own. It returns nil once src returns
+// io.EOF, and any other error src returns.
+func (table *CacheTable) Mirror(src ChangeSource) error {
+	table.SetReadOnly(true)
+	return table.ApplyChanges(src)
+}
+
+// ApplyChanges applies the changes read from src, e.g. replicated from
+// another replica, until it is exhausted. Unlike Mirror it leaves the table
+// writable. It returns nil once src returns io.EOF, and any other error src
+// returns.
+func (table *CacheTable) ApplyChanges(src ChangeSource) error {
+	for {
+		c, err := src.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		table.apply(c)
+	}
+}
+
+// Applies a replicated change, bypassing the read-only check. Versioned
+// changes older than the local item are ignored, unless a merge function is
+// configured.
+func (table *CacheTable) apply(c Change) {
+	ctx := context.Background()
+	if !c.Version.IsZero() {
+		ctx = context.WithValue(ctx, changeVersionKey{}, c.Version)
+	}
+
+	switch c.Op {
+	case ChangeSet:
+		key, err := table.normalizeKey(c.Key)
+		if err != nil {
+			table.log("Ignoring replicated change of table", table.name, ":", err)
+			return
+		}
+		item := NewCacheItem(key, c.LifeSpan, c.Data)
+		item.version = c.Version
+
+		table.Lock()
+		if table.clock != nil && !c.Version.IsZero() {
+			table.clock.update(c.Version)
+		}
+		if local, ok := table.items.get(key); ok {
+			switch {
+			case table.replicationMerge != nil:
+				item.data = table.replicationMerge(key, local.data, item.data)
+				if c.Version.Less(local.version) {
+					item.version = local.version
+				}
+			case c.Version.Less(local.version):
+				// The local item is newer, keep it.
+				table.Unlock()
+				return
+			}
+		}
+		table.addInternal(ctx, item)
+	case ChangeDelete:
+		key, err := table.normalizeKey(c.Key)
+		if err != nil {
+			table.log("Ignoring replicated change of table", table.name, ":", err)
+			return
+		}
+		table.Lock()
+		if table.clock != nil && !c.Version.IsZero() {
+			table.clock.update(c.Version)
+		}
+		if local, ok := table.items.get(key); !ok || !c.Version.Less(local.version) {
+			table.deleteInternal(ctx, key, c.Reason)
+		}
+		table.Unlock()
+	case ChangeFlush:
+		table.Lock()
+		if table.clock != nil && !c.Version.IsZero() {
+			table.clock.update(c.Version)
+		}
+		table.Unlock()
+		table.flush(ctx)
+	}
+}
+
+// The wire format of a change. Keys get encoded with a KeyCodec, data with
+// gob, so types other than Go's basic ones must be registered via
+// gob.Register.
+type wireChange struct {
+	Table    string
+	Op       ChangeOp
+	Key      []byte
+	Data     interface{}
+	LifeSpan time.Duration
+	Time     time.Time
+	Version  HLC
+	Reason   RemovalReason
+}
+
+// ChangeEncoder is a ChangeSink writing changes to a stream.
+type ChangeEncoder struct {
+	enc   *gob.Encoder
+	codec KeyCodec
+}
+
+// NewChangeEncoder returns a ChangeEncoder writing to w, encoding keys with
+// codec. Pass a nil codec to use DefaultKeyCodec.
+func NewChangeEncoder(w io.Writer, codec KeyCodec) *ChangeEncoder {
+	if codec == nil {
+		codec = DefaultKeyCodec
+	}
+	return &ChangeEncoder{enc: gob.NewEncoder(w), codec: codec}
+}
+
+// Send writes a change to the stream.
+func (e *ChangeEncoder) Send(c Change) error {
+	wc := wireChange{Table: c.Table, Op: c.Op, Data: c.Data, LifeSpan: c.LifeSpan, Time: c.Time, Version: c.Version, Reason: c.Reason}
+	if c.Op != ChangeFlush {
+		var err error
+		if wc.Key, err = e.codec.EncodeKey(c.Key); err != nil {
+			return err
+		}
+	}
+	return e.enc.Encode(&wc)
+}
+
+// ChangeDecoder is a ChangeSource reading changes written by a ChangeEncoder.
+type ChangeDecoder struct {
+	dec   *gob.Decoder
+	codec KeyCodec
+}
+
+// NewChangeDecoder returns a ChangeDecoder reading from r, decoding keys with
+// codec. Pass a nil codec to use DefaultKeyCodec.
+func NewChangeDecoder(r io.Reader, codec KeyCodec) *ChangeDecoder {
+	if codec == nil {
+		codec = DefaultKeyCodec
+	}
+	return &ChangeDecoder{dec: gob.NewDecoder(r), codec: codec}
+}
+
+// Next reads the next change from the stream.
+func (d *ChangeDecoder) Next() (Change, error) {
+	var wc wireChange
+	if err := d.dec.Decode(&wc); err != nil {
+		return Change{}, err
+	}
+
+	c := Change{Table: wc.Table, Op: wc.Op, Data: wc.Data, LifeSpan: wc.LifeSpan, Time: wc.Time, Version: wc.Version, Reason: wc.Reason}
+	if wc.Op != ChangeFlush {
+		var err error
+		if c.Key, err = d.codec.DecodeKey(wc.Key); err != nil {
+			return Change{}, err
+		}
+	}
+	return c, nil
+}
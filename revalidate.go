@@ -0,0 +1,36 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"context"
+	"time"
+)
+
+type staleItemKey struct{}
+
+// StaleItem returns the cached item a data-loader got called to refresh, e.g.
+// by SetEarlyRefresh or SetMaxStaleness. Its ETag allows for conditional
+// fetches, like HTTP's If-None-Match. If the data is still current, the
+// data-loader can return this very item, which then merely gets its lifespan
+// extended instead of being replaced.
+func StaleItem(ctx context.Context) (*CacheItem, bool) {
+	item, ok := ctx.Value(staleItemKey{}).(*CacheItem)
+	return item, ok
+}
+
+// Marks the item's data as confirmed to be current by the data-loader,
+// renewing its lifespan and staleness. With ExpireAfterWrite, this restarts
+// the lifespan just like replacing the item would.
+func (item *CacheItem) revalidated() {
+	item.Lock()
+	defer item.Unlock()
+	now := time.Now()
+	item.accessedOn = now
+	item.validatedOn = now
+}
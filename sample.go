@@ -0,0 +1,47 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"math/rand"
+)
+
+// Sample returns up to count items picked uniformly at random from this
+// table, without iterating over all of its items.
+func (table *CacheTable) Sample(count int) []*CacheItem {
+	table.RLock()
+	defer table.RUnlock()
+
+	n := table.items.len()
+	if count > n {
+		count = n
+	}
+	if count <= 0 {
+		return nil
+	}
+
+	r := make([]*CacheItem, 0, count)
+	if count > n/2 {
+		// Picking most items, a permutation is the cheaper way.
+		for _, i := range rand.Perm(n)[:count] {
+			r = append(r, table.items.at(i))
+		}
+		return r
+	}
+
+	picked := make(map[int]bool, count)
+	for len(r) < count {
+		i := rand.Intn(n)
+		if !picked[i] {
+			picked[i] = true
+			r = append(r, table.items.at(i))
+		}
+	}
+
+	return r
+}
@@ -0,0 +1,260 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Schedule describes a recurring point in time, like the end of each day.
+type Schedule interface {
+	// Next returns the first occurrence of the schedule after t, or the zero
+	// time if there is none.
+	Next(t time.Time) time.Time
+}
+
+type endOfDay struct {
+	loc *time.Location
+}
+
+// EndOfDay returns a Schedule occurring at each midnight in the given
+// location, e.g. time.UTC.
+func EndOfDay(loc *time.Location) Schedule {
+	return endOfDay{loc: loc}
+}
+
+func (s endOfDay) Next(t time.Time) time.Time {
+	t = t.In(s.loc)
+	return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, s.loc)
+}
+
+// Bounds of the cron fields.
+var cronBounds = [5]struct{ min, max int }{
+	{0, 59}, // minute
+	{0, 23}, // hour
+	{1, 31}, // day of month
+	{1, 12}, // month
+	{0, 6},  // day of week
+}
+
+var cronDescriptors = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+}
+
+type cronSchedule struct {
+	// Bitsets of the matching values per field.
+	fields [5]uint64
+	// Whether day of month or day of week are restricted.
+	domStar, dowStar bool
+	loc              *time.Location
+}
+
+// ParseSchedule parses a standard five field cron expression like
+// "30 4 * * 1-5" (minute, hour, day of month, month, day of week), or one of
+// the descriptors @hourly, @daily, @midnight, @weekly, @monthly, @yearly.
+// Fields support lists, ranges and steps. The schedule is evaluated in the
+// local time zone, unless the spec is prefixed with CRON_TZ=<location>, e.g.
+// "CRON_TZ=Europe/Berlin 0 6 * * *".
+func ParseSchedule(spec string) (Schedule, error) {
+	s := &cronSchedule{loc: time.Local}
+
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "CRON_TZ=") {
+		i := strings.IndexByte(spec, ' ')
+		if i < 0 {
+			return nil, fmt.Errorf("Invalid schedule %q: missing fields", spec)
+		}
+		loc, err := time.LoadLocation(spec[len("CRON_TZ="):i])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid schedule %q: %v", spec, err)
+		}
+		s.loc = loc
+		spec = strings.TrimSpace(spec[i:])
+	}
+	if d, ok := cronDescriptors[spec]; ok {
+		spec = d
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronBounds) {
+		return nil, fmt.Errorf("Invalid schedule %q: expected %d fields", spec, len(cronBounds))
+	}
+	for i, f := range fields {
+		bits, err := parseCronField(f, cronBounds[i].min, cronBounds[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid schedule %q: %v", spec, err)
+		}
+		s.fields[i] = bits
+	}
+	s.domStar = fields[2] == "*"
+	s.dowStar = fields[4] == "*"
+
+	return s, nil
+}
+
+// Parses a comma separated list of values, ranges and steps into a bitset.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			var err error
+			bounds := strings.SplitN(part, "-", 2)
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value %q", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("value %q out of range %d-%d", part, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (s *cronSchedule) matches(field, v int) bool {
+	return s.fields[field]&(1<<uint(v)) != 0
+}
+
+// Whether the schedule matches the day of t. As with cron, if both day of
+// month and day of week are restricted, matching either one is enough.
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	dom := s.matches(2, t.Day())
+	dow := s.matches(4, int(t.Weekday()))
+	if !s.domStar && !s.dowStar {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+func (s *cronSchedule) Next(t time.Time) time.Time {
+	t = t.In(s.loc).Truncate(time.Minute).Add(time.Minute)
+
+	// Give up after five years without a match, e.g. for February 30th.
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if !s.matches(3, int(t.Month())) {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, s.loc)
+			continue
+		}
+		if !s.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, s.loc)
+			continue
+		}
+		if !s.matches(1, t.Hour()) {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, s.loc)
+			continue
+		}
+		if !s.matches(0, t.Minute()) {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// ScheduleRefresh runs refreshFn with this table at every occurrence of the
+// cron spec, see ParseSchedule for its format, e.g. to flush and re-warm the
+// table each night. Runs are skipped while the previous one is still in
+// progress, and panics in refreshFn are recovered and logged. Call the
+// returned function to stop the schedule.
+func (table *CacheTable) ScheduleRefresh(spec string, refreshFn func(*CacheTable)) (stop func(), err error) {
+	s, err := ParseSchedule(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &scheduledRefresh{table: table, schedule: s, fn: refreshFn}
+	r.arm()
+	return r.stop, nil
+}
+
+type scheduledRefresh struct {
+	sync.Mutex
+	table    *CacheTable
+	schedule Schedule
+	fn       func(*CacheTable)
+	timer    *time.Timer
+	stopped  bool
+	// Whether fn is currently running, accessed atomically.
+	running int32
+}
+
+// Sets up the timer for the next occurrence of the schedule.
+func (r *scheduledRefresh) arm() {
+	r.Lock()
+	defer r.Unlock()
+	if r.stopped {
+		return
+	}
+
+	now := time.Now()
+	next := r.schedule.Next(now)
+	if next.IsZero() {
+		return
+	}
+	r.timer = time.AfterFunc(next.Sub(now), r.run)
+}
+
+func (r *scheduledRefresh) run() {
+	r.arm()
+
+	if !atomic.CompareAndSwapInt32(&r.running, 0, 1) {
+		r.table.log("Skipping scheduled refresh for table", r.table.name, "as the previous one is still running")
+		return
+	}
+	defer atomic.StoreInt32(&r.running, 0)
+	defer func() {
+		if err := recover(); err != nil {
+			r.table.log("Scheduled refresh for table", r.table.name, "panicked:", err)
+		}
+	}()
+
+	r.fn(r.table)
+}
+
+func (r *scheduledRefresh) stop() {
+	r.Lock()
+	defer r.Unlock()
+	r.stopped = true
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+}
@@ -0,0 +1,116 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"sync"
+	"time"
+)
+
+// Semaphore is a weighted semaphore stored as the data of a cache item. It
+// gets created by CacheTable.Acquire and vanishes once its item expires.
+type Semaphore struct {
+	mu       sync.Mutex
+	capacity int64
+	used     int64
+}
+
+// Capacity returns the total weight this semaphore can hand out.
+func (s *Semaphore) Capacity() int64 {
+	// immutable
+	return s.capacity
+}
+
+// Used returns the weight currently held.
+func (s *Semaphore) Used() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.used
+}
+
+// Acquire takes n units from the semaphore stored under key, creating it with
+// the given capacity if it does not exist yet. The semaphore item gets kept
+// alive by every Acquire and Release and expires after ttl without either.
+// It returns ErrSemaphoreFull if fewer than n units are available,
+// ErrSemaphoreUnits if n is not positive, and ErrWrongType if key holds
+// something other than a semaphore.
+func (table *CacheTable) Acquire(key interface{}, n, capacity int64, ttl time.Duration) error {
+	if err := table.checkWritable(); err != nil {
+		return err
+	}
+	if n <= 0 {
+		return ErrSemaphoreUnits
+	}
+	key, err := table.resolveKey(key)
+	if err != nil {
+		return err
+	}
+
+	table.RLock()
+	item, ok := table.items.get(key)
+	table.RUnlock()
+	if !ok {
+		if item, err = table.addContainer(key, ttl, &Semaphore{capacity: capacity}); err != nil {
+			return err
+		}
+	}
+
+	s, ok := item.data.(*Semaphore)
+	if !ok {
+		return ErrWrongType
+	}
+	item.KeepAlive()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.used+n > s.capacity {
+		return ErrSemaphoreFull
+	}
+	s.used += n
+
+	return nil
+}
+
+// Release returns n units to the semaphore stored under key. It returns
+// ErrKeyNotFound if the semaphore does not exist (anymore), ErrSemaphoreUnits
+// if n is not positive, and ErrSemaphoreRelease if more units are released
+// than are held, leaving the semaphore unchanged.
+func (table *CacheTable) Release(key interface{}, n int64) error {
+	if err := table.checkWritable(); err != nil {
+		return err
+	}
+	if n <= 0 {
+		return ErrSemaphoreUnits
+	}
+	key, err := table.resolveKey(key)
+	if err != nil {
+		return err
+	}
+
+	table.RLock()
+	item, ok := table.items.get(key)
+	table.RUnlock()
+	if !ok {
+		return ErrKeyNotFound
+	}
+
+	s, ok := item.data.(*Semaphore)
+	if !ok {
+		return ErrWrongType
+	}
+	item.KeepAlive()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n > s.used {
+		return ErrSemaphoreRelease
+	}
+	s.used -= n
+
+	return nil
+}
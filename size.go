@@ -0,0 +1,145 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// SizeError gets returned when a key or value exceeds the size limit
+// configured for a table. It wraps ErrKeyTooLarge or ErrValueTooLarge.
+type SizeError struct {
+	Key   interface{}
+	Size  int64
+	Limit int64
+
+	err error
+}
+
+func (e *SizeError) Error() string {
+	return fmt.Sprintf("%v: %d bytes exceeds limit of %d bytes", e.err, e.Size, e.Limit)
+}
+
+// Unwrap returns ErrKeyTooLarge or ErrValueTooLarge.
+func (e *SizeError) Unwrap() error {
+	return e.err
+}
+
+// SetMaxKeySize limits the size of keys added to this table. The size
+// function calculates a key's size in bytes; if it is nil, EstimateSize gets
+// used. A limit of 0 disables the check.
+func (table *CacheTable) SetMaxKeySize(limit int64, size func(key interface{}) int64) {
+	if size == nil {
+		size = EstimateSize
+	}
+
+	table.Lock()
+	defer table.Unlock()
+	table.maxKeySize = limit
+	table.keySize = size
+}
+
+// SetMaxValueSize limits the size of values added to this table. The size
+// function calculates a value's size in bytes; if it is nil, EstimateSize
+// gets used. A limit of 0 disables the check.
+func (table *CacheTable) SetMaxValueSize(limit int64, size func(data interface{}) int64) {
+	if size == nil {
+		size = EstimateSize
+	}
+
+	table.Lock()
+	defer table.Unlock()
+	table.maxValueSize = limit
+	table.valueSize = size
+}
+
+// EstimateSize returns a rough estimate of how many bytes of memory v
+// occupies, including everything it references. Memory shared between
+// several values gets counted for each of them.
+func EstimateSize(v interface{}) int64 {
+	if v == nil {
+		return 0
+	}
+	if s, ok := v.(sizer); ok {
+		return s.estimateSize()
+	}
+	return reflectSize(v)
+}
+
+// Implemented by data guarding its contents with a lock of its own, like
+// hashes and lists, to estimate its size while holding that lock.
+type sizer interface {
+	estimateSize() int64
+}
+
+// Estimates the size of v, which must not be nil, via reflection.
+func reflectSize(v interface{}) int64 {
+	rv := reflect.ValueOf(v)
+	return int64(rv.Type().Size()) + indirectSize(rv, make(map[uintptr]bool))
+}
+
+// Returns the size of the memory referenced by v, excluding v itself.
+func indirectSize(v reflect.Value, seen map[uintptr]bool) int64 {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() || seen[v.Pointer()] {
+			return 0
+		}
+		seen[v.Pointer()] = true
+		return int64(v.Elem().Type().Size()) + indirectSize(v.Elem(), seen)
+
+	case reflect.Interface:
+		if v.IsNil() {
+			return 0
+		}
+		return int64(v.Elem().Type().Size()) + indirectSize(v.Elem(), seen)
+
+	case reflect.String:
+		return int64(v.Len())
+
+	case reflect.Slice:
+		if v.IsNil() || seen[v.Pointer()] {
+			return 0
+		}
+		seen[v.Pointer()] = true
+		n := int64(v.Cap()) * int64(v.Type().Elem().Size())
+		for i := 0; i < v.Len(); i++ {
+			n += indirectSize(v.Index(i), seen)
+		}
+		return n
+
+	case reflect.Array:
+		var n int64
+		for i := 0; i < v.Len(); i++ {
+			n += indirectSize(v.Index(i), seen)
+		}
+		return n
+
+	case reflect.Map:
+		if v.IsNil() || seen[v.Pointer()] {
+			return 0
+		}
+		seen[v.Pointer()] = true
+		var n int64
+		entry := int64(v.Type().Key().Size() + v.Type().Elem().Size())
+		for _, key := range v.MapKeys() {
+			n += entry + indirectSize(key, seen) + indirectSize(v.MapIndex(key), seen)
+		}
+		return n
+
+	case reflect.Struct:
+		var n int64
+		for i := 0; i < v.NumField(); i++ {
+			n += indirectSize(v.Field(i), seen)
+		}
+		return n
+	}
+
+	return 0
+}
@@ -0,0 +1,106 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"time"
+)
+
+// Snapshot is a point-in-time copy of the items of a cache table.
+type Snapshot struct {
+	// Table is the name of the table the snapshot was taken from.
+	Table string
+	// Time is when the snapshot was taken.
+	Time time.Time
+
+	// Entries are kept in a store, wrapped in items, so keys are matched
+	// just like the table matched them.
+	entries *store
+}
+
+// A single item of a snapshot.
+type snapshotEntry struct {
+	item *CacheItem
+	// Fingerprint of the item's data when the snapshot was taken.
+	fingerprint uint64
+}
+
+// Snapshot returns a copy of the table's current items, see CacheItem.Clone.
+func (table *CacheTable) Snapshot() *Snapshot {
+	table.RLock()
+	defer table.RUnlock()
+
+	s := &Snapshot{
+		Table:   table.name,
+		Time:    time.Now(),
+		entries: newStore(table.hasher),
+	}
+	table.items.each(func(item *CacheItem) {
+		e := &snapshotEntry{item: item.Clone()}
+		item.dataMu.RLock()
+		e.fingerprint = item.dataFingerprint()
+		item.dataMu.RUnlock()
+		s.entries.set(&CacheItem{key: item.key, data: e})
+	})
+
+	return s
+}
+
+// Len returns the number of items in the snapshot.
+func (s *Snapshot) Len() int {
+	return s.entries.len()
+}
+
+// Items returns the items of the snapshot in no particular order.
+func (s *Snapshot) Items() []*CacheItem {
+	items := make([]*CacheItem, 0, s.entries.len())
+	s.entries.each(func(e *CacheItem) {
+		items = append(items, e.data.(*snapshotEntry).item)
+	})
+	return items
+}
+
+// Diff lists the keys which differ between two snapshots.
+type Diff struct {
+	// Added holds the keys only present in the newer snapshot.
+	Added []interface{}
+	// Removed holds the keys only present in the older snapshot.
+	Removed []interface{}
+	// Changed holds the keys present in both snapshots, but with different
+	// data.
+	Changed []interface{}
+}
+
+// Empty reports whether the snapshots were identical.
+func (d Diff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// SnapshotDiff reports the keys which got added, removed or changed between
+// snapshot a and the newer snapshot b, e.g. to verify cache warm-ups or detect
+// unexpected churn. Data counts as changed if its formatted representation
+// differs, so changes made in place, e.g. via CacheItem.WithLock, are
+// detected as well.
+func SnapshotDiff(a, b *Snapshot) Diff {
+	var d Diff
+	b.entries.each(func(be *CacheItem) {
+		ae, ok := a.entries.get(be.key)
+		if !ok {
+			d.Added = append(d.Added, be.key)
+		} else if ae.data.(*snapshotEntry).fingerprint != be.data.(*snapshotEntry).fingerprint {
+			d.Changed = append(d.Changed, be.key)
+		}
+	})
+	a.entries.each(func(ae *CacheItem) {
+		if _, ok := b.entries.get(ae.key); !ok {
+			d.Removed = append(d.Removed, ae.key)
+		}
+	})
+
+	return d
+}
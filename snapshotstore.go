@@ -0,0 +1,139 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SnapshotStore stores snapshots by name, e.g. in object storage, so new
+// instances can bootstrap their tables from the latest snapshot instead of
+// starting cold.
+type SnapshotStore interface {
+	// Put stores the snapshot read from r under name.
+	Put(ctx context.Context, name string, r io.Reader) error
+	// Get returns a reader for the snapshot stored under name.
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	// List returns the names of all snapshots starting with prefix.
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// Snapshot names embed the time they were taken in a lexically sortable
+// format.
+const snapshotTimeFormat = "20060102T150405.000000000Z"
+
+// UploadSnapshot writes a snapshot of the table, see SaveSnapshot, to store.
+// It returns the name the snapshot was stored under, which starts with the
+// table's name.
+func (table *CacheTable) UploadSnapshot(ctx context.Context, store SnapshotStore) (string, error) {
+	name := table.name + "-" + time.Now().UTC().Format(snapshotTimeFormat)
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(table.SaveSnapshot(pw))
+	}()
+	err := store.Put(ctx, name, pr)
+	pr.CloseWithError(err)
+	if err != nil {
+		return "", err
+	}
+
+	table.log("Uploaded snapshot", name, "of table", table.name)
+	return name, nil
+}
+
+// BootstrapSnapshot loads the latest snapshot of the table from store. It
+// returns the name of the loaded snapshot, or ErrKeyNotFound if there is
+// none.
+func (table *CacheTable) BootstrapSnapshot(ctx context.Context, store SnapshotStore) (string, error) {
+	names, err := store.List(ctx, table.name+"-")
+	if err != nil {
+		return "", err
+	}
+
+	// Skip snapshots of tables whose names merely start with ours.
+	var latest string
+	for _, name := range names {
+		ts := strings.TrimPrefix(name, table.name+"-")
+		if _, err := time.Parse(snapshotTimeFormat, ts); err == nil && name > latest {
+			latest = name
+		}
+	}
+	if latest == "" {
+		return "", ErrKeyNotFound
+	}
+
+	r, err := store.Get(ctx, latest)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	if err := table.LoadSnapshot(r); err != nil {
+		return "", err
+	}
+
+	table.log("Bootstrapped table", table.name, "from snapshot", latest)
+	return latest, nil
+}
+
+// DirSnapshotStore is a SnapshotStore keeping snapshots as files in a
+// directory, e.g. on a shared volume.
+type DirSnapshotStore string
+
+// Put stores the snapshot as a file, atomically replacing any existing one.
+func (d DirSnapshotStore) Put(ctx context.Context, name string, r io.Reader) error {
+	if err := os.MkdirAll(string(d), 0o755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(string(d), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(string(d), filepath.Base(name)))
+}
+
+// Get opens the snapshot's file.
+func (d DirSnapshotStore) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(string(d), filepath.Base(name)))
+}
+
+// List returns the names of the files starting with prefix, sorted.
+func (d DirSnapshotStore) List(ctx context.Context, prefix string) ([]string, error) {
+	files, err := ioutil.ReadDir(string(d))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, f := range files {
+		if !f.IsDir() && strings.HasPrefix(f.Name(), prefix) {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
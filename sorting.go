@@ -0,0 +1,109 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"container/heap"
+	"math"
+	"sort"
+	"time"
+)
+
+// SortField is an item property ItemsSortedBy can order items by.
+type SortField int
+
+const (
+	// SortByCreatedOn orders items by their creation time.
+	SortByCreatedOn SortField = iota
+	// SortByAccessedOn orders items by their last access.
+	SortByAccessedOn
+	// SortByAccessCount orders items by how often they got accessed.
+	SortByAccessCount
+	// SortByRemainingTTL orders items by the time left until they expire.
+	// Items that never expire have the longest remaining time.
+	SortByRemainingTTL
+)
+
+type sortEntry struct {
+	item  *CacheItem
+	value int64
+}
+
+// Bounded heap keeping the best entries, with the worst one on top.
+type sortHeap struct {
+	entries []sortEntry
+	asc     bool
+}
+
+func (h *sortHeap) Len() int      { return len(h.entries) }
+func (h *sortHeap) Swap(i, j int) { h.entries[i], h.entries[j] = h.entries[j], h.entries[i] }
+func (h *sortHeap) Less(i, j int) bool {
+	if h.asc {
+		return h.entries[i].value > h.entries[j].value
+	}
+	return h.entries[i].value < h.entries[j].value
+}
+func (h *sortHeap) Push(x interface{}) { h.entries = append(h.entries, x.(sortEntry)) }
+func (h *sortHeap) Pop() interface{} {
+	e := h.entries[len(h.entries)-1]
+	h.entries = h.entries[:len(h.entries)-1]
+	return e
+}
+
+// ItemsSortedBy returns up to limit items of this table ordered by the given
+// field, in ascending or descending order. Only the requested items get
+// sorted, so asking for a few items of a large table is cheap. A limit of 0
+// returns all items.
+func (table *CacheTable) ItemsSortedBy(field SortField, asc bool, limit int) []*CacheItem {
+	now := time.Now()
+	h := &sortHeap{asc: asc}
+
+	table.RLock()
+	table.items.each(func(item *CacheItem) {
+		e := sortEntry{item: item, value: item.sortValue(field, now)}
+		if limit <= 0 || h.Len() < limit {
+			heap.Push(h, e)
+		} else if (asc && e.value < h.entries[0].value) || (!asc && e.value > h.entries[0].value) {
+			h.entries[0] = e
+			heap.Fix(h, 0)
+		}
+	})
+	table.RUnlock()
+
+	sort.Slice(h.entries, func(i, j int) bool {
+		return h.Less(j, i)
+	})
+	r := make([]*CacheItem, len(h.entries))
+	for i, e := range h.entries {
+		r[i] = e.item
+	}
+
+	return r
+}
+
+// Returns the value of the given field, mapped to an int64.
+func (item *CacheItem) sortValue(field SortField, now time.Time) int64 {
+	item.RLock()
+	defer item.RUnlock()
+
+	switch field {
+	case SortByCreatedOn:
+		return item.createdOn.UnixNano()
+	case SortByAccessedOn:
+		return item.accessedOn.UnixNano()
+	case SortByAccessCount:
+		return item.accessCount
+	case SortByRemainingTTL:
+		remaining, expires := item.remaining(now)
+		if !expires {
+			return math.MaxInt64
+		}
+		return int64(remaining)
+	}
+	return 0
+}
@@ -0,0 +1,63 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"context"
+)
+
+// Source tells where the item returned by a lookup came from.
+type Source int
+
+const (
+	// SourceHit means the item was served from the cache.
+	SourceHit Source = iota
+	// SourceLoaded means the data-loader just produced or revalidated the
+	// item, possibly on behalf of a concurrent lookup of the same key.
+	SourceLoaded
+	// SourceStale means the item was served from the cache although it was
+	// due for a refresh, because refreshing it failed.
+	SourceStale
+)
+
+// String returns a human readable representation of the source.
+func (s Source) String() string {
+	switch s {
+	case SourceHit:
+		return "hit"
+	case SourceLoaded:
+		return "loaded"
+	case SourceStale:
+		return "stale"
+	}
+	return "unknown"
+}
+
+type sourceKey struct{}
+
+// ValueWithInfo works like Value, but also reports where the returned item
+// came from, e.g. for metrics. The source is meaningless if an error gets
+// returned.
+func (table *CacheTable) ValueWithInfo(key interface{}, args ...interface{}) (*CacheItem, Source, error) {
+	return table.ValueWithInfoCtx(context.Background(), key, args...)
+}
+
+// ValueWithInfoCtx works like ValueWithInfo, but passes ctx on to the
+// data-loader callback.
+func (table *CacheTable) ValueWithInfoCtx(ctx context.Context, key interface{}, args ...interface{}) (*CacheItem, Source, error) {
+	var source Source
+	item, err := table.ValueCtx(context.WithValue(ctx, sourceKey{}, &source), key, args...)
+	return item, source, err
+}
+
+// Reports the source of a lookup's item to ValueWithInfo, if it asked for it.
+func reportSource(ctx context.Context, s Source) {
+	if p, ok := ctx.Value(sourceKey{}).(*Source); ok {
+		*p = s
+	}
+}
@@ -0,0 +1,138 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of the usage counters of one or more cache tables.
+type Stats struct {
+	// Tables is the number of tables the stats were aggregated from.
+	Tables int
+	// Items is the number of items stored.
+	Items int
+	// Hits and Misses count the lookups which were served, or not served,
+	// from the cache.
+	Hits   int64
+	Misses int64
+	// Loads counts the items the data-loader produced.
+	Loads int64
+	// Expirations, Evictions and Deletes count the items removed because
+	// they exceeded their lifespan, got evicted to stay within the table's
+	// limits, or got deleted.
+	Expirations int64
+	Evictions   int64
+	Deletes     int64
+	// LockWait and LockHold are the durations the table-mutex was waited
+	// for and held, if lock diagnostics are enabled.
+	LockWait DurationHistogram
+	LockHold DurationHistogram
+}
+
+// HitRatio returns the fraction of lookups served from the cache.
+func (s Stats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// Adds the counters of o to s.
+func (s *Stats) add(o Stats) {
+	s.Tables += o.Tables
+	s.Items += o.Items
+	s.Hits += o.Hits
+	s.Misses += o.Misses
+	s.Loads += o.Loads
+	s.Expirations += o.Expirations
+	s.Evictions += o.Evictions
+	s.Deletes += o.Deletes
+	s.LockWait.add(o.LockWait)
+	s.LockHold.add(o.LockHold)
+}
+
+// Stats returns a snapshot of this table's usage counters.
+func (table *CacheTable) Stats() Stats {
+	s := Stats{
+		Tables:      1,
+		Items:       table.Count(),
+		Hits:        atomic.LoadInt64(&table.hits),
+		Misses:      atomic.LoadInt64(&table.misses),
+		Loads:       atomic.LoadInt64(&table.loads),
+		Expirations: atomic.LoadInt64(&table.expirations),
+		Evictions:   atomic.LoadInt64(&table.evictions),
+		Deletes:     atomic.LoadInt64(&table.deletes),
+	}
+	if table.diagnosesLocks() {
+		s.LockWait = table.lockWait.snapshot()
+		s.LockHold = table.lockHold.snapshot()
+	}
+	return s
+}
+
+// ResetStats zeroes this table's lookup and removal counters and lock
+// durations as well as the access counters of all its items, e.g. to measure
+// access patterns per deployment window. See CacheItem.ResetStats for
+// resetAccessedOn.
+func (table *CacheTable) ResetStats(resetAccessedOn bool) {
+	table.RLock()
+	defer table.RUnlock()
+
+	atomic.StoreInt64(&table.hits, 0)
+	atomic.StoreInt64(&table.misses, 0)
+	atomic.StoreInt64(&table.loads, 0)
+	atomic.StoreInt64(&table.expirations, 0)
+	atomic.StoreInt64(&table.evictions, 0)
+	atomic.StoreInt64(&table.deletes, 0)
+	table.lockWait.reset()
+	table.lockHold.reset()
+	if table.namespaces != nil {
+		table.namespaces.resetLookups()
+	}
+	table.items.each(func(item *CacheItem) {
+		item.ResetStats(resetAccessedOn)
+	})
+}
+
+// GlobalStats returns the usage counters aggregated across all existing
+// cache tables.
+func GlobalStats() Stats {
+	var s Stats
+	ForEachTable(func(table *CacheTable) {
+		s.add(table.Stats())
+	})
+
+	return s
+}
+
+// OnStatsTick calls f with the current GlobalStats every interval, e.g. to
+// flush them to a metrics system. Call the returned function to stop.
+func OnStatsTick(interval time.Duration, f func(Stats)) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				f(GlobalStats())
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	var once int32
+	return func() {
+		if atomic.CompareAndSwapInt32(&once, 0, 1) {
+			close(done)
+		}
+	}
+}
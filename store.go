@@ -0,0 +1,237 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+// Hasher provides custom hashing and equality for the keys of a table, e.g.
+// to treat strings case-insensitively or to use keys Go maps can't handle.
+// Keys which are equal must have the same hash.
+type Hasher interface {
+	// Hash returns the hash of key, or an error if key is not supported.
+	Hash(key interface{}) (uint64, error)
+	// Equal reports whether two keys are the same.
+	Equal(a, b interface{}) bool
+}
+
+// Holds the items of a table, either in a plain map using Go's equality for
+// keys, or in hash buckets maintained by a custom Hasher. Without a Hasher,
+// items with []byte keys are kept in a separate map indexed by the key's
+// string conversion, which Go performs without allocating for lookups.
+// Careful: the store is not safe for concurrent use on its own!
+type store struct {
+	hasher Hasher
+
+	items   map[interface{}]*CacheItem
+	bytes   map[string]*CacheItem
+	buckets map[uint64][]*CacheItem
+	count   int
+
+	// All items in no particular order, for random access.
+	slots []*CacheItem
+}
+
+// Used to probe whether keys can be hashed by Go maps.
+var probeMap = map[interface{}]struct{}{}
+
+func newStore(hasher Hasher) *store {
+	s := &store{hasher: hasher}
+	if hasher != nil {
+		s.buckets = make(map[uint64][]*CacheItem)
+	} else {
+		s.items = make(map[interface{}]*CacheItem)
+		s.bytes = make(map[string]*CacheItem)
+	}
+	return s
+}
+
+// Returns an error if key can't be used with this store.
+func (s *store) check(key interface{}) error {
+	if s.hasher != nil {
+		_, err := s.hasher.Hash(key)
+		return err
+	}
+	return checkHashable(key)
+}
+
+// Returns ErrUnhashableKey if key can't be used as a Go map key.
+func checkHashable(key interface{}) (err error) {
+	switch key.(type) {
+	case nil, string, []byte, bool, int, int8, int16, int32, int64,
+		uint, uint8, uint16, uint32, uint64, uintptr, float32, float64:
+		return nil
+	}
+
+	// Even for empty maps, looking up a key panics if it is unhashable.
+	defer func() {
+		if recover() != nil {
+			err = ErrUnhashableKey
+		}
+	}()
+	_ = probeMap[key]
+
+	return nil
+}
+
+// Returns a copy of the store, sharing its items.
+func (s *store) clone() *store {
+	c := newStore(s.hasher)
+	s.each(c.set)
+	return c
+}
+
+func (s *store) len() int {
+	return s.count
+}
+
+// Returns the i-th item, 0 <= i < len().
+func (s *store) at(i int) *CacheItem {
+	return s.slots[i]
+}
+
+// Keeps the slots in sync when old gets replaced by item, or item added if
+// old is nil.
+func (s *store) setSlot(old, item *CacheItem) {
+	if old != nil {
+		item.slot = old.slot
+		s.slots[item.slot] = item
+		return
+	}
+	item.slot = len(s.slots)
+	s.slots = append(s.slots, item)
+}
+
+// Keeps the slots in sync when old gets removed.
+func (s *store) removeSlot(old *CacheItem) {
+	last := s.slots[len(s.slots)-1]
+	s.slots[old.slot] = last
+	last.slot = old.slot
+	s.slots[len(s.slots)-1] = nil
+	s.slots = s.slots[:len(s.slots)-1]
+}
+
+func (s *store) get(key interface{}) (*CacheItem, bool) {
+	if s.hasher == nil {
+		if b, ok := key.([]byte); ok {
+			item, ok := s.bytes[string(b)]
+			return item, ok
+		}
+		item, ok := s.items[key]
+		return item, ok
+	}
+
+	h, err := s.hasher.Hash(key)
+	if err != nil {
+		return nil, false
+	}
+	for _, item := range s.buckets[h] {
+		if s.hasher.Equal(item.key, key) {
+			return item, true
+		}
+	}
+	return nil, false
+}
+
+// Stores item under its key, replacing any item stored under an equal key.
+func (s *store) set(item *CacheItem) {
+	if s.hasher == nil {
+		if b, ok := item.key.([]byte); ok {
+			old, ok := s.bytes[string(b)]
+			if !ok {
+				s.count++
+			}
+			s.setSlot(old, item)
+			s.bytes[string(b)] = item
+			return
+		}
+		old, ok := s.items[item.key]
+		if !ok {
+			s.count++
+		}
+		s.setSlot(old, item)
+		s.items[item.key] = item
+		return
+	}
+
+	h, err := s.hasher.Hash(item.key)
+	if err != nil {
+		return
+	}
+	bucket := s.buckets[h]
+	for i, old := range bucket {
+		if s.hasher.Equal(old.key, item.key) {
+			// Copy, as the old bucket may currently be iterated.
+			b := make([]*CacheItem, len(bucket))
+			copy(b, bucket)
+			b[i] = item
+			s.buckets[h] = b
+			s.setSlot(old, item)
+			return
+		}
+	}
+	s.buckets[h] = append(bucket[:len(bucket):len(bucket)], item)
+	s.setSlot(nil, item)
+	s.count++
+}
+
+func (s *store) remove(key interface{}) {
+	if s.hasher == nil {
+		if b, ok := key.([]byte); ok {
+			if old, ok := s.bytes[string(b)]; ok {
+				delete(s.bytes, string(b))
+				s.removeSlot(old)
+				s.count--
+			}
+			return
+		}
+		if old, ok := s.items[key]; ok {
+			delete(s.items, key)
+			s.removeSlot(old)
+			s.count--
+		}
+		return
+	}
+
+	h, err := s.hasher.Hash(key)
+	if err != nil {
+		return
+	}
+	bucket := s.buckets[h]
+	for i, old := range bucket {
+		if s.hasher.Equal(old.key, key) {
+			if len(bucket) == 1 {
+				delete(s.buckets, h)
+			} else {
+				// Copy, as the old bucket may currently be iterated.
+				b := make([]*CacheItem, 0, len(bucket)-1)
+				b = append(b, bucket[:i]...)
+				s.buckets[h] = append(b, bucket[i+1:]...)
+			}
+			s.removeSlot(old)
+			s.count--
+			return
+		}
+	}
+}
+
+// Calls f for every item. Items may be removed from the store meanwhile.
+func (s *store) each(f func(item *CacheItem)) {
+	if s.hasher == nil {
+		for _, item := range s.items {
+			f(item)
+		}
+		for _, item := range s.bytes {
+			f(item)
+		}
+		return
+	}
+
+	for _, bucket := range s.buckets {
+		for _, item := range bucket {
+			f(item)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// ItemFormat determines how StreamItems writes item summaries.
+type ItemFormat int
+
+const (
+	// ItemText writes one human readable line per item.
+	ItemText ItemFormat = iota
+	// ItemJSON writes one JSON object per line.
+	ItemJSON
+)
+
+// ItemOrder determines the order StreamItems writes items in.
+type ItemOrder struct {
+	// By is the item property to order by.
+	By SortField
+	// Desc reverses the order, so the largest values come first.
+	Desc bool
+}
+
+// ItemSummary describes a single item, as written by StreamItems.
+type ItemSummary struct {
+	Key string `json:"key"`
+	// TTL is the time left until the item expires, if it expires at all.
+	TTL         time.Duration `json:"ttl"`
+	Expires     bool          `json:"expires"`
+	AccessCount int64         `json:"access_count"`
+	// Size is the item's size as accounted for by SetMaxMemory.
+	Size int64 `json:"size"`
+}
+
+// StreamItems writes a summary of every item of this table to w, in the
+// given format and order, e.g. for inspecting which items expire next. Only
+// the order gets computed upfront, the summaries get written one by one, so
+// even tables with millions of items can be inspected without holding the
+// whole result in memory. Neither the table nor its items stay locked while
+// writing, so items changed meanwhile show up with their current state.
+func (table *CacheTable) StreamItems(w io.Writer, format ItemFormat, order ItemOrder) error {
+	now := time.Now()
+	table.RLock()
+	entries := make([]sortEntry, 0, table.items.len())
+	table.items.each(func(item *CacheItem) {
+		entries = append(entries, sortEntry{item: item, value: item.sortValue(order.By, now)})
+	})
+	table.RUnlock()
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if order.Desc {
+			return entries[i].value > entries[j].value
+		}
+		return entries[i].value < entries[j].value
+	})
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for _, e := range entries {
+		s := e.item.summary(now)
+		var err error
+		switch format {
+		case ItemJSON:
+			err = enc.Encode(s)
+		default:
+			ttl := "never"
+			if s.Expires {
+				ttl = s.TTL.String()
+			}
+			_, err = fmt.Fprintf(bw, "key=%q ttl=%s accesses=%d size=%d\n", s.Key, ttl, s.AccessCount, s.Size)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// Returns a summary of the item.
+func (item *CacheItem) summary(now time.Time) ItemSummary {
+	item.RLock()
+	remaining, expires := item.remaining(now)
+	s := ItemSummary{
+		Key:         fmt.Sprint(item.key),
+		Expires:     expires,
+		AccessCount: item.accessCount,
+	}
+	item.RUnlock()
+
+	if expires {
+		s.TTL = remaining
+	}
+	s.Size = item.estimatedSize()
+	return s
+}
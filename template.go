@@ -0,0 +1,150 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// TemplateOptions is the configuration tables created from a Template
+// inherit. Zero values leave the table's defaults in place.
+type TemplateOptions struct {
+	// Info describes the tables.
+	Info Info
+	// Logger is used for the tables' log output.
+	Logger *log.Logger
+	// DataLoader gets called for missing keys, see SetDataLoaderCtx.
+	DataLoader func(ctx context.Context, key interface{}, args ...interface{}) *CacheItem
+	// AddedItem gets called for every added item.
+	AddedItem func(item *CacheItem)
+	// AboutToDeleteItem gets called before an item gets deleted.
+	AboutToDeleteItem func(item *CacheItem)
+	// Validator checks data before it gets added, see SetValidator.
+	Validator func(key, data interface{}) error
+	// KeyNormalizer maps keys to their canonical form.
+	KeyNormalizer func(key interface{}) interface{}
+	// Hasher provides custom hashing and equality for keys.
+	Hasher Hasher
+	// MaxItems limits the number of items, see SetMaxItems.
+	MaxItems int
+	// Segmented is the fraction of the capacity reserved for frequently
+	// used items, see SetSegmented.
+	Segmented float64
+	// MaxKeySize and MaxValueSize limit the estimated sizes of keys and
+	// values.
+	MaxKeySize   int64
+	MaxValueSize int64
+	// ConflictPolicy and Merge decide what adding an existing key does, see
+	// SetConflictPolicy. ConflictMerge without Merge keeps the default.
+	ConflictPolicy ConflictPolicy
+	Merge          func(key, existing, added interface{}) interface{}
+	// EarlyRefresh enables probabilistic early refreshes, see
+	// SetEarlyRefresh.
+	EarlyRefresh float64
+	// MaxStaleness bounds the age of served items, see SetMaxStaleness.
+	MaxStaleness time.Duration
+	// Configure gets called with every new table after the other options
+	// got applied, for any further configuration.
+	Configure func(table *CacheTable)
+}
+
+// Template creates cache tables sharing the same configuration, e.g. one
+// table per tenant or topic.
+type Template struct {
+	opts TemplateOptions
+}
+
+// NewTemplate returns a template for tables configured with opts.
+func NewTemplate(opts TemplateOptions) *Template {
+	return &Template{opts: opts}
+}
+
+// Cache works like the package-level Cache function, but a table that
+// doesn't exist yet gets configured according to the template before it
+// becomes visible to anyone else, so its first use never races with its
+// configuration. An existing table gets returned as is.
+func (t *Template) Cache(name string) *CacheTable {
+	mutex.RLock()
+	table, ok := cache[name]
+	mutex.RUnlock()
+	if ok {
+		return table
+	}
+
+	table = newCacheTable(name)
+	t.apply(table)
+
+	mutex.Lock()
+	// Somebody else may have created the table meanwhile.
+	if existing, ok := cache[name]; ok {
+		mutex.Unlock()
+		return existing
+	}
+	cache[name] = table
+	mutex.Unlock()
+
+	tableCreated(table)
+	return table
+}
+
+// Configures a new table according to the template.
+func (t *Template) apply(table *CacheTable) {
+	o := t.opts
+	info := o.Info
+	if info.DefaultLifeSpan == 0 {
+		info.DefaultLifeSpan = table.Info().DefaultLifeSpan
+	}
+	table.SetInfo(info)
+	if o.Logger != nil {
+		table.SetLogger(o.Logger)
+	}
+	if o.DataLoader != nil {
+		table.SetDataLoaderCtx(o.DataLoader)
+	}
+	if o.AddedItem != nil {
+		table.AddAddedItemCallback(o.AddedItem)
+	}
+	if o.AboutToDeleteItem != nil {
+		table.AddAboutToDeleteItemCallback(o.AboutToDeleteItem)
+	}
+	if o.Validator != nil {
+		table.SetValidator(o.Validator)
+	}
+	if o.KeyNormalizer != nil {
+		table.SetKeyNormalizer(o.KeyNormalizer)
+	}
+	if o.Hasher != nil {
+		table.SetHasher(o.Hasher)
+	}
+	if o.MaxItems > 0 {
+		table.SetMaxItems(o.MaxItems)
+	}
+	if o.Segmented > 0 {
+		table.SetSegmented(o.Segmented)
+	}
+	if o.MaxKeySize > 0 {
+		table.SetMaxKeySize(o.MaxKeySize, nil)
+	}
+	if o.MaxValueSize > 0 {
+		table.SetMaxValueSize(o.MaxValueSize, nil)
+	}
+	if o.ConflictPolicy != ConflictOverwrite || o.Merge != nil {
+		table.SetConflictPolicy(o.ConflictPolicy, o.Merge)
+	}
+	if o.EarlyRefresh > 0 {
+		table.SetEarlyRefresh(o.EarlyRefresh)
+	}
+	if o.MaxStaleness > 0 {
+		table.SetMaxStaleness(o.MaxStaleness)
+	}
+	if o.Configure != nil {
+		o.Configure(table)
+	}
+}
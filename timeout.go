@@ -0,0 +1,103 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// SetOperationTimeout limits how long Value, Add and Delete, including their
+// context aware variants, wait for the table-mutex or for a concurrent load of
+// the same key, e.g. while a callback is wedged holding the mutex. Once d passes
+// they give up with ErrTimeout. Independent of the timeout, the context
+// aware variants give up once their context is done. Pass 0 to wait
+// indefinitely, which is the default.
+func (table *CacheTable) SetOperationTimeout(d time.Duration) {
+	atomic.StoreInt64(&table.opTimeout, int64(d))
+}
+
+// Returns the operation timeout, 0 if unbounded.
+func (table *CacheTable) operationTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&table.opTimeout))
+}
+
+// Locks the table-mutex for writing, or for reading unless write is set.
+// It gives up with ErrTimeout once the operation timeout passes or with
+// ctx's error once ctx is done.
+func (table *CacheTable) lockCtx(ctx context.Context, write bool) error {
+	timeout := table.operationTimeout()
+	if timeout == 0 && ctx.Done() == nil {
+		if write {
+			table.Lock()
+		} else {
+			table.RLock()
+		}
+		return nil
+	}
+	// Only wait for the mutex if it is contended.
+	if write && table.TryLock() || !write && table.TryRLock() {
+		return nil
+	}
+
+	// The mutex can't be acquired with a deadline, so a goroutine waits
+	// for it. If we give up meanwhile, it releases the mutex right away.
+	const (
+		waiting = iota
+		acquired
+		abandoned
+	)
+	var state int32
+	locked := make(chan struct{})
+	go func() {
+		if write {
+			table.Lock()
+		} else {
+			table.RLock()
+		}
+		if !atomic.CompareAndSwapInt32(&state, waiting, acquired) {
+			if write {
+				table.Unlock()
+			} else {
+				table.RUnlock()
+			}
+			return
+		}
+		close(locked)
+	}()
+
+	err := table.wait(ctx, timeout, locked)
+	if err != nil && !atomic.CompareAndSwapInt32(&state, waiting, abandoned) {
+		// The mutex got acquired in the meantime.
+		<-locked
+		return nil
+	}
+	return err
+}
+
+// Waits for done to be closed, giving up with ErrTimeout once timeout
+// passes, unless it is 0, or with ctx's error once ctx is done.
+func (table *CacheTable) wait(ctx context.Context, timeout time.Duration, done <-chan struct{}) error {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-expired:
+		table.log("Giving up on table", table.name, "after waiting", timeout)
+		return ErrTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
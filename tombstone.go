@@ -0,0 +1,154 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"context"
+	"time"
+)
+
+// TombstonePolicy determines what adding a soft-deleted key does while its
+// tombstone lasts.
+type TombstonePolicy int
+
+const (
+	// TombstoneReject makes adding the key fail with ErrTombstoned, which is
+	// the default.
+	TombstoneReject TombstonePolicy = iota
+	// TombstoneFlag adds the key anyway, but flags the item, see
+	// CacheItem.Resurrected.
+	TombstoneFlag
+)
+
+// SetTombstonePolicy configures what adding a key does while its tombstone
+// left by SoftDelete lasts.
+func (table *CacheTable) SetTombstonePolicy(policy TombstonePolicy) {
+	table.Lock()
+	defer table.Unlock()
+	table.tombstonePolicy = policy
+}
+
+// SoftDelete deletes the item stored under key, if any, and leaves a
+// tombstone for the key which lasts for tombstoneTTL. While it lasts, adding
+// the key is handled according to the table's TombstonePolicy. This keeps a
+// slow writer from re-inserting data which just got invalidated. Data-loaders
+// which started after the soft delete may store the key regardless, since
+// they loaded current data. It returns the deleted item, or nil if the key
+// wasn't stored.
+func (table *CacheTable) SoftDelete(key interface{}, tombstoneTTL time.Duration) (*CacheItem, error) {
+	if err := table.checkWritable(); err != nil {
+		return nil, err
+	}
+	key, err := table.resolveKey(key)
+	if err != nil {
+		return nil, err
+	}
+	key = ownKey(key)
+
+	table.Lock()
+	defer table.Unlock()
+
+	if table.tombstones == nil {
+		table.tombstones = newStore(table.hasher)
+	}
+	now := time.Now()
+	// Tombstones are kept in a store of their own, wrapped in items.
+	t := &CacheItem{key: key, createdOn: now, expiresAt: now.Add(tombstoneTTL)}
+	table.tombstones.set(t)
+	time.AfterFunc(tombstoneTTL, func() {
+		table.Lock()
+		defer table.Unlock()
+
+		// The tombstone may have been replaced or removed meanwhile.
+		if table.tombstones != nil {
+			if cur, ok := table.tombstones.get(key); ok && cur == t {
+				table.tombstones.remove(key)
+			}
+		}
+	})
+	table.log("Soft-deleting key", key, "for", tombstoneTTL, "from table", table.name)
+
+	r, err := table.deleteInternal(context.Background(), key, RemovalDeleted)
+	if err == ErrKeyNotFound {
+		return nil, nil
+	}
+	return r, err
+}
+
+// Tombstoned returns whether key got soft-deleted and its tombstone still
+// lasts.
+func (table *CacheTable) Tombstoned(key interface{}) bool {
+	key, err := table.resolveKey(key)
+	if err != nil {
+		return false
+	}
+
+	table.RLock()
+	defer table.RUnlock()
+	return table.tombstone(key) != nil
+}
+
+// RemoveTombstone removes the tombstone of a soft-deleted key before it
+// expires, so the key can be added again. It returns false if the key has
+// no tombstone.
+func (table *CacheTable) RemoveTombstone(key interface{}) bool {
+	key, err := table.resolveKey(key)
+	if err != nil {
+		return false
+	}
+
+	table.Lock()
+	defer table.Unlock()
+	if table.tombstone(key) == nil {
+		return false
+	}
+	table.tombstones.remove(key)
+	return true
+}
+
+// Resurrected returns whether this item got added while the tombstone of
+// its key lasted, which the TombstoneFlag policy allows.
+func (item *CacheItem) Resurrected() bool {
+	// immutable
+	return item.resurrected
+}
+
+// Returns the tombstone of key, nil if it has none or it expired.
+// Careful: do not run this method unless the table-mutex is at least
+// read-locked!
+func (table *CacheTable) tombstone(key interface{}) *CacheItem {
+	if table.tombstones == nil {
+		return nil
+	}
+	t, ok := table.tombstones.get(key)
+	if !ok || !time.Now().Before(t.expiresAt) {
+		return nil
+	}
+	return t
+}
+
+// Applies the tombstone policy to an item about to be added, which load
+// produced if it's not nil.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) checkTombstone(item *CacheItem, load *loadResult) error {
+	t := table.tombstone(item.key)
+	if t == nil {
+		return nil
+	}
+	if load != nil && item.createdOn.Add(-load.duration).After(t.createdOn) {
+		// The data-loader started after the soft delete.
+		return nil
+	}
+
+	if table.tombstonePolicy == TombstoneFlag {
+		table.log("Resurrecting soft-deleted key", item.key, "in table", table.name)
+		item.resurrected = true
+		return nil
+	}
+	return ErrTombstoned
+}
@@ -0,0 +1,89 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"context"
+	"time"
+)
+
+// CacheTableOf is a type-safe view of a cache table with keys of type K and
+// values of type V. It shares the table's items, expiration, callbacks and
+// all other settings, which get configured on the table returned by Table.
+type CacheTableOf[K comparable, V any] struct {
+	table *CacheTable
+}
+
+// CacheOf returns the existing cache table with given name or creates a new
+// one if the table does not exist yet, like Cache, as a type-safe view.
+func CacheOf[K comparable, V any](table string) *CacheTableOf[K, V] {
+	return TableOf[K, V](Cache(table))
+}
+
+// TableOf returns a type-safe view of table. Items of other types added to
+// the table directly are skipped by Foreach and make Value fail with
+// ErrWrongType.
+func TableOf[K comparable, V any](table *CacheTable) *CacheTableOf[K, V] {
+	return &CacheTableOf[K, V]{table: table}
+}
+
+// Table returns the underlying cache table.
+func (t *CacheTableOf[K, V]) Table() *CacheTable {
+	return t.table
+}
+
+// Add adds a key/value pair to the cache, see CacheTable.Add. Unlike
+// CacheTable.Add, it returns the error if the pair got rejected.
+func (t *CacheTableOf[K, V]) Add(key K, lifeSpan time.Duration, value V) error {
+	_, err := t.table.AddCtx(context.Background(), key, lifeSpan, value)
+	return err
+}
+
+// Value returns the value stored under key, see CacheTable.Value.
+func (t *CacheTableOf[K, V]) Value(key K, args ...interface{}) (V, error) {
+	item, err := t.table.Value(key, args...)
+	if err != nil {
+		var v V
+		return v, err
+	}
+	v, ok := item.Data().(V)
+	if !ok {
+		return v, ErrWrongType
+	}
+	return v, nil
+}
+
+// Delete removes the item stored under key from the cache, see
+// CacheTable.Delete.
+func (t *CacheTableOf[K, V]) Delete(key K) error {
+	_, err := t.table.Delete(key)
+	return err
+}
+
+// Exists returns whether an item exists in the cache, see CacheTable.Exists.
+func (t *CacheTableOf[K, V]) Exists(key K) bool {
+	return t.table.Exists(key)
+}
+
+// Count returns how many items are currently stored in the cache.
+func (t *CacheTableOf[K, V]) Count() int {
+	return t.table.Count()
+}
+
+// Foreach calls trans for every key/value pair in the cache.
+func (t *CacheTableOf[K, V]) Foreach(trans func(key K, value V)) {
+	t.table.Foreach(func(key interface{}, item *CacheItem) {
+		k, ok := key.(K)
+		if !ok {
+			return
+		}
+		if v, ok := item.Data().(V); ok {
+			trans(k, v)
+		}
+	})
+}
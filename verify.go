@@ -0,0 +1,76 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"errors"
+	"math"
+	"reflect"
+)
+
+// Report is the result of verifying a table against its source of truth.
+type Report struct {
+	// Sampled is the number of items that got checked.
+	Sampled int
+	// Diverged holds the keys whose cached data differs from the source of
+	// truth, or which no longer exist there.
+	Diverged []interface{}
+	// Failed holds the keys which could not be checked.
+	Failed []VerifyError
+}
+
+// VerifyError describes why an item could not be verified.
+type VerifyError struct {
+	Key interface{}
+	Err error
+}
+
+// DivergenceRatio returns the fraction of checked items that diverged.
+func (r Report) DivergenceRatio() float64 {
+	checked := r.Sampled - len(r.Failed)
+	if checked <= 0 {
+		return 0
+	}
+	return float64(len(r.Diverged)) / float64(checked)
+}
+
+// Verify compares a random sample of the table's items with the source of
+// truth, e.g. to gain confidence that invalidation works. It checks the given
+// fraction of items, between 0 and 1, fetching their current value via
+// sampler. Items get compared using reflect.DeepEqual. If sampler returns an
+// error wrapping ErrKeyNotFound, the item counts as diverged, as it should
+// have been removed from the cache.
+func (table *CacheTable) Verify(sampler func(key interface{}) (interface{}, error), sampleRate float64) Report {
+	n := int(math.Ceil(float64(table.Count()) * sampleRate))
+
+	var r Report
+	for _, item := range table.Sample(n) {
+		r.Sampled++
+
+		backend, err := sampler(item.key)
+		if errors.Is(err, ErrKeyNotFound) {
+			r.Diverged = append(r.Diverged, item.key)
+			continue
+		}
+		if err != nil {
+			r.Failed = append(r.Failed, VerifyError{Key: item.key, Err: err})
+			continue
+		}
+
+		equal := false
+		item.WithRLock(func(data interface{}) {
+			equal = reflect.DeepEqual(data, backend)
+		})
+		if !equal {
+			r.Diverged = append(r.Diverged, item.key)
+		}
+	}
+
+	table.log("Verified", r.Sampled, "items of table", table.name, ",", len(r.Diverged), "diverged")
+	return r
+}